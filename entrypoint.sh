@@ -17,7 +17,8 @@ if [ -n "$AUTOSSH_STATE_FILE" ]; then
 fi
 
 # Export WebSocket server environment variables if set
-for _var in WS_PORT WS_MAX_CONNECTIONS WS_IDLE_TIMEOUT WS_MAX_DURATION WS_ALLOWED_ORIGINS; do
+for _var in WS_PORT WS_MAX_CONNECTIONS WS_IDLE_TIMEOUT WS_MAX_DURATION WS_ALLOWED_ORIGINS \
+	WS_REAUTH_POLL_INTERVAL WS_REAUTH_WEBHOOK_URL WS_REAUTH_WEBHOOK_TOKEN WS_REAUTH_LOG_LINES; do
 	eval "[ -n \"\$$_var\" ] && export $_var"
 done
 
@@ -0,0 +1,365 @@
+// Package otlptrace exports spans to an OpenTelemetry collector over
+// OTLP/HTTP with JSON encoding. It is shared by the web panel and the
+// ws-server, and implements only what they need: server spans with
+// attributes, W3C traceparent propagation and batched export.
+package otlptrace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP span kind and status code.
+const (
+	SpanKindServer  = 2
+	spanStatusError = 2
+)
+
+// Export tuning
+var (
+	FlushInterval = 5 * time.Second
+	QueueLimit    = 2048
+)
+
+// Logf logs a message at level ("INFO", "WARN", ...).
+type Logf func(level, format string, args ...interface{})
+
+// Span is one traced operation. A nil *Span is valid and does nothing, so
+// callers need not check whether tracing is on.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span
+	sampled  bool
+
+	name  string
+	kind  int
+	start time.Time
+	end   time.Time
+	attrs map[string]interface{}
+	err   bool
+}
+
+// ParseTraceparent reads a W3C traceparent header.
+func ParseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// TraceID is the span's trace ID in hex, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// Traceparent is the W3C traceparent header for calls made within s.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// SetAttr records an attribute; value is a string, an int or a bool.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError() {
+	if s != nil {
+		s.err = true
+	}
+}
+
+// End finishes the span and queues it for export when it is sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Tracer batches finished spans and exports them to a collector.
+type Tracer struct {
+	endpoint string
+	headers  http.Header
+	service  string
+	version  string
+	client   *http.Client
+	logf     Logf
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+	failing bool
+}
+
+// FromEnv reads the standard OpenTelemetry variables:
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (the full URL) or
+// OTEL_EXPORTER_OTLP_ENDPOINT (the collector's base URL),
+// OTEL_EXPORTER_OTLP_HEADERS ("key=value,...") and OTEL_SERVICE_NAME,
+// which defaults to service. It returns nil when no endpoint is set.
+// Export problems are reported through logf, which may be nil.
+func FromEnv(service, version string, logf Logf) (*Tracer, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil, nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+	t := &Tracer{
+		endpoint: endpoint,
+		headers:  http.Header{},
+		service:  os.Getenv("OTEL_SERVICE_NAME"),
+		version:  version,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logf:     logf,
+	}
+	if t.service == "" {
+		t.service = service
+	}
+	if t.logf == nil {
+		t.logf = func(string, string, ...interface{}) {}
+	}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if v, err := url.QueryUnescape(strings.TrimSpace(value)); err == nil {
+			value = v
+		}
+		t.headers.Set(strings.TrimSpace(key), value)
+	}
+	return t, nil
+}
+
+// Endpoint is the URL spans are sent to.
+func (t *Tracer) Endpoint() string {
+	return t.endpoint
+}
+
+// Service is the service name spans are reported under.
+func (t *Tracer) Service() string {
+	return t.service
+}
+
+// Start begins a span. It continues the trace in traceparent when that is
+// valid and starts a new one otherwise. A nil tracer returns a nil span.
+func (t *Tracer) Start(traceparent, name string, kind int) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	if traceID, parentID, sampled, ok := ParseTraceparent(traceparent); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = true
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= QueueLimit {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, s)
+}
+
+// Run exports queued spans every FlushInterval until stop is closed.
+func (t *Tracer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Flush exports the queued spans now, in one request.
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		t.logf("WARN", "Dropped %d trace span(s), the export queue was full", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	body, _ := json.Marshal(t.payload(spans))
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header = t.headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = fmt.Errorf("collector returned %s", resp.Status)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		if !t.failing {
+			t.logf("WARN", "Exporting %d trace span(s) to %s failed: %v", len(spans), t.endpoint, err)
+		}
+		t.failing = true
+		return
+	}
+	if t.failing {
+		t.logf("INFO", "Exporting trace spans to %s again", t.endpoint)
+	}
+	t.failing = false
+}
+
+// KeyValue is an OTLP attribute.
+type KeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// WireSpan is a span in OTLP JSON encoding; IDs are hex and 64-bit
+// integers strings.
+type WireSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []KeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+// Request is the body of an export request.
+type Request struct {
+	ResourceSpans []ResourceSpans `json:"resourceSpans"`
+}
+
+// ResourceSpans are the spans of one service.
+type ResourceSpans struct {
+	Resource struct {
+		Attributes []KeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []ScopeSpans `json:"scopeSpans"`
+}
+
+// ScopeSpans are the spans of one instrumentation scope.
+type ScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []WireSpan `json:"spans"`
+}
+
+func attributes(attrs map[string]interface{}) []KeyValue {
+	list := make([]KeyValue, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		list = append(list, KeyValue{Key: k, Value: value})
+	}
+	return list
+}
+
+func (t *Tracer) payload(spans []*Span) Request {
+	encoded := make([]WireSpan, 0, len(spans))
+	for _, s := range spans {
+		o := WireSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        attributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err {
+			o.Status.Code = spanStatusError
+		}
+		encoded = append(encoded, o)
+	}
+	resource := map[string]interface{}{"service.name": t.service}
+	if t.version != "" {
+		resource["service.version"] = t.version
+	}
+	rs := ResourceSpans{ScopeSpans: []ScopeSpans{{Spans: encoded}}}
+	rs.Resource.Attributes = attributes(resource)
+	rs.ScopeSpans[0].Scope.Name = t.service
+	return Request{ResourceSpans: []ResourceSpans{rs}}
+}
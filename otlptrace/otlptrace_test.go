@@ -0,0 +1,276 @@
+package otlptrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a fake OTLP collector that records export requests.
+type collector struct {
+	mu       sync.Mutex
+	requests []Request
+	status   int // answer to exports; 0 means 200
+	logs     []string
+}
+
+// withCollector returns a tracer for service "svc" exporting to a fake
+// collector, and the collector.
+func withCollector(t *testing.T) (*Tracer, *collector) {
+	t.Helper()
+	c := &collector{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer otlp" ||
+			r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if c.status != 0 {
+			w.WriteHeader(c.status)
+			return
+		}
+		var req Request
+		json.NewDecoder(r.Body).Decode(&req)
+		c.requests = append(c.requests, req)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL+"/")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20otlp")
+	t.Setenv("OTEL_SERVICE_NAME", "")
+	tracer, err := FromEnv("svc", "1.2.3", func(level, format string, args ...interface{}) {
+		c.mu.Lock()
+		c.logs = append(c.logs, level+" "+fmt.Sprintf(format, args...))
+		c.mu.Unlock()
+	})
+	if err != nil || tracer == nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	return tracer, c
+}
+
+// spans returns the spans of every export so far, one slice per request.
+func (c *collector) spans() [][]WireSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var batches [][]WireSpan
+	for _, req := range c.requests {
+		var batch []WireSpan
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				batch = append(batch, ss.Spans...)
+			}
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func (c *collector) logged() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.logs, "\n")
+}
+
+func attr(s WireSpan, key string) interface{} {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			for _, v := range kv.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, sampled, ok := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if !ok || !sampled || traceID[0] != 0x0a || parentID[7] != 0x31 {
+		t.Errorf("valid traceparent: %x %x %v %v", traceID, parentID, sampled, ok)
+	}
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01",
+	} {
+		if _, _, _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("ParseTraceparent(%q) accepted", bad)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if tracer, err := FromEnv("svc", "", nil); tracer != nil || err != nil {
+		t.Errorf("without an endpoint: %v, %v; want tracing off", tracer, err)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "https://traces.example/otlp")
+	t.Setenv("OTEL_SERVICE_NAME", "edge")
+	tracer, err := FromEnv("svc", "", nil)
+	if err != nil || tracer.Endpoint() != "https://traces.example/otlp" || tracer.Service() != "edge" {
+		t.Errorf("FromEnv = %+v, %v; want the traces endpoint and OTEL_SERVICE_NAME", tracer, err)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "collector:4318")
+	if _, err := FromEnv("svc", "", nil); err == nil {
+		t.Error("endpoint without a scheme accepted")
+	}
+}
+
+func TestTracer_Batching(t *testing.T) {
+	tracer, c := withCollector(t)
+
+	parent := tracer.Start("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "GET", SpanKindServer)
+	parent.SetAttr("url.path", "/ws/auth/x")
+	parent.SetAttr("http.response.status_code", 502)
+	parent.SetError()
+	parent.End()
+	root := tracer.Start("", "POST", SpanKindServer)
+	root.End()
+	tracer.Start("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", "GET", SpanKindServer).End()
+	if len(c.spans()) != 0 {
+		t.Fatal("spans exported before a flush")
+	}
+
+	// Sampled spans go out together, in the order they ended
+	tracer.Flush()
+	batches := c.spans()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("exports = %+v, want one request with the two sampled spans", batches)
+	}
+	first, second := batches[0][0], batches[0][1]
+	if first.TraceID != "0af7651916cd43dd8448eb211c80319c" || first.ParentSpanID != "b7ad6b7169203331" ||
+		first.Name != "GET" || first.Kind != SpanKindServer || first.Status.Code != spanStatusError {
+		t.Errorf("continued span = %+v", first)
+	}
+	if attr(first, "url.path") != "/ws/auth/x" || attr(first, "http.response.status_code") != "502" {
+		t.Errorf("continued span attributes = %+v", first.Attributes)
+	}
+	if second.ParentSpanID != "" || second.TraceID != root.TraceID() || second.Status.Code != 0 {
+		t.Errorf("root span = %+v", second)
+	}
+	if first.StartTimeUnixNano == "" || first.EndTimeUnixNano < first.StartTimeUnixNano {
+		t.Errorf("span times %s..%s", first.StartTimeUnixNano, first.EndTimeUnixNano)
+	}
+
+	c.mu.Lock()
+	resource := c.requests[0].ResourceSpans[0]
+	c.mu.Unlock()
+	service := map[string]interface{}{}
+	for _, kv := range resource.Resource.Attributes {
+		for _, v := range kv.Value {
+			service[kv.Key] = v
+		}
+	}
+	if service["service.name"] != "svc" || service["service.version"] != "1.2.3" || resource.ScopeSpans[0].Scope.Name != "svc" {
+		t.Errorf("resource = %+v", resource)
+	}
+
+	// An empty queue sends nothing
+	tracer.Flush()
+	if n := len(c.spans()); n != 1 {
+		t.Errorf("%d exports after flushing an empty queue, want 1", n)
+	}
+}
+
+func TestTracer_DropWhenFull(t *testing.T) {
+	tracer, c := withCollector(t)
+	old := QueueLimit
+	t.Cleanup(func() { QueueLimit = old })
+	QueueLimit = 3
+
+	for i := 0; i < 5; i++ {
+		tracer.Start("", fmt.Sprint("span", i), SpanKindServer).End()
+	}
+	tracer.Flush()
+	batches := c.spans()
+	if len(batches) != 1 || len(batches[0]) != 3 || batches[0][2].Name != "span2" {
+		t.Fatalf("exports = %+v, want the first three spans", batches)
+	}
+	if !strings.Contains(c.logged(), "WARN Dropped 2 trace span(s)") {
+		t.Errorf("log = %q, want the drops reported", c.logged())
+	}
+
+	// The queue has room again after a flush
+	tracer.Start("", "later", SpanKindServer).End()
+	tracer.Flush()
+	if batches := c.spans(); len(batches) != 2 || batches[1][0].Name != "later" {
+		t.Errorf("exports after the flush = %+v", batches)
+	}
+	if strings.Count(c.logged(), "Dropped") != 1 {
+		t.Errorf("log = %q, want the drops reported once", c.logged())
+	}
+}
+
+func TestTracer_Flush(t *testing.T) {
+	tracer, c := withCollector(t)
+	old := FlushInterval
+	t.Cleanup(func() { FlushInterval = old })
+	FlushInterval = 10 * time.Millisecond
+
+	// Run flushes on its own
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		tracer.Run(stop)
+		close(stopped)
+	}()
+	tracer.Start("", "GET", SpanKindServer).End()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.spans()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Run did not export the span")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(stop)
+	<-stopped
+
+	// A failing collector is reported once, and its recovery too
+	c.mu.Lock()
+	c.status = http.StatusServiceUnavailable
+	c.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		tracer.Start("", "GET", SpanKindServer).End()
+		tracer.Flush()
+	}
+	if n := strings.Count(c.logged(), "failed: collector returned 503"); n != 1 {
+		t.Errorf("log = %q, want one failure", c.logged())
+	}
+	c.mu.Lock()
+	c.status = 0
+	c.mu.Unlock()
+	tracer.Start("", "GET", SpanKindServer).End()
+	tracer.Flush()
+	if !strings.Contains(c.logged(), "INFO Exporting trace spans to") {
+		t.Errorf("log = %q, want the recovery reported", c.logged())
+	}
+	if n := len(c.spans()); n != 2 {
+		t.Errorf("%d exports reached the collector, want 2", n)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start("", "GET", SpanKindServer)
+	span.SetAttr("k", "v")
+	span.SetError()
+	span.End()
+	tracer.Flush()
+	if span != nil || span.TraceID() != "" || span.Traceparent() != "" {
+		t.Errorf("nil tracer gave span %+v", span)
+	}
+}
@@ -242,7 +242,7 @@ handle_config_routes() {
 	return 1
 }
 
-# Handle Tunnel Control routes (start/stop)
+# Handle Tunnel Control routes (start/stop/reconnect)
 handle_tunnel_control_routes() {
 	local method="$1"
 	local path="$2"
@@ -301,6 +301,28 @@ handle_tunnel_control_routes() {
 		fi
 		return 0
 		;;
+	/reconnect/*)
+		if [ "$method" = "POST" ]; then
+			tunnel_hash=$(echo "$path" | sed 's|^/reconnect/||')
+			if [ -n "$tunnel_hash" ]; then
+				output=$(autossh-cli reconnect "$tunnel_hash" 2>&1)
+				result=$?
+				json_output=$(json_escape "$output")
+				if [ $result -eq 0 ]; then
+					printf '{"status": "success", "tunnel_hash": "%s", "method": "control_master", "output": "%s"}' "$tunnel_hash" "$json_output" | response "200 OK"
+				elif [ $result -eq 2 ]; then
+					printf '{"status": "error", "tunnel_hash": "%s", "method": "interactive", "message": "No live control master, interactive authentication required", "output": "%s"}' "$tunnel_hash" "$json_output" | response "409 Conflict"
+				else
+					printf '{"status": "error", "tunnel_hash": "%s", "message": "Failed to restore tunnel", "output": "%s"}' "$tunnel_hash" "$json_output" | response "500 Internal Server Error"
+				fi
+			else
+				json_error "Tunnel hash required" | response "400 Bad Request"
+			fi
+		else
+			json_error "Method not allowed" | response "405 Method Not Allowed"
+		fi
+		return 0
+		;;
 	esac
 
 	return 1
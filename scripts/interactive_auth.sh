@@ -125,10 +125,23 @@ start_interactive_tunnel() {
 	local sockets_dir=$(get_sockets_dir)
 	local ctrl_socket="$sockets_dir/$target_hash"
 
-	# Cleanup stale socket if exists
+	# Reuse a live control master instead of authenticating again
 	if [ -e "$ctrl_socket" ]; then
-		log_info "INTERACTIVE" "Cleaning up stale control socket"
-		rm -f "$ctrl_socket"
+		reuse_control_master "$target_hash"
+		case $? in
+		0)
+			return 0
+			;;
+		1)
+			log_info "INTERACTIVE" "Closing control master that could not restore the forward"
+			ssh -S "$ctrl_socket" -O exit ignored-host 2>/dev/null
+			;;
+		esac
+		# Cleanup stale socket if exists
+		if [ -e "$ctrl_socket" ]; then
+			log_info "INTERACTIVE" "Cleaning up stale control socket"
+			rm -f "$ctrl_socket"
+		fi
 	fi
 
 	# Build SSH options
@@ -240,6 +253,96 @@ start_interactive_tunnel() {
 	fi
 }
 
+# Function to build the ssh forwarding arguments for a tunnel
+# Usage: get_forward_args <direction> <remote_port> <local_port>
+# Prints "-L ..." or "-R ..." with the same host defaults as start_interactive_tunnel
+get_forward_args() {
+	local direction=$1
+	local remote_port=$2
+	local local_port=$3
+	local target_host="localhost"
+	local target_port="$remote_port"
+	local local_host="localhost"
+	local local_port_num="$local_port"
+
+	if echo "$remote_port" | grep -q ":"; then
+		target_host=$(echo "$remote_port" | cut -d: -f1)
+		target_port=$(echo "$remote_port" | cut -d: -f2)
+	fi
+	if echo "$local_port" | grep -q ":"; then
+		local_host=$(echo "$local_port" | cut -d: -f1)
+		local_port_num=$(echo "$local_port" | cut -d: -f2)
+	fi
+
+	if [ "$direction" = "local_to_remote" ]; then
+		echo "-R $target_host:$target_port:$local_host:$local_port_num"
+	else
+		echo "-L $local_host:$local_port_num:$target_host:$target_port"
+	fi
+}
+
+# Function to restore an interactive tunnel through its existing control master
+# Checks the master with 'ssh -O check' and re-adds the forward with 'ssh -O forward',
+# so no password or 2FA prompt is needed while the master connection is alive.
+# Returns 0 if the tunnel is running, 2 if there is no live master, 1 on error
+reuse_control_master() {
+	local input_hash=$1
+	local config_file="${AUTOSSH_CONFIG_FILE:-/etc/autossh/config/config.yaml}"
+
+	# Resolve hash prefix to full hash
+	local target_hash
+	target_hash=$(resolve_hash_prefix "$input_hash")
+	if [ $? -ne 0 ]; then
+		return 1
+	fi
+
+	local tunnel_config=$(parse_config "$config_file" | grep "	$target_hash	")
+	if [ -z "$tunnel_config" ]; then
+		log_error "INTERACTIVE" "Tunnel configuration not found for hash: $target_hash"
+		return 1
+	fi
+
+	local remote_host=$(echo "$tunnel_config" | cut -f1)
+	local remote_port=$(echo "$tunnel_config" | cut -f2)
+	local local_port=$(echo "$tunnel_config" | cut -f3)
+	local direction=$(echo "$tunnel_config" | cut -f4)
+	local name=$(echo "$tunnel_config" | cut -f5)
+
+	local sockets_dir=$(get_sockets_dir)
+	local ctrl_socket="$sockets_dir/$target_hash"
+
+	if [ ! -e "$ctrl_socket" ]; then
+		log_info "INTERACTIVE" "No control master for: $name ($target_hash)"
+		return 2
+	fi
+
+	local check_output=$(ssh -S "$ctrl_socket" -O check ignored-host 2>&1)
+	if ! echo "$check_output" | grep -q "Master running"; then
+		log_info "INTERACTIVE" "Control master is gone for: $name ($target_hash)"
+		rm -f "$ctrl_socket"
+		return 2
+	fi
+	local ssh_pid=$(echo "$check_output" | sed -n 's/.*pid=\([0-9]*\).*/\1/p')
+
+	local log_file="/tmp/autossh-logs/tunnel-${target_hash}.log"
+	mkdir -p /tmp/autossh-logs
+
+	# Re-adding a forward the master still holds is a no-op for ssh
+	local forward_args=$(get_forward_args "$direction" "$remote_port" "$local_port")
+	log_info "INTERACTIVE" "Reusing control master (PID: $ssh_pid) for: $name ($target_hash)" | tee -a "$log_file"
+	local forward_output
+	forward_output=$(ssh -S "$ctrl_socket" -O forward $forward_args ignored-host 2>&1)
+	if [ $? -ne 0 ]; then
+		log_error "INTERACTIVE" "Failed to restore forward through control master: $forward_output" | tee -a "$log_file"
+		return 1
+	fi
+
+	remove_tunnel_from_state "$target_hash"
+	save_tunnel_state "$remote_host" "$remote_port" "$local_port" "$direction" "$name" "$target_hash" "$ssh_pid"
+	log_info "INTERACTIVE" "Tunnel '$name' restored without re-authentication." | tee -a "$log_file"
+	return 0
+}
+
 # Function to stop an interactive tunnel using control socket
 stop_interactive_tunnel() {
 	local input_hash=$1
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"otlptrace"
+)
+
+// Log output settings
+var (
+	logJSON   bool // WEB_LOG_FORMAT=json: one JSON object per line
+	accessLog = true
+)
+
+// requestIDHeader carries a request's ID from the browser or a proxy in
+// front of the panel to the autossh API and the ws-server.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern is what an incoming request ID must look like to be
+// kept; anything else is replaced.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// loadLoggingFromEnv reads WEB_LOG_FORMAT ("text" or "json") and
+// WEB_ACCESS_LOG.
+func loadLoggingFromEnv() error {
+	switch f := os.Getenv("WEB_LOG_FORMAT"); f {
+	case "", "text":
+		logJSON = false
+	case "json":
+		logJSON = true
+	default:
+		return fmt.Errorf("invalid WEB_LOG_FORMAT %q (text or json)", f)
+	}
+	accessLog = os.Getenv("WEB_ACCESS_LOG") != "false"
+	return nil
+}
+
+// logLine writes one log line. In JSON mode fields are added to the
+// object; in text mode they are left out.
+func logLine(level, component, msg string, fields map[string]interface{}) {
+	now := time.Now()
+	if !logJSON {
+		fmt.Printf("[%s] [%s] [%s] %s\n", now.Format("2006-01-02 15:04:05"), level, component, msg)
+		return
+	}
+	entry := map[string]interface{}{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["component"] = component
+	entry["msg"] = msg
+	line, _ := json.Marshal(entry)
+	fmt.Printf("%s\n", line)
+}
+
+// requestInfo follows a request through the panel.
+type requestInfo struct {
+	ID   string
+	Span *otlptrace.Span
+	User string // set once the request is authenticated
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestID is the request's ID, or "-" outside withAccessLog.
+func requestID(r *http.Request) string {
+	if info := requestInfoFrom(r); info != nil {
+		return info.ID
+	}
+	return "-"
+}
+
+// noteUser records who made the request, for the access log.
+func noteUser(r *http.Request, user string) {
+	if info := requestInfoFrom(r); info != nil {
+		info.User = user
+	}
+}
+
+// setTraceHeaders adds the request's ID and trace context to h, the
+// headers of a call made on the request's behalf.
+func setTraceHeaders(h http.Header, r *http.Request) {
+	info := requestInfoFrom(r)
+	if info == nil {
+		return
+	}
+	h.Set(requestIDHeader, info.ID)
+	if tp := info.Span.Traceparent(); tp != "" {
+		h.Set("traceparent", tp)
+	}
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessWriter records the status and size of a response.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack hands over the connection for WebSockets, which take it by type
+// assertion.
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *accessWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isProbePath reports whether path is a health endpoint, whose successful
+// checks are left out of the access log.
+func isProbePath(path string) bool {
+	path = strings.TrimPrefix(path, basePath)
+	return path == "/healthz" || path == "/readyz"
+}
+
+// withAccessLog gives every request an ID, taken from X-Request-ID when the
+// client sent a usable one, and a server span, and logs the request once
+// it is done: status, bytes written and latency. WebSocket requests are
+// logged when the connection closes.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{ID: id, Span: tracer.Start(r.Header.Get("traceparent"), r.Method, otlptrace.SpanKindServer)}
+		w.Header().Set(requestIDHeader, id)
+
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		took := time.Since(start)
+		span := info.Span
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("http.response.status_code", status)
+		span.SetAttr("client.address", clientIP(r))
+		span.SetAttr("user_agent.original", r.UserAgent())
+		span.SetAttr("request.id", id)
+		if info.User != "" {
+			span.SetAttr("enduser.id", info.User)
+		}
+		if status >= 500 {
+			span.SetError()
+		}
+		span.End()
+
+		if !accessLog || (status == http.StatusOK && isProbePath(r.URL.Path)) {
+			return
+		}
+		user := info.User
+		if user == "" {
+			user = "-"
+		}
+		// Paths only: WebSocket URLs may carry a token in the query
+		msg := fmt.Sprintf("%s %s %q %d %dB %s id=%s", clientIP(r), user, r.Method+" "+r.URL.Path,
+			status, aw.bytes, took.Round(time.Microsecond), id)
+		if traceID := span.TraceID(); traceID != "" {
+			msg += " trace=" + traceID
+		}
+		logLine("INFO", "ACCESS", msg, map[string]interface{}{
+			"request_id":  id,
+			"trace_id":    span.TraceID(),
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      status,
+			"bytes":       aw.bytes,
+			"duration_ms": float64(took.Microseconds()) / 1000,
+			"remote":      clientIP(r),
+			"user":        info.User,
+			"user_agent":  r.UserAgent(),
+		})
+	})
+}
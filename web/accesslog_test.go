@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"otlptrace"
+)
+
+// withTracer points the tracer at a fake OTLP collector and returns the
+// spans it receives.
+func withTracer(t *testing.T) func() []otlptrace.WireSpan {
+	t.Helper()
+	var mu sync.Mutex
+	var spans []otlptrace.WireSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer otlp" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var body otlptrace.Request
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+
+	old := tracer
+	t.Cleanup(func() { tracer = old })
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL+"/")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20otlp")
+	if err := loadTracingFromEnv(); err != nil || tracer == nil {
+		t.Fatalf("loadTracingFromEnv: %v", err)
+	}
+	return func() []otlptrace.WireSpan {
+		tracer.Flush()
+		mu.Lock()
+		defer mu.Unlock()
+		return spans
+	}
+}
+
+func TestAccessLog_RequestIDAndTracing(t *testing.T) {
+	exported := withTracer(t)
+
+	seen := make(chan http.Header, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(backend.Close)
+	mux := http.NewServeMux()
+	mux.Handle("/api/autossh/", newAPIProxyHandler(backend.URL))
+	server := httptest.NewServer(withAccessLog(requireAuth(mux)))
+	t.Cleanup(server.Close)
+
+	get := func(id, traceparent string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+"/api/autossh/status", nil)
+		req.Header.Set(requestIDHeader, id)
+		req.Header.Set("traceparent", traceparent)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// A usable ID and trace context from the client are carried on
+	const parent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	resp := get("lb-7f3a", parent)
+	got := <-seen
+	if resp.Header.Get(requestIDHeader) != "lb-7f3a" || got.Get(requestIDHeader) != "lb-7f3a" {
+		t.Errorf("request ID: response %q, backend %q", resp.Header.Get(requestIDHeader), got.Get(requestIDHeader))
+	}
+	traceID, spanID, sampled, ok := otlptrace.ParseTraceparent(got.Get("traceparent"))
+	if !ok || !sampled || hex.EncodeToString(traceID[:]) != "0af7651916cd43dd8448eb211c80319c" ||
+		hex.EncodeToString(spanID[:]) == "b7ad6b7169203331" {
+		t.Errorf("backend traceparent = %q", got.Get("traceparent"))
+	}
+
+	// Anything else gets a fresh ID
+	resp = get("not a valid id", "garbage")
+	got = <-seen
+	id := resp.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) || id == "not a valid id" || got.Get(requestIDHeader) != id {
+		t.Errorf("generated request ID: response %q, backend %q", id, got.Get(requestIDHeader))
+	}
+
+	spans := exported()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2: %+v", len(spans), spans)
+	}
+	// The backend's parent is the panel's span, which continues the client's
+	first := spans[0]
+	if first.TraceID != "0af7651916cd43dd8448eb211c80319c" || first.ParentSpanID != "b7ad6b7169203331" ||
+		first.SpanID != hex.EncodeToString(spanID[:]) || first.Kind != otlptrace.SpanKindServer {
+		t.Errorf("continued span = %+v", first)
+	}
+	if second := spans[1]; second.ParentSpanID != "" || second.TraceID == first.TraceID {
+		t.Errorf("root span = %+v", second)
+	}
+}
+
+func TestLoadLoggingFromEnv(t *testing.T) {
+	oldJSON, oldAccess := logJSON, accessLog
+	t.Cleanup(func() { logJSON, accessLog = oldJSON, oldAccess })
+	t.Setenv("WEB_LOG_FORMAT", "json")
+	t.Setenv("WEB_ACCESS_LOG", "false")
+	if err := loadLoggingFromEnv(); err != nil || !logJSON || accessLog {
+		t.Errorf("json, access log off: %v, json %v, access %v", err, logJSON, accessLog)
+	}
+	t.Setenv("WEB_LOG_FORMAT", "xml")
+	if err := loadLoggingFromEnv(); err == nil {
+		t.Error("WEB_LOG_FORMAT=xml accepted")
+	}
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// An agent is a panel next to an autossh container the central panel cannot
+// reach. It dials out to the central panel over a WebSocket, which then
+// opens streams back over that connection: HTTP requests to the agent's
+// autossh API and WebSocket sessions with its ws-server. On the central
+// panel an agent is a backend like the ones from WEB_BACKENDS_FILE.
+
+// Host names the central panel uses for an agent's API and ws-server; the
+// agent routes each stream by them.
+const (
+	agentAPIHost = "api"
+	agentWSHost  = "ws"
+)
+
+// Agent reconnection backoff. A connection that lasted agentStableAfter
+// resets it.
+var (
+	agentMinBackoff  = time.Second
+	agentMaxBackoff  = time.Minute
+	agentStableAfter = time.Minute
+)
+
+const agentHelloTimeout = 10 * time.Second
+
+var (
+	errAgentOffline   = errors.New("agent not connected")
+	errAgentUnknown   = errors.New("unknown agent")
+	errAgentConnected = errors.New("agent is connected")
+	errAgentTaken     = errors.New("agent is connected with another token")
+)
+
+// agentHello is the first message an agent sends after connecting.
+type agentHello struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	WSEnabled bool   `json:"ws_enabled"`
+}
+
+// agentWelcome is the central panel's answer to an accepted hello. A
+// rejected agent gets a close frame with the reason instead.
+type agentWelcome struct {
+	Status string `json:"status"`
+}
+
+// agentLink is the central panel's side of one agent: its current
+// connection, if any, and what it said about itself.
+type agentLink struct {
+	mu             sync.Mutex
+	session        *muxSession
+	tokenID        string // the token the session connected with
+	remoteAddr     string
+	version        string
+	wsEnabled      bool
+	connectedAt    time.Time
+	disconnectedAt time.Time
+}
+
+// dial opens a stream to the agent; addr's host picks the API or the
+// ws-server.
+func (a *agentLink) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	a.mu.Lock()
+	s := a.session
+	a.mu.Unlock()
+	if s == nil {
+		return nil, errAgentOffline
+	}
+	return s.Open(host)
+}
+
+// agentView is how an agent's connection is shown.
+type agentView struct {
+	Connected      bool       `json:"connected"`
+	RemoteAddr     string     `json:"remote_addr,omitempty"`
+	Version        string     `json:"version,omitempty"`
+	ConnectedAt    *time.Time `json:"connected_at,omitempty"`
+	DisconnectedAt *time.Time `json:"disconnected_at,omitempty"`
+}
+
+func (a *agentLink) view() *agentView {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	v := &agentView{Connected: a.session != nil, RemoteAddr: a.remoteAddr, Version: a.version}
+	if !a.connectedAt.IsZero() {
+		at := a.connectedAt
+		v.ConnectedAt = &at
+	}
+	if !a.disconnectedAt.IsZero() && a.session == nil {
+		at := a.disconnectedAt
+		v.DisconnectedAt = &at
+	}
+	return v
+}
+
+// AgentRegistry holds the agents that have connected to this panel, by
+// name. Agents stay listed when they disconnect, until they are removed.
+type AgentRegistry struct {
+	mu       sync.Mutex
+	backends map[string]*Backend
+}
+
+// agents is the central panel's registry; agents connect with an API token
+// that has the agent scope.
+var agents = NewAgentRegistry()
+
+// NewAgentRegistry returns a registry without agents.
+func NewAgentRegistry() *AgentRegistry {
+	return &AgentRegistry{backends: map[string]*Backend{}}
+}
+
+// List returns the agents' backends sorted by name.
+func (g *AgentRegistry) List() []*Backend {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	list := make([]*Backend, 0, len(g.backends))
+	for _, b := range g.backends {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// checkName reports why an agent may not use name.
+func (g *AgentRegistry) checkName(name string) error {
+	if !backendNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid agent name %q", name)
+	}
+	if name == defaultBackendName {
+		return fmt.Errorf("agent name %q is taken by the default backend", name)
+	}
+	for _, b := range backendRegistry {
+		if b.Name == name {
+			return fmt.Errorf("agent name %q is taken by a configured backend", name)
+		}
+	}
+	return nil
+}
+
+// checkFree reports errAgentTaken when the agent called name is connected
+// with a token other than tokenID.
+func (g *AgentRegistry) checkFree(name, tokenID string) error {
+	g.mu.Lock()
+	b, ok := g.backends[name]
+	g.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	b.agent.mu.Lock()
+	defer b.agent.mu.Unlock()
+	if b.agent.session != nil && b.agent.tokenID != tokenID {
+		return errAgentTaken
+	}
+	return nil
+}
+
+// Attach makes s, which connected with the token tokenID, the connection of
+// the agent called hello.Name. A reconnection with the same token replaces
+// the agent's connection; one with another token is refused while the
+// agent is connected.
+func (g *AgentRegistry) Attach(hello agentHello, tokenID string, s *muxSession, remoteAddr string) (*Backend, error) {
+	if err := g.checkName(hello.Name); err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	b, ok := g.backends[hello.Name]
+	if !ok {
+		link := &agentLink{}
+		transport := &http.Transport{
+			DialContext:         link.dial,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		b = &Backend{
+			Name:      hello.Name,
+			APIURL:    "http://" + agentAPIHost,
+			WSURL:     "ws://" + agentWSHost,
+			agent:     link,
+			transport: transport,
+		}
+		b.tunnels = &TunnelDirectory{fetch: b.getJSON}
+		b.proxy = newBackendProxyHandler(b, b.APIURL, "/api/backends/"+b.Name+"/autossh")
+		g.backends[b.Name] = b
+	}
+	g.mu.Unlock()
+
+	link := b.agent
+	link.mu.Lock()
+	old := link.session
+	if old != nil && link.tokenID != tokenID {
+		link.mu.Unlock()
+		return nil, errAgentTaken
+	}
+	link.session, link.tokenID, link.remoteAddr, link.version, link.wsEnabled = s, tokenID, remoteAddr, hello.Version, hello.WSEnabled
+	link.connectedAt = time.Now()
+	link.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	b.transport.(*http.Transport).CloseIdleConnections()
+	return b, nil
+}
+
+// Detach records that s, the connection of the agent b, ended.
+func (g *AgentRegistry) Detach(b *Backend, s *muxSession) {
+	link := b.agent
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.session == s {
+		link.session = nil
+		link.disconnectedAt = time.Now()
+	}
+}
+
+// Remove forgets a disconnected agent.
+func (g *AgentRegistry) Remove(name string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b, ok := g.backends[name]
+	if !ok {
+		return errAgentUnknown
+	}
+	if b.agent.view().Connected {
+		return errAgentConnected
+	}
+	delete(g.backends, name)
+	return nil
+}
+
+// agentUpgrader accepts agent connections; agents are not browsers, so
+// there is no origin to check.
+var agentUpgrader = websocket.Upgrader{
+	ReadBufferSize:  32 << 10,
+	WriteBufferSize: 32 << 10,
+	CheckOrigin:     func(*http.Request) bool { return true },
+}
+
+// agentConnectHandler serves GET /api/agents/connect, where agents dial in.
+// They present an API token with the agent scope, which names the one agent
+// they may connect as.
+func agentConnectHandler(w http.ResponseWriter, r *http.Request) {
+	if tokenStore == nil {
+		writeJSONError(w, http.StatusNotFound, "Agents need WEB_TOKENS_FILE")
+		return
+	}
+	sess := tokenSession(r)
+	if sess == nil {
+		logMsg("WARN", "AGENT", "Agent connection from %s without a valid token", r.RemoteAddr)
+		writeJSONError(w, http.StatusUnauthorized, "Invalid or expired token")
+		return
+	}
+	if !sess.Token.HasScope(ScopeAgent) {
+		logMsg("WARN", "AGENT", "Token %q from %s lacks the agent scope", sess.Token.Name, r.RemoteAddr)
+		writeJSONError(w, http.StatusForbidden, "Token lacks the agent scope")
+		return
+	}
+
+	conn, err := agentUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logMsg("WARN", "AGENT", "Agent upgrade from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	// The server's read and write timeouts cover the handshake only
+	conn.NetConn().SetDeadline(time.Time{})
+	reject := func(reason string) {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(time.Second))
+		conn.Close()
+	}
+
+	var hello agentHello
+	conn.SetReadDeadline(time.Now().Add(agentHelloTimeout))
+	if err := conn.ReadJSON(&hello); err != nil {
+		logMsg("WARN", "AGENT", "No hello from agent at %s: %v", r.RemoteAddr, err)
+		reject("hello expected")
+		return
+	}
+	if hello.Name != sess.Token.Agent {
+		logMsg("WARN", "AGENT", "Token %q from %s is for agent %q, not %q", sess.Token.Name, r.RemoteAddr, sess.Token.Agent, hello.Name)
+		reject("token is not for this agent")
+		return
+	}
+	if err := agents.checkName(hello.Name); err != nil {
+		logMsg("WARN", "AGENT", "Rejected agent from %s: %v", r.RemoteAddr, err)
+		reject(err.Error())
+		return
+	}
+	if err := agents.checkFree(hello.Name, sess.Token.ID); err != nil {
+		logMsg("WARN", "AGENT", "Rejected agent %s from %s with token %q: %v", hello.Name, r.RemoteAddr, sess.Token.Name, err)
+		reject(err.Error())
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	if err := conn.WriteJSON(agentWelcome{Status: "ok"}); err != nil {
+		conn.Close()
+		return
+	}
+
+	s := newMuxSession(conn, false)
+	b, err := agents.Attach(hello, sess.Token.ID, s, clientIP(r))
+	if err != nil {
+		logMsg("WARN", "AGENT", "Rejected agent %s from %s with token %q: %v", hello.Name, r.RemoteAddr, sess.Token.Name, err)
+		s.Close()
+		return
+	}
+	logMsg("INFO", "AGENT", "Agent %s (%s) connected from %s with token %q", hello.Name, hello.Version, clientIP(r), sess.Token.Name)
+	<-s.Done()
+	agents.Detach(b, s)
+	logMsg("INFO", "AGENT", "Agent %s disconnected: %v", hello.Name, s.Err())
+}
+
+// agentAccessRules covers the agent list.
+var agentAccessRules = []accessRule{
+	{http.MethodGet, "/api/agents", RoleViewer, ScopeRead},
+	{http.MethodDelete, "/api/agents/*", RoleAdmin, ScopeConfig},
+}
+
+// agentListEntry is an agent in GET /api/agents.
+type agentListEntry struct {
+	Name      string `json:"name"`
+	WSEnabled bool   `json:"ws_enabled"`
+	agentView
+}
+
+// agentsHandler serves GET /api/agents and DELETE /api/agents/{name}, which
+// removes a disconnected agent.
+func agentsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/agents"), "/")
+	if name == "connect" {
+		agentConnectHandler(w, r)
+		return
+	}
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		if !checkAccess(w, r, agentAccessRules, "/api/agents") {
+			return
+		}
+		list := []agentListEntry{}
+		for _, b := range agents.List() {
+			list = append(list, agentListEntry{Name: b.Name, WSEnabled: b.wsEnabled(), agentView: *b.agent.view()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case name != "" && r.Method == http.MethodDelete:
+		if !checkAccess(w, r, agentAccessRules, r.URL.Path) {
+			return
+		}
+		switch err := agents.Remove(name); err {
+		case errAgentUnknown:
+			writeJSONError(w, http.StatusNotFound, "Unknown agent")
+			return
+		case errAgentConnected:
+			writeJSONError(w, http.StatusConflict, "Agent is connected")
+			return
+		}
+		logMsg("INFO", "AGENT", "Agent %s removed", name)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success"}`))
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// AgentClient connects this panel's backend to a central panel.
+type AgentClient struct {
+	URL   string // the central panel's agent endpoint
+	Name  string
+	Token string
+
+	handler http.Handler
+}
+
+// agentClient is set when WEB_AGENT_URL is.
+var agentClient *AgentClient
+
+// loadAgentFromEnv reads WEB_AGENT_URL, the central panel's address,
+// WEB_AGENT_TOKEN and WEB_AGENT_NAME (default: the host name). The agent
+// serves the backend from API_BASE_URL and WS_BASE_URL.
+func loadAgentFromEnv() error {
+	panel := os.Getenv("WEB_AGENT_URL")
+	if panel == "" {
+		return nil
+	}
+	if apiBaseURL == "" {
+		return fmt.Errorf("WEB_AGENT_URL needs API_BASE_URL")
+	}
+	c := &AgentClient{Token: os.Getenv("WEB_AGENT_TOKEN"), Name: os.Getenv("WEB_AGENT_NAME")}
+	if c.Token == "" {
+		return fmt.Errorf("WEB_AGENT_URL needs WEB_AGENT_TOKEN")
+	}
+	if c.Name == "" {
+		c.Name, _ = os.Hostname()
+	}
+	if !backendNamePattern.MatchString(c.Name) {
+		return fmt.Errorf("invalid WEB_AGENT_NAME %q", c.Name)
+	}
+	u, err := url.Parse(panel)
+	if err != nil {
+		return fmt.Errorf("invalid WEB_AGENT_URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return fmt.Errorf("WEB_AGENT_URL must be an http(s) URL")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/agents/connect"
+	c.URL = u.String()
+	agentClient = c
+	return nil
+}
+
+// Run keeps the agent connected until stop is closed, backing off between
+// attempts.
+func (c *AgentClient) Run(stop <-chan struct{}) {
+	c.handler = newAgentHandler()
+	backoff := agentMinBackoff
+	for {
+		started := time.Now()
+		err := c.connect(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if time.Since(started) >= agentStableAfter {
+			backoff = agentMinBackoff
+		}
+		wait := backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+		logMsg("WARN", "AGENT", "Not connected to the panel at %s: %v; retrying in %s", c.URL, err, wait.Round(time.Second))
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+		backoff = min(backoff*2, agentMaxBackoff)
+	}
+}
+
+// connect makes one connection to the central panel and serves its
+// streams until either side ends it.
+func (c *AgentClient) connect(stop <-chan struct{}) error {
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 30 * time.Second,
+		ReadBufferSize:   32 << 10,
+		WriteBufferSize:  32 << 10,
+	}
+	conn, resp, err := dialer.Dial(c.URL, http.Header{"Authorization": {"Bearer " + c.Token}})
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%w (%s)", err, resp.Status)
+		}
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	if err := conn.WriteJSON(agentHello{Name: c.Name, Version: version, WSEnabled: wsBaseURL != ""}); err != nil {
+		conn.Close()
+		return err
+	}
+	var welcome agentWelcome
+	conn.SetReadDeadline(time.Now().Add(agentHelloTimeout))
+	if err := conn.ReadJSON(&welcome); err != nil {
+		conn.Close()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && closeErr.Text != "" {
+			return fmt.Errorf("rejected: %s", closeErr.Text)
+		}
+		return err
+	}
+
+	s := newMuxSession(conn, true)
+	logMsg("INFO", "AGENT", "Connected to the panel at %s as %s", c.URL, c.Name)
+	server := &http.Server{Handler: withAccessLog(c.handler), ReadHeaderTimeout: readHeaderTimeout}
+	go server.Serve(muxListener{s})
+	select {
+	case <-s.Done():
+	case <-stop:
+		s.Close()
+	}
+	server.Close()
+	return s.Err()
+}
+
+// newAgentHandler serves the central panel's streams: requests for the
+// ws-server host go to WS_BASE_URL, the rest to API_BASE_URL, both with
+// this panel's API key.
+func newAgentHandler() http.Handler {
+	api := newAgentProxy(apiBaseURL)
+	var ws http.Handler
+	if wsBaseURL != "" {
+		if u, err := wsHTTPURL(wsBaseURL); err != nil {
+			logMsg("WARN", "AGENT", "Not forwarding ws-server streams: %v", err)
+		} else {
+			ws = newAgentProxy(u.String())
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		logMsg("DEBUG", "AGENT", "%s %s for the panel (%s)", r.Method, r.URL.Path, host)
+		if host != agentWSHost {
+			api.ServeHTTP(w, r)
+			return
+		}
+		if ws == nil {
+			http.Error(w, "WebSocket not configured", http.StatusServiceUnavailable)
+			return
+		}
+		ws.ServeHTTP(w, r)
+	})
+}
+
+// newAgentProxy forwards to targetURL, switching protocols for WebSocket
+// upgrades.
+func newAgentProxy(targetURL string) http.Handler {
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Agent proxy misconfigured", http.StatusBadGateway)
+		})
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		req.Host = target.Host
+		setTraceHeaders(req.Header, req)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			query := req.URL.Query()
+			if query.Has("token") {
+				query.Del("token")
+				req.URL.RawQuery = query.Encode()
+			}
+		}
+	}
+	return proxy
+}
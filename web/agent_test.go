@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withAgents gives the test an empty agent registry and short reconnection
+// backoff.
+func withAgents(t *testing.T) {
+	t.Helper()
+	oldAgents, oldMin, oldMax := agents, agentMinBackoff, agentMaxBackoff
+	t.Cleanup(func() { agents, agentMinBackoff, agentMaxBackoff = oldAgents, oldMin, oldMax })
+	agents, agentMinBackoff, agentMaxBackoff = NewAgentRegistry(), 10*time.Millisecond, 50*time.Millisecond
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAgent(t *testing.T) {
+	withAgents(t)
+	store := withTokenStore(t)
+	_, secret, _ := store.Create("edge-agent", []string{ScopeAgent}, nil, "edge", 0, "alice")
+	_, rogue, _ := store.Create("rogue-agent", []string{ScopeAgent}, nil, "edge", 0, "alice")
+	_, local, _ := store.Create("local-agent", []string{ScopeAgent}, nil, "local", 0, "alice")
+	_, readOnly, _ := store.Create("ci", []string{ScopeRead}, nil, "", 0, "alice")
+
+	// The agent's own autossh API and ws-server, which echoes
+	api, apiURL := newFakeBackendAPI(t, map[string]tunnelState{"e1": {"name": "cache", "hash": "e1"}})
+	var many []TunnelStatus
+	for i := 0; i < 2000; i++ {
+		many = append(many, TunnelStatus{Hash: fmt.Sprintf("h%d", i), Name: "cache", Status: "NORMAL"})
+	}
+	api.status.set(many...)
+	wsAuth := make(chan string, 1)
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsAuth <- r.Header.Get("Authorization")
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(typ, append([]byte(r.URL.Path+" "), data...))
+		}
+	}))
+	t.Cleanup(wsServer.Close)
+	withBackends(t, apiURL, `{"backends": []}`)
+	wsBaseURL, apiKey = "ws"+strings.TrimPrefix(wsServer.URL, "http"), "agent-key"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/agents", agentsHandler)
+	mux.HandleFunc("/api/agents/", agentsHandler)
+	mux.HandleFunc("/api/backends/", backendsHandler)
+	central := httptest.NewServer(requireAuth(mux))
+	t.Cleanup(central.Close)
+
+	connectURL := "ws" + strings.TrimPrefix(central.URL, "http") + "/api/agents/connect"
+	client := &AgentClient{URL: connectURL, Name: "edge", Token: secret}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		client.Run(stop)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		select {
+		case <-stop:
+		default:
+			close(stop)
+		}
+		<-stopped
+	})
+	connected := func() bool {
+		list := agents.List()
+		return len(list) == 1 && list[0].agent.view().Connected
+	}
+	waitFor(t, "the agent to connect", connected)
+
+	// API requests travel to the agent and go out with its key
+	resp, err := http.Get(central.URL + "/api/backends/edge/autossh/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status []TunnelStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(status) != len(many) || api.lastAuth() != "Bearer agent-key" {
+		t.Fatalf("status through the agent: %d, %d tunnels, auth %q", resp.StatusCode, len(status), api.lastAuth())
+	}
+
+	// So do WebSocket sessions
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(central.URL, "http")+"/api/backends/edge/ws/auth/e1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	_, echo, err := conn.ReadMessage()
+	conn.Close()
+	if err != nil || string(echo) != "/ws/auth/e1 hello" || <-wsAuth != "Bearer agent-key" {
+		t.Fatalf("WebSocket through the agent: %q, %v", echo, err)
+	}
+
+	var listed []agentListEntry
+	resp, _ = http.Get(central.URL + "/api/agents")
+	json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if len(listed) != 1 || listed[0].Name != "edge" || !listed[0].Connected || !listed[0].WSEnabled {
+		t.Errorf("GET /api/agents = %+v", listed)
+	}
+
+	// A dropped connection is re-established
+	first := agents.List()[0].agent.view().ConnectedAt
+	agents.List()[0].agent.session.Close()
+	waitFor(t, "the agent to reconnect", func() bool {
+		v := agents.List()[0].agent.view()
+		return v.Connected && v.ConnectedAt.After(*first)
+	})
+
+	// A token only connects as the agent it was made for, and another
+	// token for the same agent cannot take over its connection
+	connectedAt := agents.List()[0].agent.view().ConnectedAt
+	renamed := &AgentClient{URL: connectURL, Name: "other", Token: secret}
+	if err := renamed.connect(make(chan struct{})); err == nil || !strings.Contains(err.Error(), "not for this agent") {
+		t.Errorf("token used for another agent: %v", err)
+	}
+	impostor := &AgentClient{URL: connectURL, Name: "edge", Token: rogue}
+	if err := impostor.connect(make(chan struct{})); err == nil || !strings.Contains(err.Error(), "another token") {
+		t.Errorf("second token for a connected agent: %v", err)
+	}
+	if v := agents.List()[0].agent.view(); !v.Connected || !v.ConnectedAt.Equal(*connectedAt) {
+		t.Error("the agent's connection was replaced")
+	}
+
+	// Names of configured backends are taken, and tokens need the scope
+	taken := &AgentClient{URL: connectURL, Name: "local", Token: local}
+	if err := taken.connect(make(chan struct{})); err == nil || !strings.Contains(err.Error(), "taken") {
+		t.Errorf("agent named like the default backend: %v", err)
+	}
+	unscoped := &AgentClient{URL: connectURL, Name: "other", Token: readOnly}
+	if err := unscoped.connect(make(chan struct{})); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("token without the agent scope: %v", err)
+	}
+
+	// Connected agents stay; disconnected ones can be removed
+	del := func() int {
+		req, _ := http.NewRequest("DELETE", central.URL+"/api/agents/edge", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := del(); code != http.StatusConflict {
+		t.Errorf("remove connected agent: status %d, want 409", code)
+	}
+	close(stop)
+	<-stopped
+	waitFor(t, "the agent to disconnect", func() bool { return !connected() })
+	resp, _ = http.Get(central.URL + "/api/backends/edge/autossh/status")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(staleHeader) == "" {
+		t.Errorf("status of a disconnected agent: %d, stale %q; want its last status", resp.StatusCode, resp.Header.Get(staleHeader))
+	}
+	resp, _ = http.Get(central.URL + "/api/backends/edge/autossh/config")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("configuration of a disconnected agent: %d, want 502", resp.StatusCode)
+	}
+	if code := del(); code != http.StatusOK || len(agents.List()) != 0 {
+		t.Errorf("remove disconnected agent: status %d, %d agents left", code, len(agents.List()))
+	}
+}
+
+func TestLoadAgentFromEnv(t *testing.T) {
+	old, oldBase := agentClient, apiBaseURL
+	t.Cleanup(func() { agentClient, apiBaseURL = old, oldBase })
+	apiBaseURL = "http://localhost:8080"
+	t.Setenv("WEB_AGENT_TOKEN", "ast_x")
+	t.Setenv("WEB_AGENT_NAME", "edge")
+	for _, tc := range []struct{ in, want string }{
+		{"https://panel.example.com/tunnels/", "wss://panel.example.com/tunnels/api/agents/connect"},
+		{"http://panel:5000", "ws://panel:5000/api/agents/connect"},
+	} {
+		t.Setenv("WEB_AGENT_URL", tc.in)
+		if err := loadAgentFromEnv(); err != nil || agentClient.URL != tc.want {
+			t.Errorf("WEB_AGENT_URL=%s: %v, %+v", tc.in, err, agentClient)
+		}
+	}
+	t.Setenv("WEB_AGENT_URL", "ftp://panel")
+	if err := loadAgentFromEnv(); err == nil {
+		t.Error("ftp URL accepted")
+	}
+	t.Setenv("WEB_AGENT_URL", "https://panel")
+	t.Setenv("WEB_AGENT_NAME", "a/b")
+	if err := loadAgentFromEnv(); err == nil {
+		t.Error("invalid name accepted")
+	}
+}
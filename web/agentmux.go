@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// An agent connection carries many byte streams over one WebSocket. Each
+// binary message is a frame: a type byte, a big-endian stream ID and the
+// payload. The panel opens streams; the agent accepts them.
+const (
+	frameOpen  byte = 1
+	frameData  byte = 2
+	frameClose byte = 3
+)
+
+const (
+	muxFrameSize     = 32 << 10
+	muxStreamBuffer  = 16 << 20 // unread bytes a stream may hold before it is reset
+	muxPingInterval  = 30 * time.Second
+	muxReadTimeout   = 90 * time.Second
+	muxWriteTimeout  = 10 * time.Second
+	muxAcceptBacklog = 64
+)
+
+var (
+	errMuxClosed      = errors.New("agent connection closed")
+	errStreamReset    = errors.New("stream reset: too much unread data")
+	errStreamBacklog  = errors.New("too many streams waiting to be accepted")
+	errStreamOverflow = errors.New("stream ID space exhausted")
+)
+
+// muxSession multiplexes streams over a WebSocket.
+type muxSession struct {
+	conn *websocket.Conn
+	wmu  sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error
+
+	accept chan *muxStream // nil on the opening side
+	done   chan struct{}
+}
+
+// newMuxSession starts reading frames from conn. With accepting set, the
+// peer may open streams and they are handed out by Accept.
+func newMuxSession(conn *websocket.Conn, accepting bool) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		streams: map[uint32]*muxStream{},
+		done:    make(chan struct{}),
+	}
+	if accepting {
+		s.accept = make(chan *muxStream, muxAcceptBacklog)
+	}
+	extend := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(muxReadTimeout))
+	}
+	conn.SetPongHandler(extend)
+	conn.SetPingHandler(func(data string) error {
+		extend(data)
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(muxWriteTimeout))
+	})
+	extend("")
+	go s.readLoop()
+	go s.keepAlive()
+	return s
+}
+
+// Done is closed when the session ends.
+func (s *muxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err is why the session ended.
+func (s *muxSession) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the session and every stream on it.
+func (s *muxSession) Close() error {
+	s.shutdown(errMuxClosed)
+	return nil
+}
+
+func (s *muxSession) shutdown(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = map[uint32]*muxStream{}
+	s.mu.Unlock()
+
+	s.wmu.Lock()
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	s.wmu.Unlock()
+	s.conn.Close()
+	for _, st := range streams {
+		st.remoteClosed(errMuxClosed)
+	}
+	close(s.done)
+}
+
+// Open starts a stream to target on the accepting side.
+func (s *muxSession) Open(target string) (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.nextID++
+	if s.nextID == 0 {
+		s.mu.Unlock()
+		return nil, errStreamOverflow
+	}
+	st := newMuxStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, st.id, []byte(target)); err != nil {
+		s.forget(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream. The target it asked for is
+// in the stream's Target field.
+func (s *muxSession) Accept() (*muxStream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.Err()
+	}
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	copy(frame[5:], payload)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.Err(); err != nil {
+		return err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		go s.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (s *muxSession) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) readLoop() {
+	for {
+		typ, frame, err := s.conn.ReadMessage()
+		if err != nil {
+			s.shutdown(err)
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(muxReadTimeout))
+		if typ != websocket.BinaryMessage || len(frame) < 5 {
+			continue
+		}
+		id := binary.BigEndian.Uint32(frame[1:5])
+		payload := frame[5:]
+
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		switch frame[0] {
+		case frameOpen:
+			if s.accept == nil || st != nil {
+				s.writeFrame(frameClose, id, nil)
+				continue
+			}
+			st = newMuxStream(s, id)
+			st.Target = string(payload)
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			default:
+				st.reset(errStreamBacklog)
+			}
+		case frameData:
+			if st != nil && !st.push(payload) {
+				st.reset(errStreamReset)
+			}
+		case frameClose:
+			if st != nil {
+				s.forget(id)
+				st.remoteClosed(io.EOF)
+			}
+		}
+	}
+}
+
+// keepAlive pings the peer so dead connections are noticed on both sides.
+func (s *muxSession) keepAlive() {
+	ticker := time.NewTicker(muxPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(muxWriteTimeout)); err != nil {
+				s.shutdown(err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// muxStream is one stream of a muxSession. It is a net.Conn; write
+// deadlines are not supported, the session's write timeout applies.
+type muxStream struct {
+	Target string
+
+	s  *muxSession
+	id uint32
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	readErr  error // returned once buf is drained
+	closed   bool  // closed locally
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	st := &muxStream{s: s, id: id}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+// push queues data from the peer; false means the reader fell too far
+// behind.
+func (st *muxStream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.readErr != nil || st.closed {
+		return true
+	}
+	if st.buf.Len()+len(data) > muxStreamBuffer {
+		return false
+	}
+	st.buf.Write(data)
+	st.cond.Broadcast()
+	return true
+}
+
+// remoteClosed ends reads with err once buffered data is consumed.
+func (st *muxStream) remoteClosed(err error) {
+	st.mu.Lock()
+	if st.readErr == nil {
+		st.readErr = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+// reset drops the stream on both ends. Reads return err rather than
+// net.ErrClosed, so the reader learns why.
+func (st *muxStream) reset(err error) {
+	st.mu.Lock()
+	st.buf.Reset()
+	st.mu.Unlock()
+	st.remoteClosed(err)
+	st.s.forget(st.id)
+	st.s.writeFrame(frameClose, st.id, nil)
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for st.buf.Len() == 0 {
+		switch {
+		case st.closed:
+			return 0, net.ErrClosed
+		case st.readErr != nil:
+			return 0, st.readErr
+		case !st.deadline.IsZero() && !time.Now().Before(st.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.cond.Wait()
+	}
+	return st.buf.Read(p)
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	st.mu.Lock()
+	closed, readErr := st.closed, st.readErr
+	st.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	if readErr != nil {
+		// The peer has let go of the stream
+		return 0, io.ErrClosedPipe
+	}
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, muxFrameSize)
+		if err := st.s.writeFrame(frameData, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close closes the stream on both ends.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	st.s.forget(st.id)
+	st.s.writeFrame(frameClose, st.id, nil)
+	return nil
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.s.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	return st.SetReadDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.deadline = t
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	if !t.IsZero() {
+		st.timer = time.AfterFunc(time.Until(t), func() {
+			st.mu.Lock()
+			st.cond.Broadcast()
+			st.mu.Unlock()
+		})
+	}
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// muxListener hands out the streams the peer opens, for an http.Server.
+type muxListener struct {
+	s *muxSession
+}
+
+func (l muxListener) Accept() (net.Conn, error) {
+	st, err := l.s.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (l muxListener) Close() error   { return l.s.Close() }
+func (l muxListener) Addr() net.Addr { return l.s.conn.LocalAddr() }
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair connects two in-process WebSockets and returns the server's end
+// and the client's.
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	t.Cleanup(func() {
+		conn.Close()
+		client.Close()
+	})
+	return conn, client
+}
+
+// muxPair returns the opening side of a mux session, like the central
+// panel, and the accepting side, like an agent.
+func muxPair(t *testing.T) (*muxSession, *muxSession) {
+	t.Helper()
+	serverConn, clientConn := wsPair(t)
+	opener, acceptor := newMuxSession(serverConn, false), newMuxSession(clientConn, true)
+	t.Cleanup(func() {
+		opener.Close()
+		acceptor.Close()
+	})
+	return opener, acceptor
+}
+
+// muxPeer returns a mux session and the raw WebSocket at its other end, for
+// tests that write frames by hand.
+func muxPeer(t *testing.T, accepting bool) (*muxSession, *websocket.Conn) {
+	t.Helper()
+	serverConn, clientConn := wsPair(t)
+	s := newMuxSession(serverConn, accepting)
+	t.Cleanup(func() { s.Close() })
+	return s, clientConn
+}
+
+func sendFrame(t *testing.T, conn *websocket.Conn, typ byte, id uint32, payload []byte) {
+	t.Helper()
+	frame := append([]byte{typ, 0, 0, 0, 0}, payload...)
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame returns the next frame the session sent to conn.
+func readFrame(t *testing.T, conn *websocket.Conn) (byte, uint32, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	typ, frame, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.BinaryMessage || len(frame) < 5 {
+		t.Fatalf("malformed frame %q", frame)
+	}
+	return frame[0], binary.BigEndian.Uint32(frame[1:5]), frame[5:]
+}
+
+// accept waits for the session to hand out a stream.
+func accept(t *testing.T, s *muxSession) *muxStream {
+	t.Helper()
+	select {
+	case st := <-s.accept:
+		return st
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream was accepted")
+		return nil
+	}
+}
+
+func TestMux_Streams(t *testing.T) {
+	opener, acceptor := muxPair(t)
+
+	st, err := opener.Open("api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := acceptor.Accept()
+	if err != nil || peer.Target != "api" {
+		t.Fatalf("Accept = %+v, %v; want the api stream", peer, err)
+	}
+
+	// Writes larger than a frame arrive whole and in order
+	data := bytes.Repeat([]byte("0123456789"), muxFrameSize/4)
+	go st.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(peer, got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v; want what was written", len(got), err)
+	}
+	peer.Write([]byte("reply"))
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(st, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("reply = %q, %v", reply, err)
+	}
+
+	// Closing one end ends reads and writes at the other
+	peer.Close()
+	if _, err := st.Read(reply); err != io.EOF {
+		t.Errorf("read after the peer closed: %v, want EOF", err)
+	}
+	if _, err := st.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("write after the peer closed: %v, want ErrClosedPipe", err)
+	}
+	if _, err := peer.Read(reply); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after Close: %v, want net.ErrClosed", err)
+	}
+
+	// Closing the session ends its streams and Accept
+	st2, _ := opener.Open("ws")
+	accept(t, acceptor)
+	opener.Close()
+	if _, err := st2.Read(reply); err != errMuxClosed {
+		t.Errorf("read after the session closed: %v", err)
+	}
+	if _, err := acceptor.Accept(); err == nil {
+		t.Error("Accept succeeded after the peer went away")
+	}
+	if _, err := opener.Open("api"); err != errMuxClosed {
+		t.Errorf("Open on a closed session: %v", err)
+	}
+}
+
+func TestMux_Frames(t *testing.T) {
+	s, peer := muxPeer(t, true)
+
+	// Text messages, short frames and frames for unknown streams are ignored
+	peer.WriteMessage(websocket.TextMessage, []byte("hello"))
+	peer.WriteMessage(websocket.BinaryMessage, []byte{frameOpen, 0, 0})
+	sendFrame(t, peer, frameData, 9, []byte("lost"))
+	sendFrame(t, peer, frameClose, 9, nil)
+
+	sendFrame(t, peer, frameOpen, 7, []byte("ws /ws/auth/e1"))
+	st := accept(t, s)
+	if st.id != 7 || st.Target != "ws /ws/auth/e1" {
+		t.Fatalf("opened stream %d for %q", st.id, st.Target)
+	}
+
+	// A second open for a live stream is refused
+	sendFrame(t, peer, frameOpen, 7, nil)
+	if typ, id, _ := readFrame(t, peer); typ != frameClose || id != 7 {
+		t.Errorf("duplicate open answered with frame %d for stream %d, want a close", typ, id)
+	}
+
+	st.Write([]byte("out"))
+	if typ, id, payload := readFrame(t, peer); typ != frameData || id != 7 || string(payload) != "out" {
+		t.Errorf("write sent frame %d for stream %d: %q", typ, id, payload)
+	}
+
+	sendFrame(t, peer, frameData, 7, []byte("ab"))
+	sendFrame(t, peer, frameData, 7, []byte("cd"))
+	sendFrame(t, peer, frameClose, 7, nil)
+	if got, err := io.ReadAll(st); err != nil || string(got) != "abcd" {
+		t.Errorf("stream read %q, %v; want the data before the close", got, err)
+	}
+}
+
+func TestMux_OpenOnOpeningSide(t *testing.T) {
+	_, peer := muxPeer(t, false)
+	sendFrame(t, peer, frameOpen, 1, []byte("api"))
+	if typ, id, _ := readFrame(t, peer); typ != frameClose || id != 1 {
+		t.Errorf("open to the panel answered with frame %d for stream %d, want a close", typ, id)
+	}
+}
+
+func TestMux_Backlog(t *testing.T) {
+	s, peer := muxPeer(t, true)
+
+	// Nobody accepts: the stream past the backlog is reset
+	for id := uint32(1); id <= muxAcceptBacklog+1; id++ {
+		sendFrame(t, peer, frameOpen, id, []byte("api"))
+	}
+	if typ, id, _ := readFrame(t, peer); typ != frameClose || id != muxAcceptBacklog+1 {
+		t.Fatalf("got frame %d for stream %d, want a close for stream %d", typ, id, muxAcceptBacklog+1)
+	}
+	if n := len(s.accept); n != muxAcceptBacklog {
+		t.Errorf("%d streams waiting, want %d", n, muxAcceptBacklog)
+	}
+	for len(s.accept) > 0 {
+		if st := <-s.accept; st.id == muxAcceptBacklog+1 {
+			t.Error("the stream past the backlog was handed out")
+		}
+	}
+	s.mu.Lock()
+	_, kept := s.streams[muxAcceptBacklog+1]
+	s.mu.Unlock()
+	if kept {
+		t.Error("the stream past the backlog is still registered")
+	}
+
+	// Data for it is ignored and the queued streams still work
+	sendFrame(t, peer, frameData, muxAcceptBacklog+1, []byte("late"))
+	sendFrame(t, peer, frameOpen, muxAcceptBacklog+2, []byte("api"))
+	if st := accept(t, s); st.id != muxAcceptBacklog+2 {
+		t.Errorf("accepted stream %d after draining the backlog", st.id)
+	}
+}
+
+func TestMux_Overflow(t *testing.T) {
+	s, peer := muxPeer(t, true)
+	sendFrame(t, peer, frameOpen, 1, []byte("api"))
+	st := accept(t, s)
+
+	// The reader never reads, so the buffer fills up and the stream resets
+	chunk := make([]byte, 1<<20)
+	for sent := 0; sent <= muxStreamBuffer; sent += len(chunk) {
+		sendFrame(t, peer, frameData, 1, chunk)
+	}
+	if typ, id, _ := readFrame(t, peer); typ != frameClose || id != 1 {
+		t.Fatalf("got frame %d for stream %d, want the stream closed", typ, id)
+	}
+	if _, err := st.Read(make([]byte, 1)); err != errStreamReset {
+		t.Errorf("read of an overflowed stream: %v, want %v", err, errStreamReset)
+	}
+	if _, err := st.Write([]byte("x")); err == nil {
+		t.Error("write to an overflowed stream succeeded")
+	}
+
+	// The session and its other streams carry on
+	sendFrame(t, peer, frameOpen, 2, []byte("api"))
+	other := accept(t, s)
+	sendFrame(t, peer, frameData, 2, []byte("ok"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(other, buf); err != nil || string(buf) != "ok" {
+		t.Errorf("other stream read %q, %v", buf, err)
+	}
+}
+
+func TestMux_ReadDeadline(t *testing.T) {
+	s, peer := muxPeer(t, true)
+	sendFrame(t, peer, frameOpen, 1, []byte("api"))
+	st := accept(t, s)
+	buf := make([]byte, 4)
+
+	start := time.Now()
+	st.SetReadDeadline(start.Add(50 * time.Millisecond))
+	if _, err := st.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read past the deadline: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("read gave up after %v", elapsed)
+	}
+
+	// Data that has arrived is still handed out
+	sendFrame(t, peer, frameData, 1, []byte("data"))
+	waitFor(t, "the data to arrive", func() bool {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.buf.Len() == 4
+	})
+	if n, err := st.Read(buf); err != nil || string(buf[:n]) != "data" {
+		t.Errorf("read with data waiting: %q, %v", buf[:n], err)
+	}
+
+	// Without a deadline reads wait; setting one wakes them
+	st.SetDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := st.Read(buf)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("read without a deadline returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	st.SetReadDeadline(time.Now())
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("read after the deadline moved: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("moving the deadline did not wake the reader")
+	}
+}
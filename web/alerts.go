@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Alert rules
+const (
+	ruleDown     = "down"     // tunnel in a failed state for longer than down_for
+	ruleFlapping = "flapping" // tunnel failed more than flaps_per_hour times in the last hour
+	ruleReauth   = "reauth"   // interactive tunnel dropped and needs authenticating again
+	ruleTest     = "test"     // sent from POST /api/alerts/test
+)
+
+// Alert states
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertHistorySize is how many resolved alerts GET /api/alerts returns.
+const alertHistorySize = 100
+
+// Alert is one rule firing for one tunnel. While it fires, further matches
+// of the same rule and tunnel are folded into it.
+type Alert struct {
+	ID       string     `json:"id"` // rule:hash
+	Rule     string     `json:"rule"`
+	Hash     string     `json:"hash"`
+	Name     string     `json:"name,omitempty"`
+	State    string     `json:"state"`
+	Summary  string     `json:"summary"`
+	StartsAt time.Time  `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+	Silenced bool       `json:"silenced"` // recorded, but no notifications sent
+
+	notify []string // notifiers chosen when the alert fired
+}
+
+func (a Alert) displayName() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return shortHash(a.Hash)
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
+// AlertRules is a set of rule settings in the alerts file. Settings left
+// out inherit from "defaults", and those from the built-in defaults.
+type AlertRules struct {
+	DownFor      *string  `json:"down_for,omitempty"`       // duration, or "off"
+	FlapsPerHour *int     `json:"flaps_per_hour,omitempty"` // 0 disables
+	Reauth       *bool    `json:"reauth,omitempty"`
+	Notify       []string `json:"notify,omitempty"` // notifier names; default all
+	Silenced     *bool    `json:"silenced,omitempty"`
+}
+
+// tunnelAlertRules overrides the defaults for tunnels whose hash equals
+// Match or whose name matches it as a glob. The first match applies.
+type tunnelAlertRules struct {
+	Match string `json:"match"`
+	AlertRules
+}
+
+// alertsFile is the format of WEB_ALERTS_FILE. String values may refer to
+// environment variables as ${NAME}.
+type alertsFile struct {
+	Notifiers map[string]notifierConfig `json:"notifiers"`
+	Defaults  AlertRules                `json:"defaults"`
+	Tunnels   []tunnelAlertRules        `json:"tunnels"`
+}
+
+// alertPolicy is the effective rule settings for one tunnel.
+type alertPolicy struct {
+	down     bool
+	downFor  time.Duration
+	flaps    int
+	reauth   bool
+	notify   []string
+	silenced bool
+}
+
+// apply overrides p with the settings present in r.
+func (p alertPolicy) apply(r AlertRules) alertPolicy {
+	if r.DownFor != nil {
+		if *r.DownFor == "off" {
+			p.down = false
+		} else {
+			p.down = true
+			p.downFor, _ = time.ParseDuration(*r.DownFor) // checked by validate
+		}
+	}
+	if r.FlapsPerHour != nil {
+		p.flaps = *r.FlapsPerHour
+	}
+	if r.Reauth != nil {
+		p.reauth = *r.Reauth
+	}
+	if r.Notify != nil {
+		p.notify = r.Notify
+	}
+	if r.Silenced != nil {
+		p.silenced = *r.Silenced
+	}
+	return p
+}
+
+// validate checks r against the configured notifiers.
+func (r AlertRules) validate(notifiers map[string]Notifier) error {
+	if r.DownFor != nil && *r.DownFor != "off" {
+		if d, err := time.ParseDuration(*r.DownFor); err != nil || d < 0 {
+			return fmt.Errorf("invalid down_for %q", *r.DownFor)
+		}
+	}
+	if r.FlapsPerHour != nil && *r.FlapsPerHour < 0 {
+		return fmt.Errorf("invalid flaps_per_hour %d", *r.FlapsPerHour)
+	}
+	for _, name := range r.Notify {
+		if _, ok := notifiers[name]; !ok {
+			return fmt.Errorf("unknown notifier %q", name)
+		}
+	}
+	return nil
+}
+
+// tunnelAlertState is what the manager remembers about one tunnel.
+type tunnelAlertState struct {
+	name      string
+	status    string
+	downSince time.Time   // start of the current failure
+	failures  []time.Time // failures in the last hour
+	reauthAt  time.Time   // drop reported by the ws-server, until it runs again
+}
+
+// reauthRetry is the first wait before reconnecting to the ws-server's
+// event stream; it doubles up to a minute.
+var reauthRetry = 2 * time.Second
+
+// AlertManager evaluates the alert rules against polled tunnel status and
+// reauth events, and notifies when an alert fires or resolves.
+type AlertManager struct {
+	notifiers map[string]Notifier
+	defaults  alertPolicy
+	tunnels   []tunnelAlertRules
+
+	mu         sync.Mutex
+	state      map[string]*tunnelAlertState // by hash
+	reauthSeen map[string]time.Time         // newest drop handled, by hash
+	active     map[string]*Alert            // by ID
+	resolved   []Alert                      // newest last
+	send       func(a Alert, names []string)
+}
+
+// alerts is nil when WEB_ALERTS_FILE is unset, which disables alerting.
+var alerts *AlertManager
+
+// NewAlertManager builds a manager from the alerts file contents.
+func NewAlertManager(data []byte) (*AlertManager, error) {
+	var f alertsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	m := &AlertManager{
+		notifiers:  map[string]Notifier{},
+		state:      map[string]*tunnelAlertState{},
+		reauthSeen: map[string]time.Time{},
+		active:     map[string]*Alert{},
+		tunnels:    f.Tunnels,
+	}
+	m.send = m.dispatch
+	for name, c := range f.Notifiers {
+		c.expandEnv()
+		n, err := newNotifier(c)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %q: %w", name, err)
+		}
+		m.notifiers[name] = n
+	}
+
+	if err := f.Defaults.validate(m.notifiers); err != nil {
+		return nil, fmt.Errorf("defaults: %w", err)
+	}
+	for i, t := range f.Tunnels {
+		if t.Match == "" {
+			return nil, fmt.Errorf("tunnels[%d]: match is required", i)
+		}
+		if _, err := path.Match(t.Match, ""); err != nil {
+			return nil, fmt.Errorf("tunnels[%d]: invalid match %q", i, t.Match)
+		}
+		if err := t.validate(m.notifiers); err != nil {
+			return nil, fmt.Errorf("tunnels[%d]: %w", i, err)
+		}
+	}
+
+	all := make([]string, 0, len(m.notifiers))
+	for name := range m.notifiers {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+	m.defaults = alertPolicy{
+		down:    true,
+		downFor: time.Minute,
+		flaps:   5,
+		reauth:  true,
+		notify:  all,
+	}.apply(f.Defaults)
+	return m, nil
+}
+
+// policyFor returns the rule settings for a tunnel.
+func (m *AlertManager) policyFor(hash, name string) alertPolicy {
+	for _, t := range m.tunnels {
+		if t.Match == hash {
+			return m.defaults.apply(t.AlertRules)
+		}
+		if matched, _ := path.Match(t.Match, name); matched && name != "" {
+			return m.defaults.apply(t.AlertRules)
+		}
+	}
+	return m.defaults
+}
+
+// tunnel returns the state kept for hash. Callers must hold m.mu.
+func (m *AlertManager) tunnel(hash, name string) *tunnelAlertState {
+	ts, ok := m.state[hash]
+	if !ok {
+		ts = &tunnelAlertState{}
+		m.state[hash] = ts
+	}
+	if name != "" {
+		ts.name = name
+	}
+	return ts
+}
+
+// Evaluate is a StatusObserver. A failed poll says nothing about the
+// tunnels, so it neither fires nor resolves anything.
+func (m *AlertManager) Evaluate(at time.Time, state map[string]TunnelStatus, pollErr error) {
+	if pollErr != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, t := range state {
+		ts := m.tunnel(hash, t.Name)
+		failed := statusClass(t.Status) == "outage"
+		if failed && ts.downSince.IsZero() {
+			ts.downSince = at
+			if statusClass(ts.status) == "up" {
+				ts.failures = append(ts.failures, at)
+			}
+		} else if !failed {
+			ts.downSince = time.Time{}
+		}
+		ts.status = t.Status
+		m.evaluate(hash, ts, at)
+	}
+
+	// Tunnels missing from the list are stopped, which is not a failure
+	for hash, ts := range m.state {
+		if _, ok := state[hash]; ok {
+			continue
+		}
+		ts.status = "STOPPED"
+		ts.downSince = time.Time{}
+		m.evaluate(hash, ts, at)
+		if len(ts.failures) == 0 && ts.reauthAt.IsZero() {
+			delete(m.state, hash)
+		}
+	}
+
+	// Alerts still firing when their silence ends are sent then; those
+	// silenced later resolve quietly
+	for _, a := range m.active {
+		muted := m.muted(m.policyFor(a.Hash, a.Name), a.Hash, a.Name, at)
+		if a.Silenced && !muted {
+			a.Silenced = false
+			m.send(*a, a.notify)
+		}
+		a.Silenced = muted
+	}
+}
+
+// evaluate fires or resolves each rule for one tunnel. Callers must hold
+// m.mu.
+func (m *AlertManager) evaluate(hash string, ts *tunnelAlertState, at time.Time) {
+	p := m.policyFor(hash, ts.name)
+	name := ts.name
+
+	if p.down && !ts.downSince.IsZero() && at.Sub(ts.downSince) >= p.downFor {
+		m.fire(ruleDown, hash, name, fmt.Sprintf("Tunnel %s is %s since %s",
+			displayName(name, hash), ts.status, ts.downSince.Format(time.RFC3339)), p, ts.downSince, at)
+	} else {
+		m.resolve(ruleDown+":"+hash, at)
+	}
+
+	cutoff := at.Add(-time.Hour)
+	for len(ts.failures) > 0 && !ts.failures[0].After(cutoff) {
+		ts.failures = ts.failures[1:]
+	}
+	if p.flaps > 0 && len(ts.failures) > p.flaps {
+		m.fire(ruleFlapping, hash, name, fmt.Sprintf("Tunnel %s failed %d times in the last hour",
+			displayName(name, hash), len(ts.failures)), p, at, at)
+	} else {
+		m.resolve(ruleFlapping+":"+hash, at)
+	}
+
+	if !ts.reauthAt.IsZero() && statusClass(ts.status) == "up" && at.After(ts.reauthAt) {
+		ts.reauthAt = time.Time{}
+		m.resolve(ruleReauth+":"+hash, at)
+	}
+}
+
+func displayName(name, hash string) string {
+	return Alert{Name: name, Hash: hash}.displayName()
+}
+
+// Reauth raises a reauth alert for an interactive tunnel the ws-server
+// reported as dropped. It resolves once the tunnel runs again. The
+// ws-server replays pending drops on every connect, so a drop no newer
+// than the last one handled for the tunnel is ignored.
+func (m *AlertManager) Reauth(hash, name string, detectedAt time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !detectedAt.After(m.reauthSeen[hash]) {
+		return
+	}
+	m.reauthSeen[hash] = detectedAt
+	ts := m.tunnel(hash, name)
+	ts.reauthAt = detectedAt
+	if p := m.policyFor(hash, ts.name); p.reauth {
+		m.fire(ruleReauth, hash, ts.name, fmt.Sprintf("Interactive tunnel %s dropped and needs to be authenticated again",
+			displayName(ts.name, hash)), p, detectedAt, time.Now())
+	}
+}
+
+// muted reports whether alerts for the tunnel are silenced at at, by its
+// rules or by a silence.
+func (m *AlertManager) muted(p alertPolicy, hash, name string, at time.Time) bool {
+	return p.silenced || len(silences.Active(hash, name, at)) > 0
+}
+
+// fire records an alert unless the same one is already firing. Callers
+// must hold m.mu.
+func (m *AlertManager) fire(rule, hash, name, summary string, p alertPolicy, startsAt, at time.Time) {
+	id := rule + ":" + hash
+	if _, ok := m.active[id]; ok {
+		return
+	}
+	a := &Alert{
+		ID:       id,
+		Rule:     rule,
+		Hash:     hash,
+		Name:     name,
+		State:    alertFiring,
+		Summary:  summary,
+		StartsAt: startsAt,
+		Silenced: m.muted(p, hash, name, at),
+		notify:   p.notify,
+	}
+	m.active[id] = a
+	logMsg("WARN", "ALERT", "%s", summary)
+	if !a.Silenced {
+		m.send(*a, a.notify)
+	}
+}
+
+// resolve ends the alert with id if it is firing. Callers must hold m.mu.
+func (m *AlertManager) resolve(id string, at time.Time) {
+	a, ok := m.active[id]
+	if !ok {
+		return
+	}
+	delete(m.active, id)
+	a.State = alertResolved
+	a.EndsAt = &at
+	m.resolved = append(m.resolved, *a)
+	if len(m.resolved) > alertHistorySize {
+		m.resolved = m.resolved[len(m.resolved)-alertHistorySize:]
+	}
+	logMsg("INFO", "ALERT", "Resolved %s alert for tunnel %s", a.Rule, a.displayName())
+	if !a.Silenced {
+		m.send(*a, a.notify)
+	}
+}
+
+// dispatch hands a to the named notifiers in the background, so a slow
+// notifier does not hold up status polling.
+func (m *AlertManager) dispatch(a Alert, names []string) {
+	for _, name := range names {
+		n, ok := m.notifiers[name]
+		if !ok {
+			continue
+		}
+		go func(name string, n Notifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := n.Notify(ctx, a); err != nil {
+				logMsg("ERROR", "ALERT", "Failed to send %s alert for tunnel %s via %s: %v", a.State, a.displayName(), name, err)
+			}
+		}(name, n)
+	}
+}
+
+// Active returns the firing alerts, oldest first.
+func (m *AlertManager) Active() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Alert, 0, len(m.active))
+	for _, a := range m.active {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].StartsAt.Equal(list[j].StartsAt) {
+			return list[i].StartsAt.Before(list[j].StartsAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Resolved returns recently resolved alerts, newest first.
+func (m *AlertManager) Resolved() []Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]Alert, len(m.resolved))
+	for i, a := range m.resolved {
+		list[len(list)-1-i] = a
+	}
+	return list
+}
+
+// followReauthEvents listens on the ws-server's /ws/events for dropped
+// interactive tunnels and raises reauth alerts, reconnecting until stop is
+// closed. Pending drops are replayed on every connect; Reauth ignores
+// the ones already handled.
+func followReauthEvents(m *AlertManager, stop <-chan struct{}) {
+	backoff := reauthRetry
+	for {
+		connected, err := readReauthEvents(m, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if connected {
+			backoff = reauthRetry
+		}
+		logMsg("WARN", "ALERT", "Reauth event stream unavailable, retrying in %s: %v", backoff, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// readReauthEvents reads one connection's worth of events.
+func readReauthEvents(m *AlertManager, stop <-chan struct{}) (connected bool, err error) {
+	u, err := url.Parse(wsBaseURL)
+	if err != nil {
+		return false, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws/events"
+	headers := http.Header{}
+	if apiKey != "" {
+		headers.Set("Authorization", "Bearer "+apiKey)
+	}
+	dialer := websocket.Dialer{Proxy: http.ProxyFromEnvironment, HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.Dial(u.String(), headers)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		var ev struct {
+			Type       string    `json:"type"`
+			Hash       string    `json:"hash"`
+			Name       string    `json:"name"`
+			DetectedAt time.Time `json:"detected_at"`
+		}
+		if json.Unmarshal(data, &ev) != nil || ev.Type != "reauth_required" || ev.Hash == "" {
+			continue
+		}
+		m.Reauth(ev.Hash, ev.Name, ev.DetectedAt)
+	}
+}
+
+// alertAccessRules covers /api/alerts.
+var alertAccessRules = []accessRule{
+	{http.MethodGet, "/api/alerts", RoleViewer, ScopeRead},
+	{http.MethodPost, "/api/alerts/test", RoleAdmin, ScopeConfig},
+}
+
+// alertsHandler serves GET /api/alerts with the firing and recently
+// resolved alerts, and POST /api/alerts/test {"notifier": name}, which
+// sends a test notification and reports whether it was delivered.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if alerts == nil {
+		writeJSONError(w, http.StatusNotFound, "Alerting is not enabled")
+		return
+	}
+	if !checkAccess(w, r, alertAccessRules, r.URL.Path) {
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/api/alerts" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]Alert{
+			"active":   alerts.Active(),
+			"resolved": alerts.Resolved(),
+		})
+
+	case r.URL.Path == "/api/alerts/test" && r.Method == http.MethodPost:
+		var req struct {
+			Notifier string `json:"notifier"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		n, ok := alerts.notifiers[req.Notifier]
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "Unknown notifier")
+			return
+		}
+		a := Alert{
+			ID:       ruleTest + ":-",
+			Rule:     ruleTest,
+			Hash:     "-",
+			Name:     "test",
+			State:    alertFiring,
+			Summary:  "Test notification from the autossh web panel",
+			StartsAt: time.Now(),
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), notifyTimeout)
+		defer cancel()
+		if err := n.Notify(ctx, a); err != nil {
+			logMsg("WARN", "ALERT", "Test notification via %s failed: %v", req.Notifier, err)
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// loadAlertsFromEnv reads the alert rules and notifiers from
+// WEB_ALERTS_FILE.
+func loadAlertsFromEnv() error {
+	f := os.Getenv("WEB_ALERTS_FILE")
+	if f == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	m, err := NewAlertManager(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f, err)
+	}
+	alerts = m
+	return nil
+}
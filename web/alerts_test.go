@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sentAlert is one notification captured by withAlerts.
+type sentAlert struct {
+	Alert
+	names []string
+}
+
+// withAlerts installs a manager built from config and captures what it
+// would send.
+func withAlerts(t *testing.T, config string) *[]sentAlert {
+	t.Helper()
+	old := alerts
+	t.Cleanup(func() { alerts = old })
+	m, err := NewAlertManager([]byte(config))
+	if err != nil {
+		t.Fatalf("NewAlertManager: %v", err)
+	}
+	sent := &[]sentAlert{}
+	m.send = func(a Alert, names []string) { *sent = append(*sent, sentAlert{a, names}) }
+	alerts = m
+	return sent
+}
+
+func TestNewAlertManager_Invalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"unknown type":     `{"notifiers": {"x": {"type": "pager"}}}`,
+		"webhook url":      `{"notifiers": {"x": {"type": "webhook", "url": "ftp://host"}}}`,
+		"smtp recipients":  `{"notifiers": {"x": {"type": "smtp", "addr": "mail:25", "from": "a@b"}}}`,
+		"down_for":         `{"defaults": {"down_for": "soon"}}`,
+		"flaps_per_hour":   `{"defaults": {"flaps_per_hour": -1}}`,
+		"unknown notifier": `{"tunnels": [{"match": "db", "notify": ["ops"]}]}`,
+		"missing match":    `{"tunnels": [{"reauth": false}]}`,
+		"bad glob":         `{"tunnels": [{"match": "db["}]}`,
+	} {
+		if _, err := NewAlertManager([]byte(config)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestAlertManager_Evaluate(t *testing.T) {
+	sent := withAlerts(t, `{
+		"notifiers": {"ops": {"type": "webhook", "url": "http://ops.example"}, "chat": {"type": "slack", "url": "http://chat.example"}},
+		"defaults": {"down_for": "2m", "flaps_per_hour": 2},
+		"tunnels": [
+			{"match": "lab-*", "silenced": true},
+			{"match": "beef", "down_for": "off", "notify": ["chat"]}
+		]
+	}`)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	poll := func(min int, statuses map[string]string) {
+		state := map[string]TunnelStatus{}
+		for hash, status := range statuses {
+			state[hash] = TunnelStatus{Hash: hash, Name: map[string]string{"abc": "db", "lab": "lab-1", "beef": "web"}[hash], Status: status}
+		}
+		alerts.Evaluate(at(min), state, nil)
+	}
+	ids := func() []string {
+		var list []string
+		for _, s := range *sent {
+			list = append(list, s.State+" "+s.ID)
+		}
+		*sent = nil
+		return list
+	}
+
+	poll(0, map[string]string{"abc": "NORMAL", "lab": "NORMAL", "beef": "NORMAL"})
+	poll(1, map[string]string{"abc": "DEAD", "lab": "DEAD", "beef": "DEAD"})
+	poll(2, map[string]string{"abc": "STARTING", "lab": "DEAD", "beef": "DEAD"})
+	if got := ids(); len(got) != 0 {
+		t.Fatalf("sent before down_for passed: %v", got)
+	}
+	poll(3, map[string]string{"abc": "DEAD", "lab": "DEAD", "beef": "DEAD"})
+	poll(4, map[string]string{"abc": "DEAD", "lab": "DEAD", "beef": "DEAD"})
+	if got := ids(); len(got) != 1 || got[0] != "firing down:abc" {
+		t.Fatalf("after 2m down: sent %v, want one down alert for abc", got)
+	}
+	if active := alerts.Active(); len(active) != 2 || !active[1].Silenced || active[1].Hash != "lab" {
+		t.Errorf("active = %+v, want abc and a silenced lab alert", active)
+	} else if !active[0].StartsAt.Equal(at(1)) {
+		t.Errorf("down alert starts at %v, want when the tunnel failed", active[0].StartsAt)
+	}
+
+	// Stopping a tunnel is not a failure and ends its down alert
+	poll(5, map[string]string{"lab": "NORMAL", "beef": "NORMAL"})
+	if got := ids(); len(got) != 1 || got[0] != "resolved down:abc" {
+		t.Fatalf("after recovery: sent %v", got)
+	}
+
+	// Third failure within the hour trips flaps_per_hour 2
+	poll(6, map[string]string{"abc": "NORMAL", "beef": "DEAD"})
+	poll(7, map[string]string{"abc": "DEAD", "beef": "NORMAL"})
+	poll(8, map[string]string{"abc": "NORMAL", "beef": "DEAD"})
+	got := ids()
+	if len(got) != 1 || got[0] != "firing flapping:beef" {
+		t.Fatalf("flapping: sent %v", got)
+	}
+	if active := alerts.Active(); len(active) != 1 || len(active[0].notify) != 1 || active[0].notify[0] != "chat" {
+		t.Errorf("active = %+v, want the flapping alert for the tunnel's notifiers", active)
+	}
+	poll(69, map[string]string{"abc": "NORMAL", "beef": "NORMAL"})
+	if got := ids(); len(got) != 1 || got[0] != "resolved flapping:beef" {
+		t.Errorf("an hour later: sent %v", got)
+	}
+	if resolved := alerts.Resolved(); len(resolved) != 3 || resolved[0].ID != "flapping:beef" || resolved[0].EndsAt == nil {
+		t.Errorf("resolved = %+v", resolved)
+	}
+
+	// A failed poll changes nothing
+	alerts.Evaluate(at(70), nil, fmt.Errorf("backend down"))
+	if got := ids(); len(got) != 0 {
+		t.Errorf("poll error: sent %v", got)
+	}
+}
+
+func TestAlertManager_Reauth(t *testing.T) {
+	sent := withAlerts(t, `{"notifiers": {"ops": {"type": "webhook", "url": "http://ops.example"}}}`)
+	dropped := time.Now()
+	alerts.Reauth("abc", "vpn", dropped)
+	alerts.Reauth("abc", "vpn", dropped) // replayed on reconnect
+	alerts.Evaluate(dropped.Add(time.Second), map[string]TunnelStatus{}, nil)
+	if len(*sent) != 1 || (*sent)[0].ID != "reauth:abc" || (*sent)[0].names[0] != "ops" {
+		t.Fatalf("sent %+v, want one reauth alert to ops", *sent)
+	}
+	alerts.Evaluate(dropped.Add(time.Minute), map[string]TunnelStatus{"abc": {Hash: "abc", Name: "vpn", Status: "NORMAL"}}, nil)
+	if len(*sent) != 2 || (*sent)[1].State != alertResolved {
+		t.Errorf("after authenticating again: sent %+v", *sent)
+	}
+}
+
+func TestFollowReauthEvents_Reconnect(t *testing.T) {
+	sent := withAlerts(t, `{"notifiers": {"ops": {"type": "webhook", "url": "http://ops.example"}}}`)
+	oldBase, oldKey, oldRetry := wsBaseURL, apiKey, reauthRetry
+	t.Cleanup(func() { wsBaseURL, apiKey, reauthRetry = oldBase, oldKey, oldRetry })
+	reauthRetry = 10 * time.Millisecond
+
+	// Like the ws-server, every connection replays the pending drop; this
+	// one then hangs up straight away
+	dropped := time.Now().Add(-time.Minute).UTC()
+	var connects atomic.Int32
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]interface{}{"type": "reauth_required", "hash": "abc", "name": "vpn", "detected_at": dropped})
+		connects.Add(1)
+	}))
+	t.Cleanup(events.Close)
+	wsBaseURL, apiKey = "ws"+strings.TrimPrefix(events.URL, "http"), ""
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		followReauthEvents(alerts, stop)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-stopped
+	})
+	waitFor(t, "the first reauth alert", func() bool {
+		alerts.mu.Lock()
+		defer alerts.mu.Unlock()
+		return len(*sent) == 1
+	})
+
+	// The tunnel runs again, so the alert resolves; later replays of the
+	// same drop must not raise it again
+	alerts.Evaluate(time.Now(), map[string]TunnelStatus{"abc": {Hash: "abc", Name: "vpn", Status: "NORMAL"}}, nil)
+	// A fifth connection means the fourth replay has been read
+	waitFor(t, "more replays", func() bool { return connects.Load() >= 5 })
+	alerts.mu.Lock()
+	got := append([]sentAlert(nil), *sent...)
+	alerts.mu.Unlock()
+	if len(got) != 2 || got[0].State != alertFiring || got[1].State != alertResolved {
+		t.Errorf("sent %+v, want the alert fired and resolved once", got)
+	}
+
+	// A newer drop is a new alert
+	alerts.Reauth("abc", "vpn", time.Now())
+	alerts.mu.Lock()
+	defer alerts.mu.Unlock()
+	if len(*sent) != 3 || (*sent)[2].State != alertFiring {
+		t.Errorf("after a newer drop: sent %+v", *sent)
+	}
+}
+
+// fakeSMTP accepts one message and returns its DATA section.
+func fakeSMTP(t *testing.T) (addr string, message <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		reply := func(s string) { fmt.Fprintf(conn, "%s\r\n", s) }
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case strings.HasPrefix(cmd, "AUTH PLAIN"):
+				reply("235 Authenticated")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 Go ahead")
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				ch <- data.String()
+				reply("250 Queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+func TestNotifiers(t *testing.T) {
+	received := make(chan string, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.URL.Path + " " + r.Header.Get("X-Token") + " " + string(body)
+	}))
+	t.Cleanup(hook.Close)
+	smtpAddr, mail := fakeSMTP(t)
+	t.Setenv("TEST_SMTP_PASSWORD", "secret")
+	t.Setenv("TEST_HOOK_TOKEN", `t0k"`)
+
+	withAlerts(t, `{"notifiers": {
+		"hook": {"type": "webhook", "url": "`+hook.URL+`/hook", "headers": {"X-Token": "${TEST_HOOK_TOKEN}", "X-Plain": "a$b"}},
+		"chat": {"type": "slack", "url": "`+hook.URL+`/chat"},
+		"mail": {"type": "smtp", "addr": "`+smtpAddr+`", "username": "panel", "password": "${TEST_SMTP_PASSWORD}",
+			"from": "panel@example.com", "to": ["ops@example.com"]}
+	}}`)
+	if c := alerts.notifiers["mail"].(*smtpNotifier).config; c.Password != "secret" {
+		t.Errorf("password = %q, want it expanded from the environment", c.Password)
+	}
+	if h := alerts.notifiers["hook"].(*webhookNotifier).headers; h["X-Plain"] != "a$b" {
+		t.Errorf("headers = %q, want a bare $ kept", h)
+	}
+
+	ended := time.Date(2026, 1, 1, 0, 5, 0, 0, time.UTC)
+	a := Alert{ID: "down:abc", Rule: ruleDown, Hash: "abc", Name: "db", State: alertResolved,
+		Summary: "Tunnel db is DEAD", StartsAt: ended.Add(-5 * time.Minute), EndsAt: &ended}
+	ctx := context.Background()
+	for name, n := range alerts.notifiers {
+		if err := n.Notify(ctx, a); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	got := map[string]string{}
+	for i := 0; i < 2; i++ {
+		r := <-received
+		got[strings.Fields(r)[0]] = r
+	}
+	var posted Alert
+	json.Unmarshal([]byte(strings.SplitN(got["/hook"], " ", 3)[2]), &posted)
+	if !strings.HasPrefix(got["/hook"], "/hook t0k\" ") || posted.ID != "down:abc" || posted.State != alertResolved {
+		t.Errorf("webhook received %q", got["/hook"])
+	}
+	if !strings.Contains(got["/chat"], `"text":":large_green_circle: *[RESOLVED] db: down*`) {
+		t.Errorf("slack received %q", got["/chat"])
+	}
+	msg := <-mail
+	if !strings.Contains(msg, "Subject: [RESOLVED] db: down\r\n") || !strings.Contains(msg, "To: ops@example.com\r\n") ||
+		!strings.Contains(msg, "(after 5m0s)") {
+		t.Errorf("mail:\n%s", msg)
+	}
+}
+
+func TestAlertsHandler(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+	withAlerts(t, `{"notifiers": {"hook": {"type": "webhook", "url": "`+failing.URL+`"}}}`)
+	alerts.Reauth("abc", "vpn", time.Now())
+
+	w := httptest.NewRecorder()
+	alertsHandler(w, httptest.NewRequest("GET", "/api/alerts", nil))
+	var body struct {
+		Active   []Alert `json:"active"`
+		Resolved []Alert `json:"resolved"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusOK || len(body.Active) != 1 || body.Active[0].ID != "reauth:abc" || body.Resolved == nil {
+		t.Errorf("GET /api/alerts: %d %+v", w.Code, body)
+	}
+
+	for body, want := range map[string]int{`{"notifier": "hook"}`: http.StatusBadGateway, `{"notifier": "pager"}`: http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		alertsHandler(w, httptest.NewRequest("POST", "/api/alerts/test", strings.NewReader(body)))
+		if w.Code != want {
+			t.Errorf("POST /api/alerts/test %s: status %d, want %d", body, w.Code, want)
+		}
+	}
+
+	alerts = nil
+	w = httptest.NewRecorder()
+	alertsHandler(w, httptest.NewRequest("GET", "/api/alerts", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("alerting disabled: status %d, want 404", w.Code)
+	}
+}
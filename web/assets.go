@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// The panel ships as a single binary: templates and static files are
+// embedded at build time. WEB_DEV_ASSETS=true reads them from disk instead
+// and re-parses templates on every request.
+//
+//go:embed static templates
+var embeddedAssets embed.FS
+
+var devAssets bool
+
+// staticFS and templatesFS serve the embedded files until loadAssetsFromEnv
+// switches to disk.
+var (
+	staticFS    fs.FS = mustSub(embeddedAssets, staticDir)
+	templatesFS fs.FS = mustSub(embeddedAssets, templatesDir)
+)
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// loadAssetsFromEnv serves assets from the working directory when
+// WEB_DEV_ASSETS is true, and otherwise starts precompressing the embedded
+// static files in the background.
+func loadAssetsFromEnv() {
+	devAssets = os.Getenv("WEB_DEV_ASSETS") == "true"
+	if devAssets {
+		staticFS = os.DirFS(staticDir)
+		templatesFS = os.DirFS(templatesDir)
+		logMsg("INFO", "WEB", "Serving templates and static files from disk")
+		return
+	}
+	go func() {
+		start := time.Now()
+		n := 0
+		fs.WalkDir(staticFS, ".", func(name string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if a, err := assets.get(name); err == nil {
+					a.compress()
+					n++
+				}
+			}
+			return nil
+		})
+		logMsg("DEBUG", "WEB", "Precompressed %d static file(s) in %s", n, time.Since(start).Round(time.Millisecond))
+	}()
+}
+
+// staticAsset is a static file with its content hash and, for text-like
+// types, gzip and brotli encodings.
+type staticAsset struct {
+	data        []byte
+	hash        string
+	contentType string
+
+	once sync.Once
+	gz   []byte
+	br   []byte
+}
+
+// fontTypes fills in what the system MIME table may lack.
+var fontTypes = map[string]string{".ttf": "font/ttf", ".woff": "font/woff", ".woff2": "font/woff2"}
+
+func contentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := fontTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// compressibleTypes are worth compressing; images and woff2 already are.
+var compressibleTypes = []string{"text/", "application/javascript", "application/json", "image/svg+xml", "font/ttf"}
+
+func (a *staticAsset) compressible() bool {
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(a.contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compress fills in the encoded variants the first time it is called.
+// Encodings that do not shrink the file are dropped.
+func (a *staticAsset) compress() {
+	a.once.Do(func() {
+		if !a.compressible() {
+			return
+		}
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(a.data)
+		zw.Close()
+		if buf.Len() < len(a.data) {
+			a.gz = append([]byte(nil), buf.Bytes()...)
+		}
+
+		buf.Reset()
+		bw := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+		bw.Write(a.data)
+		bw.Close()
+		if buf.Len() < len(a.data) {
+			a.br = append([]byte(nil), buf.Bytes()...)
+		}
+	})
+}
+
+// assetCache holds loaded static files. In dev mode every lookup reads
+// the file again.
+type assetCache struct {
+	mu    sync.Mutex
+	files map[string]*staticAsset
+}
+
+var assets = &assetCache{files: map[string]*staticAsset{}}
+
+func (c *assetCache) get(name string) (*staticAsset, error) {
+	if !devAssets {
+		c.mu.Lock()
+		a, ok := c.files[name]
+		c.mu.Unlock()
+		if ok {
+			return a, nil
+		}
+	}
+
+	data, err := fs.ReadFile(staticFS, name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	a := &staticAsset{data: data, hash: hex.EncodeToString(sum[:])[:12]}
+	if a.contentType = contentType(name); a.contentType == "" {
+		a.contentType = http.DetectContentType(data)
+	}
+	if devAssets {
+		return a, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.files[name]; ok {
+		return cached, nil
+	}
+	c.files[name] = a
+	return a, nil
+}
+
+// assetURL returns the URL of a static file with its content hash, so
+// pages can let browsers cache it for good.
+func assetURL(name string) string {
+	a, err := assets.get(name)
+	if err != nil {
+		logMsg("WARN", "WEB", "Template references missing static file %s", name)
+		return withBase("/static/" + name)
+	}
+	return withBase("/static/" + name + "?v=" + a.hash)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows enc.
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+// staticHandler serves /static/. URLs carrying the file's current hash are
+// cached for a year; others are revalidated with the ETag.
+func staticHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/static/")
+	a, err := assets.get(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.URL.Query().Get("v") == a.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", a.contentType)
+
+	body, etag := a.data, a.hash
+	if a.compressible() {
+		w.Header().Add("Vary", "Accept-Encoding")
+		a.compress()
+		accept := r.Header.Get("Accept-Encoding")
+		switch {
+		case a.br != nil && acceptsEncoding(accept, "br"):
+			body, etag = a.br, a.hash+"-br"
+			w.Header().Set("Content-Encoding", "br")
+		case a.gz != nil && acceptsEncoding(accept, "gzip"):
+			body, etag = a.gz, a.hash+"-gz"
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(body))
+}
+
+// templateFuncs are available to every page template.
+var templateFuncs = template.FuncMap{
+	"asset": assetURL,
+	"base":  func() string { return basePath },
+}
+
+// pageTemplates caches parsed templates by file name.
+var pageTemplates = struct {
+	sync.Mutex
+	byName map[string]*template.Template
+}{byName: map[string]*template.Template{}}
+
+// loadTemplate returns the parsed template name, parsing it once unless
+// assets come from disk.
+func loadTemplate(name string) (*template.Template, error) {
+	if !devAssets {
+		pageTemplates.Lock()
+		defer pageTemplates.Unlock()
+		if tmpl, ok := pageTemplates.byName[name]; ok {
+			return tmpl, nil
+		}
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).ParseFS(templatesFS, name)
+	if err != nil {
+		return nil, err
+	}
+	if !devAssets {
+		pageTemplates.byName[name] = tmpl
+	}
+	return tmpl, nil
+}
+
+// parseTemplates parses every page template, so a broken one stops the
+// server at startup rather than on first use.
+func parseTemplates() error {
+	names, err := fs.Glob(templatesFS, "*.html")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := loadTemplate(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderTemplate executes the page template name with data and writes it
+// with status. The page is rendered to a buffer first so a template error
+// yields a clean 500.
+func renderTemplate(w http.ResponseWriter, status int, name string, data interface{}) {
+	tmpl, err := loadTemplate(name)
+	var buf bytes.Buffer
+	if err == nil {
+		err = tmpl.Execute(&buf, data)
+	}
+	if err != nil {
+		logMsg("ERROR", "WEB", "Failed to render %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header, enc string
+		want        bool
+	}{
+		{"gzip, deflate, br", "br", true},
+		{"gzip;q=1.0, br; q=0", "br", false},
+		{"GZIP", "gzip", true},
+		{"", "gzip", false},
+		{"deflate", "gzip", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.header, tt.enc); got != tt.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v, want %v", tt.header, tt.enc, got, tt.want)
+		}
+	}
+}
+
+func getStatic(t *testing.T, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	staticHandler(w, r)
+	return w
+}
+
+func TestStaticHandler(t *testing.T) {
+	want, err := fs.ReadFile(staticFS, "style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := assets.get("style.css")
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"":     func(r io.Reader) (io.Reader, error) { return r, nil },
+	}
+	for _, accept := range []string{"gzip, br", "gzip", ""} {
+		w := getStatic(t, "/static/style.css", http.Header{"Accept-Encoding": {accept}})
+		enc := w.Header().Get("Content-Encoding")
+		if accept != "" && enc == "" {
+			t.Errorf("Accept-Encoding %q: response not compressed", accept)
+		}
+		body, err := decoders[enc](w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := io.ReadAll(body)
+		if !bytes.Equal(got, want) {
+			t.Errorf("Accept-Encoding %q (%s): body differs from style.css", accept, enc)
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("headers = %v", w.Header())
+		}
+	}
+
+	// Unversioned URLs revalidate; hashed ones are cached for good
+	w := getStatic(t, "/static/style.css", nil)
+	if w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("unversioned Cache-Control = %q", w.Header().Get("Cache-Control"))
+	}
+	w = getStatic(t, "/static/style.css?v="+a.hash, nil)
+	if !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("versioned Cache-Control = %q", w.Header().Get("Cache-Control"))
+	}
+	w = getStatic(t, "/static/style.css", http.Header{"If-None-Match": {w.Header().Get("ETag")}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status %d, want 304", w.Code)
+	}
+
+	for _, target := range []string{"/static/missing.css", "/static/../main.go", "/static/", "/static/locales"} {
+		if w := getStatic(t, target, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", target, w.Code)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	if err := parseTemplates(); err != nil {
+		t.Fatalf("parseTemplates: %v", err)
+	}
+	w := httptest.NewRecorder()
+	renderTemplate(w, http.StatusOK, "index.html", nil)
+	a, _ := assets.get("script.js")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `src="/static/script.js?v=`+a.hash+`"`) {
+		t.Errorf("index.html does not reference the hashed script: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	renderTemplate(w, http.StatusOK, "missing.html", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("missing template: status %d, want 500", w.Code)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditMemoryLimit bounds the entries kept when WEB_AUDIT_FILE is unset.
+const auditMemoryLimit = 1000
+
+// auditBodyLimit bounds how much of a backend response is kept to read
+// the resulting tunnel from.
+const auditBodyLimit = 64 << 10
+
+// AuditEntry records one mutating request proxied to the autossh API.
+type AuditEntry struct {
+	Time       time.Time     `json:"time"`
+	Backend    string        `json:"backend,omitempty"` // unset for the default backend
+	User       string        `json:"user"`
+	Source     string        `json:"source,omitempty"`
+	ClientIP   string        `json:"client_ip"`
+	Method     string        `json:"method"`
+	Path       string        `json:"path"` // backend path, e.g. /stop/<hash>
+	Action     string        `json:"action"`
+	Tunnel     string        `json:"tunnel,omitempty"` // hash
+	TunnelName string        `json:"tunnel_name,omitempty"`
+	Status     int           `json:"status"`
+	Changes    []auditChange `json:"changes,omitempty"`
+}
+
+// auditChange is one field that differs between the tunnel before and
+// after a configuration change. Before is absent for new tunnels and After
+// for deleted ones.
+type auditChange struct {
+	Tunnel string      `json:"tunnel,omitempty"` // tunnel name, for whole-config saves
+	Field  string      `json:"field"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// AuditFilter selects entries from the audit log. Zero fields match all.
+type AuditFilter struct {
+	User   string
+	Tunnel string // hash prefix or name glob
+	Action string // exact, or a prefix such as "config"
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f AuditFilter) match(e *AuditEntry) bool {
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if f.Tunnel != "" && !strings.HasPrefix(e.Tunnel, f.Tunnel) {
+		if ok, _ := path.Match(f.Tunnel, e.TunnelName); !ok {
+			return false
+		}
+	}
+	if f.Action != "" && e.Action != f.Action && !strings.HasPrefix(e.Action, f.Action+".") {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only record of configuration and control actions.
+// Entries go to a JSON-lines file, or to a bounded in-memory list when no
+// file is configured.
+type AuditLog struct {
+	mu     sync.Mutex
+	path   string
+	recent []AuditEntry
+}
+
+// Global audit log; in memory until WEB_AUDIT_FILE is set
+var auditLog = &AuditLog{}
+
+// NewAuditLog returns a log appending to the file at path, creating it
+// if needed.
+func NewAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &AuditLog{path: path}, nil
+}
+
+// Append records e.
+func (l *AuditLog) Append(e AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" {
+		l.recent = append(l.recent, e)
+		if len(l.recent) > auditMemoryLimit {
+			l.recent = l.recent[len(l.recent)-auditMemoryLimit:]
+		}
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query returns the entries matching f, newest first.
+func (l *AuditLog) Query(f AuditFilter) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var all []AuditEntry
+	if l.path == "" {
+		all = l.recent
+	} else {
+		file, err := os.Open(l.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+		for scanner.Scan() {
+			var e AuditEntry
+			// A torn last line from a crash should not hide the rest
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				all = append(all, e)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	matched := []AuditEntry{}
+	for i := len(all) - 1; i >= 0; i-- {
+		if f.match(&all[i]) {
+			matched = append(matched, all[i])
+			if f.Limit > 0 && len(matched) == f.Limit {
+				break
+			}
+		}
+	}
+	return matched, nil
+}
+
+// auditAction names what a backend request does, e.g. "stop" or
+// "config.update", and which tunnel it is about.
+func auditAction(method, backendPath string) (action, hash string) {
+	parts := strings.Split(strings.Trim(backendPath, "/"), "/")
+	if len(parts) > 1 && parts[1] != "new" {
+		hash = parts[1]
+	}
+	switch {
+	case parts[0] != "config":
+		return parts[0], hash
+	case len(parts) == 1:
+		return "config.replace", ""
+	case parts[1] == "new":
+		return "config.create", ""
+	case method == http.MethodDelete || (len(parts) > 2 && parts[2] == "delete"):
+		return "config.delete", hash
+	default:
+		return "config.update", hash
+	}
+}
+
+// backendClient makes the panel's own requests to the autossh API.
+var backendClient = &http.Client{Timeout: 5 * time.Second}
+
+// getBackendJSON decodes the default backend's response to GET path into v.
+func getBackendJSON(path string, v interface{}) error {
+	return defaultBackend().getJSON(path, v)
+}
+
+// tunnelState is a tunnel's configuration as the autossh API returns it.
+type tunnelState map[string]interface{}
+
+// diffTunnel lists the fields that differ between before and after,
+// either of which may be nil.
+func diffTunnel(name string, before, after tunnelState) []auditChange {
+	fields := map[string]bool{}
+	for k := range before {
+		fields[k] = true
+	}
+	for k := range after {
+		fields[k] = true
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var changes []auditChange
+	for _, k := range keys {
+		if !reflect.DeepEqual(before[k], after[k]) {
+			changes = append(changes, auditChange{Tunnel: name, Field: k, Before: before[k], After: after[k]})
+		}
+	}
+	return changes
+}
+
+// diffConfig lists the changes between two whole configurations.
+func diffConfig(before, after map[string]tunnelState) []auditChange {
+	names := map[string]bool{}
+	for n := range before {
+		names[n] = true
+	}
+	for n := range after {
+		names[n] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for n := range names {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	var changes []auditChange
+	for _, n := range sorted {
+		changes = append(changes, diffTunnel(n, before[n], after[n])...)
+	}
+	return changes
+}
+
+// auditWriter captures the status and the start of the body of a proxied
+// response.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := auditBodyLimit - w.body.Len(); room > 0 {
+		w.body.Write(p[:min(len(p), room)])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isMutating reports whether method changes state on the backend.
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// serveAudited proxies a mutating request to b and records it in the audit
+// log, with the tunnel before and after for configuration changes.
+func serveAudited(proxy http.Handler, w http.ResponseWriter, r *http.Request, b *Backend, backendPath string) {
+	entry := AuditEntry{
+		Time:     time.Now().UTC(),
+		User:     "-",
+		ClientIP: clientIP(r),
+		Method:   r.Method,
+		Path:     backendPath,
+	}
+	if !b.isDefault() {
+		entry.Backend = b.Name
+	}
+	if sess := currentSession(r); sess != nil {
+		entry.User, entry.Source = sess.User, sess.Source
+	}
+	entry.Action, entry.Tunnel = auditAction(r.Method, backendPath)
+	isConfig := strings.HasPrefix(entry.Action, "config.")
+
+	// Capture the state the request is about to change
+	var before tunnelState
+	var beforeAll map[string]tunnelState
+	var err error
+	switch {
+	case entry.Action == "config.replace":
+		beforeAll, err = b.configState()
+	case isConfig && entry.Tunnel != "":
+		err = b.getJSON("/config/"+entry.Tunnel, &before)
+	}
+	if err != nil {
+		logMsg("WARN", "AUDIT", "Could not read configuration before %s %s: %v", r.Method, backendPath, err)
+	}
+
+	aw := &auditWriter{ResponseWriter: w}
+	proxy.ServeHTTP(aw, r)
+	entry.Status = aw.status
+
+	if isConfig && aw.status < 300 {
+		var after tunnelState
+		switch entry.Action {
+		case "config.replace":
+			var afterAll map[string]tunnelState
+			if afterAll, err = b.configState(); err == nil {
+				entry.Changes = diffConfig(beforeAll, afterAll)
+			}
+		case "config.create", "config.update":
+			// The backend answers with the saved tunnel, or with its hash
+			if json.Unmarshal(aw.body.Bytes(), &after) == nil && after["name"] == nil {
+				if hash, ok := after["hash"].(string); ok {
+					after = nil
+					err = b.getJSON("/config/"+hash, &after)
+				}
+			}
+			fallthrough
+		case "config.delete":
+			entry.Changes = diffTunnel("", before, after)
+			if name, ok := after["name"].(string); ok {
+				entry.TunnelName = name
+			} else if name, ok := before["name"].(string); ok {
+				entry.TunnelName = name
+			}
+			if entry.Tunnel == "" {
+				entry.Tunnel, _ = after["hash"].(string)
+			}
+		}
+		if err != nil {
+			logMsg("WARN", "AUDIT", "Could not read configuration after %s %s: %v", r.Method, backendPath, err)
+		}
+	}
+	if entry.TunnelName == "" && entry.Tunnel != "" {
+		entry.TunnelName, _ = b.tunnels.Name(entry.Tunnel)
+	}
+
+	logMsg("INFO", "AUDIT", "%s %s on %s by %s from %s: %d", entry.Action, entry.Tunnel, b.Name, entry.User, entry.ClientIP, entry.Status)
+	if err := auditLog.Append(entry); err != nil {
+		logMsg("ERROR", "AUDIT", "Failed to write audit entry: %v", err)
+	}
+}
+
+// loadAuditFromEnv switches the audit log to WEB_AUDIT_FILE when set.
+func loadAuditFromEnv() error {
+	f := os.Getenv("WEB_AUDIT_FILE")
+	if f == "" {
+		return nil
+	}
+	l, err := NewAuditLog(f)
+	if err != nil {
+		return err
+	}
+	auditLog = l
+	return nil
+}
+
+// auditHandler serves GET /api/audit, filtered by the user, tunnel,
+// action, since and until (RFC 3339) and limit query parameters. Only admins may read it.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if sess := currentSession(r); authEnabled() && (sess == nil || sess.Role != RoleAdmin) {
+		writeJSONError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	q := r.URL.Query()
+	filter := AuditFilter{
+		User:   q.Get("user"),
+		Tunnel: q.Get("tunnel"),
+		Action: q.Get("action"),
+		Limit:  200,
+	}
+	for name, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid "+name)
+				return
+			}
+			*dst = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		filter.Limit = n
+	}
+
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		logMsg("ERROR", "AUDIT", "Failed to read audit log: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read audit log")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
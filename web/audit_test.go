@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func withAuditLog(t *testing.T) *AuditLog {
+	t.Helper()
+	old := auditLog
+	t.Cleanup(func() { auditLog = old })
+	l, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("NewAuditLog: %v", err)
+	}
+	auditLog = l
+	return l
+}
+
+func TestAuditAction(t *testing.T) {
+	tests := []struct {
+		method, path, action, hash string
+	}{
+		{"POST", "/start", "start", ""},
+		{"POST", "/stop/abc", "stop", "abc"},
+		{"POST", "/reconnect/abc", "reconnect", "abc"},
+		{"POST", "/config", "config.replace", ""},
+		{"POST", "/config/new", "config.create", ""},
+		{"POST", "/config/abc", "config.update", "abc"},
+		{"PUT", "/config/abc", "config.update", "abc"},
+		{"DELETE", "/config/abc", "config.delete", "abc"},
+		{"POST", "/config/abc/delete", "config.delete", "abc"},
+	}
+	for _, tt := range tests {
+		action, hash := auditAction(tt.method, tt.path)
+		if action != tt.action || hash != tt.hash {
+			t.Errorf("auditAction(%s %s) = %q, %q; want %q, %q", tt.method, tt.path, action, hash, tt.action, tt.hash)
+		}
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	before := map[string]tunnelState{
+		"db":  {"name": "db", "local_port": "15432"},
+		"web": {"name": "web", "local_port": "8080"},
+	}
+	after := map[string]tunnelState{
+		"db":    {"name": "db", "local_port": "15433"},
+		"cache": {"name": "cache"},
+	}
+	got := diffConfig(before, after)
+	want := []auditChange{
+		{Tunnel: "cache", Field: "name", After: "cache"},
+		{Tunnel: "db", Field: "local_port", Before: "15432", After: "15433"},
+		{Tunnel: "web", Field: "local_port", Before: "8080"},
+		{Tunnel: "web", Field: "name", Before: "web"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("diffConfig = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAuditLog_Query(t *testing.T) {
+	l := withAuditLog(t)
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []AuditEntry{
+		{User: "alice", Action: "stop", Tunnel: "aaaa1111", TunnelName: "ci-runner"},
+		{User: "bob", Action: "config.update", Tunnel: "bbbb2222", TunnelName: "prod-db"},
+		{User: "alice", Action: "config.delete", Tunnel: "aaaa1111", TunnelName: "ci-runner"},
+	} {
+		e.Time = base.Add(time.Duration(i) * time.Hour)
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A torn line from a crash is skipped
+	f, _ := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"user":"tor`)
+	f.Close()
+
+	tests := []struct {
+		filter AuditFilter
+		want   []string // actions, newest first
+	}{
+		{AuditFilter{}, []string{"config.delete", "config.update", "stop"}},
+		{AuditFilter{User: "alice"}, []string{"config.delete", "stop"}},
+		{AuditFilter{Action: "config"}, []string{"config.delete", "config.update"}},
+		{AuditFilter{Tunnel: "ci-*"}, []string{"config.delete", "stop"}},
+		{AuditFilter{Tunnel: "bbbb"}, []string{"config.update"}},
+		{AuditFilter{Since: base.Add(30 * time.Minute), Until: base.Add(90 * time.Minute)}, []string{"config.update"}},
+		{AuditFilter{Limit: 1}, []string{"config.delete"}},
+	}
+	for _, tt := range tests {
+		entries, err := l.Query(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Action)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Query(%+v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+// fakeConfigAPI serves the autossh config and control endpoints from memory.
+type fakeConfigAPI struct {
+	mu      sync.Mutex
+	tunnels map[string]tunnelState
+}
+
+func (f *fakeConfigAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/config":
+		list := []tunnelState{}
+		for _, t := range f.tunnels {
+			list = append(list, t)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"tunnels": list})
+	case parts[0] == "config" && len(parts) == 2 && f.tunnels[parts[1]] == nil:
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+	case r.Method == "GET" && parts[0] == "config":
+		json.NewEncoder(w).Encode(f.tunnels[parts[1]])
+	case r.Method == "POST" && parts[0] == "config" && len(parts) == 2:
+		var t tunnelState
+		json.NewDecoder(r.Body).Decode(&t)
+		delete(f.tunnels, parts[1])
+		t["hash"] = "new" + parts[1]
+		f.tunnels[t["hash"].(string)] = t
+		json.NewEncoder(w).Encode(t)
+	case r.Method == "POST" && parts[0] == "config" && len(parts) == 3:
+		delete(f.tunnels, parts[1])
+		w.Write([]byte(`{"status":"success"}`))
+	default:
+		w.Write([]byte(`{"status":"success"}`))
+	}
+}
+
+func TestAPIProxy_RecordsAudit(t *testing.T) {
+	withTrustedProxy(t, "127.0.0.1", "")
+	withTunnels(t, map[string]string{"abc123": "db"})
+	l := withAuditLog(t)
+
+	backend := httptest.NewServer(&fakeConfigAPI{tunnels: map[string]tunnelState{
+		"abc123": {"name": "db", "hash": "abc123", "local_port": "15432"},
+	}})
+	t.Cleanup(backend.Close)
+	oldBase := apiBaseURL
+	t.Cleanup(func() { apiBaseURL = oldBase })
+	apiBaseURL = backend.URL
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/autossh/", newAPIProxyHandler(backend.URL))
+	mux.HandleFunc("/api/audit", auditHandler)
+	server := httptest.NewServer(requireAuth(mux))
+	t.Cleanup(server.Close)
+
+	sess := sessions.Create("alice", RoleAdmin, SourcePassword)
+	call := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.ID})
+		req.Header.Set(csrfHeaderName, sess.CSRFToken)
+		// The test client connects from the trusted proxy address
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	call("GET", "/api/autossh/status", "")
+	call("POST", "/api/autossh/stop/abc123", "")
+	call("POST", "/api/autossh/config/abc123", `{"name":"db","local_port":"15433"}`)
+	call("POST", "/api/autossh/config/newabc123/delete", "")
+
+	entries, _ := l.Query(AuditFilter{})
+	if len(entries) != 3 {
+		t.Fatalf("recorded %d entries, want 3 (reads are not audited): %+v", len(entries), entries)
+	}
+	del, update, stop := entries[0], entries[1], entries[2]
+
+	if stop.Action != "stop" || stop.TunnelName != "db" || stop.User != "alice" ||
+		stop.ClientIP != "203.0.113.7" || stop.Status != http.StatusOK {
+		t.Errorf("stop entry = %+v", stop)
+	}
+	wantUpdate := []auditChange{
+		{Field: "hash", Before: "abc123", After: "newabc123"},
+		{Field: "local_port", Before: "15432", After: "15433"},
+	}
+	if update.Action != "config.update" || len(update.Changes) != len(wantUpdate) {
+		t.Fatalf("update entry = %+v", update)
+	}
+	for i := range wantUpdate {
+		if update.Changes[i] != wantUpdate[i] {
+			t.Errorf("update change %d = %+v, want %+v", i, update.Changes[i], wantUpdate[i])
+		}
+	}
+	if del.Action != "config.delete" || del.TunnelName != "db" || len(del.Changes) != 3 || del.Changes[0].After != nil {
+		t.Errorf("delete entry = %+v", del)
+	}
+
+	// The log is readable through the API
+	resp := call("GET", "/api/audit?action=config&limit=1", "")
+	var listed []AuditEntry
+	json.NewDecoder(resp.Body).Decode(&listed)
+	if resp.StatusCode != http.StatusOK || len(listed) != 1 || listed[0].Action != "config.delete" {
+		t.Errorf("GET /api/audit: status %d, entries %+v", resp.StatusCode, listed)
+	}
+	if resp := call("GET", "/api/audit?since=yesterday", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad since: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestAuditHandler_AdminOnly(t *testing.T) {
+	withTrustedProxy(t, "10.255.255.255", "")
+	withAuditLog(t)
+
+	sess := sessions.Create("bob", RoleOperator, SourcePassword)
+	r := httptest.NewRequest("GET", "/api/audit", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.ID})
+	w := httptest.NewRecorder()
+	requireAuth(http.HandlerFunc(auditHandler)).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("operator: status %d, want 403", w.Code)
+	}
+}
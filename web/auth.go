@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookieName = "autossh_session"
+	csrfHeaderName    = "X-CSRF-Token"
+	csrfFormField     = "csrf_token"
+)
+
+// Panel roles, from least to most privileged.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// roleRank orders roles so the most privileged one wins.
+var roleRank = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// roleForGroups returns the most privileged role roleMap grants to groups,
+// "" if none. An empty map gives everyone defaultRole; the "*" entry
+// matches any user.
+func roleForGroups(roleMap map[string]string, groups []string, defaultRole string) string {
+	if len(roleMap) == 0 {
+		return defaultRole
+	}
+	best := roleMap["*"]
+	for _, group := range groups {
+		// Keycloak group paths start with "/"
+		role, ok := roleMap[group]
+		if !ok {
+			role = roleMap[strings.TrimPrefix(group, "/")]
+		}
+		if roleRank[role] > roleRank[best] {
+			best = role
+		}
+	}
+	return best
+}
+
+// How a session was authenticated.
+const (
+	SourcePassword = "password"
+	SourceSSO      = "sso"
+	SourceProxy    = "proxy"
+	SourceToken    = "token"
+)
+
+// Login configuration
+var (
+	sessionTTL   = 12 * time.Hour
+	cookieSecure = false // force the Secure flag when TLS ends at a proxy
+)
+
+// dummyHash is compared against for unknown users so that a login attempt
+// takes the same time whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("autossh-dummy-password"), bcrypt.DefaultCost)
+
+// UserStore holds local accounts read from a file of "username:bcrypt-hash"
+// lines (htpasswd -B format), optionally followed by ":role". Accounts
+// without a role are admins. The file is re-read when it changes.
+type UserStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	users   map[string]localUser
+}
+
+type localUser struct {
+	hash string
+	role string
+}
+
+// users is nil when WEB_USERS_FILE is unset, which disables login.
+var users *UserStore
+
+// NewUserStore loads the users file at path.
+func NewUserStore(path string) (*UserStore, error) {
+	s := &UserStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload re-reads the users file if it changed since the last read.
+// Callers must hold s.mu or own s exclusively.
+func (s *UserStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if s.users != nil && info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	loaded := make(map[string]localUser)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		hash, role, hasRole := strings.Cut(hash, ":")
+		if !hasRole {
+			role = RoleAdmin
+		}
+		if !ok || name == "" || !strings.HasPrefix(hash, "$2") || roleRank[role] == 0 {
+			logMsg("WARN", "AUTH", "Ignoring malformed line %d in %s", lineNo, s.path)
+			continue
+		}
+		loaded[name] = localUser{hash: hash, role: role}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.users = loaded
+	s.modTime = info.ModTime()
+	logMsg("INFO", "AUTH", "Loaded %d user(s) from %s", len(loaded), s.path)
+	return nil
+}
+
+// Authenticate checks a username and password and returns the user's role.
+func (s *UserStore) Authenticate(name, password string) (role string, ok bool) {
+	s.mu.Lock()
+	if err := s.reload(); err != nil {
+		logMsg("ERROR", "AUTH", "Failed to reload users file: %v", err)
+	}
+	u, found := s.users[name]
+	s.mu.Unlock()
+
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return "", false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.hash), []byte(password)) != nil {
+		return "", false
+	}
+	return u.role, true
+}
+
+// Session is a logged-in browser.
+type Session struct {
+	ID        string
+	User      string
+	Role      string
+	Source    string    // SourcePassword, SourceSSO, SourceProxy or SourceToken
+	Token     *APIToken // set for requests made with an API token
+	CSRFToken string
+	Expires   time.Time
+}
+
+// SessionStore keeps sessions in memory; they do not survive a restart.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewSessionStore creates an empty session store.
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[string]*Session)}
+}
+
+// Global session store
+var sessions = NewSessionStore()
+
+// Create starts a session for user with role and drops expired ones.
+func (s *SessionStore) Create(user, role, source string) *Session {
+	sess := &Session{
+		ID:        randomToken(),
+		User:      user,
+		Role:      role,
+		Source:    source,
+		CSRFToken: randomToken(),
+		Expires:   time.Now().Add(sessionTTL),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, old := range s.sessions {
+		if now.After(old.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[sess.ID] = sess
+	return sess
+}
+
+// Get returns the live session with id, or nil.
+func (s *SessionStore) Get(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(sess.Expires) {
+		delete(s.sessions, id)
+		return nil
+	}
+	return sess
+}
+
+// Delete ends the session with id.
+func (s *SessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// randomToken returns 32 random bytes, base64url encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// authEnabled reports whether the panel requires login.
+func authEnabled() bool {
+	return users != nil || oidc != nil || proxyAuthEnabled()
+}
+
+// loginPageEnabled reports whether there is a login form to send users to.
+func loginPageEnabled() bool {
+	return users != nil || oidc != nil
+}
+
+type sessionContextKey struct{}
+
+// currentSession returns the session of the request, or nil. requireAuth
+// stores the session in the request context, so a session started by a
+// trusted proxy is visible before the browser has its cookie.
+func currentSession(r *http.Request) *Session {
+	if sess, ok := r.Context().Value(sessionContextKey{}).(*Session); ok {
+		return sess
+	}
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	return sessions.Get(c.Value)
+}
+
+// setSessionCookie writes the session cookie; a nil session clears it.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, sess *Session) {
+	c := &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     withBase("/"),
+		HttpOnly: true,
+		Secure:   cookieSecure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if sess != nil {
+		c.Value = sess.ID
+		c.Expires = sess.Expires
+	} else {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// isPublicPath reports whether path is reachable without logging in.
+func isPublicPath(path string) bool {
+	return path == "/login" ||
+		path == "/login/totp" ||
+		path == "/auth/login" ||
+		path == "/auth/callback" ||
+		path == "/api/languages" ||
+		path == "/healthz" ||
+		path == "/readyz" ||
+		strings.HasPrefix(path, "/static/")
+}
+
+// tokenAllowedPath reports whether API tokens are accepted for path.
+func tokenAllowedPath(path string) bool {
+	return strings.HasPrefix(path, "/api/autossh/") || strings.HasPrefix(path, "/ws/") ||
+		strings.HasPrefix(path, "/api/backends") || strings.HasPrefix(path, "/api/agents") ||
+		path == "/api/fleet" || path == "/metrics"
+}
+
+// isSafeMethod reports whether method cannot change state.
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// requireAuth enforces login and CSRF tokens for everything but public paths.
+// API and WebSocket requests get 401; pages redirect to the login form.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Scripts present an API token instead of a session; there is no
+		// cookie to ride on, so CSRF does not apply. Tokens are checked,
+		// and their scopes enforced, whenever there is a token store.
+		if tokenStore != nil && tokenAllowedPath(r.URL.Path) && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "+apiTokenPrefix) {
+			sess := tokenSession(r)
+			if sess == nil {
+				logMsg("WARN", "AUTH", "Invalid or expired API token for %s from %s", r.URL.Path, r.RemoteAddr)
+				writeJSONError(w, http.StatusUnauthorized, "Invalid or expired token")
+				return
+			}
+			noteUser(r, sess.User)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, sess)))
+			return
+		}
+		if !authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sess := currentSession(r)
+		if sess != nil && sess.Source == SourceProxy {
+			// Proxy sessions only hold while the proxy keeps vouching
+			sess = nil
+		}
+		if user, groups, ok := proxyIdentity(r); ok {
+			role := roleForGroups(proxyRoleMap, groups, proxyDefaultRole)
+			if role == "" {
+				logMsg("WARN", "AUTH", "Proxy user %q from %s has no role", user, r.RemoteAddr)
+				writeJSONError(w, http.StatusForbidden, "No role for user")
+				return
+			}
+			sess = currentSession(r)
+			if sess == nil || sess.Source != SourceProxy || sess.User != user || sess.Role != role {
+				sess = sessions.Create(user, role, SourceProxy)
+				setSessionCookie(w, r, sess)
+				logMsg("INFO", "AUTH", "User %q signed in via trusted proxy %s as %s", user, r.RemoteAddr, role)
+			}
+		}
+
+		if sess == nil {
+			apiRequest := strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/ws/")
+			switch {
+			case apiRequest:
+				writeJSONError(w, http.StatusUnauthorized, "Login required")
+			case !loginPageEnabled():
+				http.Error(w, "Authentication required", http.StatusUnauthorized)
+			default:
+				http.Redirect(w, r, withBase("/login?next="+url.QueryEscape(withBase(r.URL.RequestURI()))), http.StatusSeeOther)
+			}
+			return
+		}
+
+		if !isSafeMethod(r.Method) {
+			token := r.Header.Get(csrfHeaderName)
+			if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+				token = r.PostFormValue(csrfFormField)
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRFToken)) != 1 {
+				logMsg("WARN", "AUTH", "CSRF token mismatch for %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+				writeJSONError(w, http.StatusForbidden, "Invalid CSRF token")
+				return
+			}
+		}
+
+		noteUser(r, sess.User)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, sess)))
+	})
+}
+
+// writeJSONError writes {"error": message} with status.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// writeAPIError writes a JSON error with a stable code next to the message.
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message, "code": code})
+}
+
+// safeRedirect returns next if it is a local path, otherwise the panel's
+// home page.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return withBase("/")
+	}
+	return next
+}
+
+// LoginPage is the data for templates/login.html.
+type LoginPage struct {
+	Next          string
+	Error         string // "invalid", "totp_locked", "sso_failed" or "sso_forbidden"
+	PasswordLogin bool
+	SSOLogin      bool
+}
+
+func newLoginPage(next, errKey string) LoginPage {
+	return LoginPage{
+		Next:          next,
+		Error:         errKey,
+		PasswordLogin: users != nil,
+		SSOLogin:      oidc != nil,
+	}
+}
+
+func renderLogin(w http.ResponseWriter, status int, page LoginPage) {
+	renderTemplate(w, status, "login.html", page)
+}
+
+// loginHandler shows the login form and starts sessions.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	next := safeRedirect(r.FormValue("next"))
+	if !authEnabled() {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		logMsg("INFO", "WEB", "GET /login from %s", r.RemoteAddr)
+		renderLogin(w, http.StatusOK, newLoginPage(next, ""))
+	case http.MethodPost:
+		if users == nil {
+			http.Error(w, "Password login is disabled", http.StatusNotFound)
+			return
+		}
+		// There is no session yet to carry a CSRF token, so reject
+		// cross-site form posts by origin instead
+		if !checkWSOrigin(r) {
+			http.Error(w, "Forbidden origin", http.StatusForbidden)
+			return
+		}
+		username := r.PostFormValue("username")
+		role, ok := users.Authenticate(username, r.PostFormValue("password"))
+		if !ok {
+			logMsg("WARN", "AUTH", "Failed login for user %q from %s", username, r.RemoteAddr)
+			renderLogin(w, http.StatusUnauthorized, newLoginPage(next, "invalid"))
+			return
+		}
+		if startMFA(w, r, username, role, next) {
+			return
+		}
+		sess := sessions.Create(username, role, SourcePassword)
+		setSessionCookie(w, r, sess)
+		logMsg("INFO", "AUTH", "User %q logged in as %s from %s", username, role, r.RemoteAddr)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// logoutHandler ends the session. requireAuth has already checked the CSRF
+// token.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if sess := currentSession(r); sess != nil {
+		sessions.Delete(sess.ID)
+		logMsg("INFO", "AUTH", "User %q logged out", sess.User)
+	}
+	setSessionCookie(w, r, nil)
+	http.Redirect(w, r, withBase("/login"), http.StatusSeeOther)
+}
+
+// writeJSONFile replaces path with v as indented JSON, readable only by the
+// owner.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// writeFileAtomic replaces path with data. The file is written to a
+// temporary name first so readers never see a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// runHashPassword implements "app hash-password": it reads a password from
+// stdin and prints its bcrypt hash for the users file.
+func runHashPassword() {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "usage: echo 'password' | app hash-password")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(string(hash))
+}
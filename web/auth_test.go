@@ -0,0 +1,231 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// withPasswordLogin serves password login from a users file holding alice,
+// an admin with password "pw". It returns the server and the file.
+func withPasswordLogin(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	oldUsers, oldOIDC, oldTOTP := users, oidc, totp
+	t.Cleanup(func() { users, oidc, totp = oldUsers, oldOIDC, oldTOTP })
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	usersFile := filepath.Join(t.TempDir(), "users")
+	os.WriteFile(usersFile, []byte("alice:"+string(hash)+"\n"), 0600)
+	var err error
+	if users, err = NewUserStore(usersFile); err != nil {
+		t.Fatal(err)
+	}
+	oidc, totp = nil, nil
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "home") })
+	mux.HandleFunc("/api/thing", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "done") })
+	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/logout", logoutHandler)
+	server := httptest.NewServer(requireAuth(mux))
+	t.Cleanup(server.Close)
+	return server, usersFile
+}
+
+// noRedirectClient keeps cookies but stops at the first redirect.
+func noRedirectClient() *http.Client {
+	client := newJarClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return client
+}
+
+// login posts the login form and returns the response.
+func login(t *testing.T, client *http.Client, server, user, password, next string) *http.Response {
+	t.Helper()
+	resp, _ := postForm(t, client, server+"/login", url.Values{"username": {user}, "password": {password}, "next": {next}})
+	return resp
+}
+
+// sessionOf returns the session the client's cookie points at.
+func sessionOf(t *testing.T, client *http.Client, server string) *Session {
+	t.Helper()
+	cookies := sessionCookies(client, server)
+	if len(cookies) != 1 {
+		t.Fatalf("%d session cookies, want 1", len(cookies))
+	}
+	sess := sessions.Get(cookies[0].Value)
+	if sess == nil {
+		t.Fatal("session cookie does not name a live session")
+	}
+	return sess
+}
+
+func TestLogin_Password(t *testing.T) {
+	server, _ := withPasswordLogin(t)
+
+	// Pages send strangers to the login form; API calls get 401
+	client := noRedirectClient()
+	resp, _ := client.Get(server.URL + "/tunnels?x=1")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login?next="+url.QueryEscape("/tunnels?x=1") {
+		t.Errorf("anonymous page: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp, _ = client.Get(server.URL + "/api/thing")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous API call: %d, want 401", resp.StatusCode)
+	}
+
+	if resp := login(t, client, server.URL, "alice", "wrong", "/"); resp.StatusCode != http.StatusUnauthorized ||
+		len(sessionCookies(client, server.URL)) != 0 {
+		t.Errorf("wrong password: %d with %d session cookies", resp.StatusCode, len(sessionCookies(client, server.URL)))
+	}
+	if resp := login(t, client, server.URL, "mallory", "pw", "/"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unknown user: %d, want 401", resp.StatusCode)
+	}
+
+	resp = login(t, client, server.URL, "alice", "pw", "/tunnels")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/tunnels" {
+		t.Fatalf("login: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if sess := sessionOf(t, client, server.URL); sess.User != "alice" || sess.Role != RoleAdmin || sess.Source != SourcePassword {
+		t.Errorf("session = %+v", sess)
+	}
+	if resp, _ := client.Get(server.URL + "/api/thing"); resp.StatusCode != http.StatusOK {
+		t.Errorf("API call with a session: %d", resp.StatusCode)
+	}
+
+	// A cross-site login form is turned away
+	req, _ := http.NewRequest("POST", server.URL+"/login", strings.NewReader("username=alice&password=pw"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.example")
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("cross-origin login: %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestLogin_OpenRedirect(t *testing.T) {
+	server, _ := withPasswordLogin(t)
+	for _, next := range []string{"//evil.example/x", "/\\evil.example", "https://evil.example/", "evil"} {
+		resp := login(t, noRedirectClient(), server.URL, "alice", "pw", next)
+		if loc := resp.Header.Get("Location"); loc != "/" {
+			t.Errorf("next=%q redirected to %q, want /", next, loc)
+		}
+	}
+}
+
+func TestRequireAuth_CSRF(t *testing.T) {
+	server, _ := withPasswordLogin(t)
+	client := noRedirectClient()
+	login(t, client, server.URL, "alice", "pw", "/")
+	sess := sessionOf(t, client, server.URL)
+
+	post := func(header, form string) int {
+		req, _ := http.NewRequest("POST", server.URL+"/api/thing", strings.NewReader(form))
+		if form != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if header != "" {
+			req.Header.Set(csrfHeaderName, header)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("", ""); code != http.StatusForbidden {
+		t.Errorf("POST without a token: %d, want 403", code)
+	}
+	if code := post("not-the-token", ""); code != http.StatusForbidden {
+		t.Errorf("POST with a wrong token: %d, want 403", code)
+	}
+	if code := post(sess.CSRFToken, ""); code != http.StatusOK {
+		t.Errorf("POST with the header: %d", code)
+	}
+	if code := post("", csrfFormField+"="+url.QueryEscape(sess.CSRFToken)); code != http.StatusOK {
+		t.Errorf("POST with the form field: %d", code)
+	}
+
+	// Logging out needs the token too, and ends the session
+	if code := postTo(t, client, server.URL+"/logout", ""); code != http.StatusForbidden {
+		t.Errorf("logout without a token: %d, want 403", code)
+	}
+	if code := postTo(t, client, server.URL+"/logout", sess.CSRFToken); code != http.StatusSeeOther || sessions.Get(sess.ID) != nil {
+		t.Errorf("logout: %d, session still live: %v", code, sessions.Get(sess.ID) != nil)
+	}
+}
+
+func postTo(t *testing.T, client *http.Client, target, csrf string) int {
+	t.Helper()
+	req, _ := http.NewRequest("POST", target, nil)
+	if csrf != "" {
+		req.Header.Set(csrfHeaderName, csrf)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSession_Expired(t *testing.T) {
+	server, _ := withPasswordLogin(t)
+	client := noRedirectClient()
+	login(t, client, server.URL, "alice", "pw", "/")
+	sess := sessionOf(t, client, server.URL)
+
+	sessions.mu.Lock()
+	sess.Expires = time.Now().Add(-time.Second)
+	sessions.mu.Unlock()
+
+	if resp, _ := client.Get(server.URL + "/api/thing"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expired session: %d, want 401", resp.StatusCode)
+	}
+	if sessions.Get(sess.ID) != nil {
+		t.Error("expired session still in the store")
+	}
+}
+
+func TestUserStore_Reload(t *testing.T) {
+	server, usersFile := withPasswordLogin(t)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw2"), bcrypt.MinCost)
+	os.WriteFile(usersFile, []byte("bob:"+string(hash)+":viewer\n"), 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(usersFile, later, later)
+
+	if resp := login(t, noRedirectClient(), server.URL, "alice", "pw", "/"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("removed user: %d, want 401", resp.StatusCode)
+	}
+	client := noRedirectClient()
+	if resp := login(t, client, server.URL, "bob", "pw2", "/"); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("added user: %d", resp.StatusCode)
+	}
+	if sess := sessionOf(t, client, server.URL); sess.Role != RoleViewer {
+		t.Errorf("added user's role = %q, want viewer", sess.Role)
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	for next, want := range map[string]string{
+		"/tunnels?x=1":         "/tunnels?x=1",
+		"":                     "/",
+		"//evil.example":       "/",
+		"/\\evil.example":      "/",
+		"https://evil.example": "/",
+		"javascript:alert(1)":  "/",
+	} {
+		if got := safeRedirect(next); got != want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
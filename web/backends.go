@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend is one autossh container the panel manages: its API server, its
+// ws-server for interactive authentication (optional) and the key for both.
+type Backend struct {
+	Name   string `json:"name"`
+	APIURL string `json:"api_url"`
+	WSURL  string `json:"ws_url,omitempty"`
+	APIKey string `json:"api_key,omitempty"`
+
+	tunnels   *TunnelDirectory
+	proxy     http.Handler
+	agent     *agentLink        // set for agents connected to this panel
+	transport http.RoundTripper // nil for the default transport
+}
+
+// defaultBackendName names the backend from API_BASE_URL, or the first one
+// in WEB_BACKENDS_FILE when API_BASE_URL is unset.
+var defaultBackendName = "local"
+
+// backendRegistry holds the backends from WEB_BACKENDS_FILE other than the
+// default one, in file order.
+var backendRegistry []*Backend
+
+// defaultAPIProxy is the handler behind /api/autossh/.
+var defaultAPIProxy http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusServiceUnavailable, codeBackendNotConfigured, "No autossh API configured (API_BASE_URL)")
+})
+
+var backendNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// defaultBackend is the backend behind /api/autossh and /ws/, and the one
+// status history, alerts and metrics follow.
+func defaultBackend() *Backend {
+	return &Backend{Name: defaultBackendName, APIURL: apiBaseURL, WSURL: wsBaseURL, APIKey: apiKey, tunnels: tunnels}
+}
+
+// isDefault reports whether b is the default backend.
+func (b *Backend) isDefault() bool {
+	return b.Name == defaultBackendName
+}
+
+// allBackends returns the default backend, when there is one, followed by
+// the registry and the agents.
+func allBackends() []*Backend {
+	var list []*Backend
+	if apiBaseURL != "" {
+		list = append(list, defaultBackend())
+	}
+	list = append(list, backendRegistry...)
+	return append(list, agents.List()...)
+}
+
+// wsEnabled reports whether the backend has a ws-server.
+func (b *Backend) wsEnabled() bool {
+	if b.agent != nil {
+		b.agent.mu.Lock()
+		defer b.agent.mu.Unlock()
+		return b.agent.wsEnabled
+	}
+	return b.WSURL != ""
+}
+
+// client returns the HTTP client for the panel's own requests to b.
+func (b *Backend) client() *http.Client {
+	if b.transport == nil {
+		return backendClient
+	}
+	return &http.Client{Transport: b.transport, Timeout: backendClient.Timeout}
+}
+
+// findBackend returns the backend called name.
+func findBackend(name string) (*Backend, bool) {
+	for _, b := range allBackends() {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// getJSON decodes the backend API's response to GET path into v.
+func (b *Backend) getJSON(path string, v interface{}) error {
+	if b.APIURL == "" {
+		return fmt.Errorf("API_BASE_URL not set")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(b.APIURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if b.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.APIKey)
+	}
+	resp, err := b.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// configState fetches the backend's tunnels keyed by name.
+func (b *Backend) configState() (map[string]tunnelState, error) {
+	var config struct {
+		Tunnels []tunnelState `json:"tunnels"`
+	}
+	if err := b.getJSON("/config", &config); err != nil {
+		return nil, err
+	}
+	byName := make(map[string]tunnelState, len(config.Tunnels))
+	for _, t := range config.Tunnels {
+		name, _ := t["name"].(string)
+		byName[name] = t
+	}
+	return byName, nil
+}
+
+// backendsFile is the format of WEB_BACKENDS_FILE.
+type backendsFile struct {
+	Backends []*Backend `json:"backends"`
+}
+
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnvRefs replaces each ${NAME} in s with the environment variable
+// NAME. Unlike os.ExpandEnv it leaves a bare $ alone, so it is safe on
+// secrets that contain one.
+func expandEnvRefs(s string) string {
+	return envRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
+
+// parseBackends reads a backends file. ${NAME} in api_url, ws_url and
+// api_key is replaced with the environment variable NAME, so API keys can
+// stay out of the file.
+func parseBackends(data []byte) ([]*Backend, error) {
+	var f backendsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, b := range f.Backends {
+		b.APIURL, b.WSURL, b.APIKey = expandEnvRefs(b.APIURL), expandEnvRefs(b.WSURL), expandEnvRefs(b.APIKey)
+		if !backendNamePattern.MatchString(b.Name) {
+			return nil, fmt.Errorf("invalid backend name %q", b.Name)
+		}
+		if seen[b.Name] {
+			return nil, fmt.Errorf("duplicate backend %q", b.Name)
+		}
+		seen[b.Name] = true
+		if u, err := url.Parse(b.APIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("backend %q needs an http(s) api_url", b.Name)
+		}
+		if b.WSURL != "" {
+			if u, err := url.Parse(b.WSURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+				return nil, fmt.Errorf("backend %q: ws_url must be a ws(s) URL", b.Name)
+			}
+		}
+	}
+	return f.Backends, nil
+}
+
+// loadBackendsFromEnv reads WEB_BACKENDS_FILE. Without API_BASE_URL the
+// first backend in the file becomes the default one. Call it after the
+// API_BASE_URL, WS_BASE_URL and API_KEY globals are set.
+func loadBackendsFromEnv() error {
+	f := os.Getenv("WEB_BACKENDS_FILE")
+	if f == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	list, err := parseBackends(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f, err)
+	}
+	if apiBaseURL == "" && len(list) > 0 {
+		first := list[0]
+		defaultBackendName, apiBaseURL, wsBaseURL, apiKey = first.Name, first.APIURL, first.WSURL, first.APIKey
+		list = list[1:]
+	}
+	for _, b := range list {
+		if b.Name == defaultBackendName {
+			return fmt.Errorf("%s: backend %q clashes with the default backend from API_BASE_URL", f, b.Name)
+		}
+		b.tunnels = &TunnelDirectory{fetch: b.getJSON}
+		b.proxy = newBackendProxyHandler(b, b.APIURL, "/api/backends/"+b.Name+"/autossh")
+	}
+	backendRegistry = list
+	return nil
+}
+
+// backendView is how a backend is listed; URLs and keys stay private.
+type backendView struct {
+	Name      string     `json:"name"`
+	Default   bool       `json:"default"`
+	WSEnabled bool       `json:"ws_enabled"`
+	Agent     *agentView `json:"agent,omitempty"`
+}
+
+func viewBackend(b *Backend) backendView {
+	v := backendView{Name: b.Name, Default: b.isDefault(), WSEnabled: b.wsEnabled()}
+	if b.agent != nil {
+		v.Agent = b.agent.view()
+	}
+	return v
+}
+
+// backendHealth is a backend's state in the fleet view.
+type backendHealth struct {
+	backendView
+	Up        bool   `json:"up"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Tunnels   int    `json:"tunnels"` // configured
+	Running   int    `json:"running"`
+	Failed    int    `json:"failed"`
+}
+
+// fleetTunnel is one tunnel in the fleet view.
+type fleetTunnel struct {
+	Backend string `json:"backend"`
+	TunnelStatus
+}
+
+// FleetStatus is the status of every backend and its tunnels.
+type FleetStatus struct {
+	Backends []backendHealth `json:"backends"`
+	Tunnels  []fleetTunnel   `json:"tunnels"`
+}
+
+// probeBackend fetches a backend's configuration and status. Configured
+// tunnels missing from the status list are STOPPED; the backend is up when
+// its status list could be read.
+func probeBackend(b *Backend) (backendHealth, []fleetTunnel) {
+	h := backendHealth{backendView: viewBackend(b)}
+	var (
+		wg     sync.WaitGroup
+		status []TunnelStatus
+		config struct {
+			Tunnels []tunnelInfo `json:"tunnels"`
+		}
+		statusErr, configErr error
+	)
+	start := time.Now()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		statusErr = b.getJSON("/status", &status)
+	}()
+	go func() {
+		defer wg.Done()
+		configErr = b.getJSON("/config", &config)
+	}()
+	wg.Wait()
+	h.LatencyMS = time.Since(start).Milliseconds()
+
+	if statusErr != nil {
+		h.Error = statusErr.Error()
+		return h, nil
+	}
+	h.Up = true
+	if configErr != nil {
+		h.Error = configErr.Error()
+	}
+
+	running := make(map[string]TunnelStatus, len(status))
+	for _, t := range status {
+		running[t.Hash] = t
+	}
+	var list []fleetTunnel
+	for _, t := range config.Tunnels {
+		s, ok := running[t.Hash]
+		if !ok {
+			s = TunnelStatus{Hash: t.Hash, Name: t.Name, Status: "STOPPED"}
+		}
+		delete(running, t.Hash)
+		list = append(list, fleetTunnel{Backend: b.Name, TunnelStatus: s})
+	}
+	for _, s := range running {
+		list = append(list, fleetTunnel{Backend: b.Name, TunnelStatus: s})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Hash < list[j].Hash
+	})
+	h.Tunnels = len(config.Tunnels)
+	for _, t := range list {
+		switch statusClass(t.Status) {
+		case "up":
+			h.Running++
+		case "outage":
+			h.Failed++
+		}
+	}
+	return h, list
+}
+
+// fleetCacheTTL is how long a fleet view is reused, so a panel refreshing
+// it, or several open at once, do not each call every backend.
+var fleetCacheTTL = 2 * time.Second
+
+// fleetCache holds the last fleet view. Its lock is held while probing, so
+// concurrent requests wait for one round of probes.
+var fleetCache struct {
+	sync.Mutex
+	at     time.Time
+	result FleetStatus
+}
+
+// cachedFleetStatus returns the last fleet view when it is recent and
+// probes the backends again otherwise. The result is shared, so callers
+// must not modify it.
+func cachedFleetStatus() FleetStatus {
+	fleetCache.Lock()
+	defer fleetCache.Unlock()
+	if fleetCache.at.IsZero() || time.Since(fleetCache.at) >= fleetCacheTTL {
+		fleetCache.result = fleetStatus()
+		fleetCache.at = time.Now()
+	}
+	return fleetCache.result
+}
+
+// fleetStatus probes every backend at once.
+func fleetStatus() FleetStatus {
+	list := allBackends()
+	health := make([]backendHealth, len(list))
+	tunnels := make([][]fleetTunnel, len(list))
+	var wg sync.WaitGroup
+	for i, b := range list {
+		wg.Add(1)
+		go func(i int, b *Backend) {
+			defer wg.Done()
+			health[i], tunnels[i] = probeBackend(b)
+		}(i, b)
+	}
+	wg.Wait()
+
+	fleet := FleetStatus{Backends: health, Tunnels: []fleetTunnel{}}
+	for _, t := range tunnels {
+		fleet.Tunnels = append(fleet.Tunnels, t...)
+	}
+	return fleet
+}
+
+// backendAccessRules covers the backend list and the fleet view.
+var backendAccessRules = []accessRule{
+	{http.MethodGet, "/api/backends", RoleViewer, ScopeRead},
+	{http.MethodGet, "/api/fleet", RoleViewer, ScopeRead},
+}
+
+// fleetHandler serves GET /api/fleet, the merged status of every backend's
+// tunnels with each backend's health.
+func fleetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !checkAccess(w, r, backendAccessRules, r.URL.Path) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cachedFleetStatus())
+}
+
+// backendsHandler serves GET /api/backends, the list of backends, and
+// routes /api/backends/{name}/autossh/... to that backend's API and
+// /api/backends/{name}/ws/... to its ws-server.
+func backendsHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/backends")
+	if rest == "" || rest == "/" {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		if !checkAccess(w, r, backendAccessRules, "/api/backends") {
+			return
+		}
+		views := []backendView{}
+		for _, b := range allBackends() {
+			views = append(views, viewBackend(b))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(views)
+		return
+	}
+
+	name, sub, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	b, ok := findBackend(name)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Unknown backend")
+		return
+	}
+	switch {
+	case sub == "autossh" || strings.HasPrefix(sub, "autossh/"):
+		if b.isDefault() {
+			// The handler behind /api/autossh also takes this path
+			defaultAPIProxy.ServeHTTP(w, r)
+			return
+		}
+		b.proxy.ServeHTTP(w, r)
+	case strings.HasPrefix(sub, "ws/"):
+		proxyWebSocket(w, r, b, "/"+sub)
+	default:
+		writeJSONError(w, http.StatusNotFound, "Not found")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withBackends loads spec as WEB_BACKENDS_FILE on top of the API_BASE_URL
+// given, restoring the backend globals afterwards. It also drops any cached
+// fleet view.
+func withBackends(t *testing.T, base, spec string) error {
+	t.Helper()
+	oldBase, oldWS, oldKey, oldName, oldRegistry := apiBaseURL, wsBaseURL, apiKey, defaultBackendName, backendRegistry
+	t.Cleanup(func() {
+		apiBaseURL, wsBaseURL, apiKey, defaultBackendName, backendRegistry = oldBase, oldWS, oldKey, oldName, oldRegistry
+		fleetCache.at = time.Time{}
+	})
+	fleetCache.at = time.Time{}
+	path := filepath.Join(t.TempDir(), "backends.json")
+	if err := os.WriteFile(path, []byte(spec), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WEB_BACKENDS_FILE", path)
+	apiBaseURL, wsBaseURL, apiKey, defaultBackendName, backendRegistry = base, "", "", "local", nil
+	return loadBackendsFromEnv()
+}
+
+// fakeBackendAPI is an autossh API with status, config and health that
+// records the Authorization header of the last request.
+type fakeBackendAPI struct {
+	*fakeConfigAPI
+	status fakeStatusAPI
+	mu     sync.Mutex
+	auth   string
+	health int // /health requests
+}
+
+func newFakeBackendAPI(t *testing.T, tunnels map[string]tunnelState) (*fakeBackendAPI, string) {
+	t.Helper()
+	f := &fakeBackendAPI{fakeConfigAPI: &fakeConfigAPI{tunnels: tunnels}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.auth = r.Header.Get("Authorization")
+		if r.URL.Path == "/health" {
+			f.health++
+		}
+		f.mu.Unlock()
+		if r.URL.Path == "/health" {
+			w.Write([]byte(`{"status": "ok"}`))
+			return
+		}
+		if r.URL.Path == "/status" {
+			f.status.ServeHTTP(w, r)
+			return
+		}
+		f.fakeConfigAPI.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func (f *fakeBackendAPI) lastAuth() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.auth
+}
+
+func (f *fakeBackendAPI) healthChecks() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.health
+}
+
+func TestParseBackends(t *testing.T) {
+	t.Setenv("EDGE_KEY", "s3cret")
+	list, err := parseBackends([]byte(`{"backends": [
+		{"name": "edge", "api_url": "http://edge:8080", "ws_url": "ws://edge:8022", "api_key": "${EDGE_KEY}"},
+		{"name": "lab-2", "api_url": "https://lab.example"}
+	]}`))
+	if err != nil || len(list) != 2 || list[0].APIKey != "s3cret" || list[1].WSURL != "" {
+		t.Fatalf("parseBackends = %+v, %v", list, err)
+	}
+
+	// Only ${NAME} in the decoded values is replaced: a bare $ stays, and
+	// quotes in a variable cannot break the JSON
+	t.Setenv("EDGE_KEY", `k"ey`)
+	t.Setenv("EDGE_HOST", "edge.example")
+	list, err = parseBackends([]byte(`{"backends": [
+		{"name": "edge", "api_url": "https://${EDGE_HOST}", "api_key": "${EDGE_KEY}"},
+		{"name": "lab", "api_url": "http://lab:8080", "api_key": "pa$$word$EDGE_KEY"}
+	]}`))
+	if err != nil || list[0].APIURL != "https://edge.example" || list[0].APIKey != `k"ey` || list[1].APIKey != "pa$$word$EDGE_KEY" {
+		t.Fatalf("parseBackends = %+v, %v", list, err)
+	}
+	for _, spec := range []string{
+		`{"backends": [{"name": "", "api_url": "http://a"}]}`,
+		`{"backends": [{"name": "a/b", "api_url": "http://a"}]}`,
+		`{"backends": [{"name": "a", "api_url": "http://a"}, {"name": "a", "api_url": "http://b"}]}`,
+		`{"backends": [{"name": "a", "api_url": "a:8080"}]}`,
+		`{"backends": [{"name": "a", "api_url": "http://a", "ws_url": "http://a:8022"}]}`,
+		`{"backends": {}}`,
+	} {
+		if _, err := parseBackends([]byte(spec)); err == nil {
+			t.Errorf("parseBackends(%s) succeeded", spec)
+		}
+	}
+}
+
+func TestLoadBackendsFromEnv(t *testing.T) {
+	spec := `{"backends": [
+		{"name": "edge", "api_url": "http://edge:8080", "ws_url": "ws://edge:8022", "api_key": "k1"},
+		{"name": "lab", "api_url": "http://lab:8080"}
+	]}`
+	// Without API_BASE_URL the first backend is the default
+	if err := withBackends(t, "", spec); err != nil {
+		t.Fatal(err)
+	}
+	if defaultBackendName != "edge" || apiBaseURL != "http://edge:8080" || wsBaseURL != "ws://edge:8022" || apiKey != "k1" {
+		t.Errorf("default = %s %s %s %s", defaultBackendName, apiBaseURL, wsBaseURL, apiKey)
+	}
+	if all := allBackends(); len(all) != 2 || !all[0].isDefault() || all[1].Name != "lab" || all[1].proxy == nil {
+		t.Errorf("allBackends = %+v", all)
+	}
+
+	// With API_BASE_URL every entry is a further backend
+	if err := withBackends(t, "http://local:8080", spec); err != nil {
+		t.Fatal(err)
+	}
+	if all := allBackends(); len(all) != 3 || all[0].Name != "local" || all[0].APIURL != "http://local:8080" {
+		t.Errorf("allBackends = %+v", all)
+	}
+	if err := withBackends(t, "http://local:8080", `{"backends": [{"name": "local", "api_url": "http://b"}]}`); err == nil {
+		t.Error("a backend named like the default one was accepted")
+	}
+}
+
+func TestBackendsHandler(t *testing.T) {
+	withTrustedProxy(t, "127.0.0.1", "")
+	withTunnels(t, map[string]string{"a1": "db"})
+	l := withAuditLog(t)
+
+	local, localURL := newFakeBackendAPI(t, map[string]tunnelState{
+		"a1": {"name": "db", "hash": "a1"},
+	})
+	local.status.set(TunnelStatus{Hash: "a1", Name: "db", Status: "NORMAL"})
+	edge, edgeURL := newFakeBackendAPI(t, map[string]tunnelState{
+		"e1": {"name": "cache", "hash": "e1"},
+		"e2": {"name": "queue", "hash": "e2"},
+	})
+	edge.status.set(TunnelStatus{Hash: "e1", Name: "cache", Status: "DEAD"})
+	err := withBackends(t, localURL, `{"backends": [
+		{"name": "edge", "api_url": "`+edgeURL+`", "api_key": "edge-key"},
+		{"name": "gone", "api_url": "http://127.0.0.1:1"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldProxy := defaultAPIProxy
+	t.Cleanup(func() { defaultAPIProxy = oldProxy })
+	defaultAPIProxy = newAPIProxyHandler(localURL)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/autossh/", defaultAPIProxy)
+	mux.HandleFunc("/api/backends", backendsHandler)
+	mux.HandleFunc("/api/backends/", backendsHandler)
+	mux.HandleFunc("/api/fleet", fleetHandler)
+	server := httptest.NewServer(requireAuth(mux))
+	t.Cleanup(server.Close)
+
+	sess := sessions.Create("alice", RoleAdmin, SourcePassword)
+	call := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.ID})
+		req.Header.Set(csrfHeaderName, sess.CSRFToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	var views []backendView
+	json.NewDecoder(call("GET", "/api/backends").Body).Decode(&views)
+	if len(views) != 3 || views[0].Name != "local" || !views[0].Default || views[1].Name != "edge" || views[1].Default {
+		t.Errorf("GET /api/backends = %+v", views)
+	}
+
+	// Each backend is reached with its own key under its own prefix
+	resp := call("GET", "/api/backends/edge/autossh/config")
+	var config struct {
+		Tunnels []tunnelInfo `json:"tunnels"`
+	}
+	json.NewDecoder(resp.Body).Decode(&config)
+	if resp.StatusCode != http.StatusOK || len(config.Tunnels) != 2 || edge.lastAuth() != "Bearer edge-key" {
+		t.Errorf("edge config: %d %+v, auth %q", resp.StatusCode, config, edge.lastAuth())
+	}
+	if resp := call("GET", "/api/backends/local/autossh/status"); resp.StatusCode != http.StatusOK || local.status.polled != 1 {
+		t.Errorf("local status: %d, polled %d", resp.StatusCode, local.status.polled)
+	}
+	for _, path := range []string{"/api/backends/nope/autossh/status", "/api/backends/edge/other"} {
+		if resp := call("GET", path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", path, resp.StatusCode)
+		}
+	}
+
+	// Changes are audited with the backend and its tunnel names
+	call("POST", "/api/backends/edge/autossh/stop/e1")
+	call("POST", "/api/autossh/stop/a1")
+	entries, _ := l.Query(AuditFilter{})
+	if len(entries) != 2 || entries[1].Backend != "edge" || entries[1].TunnelName != "cache" ||
+		entries[0].Backend != "" || entries[0].TunnelName != "db" {
+		t.Errorf("audit entries = %+v", entries)
+	}
+
+	var fleet FleetStatus
+	json.NewDecoder(call("GET", "/api/fleet").Body).Decode(&fleet)
+	if len(fleet.Backends) != 3 || len(fleet.Tunnels) != 3 {
+		t.Fatalf("fleet = %+v", fleet)
+	}
+	l0, e, g := fleet.Backends[0], fleet.Backends[1], fleet.Backends[2]
+	if !l0.Up || l0.Running != 1 || !e.Up || e.Tunnels != 2 || e.Running != 0 || e.Failed != 1 || g.Up || g.Error == "" {
+		t.Errorf("fleet backends = %+v", fleet.Backends)
+	}
+	if tn := fleet.Tunnels[2]; tn.Backend != "edge" || tn.Name != "queue" || tn.Status != "STOPPED" {
+		t.Errorf("fleet tunnel = %+v", tn)
+	}
+	if !strings.Contains(g.Error, "127.0.0.1:1") {
+		t.Errorf("unreachable backend error = %q", g.Error)
+	}
+
+	// A second request within fleetCacheTTL reuses the probes
+	json.NewDecoder(call("GET", "/api/fleet").Body).Decode(&fleet)
+	if local.status.polled != 2 || len(fleet.Backends) != 3 {
+		t.Errorf("after a second fleet request: local polled %d times, fleet %+v", local.status.polled, fleet.Backends)
+	}
+	fleetCache.Lock()
+	fleetCache.at = time.Now().Add(-fleetCacheTTL)
+	fleetCache.Unlock()
+	call("GET", "/api/fleet")
+	if local.status.polled != 3 {
+		t.Errorf("after the cache expired: local polled %d times, want 3", local.status.polled)
+	}
+}
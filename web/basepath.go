@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// basePath is the URL prefix the panel is served under, e.g. "/tunnels",
+// or "" at the root. Handlers see paths with the prefix removed; links,
+// redirects and cookies the panel hands out carry it.
+var basePath string
+
+// parseBasePath normalizes a BASE_PATH value to "" or "/a/b".
+func parseBasePath(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if v == "" || v == "/" {
+		return "", nil
+	}
+	if !strings.HasPrefix(v, "/") || strings.ContainsAny(v, "?#%\\") {
+		return "", fmt.Errorf("must be an absolute path such as /tunnels")
+	}
+	clean := path.Clean(v)
+	if clean != strings.TrimSuffix(v, "/") {
+		return "", fmt.Errorf("must not contain empty, . or .. segments")
+	}
+	return clean, nil
+}
+
+func loadBasePathFromEnv() error {
+	p, err := parseBasePath(os.Getenv("BASE_PATH"))
+	if err != nil {
+		return fmt.Errorf("invalid BASE_PATH %q: %w", os.Getenv("BASE_PATH"), err)
+	}
+	basePath = p
+	return nil
+}
+
+// withBase prefixes a root-relative panel path with the base path.
+func withBase(p string) string {
+	return basePath + p
+}
+
+// mountAtBase serves h under the base path: the prefix is stripped before
+// h sees the request, the bare prefix redirects to its trailing-slash form
+// and everything outside it is not found.
+func mountAtBase(h http.Handler) http.Handler {
+	if basePath == "" {
+		return h
+	}
+	stripped := http.StripPrefix(basePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == basePath:
+			target := basePath + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, basePath+"/"):
+			stripped.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func withBasePath(t *testing.T, p string) {
+	t.Helper()
+	old := basePath
+	t.Cleanup(func() { basePath = old })
+	basePath = p
+}
+
+func TestParseBasePath(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"/tunnels", "/tunnels", true},
+		{" /tunnels/ ", "/tunnels", true},
+		{"/ops/tunnels", "/ops/tunnels", true},
+		{"tunnels", "", false},
+		{"/a//b", "", false},
+		{"/a/../b", "", false},
+		{"/a?b", "", false},
+		{"/a%2Fb", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseBasePath(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseBasePath(%q) = %q, %v; want %q, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMountAtBase(t *testing.T) {
+	withTOTPLogin(t)
+	withBasePath(t, "/tunnels")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "home "+r.URL.Path) })
+	mux.HandleFunc("/login", loginHandler)
+	server := httptest.NewServer(mountAtBase(requireAuth(mux)))
+	t.Cleanup(server.Close)
+
+	client := newJarClient()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	get := func(path string) *http.Response {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("/tunnels?x=1"); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/tunnels/?x=1" {
+		t.Errorf("bare prefix: %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	for _, path := range []string{"/", "/login", "/tunnelsx/"} {
+		if resp := get(path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", path, resp.StatusCode)
+		}
+	}
+
+	// Redirects to the login page keep the prefix, in the path and in next
+	resp := get("/tunnels/tunnel-detail?hash=abc")
+	wantLogin := "/tunnels/login?next=" + url.QueryEscape("/tunnels/tunnel-detail?hash=abc")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != wantLogin {
+		t.Fatalf("unauthenticated: %d %q, want %q", resp.StatusCode, resp.Header.Get("Location"), wantLogin)
+	}
+
+	resp, body := postForm(t, client, server.URL+"/tunnels/login", url.Values{
+		"username": {"bob"}, "password": {"pw"}, "next": {"/tunnels/tunnel-detail?hash=abc"},
+	})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/tunnels/tunnel-detail?hash=abc" {
+		t.Fatalf("login: %d %q %s", resp.StatusCode, resp.Header.Get("Location"), body)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName && c.Path != "/tunnels/" {
+			t.Errorf("session cookie path = %q, want /tunnels/", c.Path)
+		}
+	}
+
+	resp, err := client.Get(server.URL + "/tunnels/tunnel-detail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(got) != "home /tunnel-detail" {
+		t.Errorf("handler saw %q, want the path without the prefix", got)
+	}
+}
+
+func TestTemplates_BasePath(t *testing.T) {
+	withBasePath(t, "/tunnels")
+	w := httptest.NewRecorder()
+	renderTemplate(w, http.StatusOK, "index.html", nil)
+	body := w.Body.String()
+	for _, want := range []string{`src="/tunnels/static/script.js?v=`, `window.BASE_PATH = "/tunnels"`, `href="/tunnels/help"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("index.html does not contain %s", want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status event stream configuration
+var (
+	statusPollInterval = 5 * time.Second
+	sseKeepAlive       = 25 * time.Second
+)
+
+// statusEventBacklog is how many transitions are kept for clients resuming
+// with Last-Event-ID.
+const statusEventBacklog = 256
+
+// TunnelStatus is one running tunnel as reported by the autossh API.
+type TunnelStatus struct {
+	Hash   string `json:"hash"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// StatusEvent is a tunnel changing state. Tunnels missing from the status
+// list are STOPPED.
+type StatusEvent struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Hash string    `json:"hash"`
+	Name string    `json:"name"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// StatusHub polls the autossh API for tunnel status on behalf of every
+// connected browser and fans out the changes. It polls while someone is
+// subscribed, or all the time once an observer is registered.
+type StatusHub struct {
+	pollMu    sync.Mutex // serializes polls and observer calls
+	observers []StatusObserver
+
+	mu       sync.Mutex
+	epoch    string // distinguishes event IDs across restarts
+	seq      uint64
+	state    map[string]TunnelStatus // by hash
+	polledAt time.Time
+	pollTook time.Duration
+	pollErr  error
+	backlog  []StatusEvent
+	subs     map[chan StatusEvent]struct{}
+	closed   bool
+}
+
+// StatusObserver is called after every poll with the running tunnels, or
+// with the error that made the poll fail.
+type StatusObserver func(at time.Time, state map[string]TunnelStatus, err error)
+
+// NewStatusHub returns a hub with no state; the first poll fills it in.
+func NewStatusHub() *StatusHub {
+	return &StatusHub{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:  map[chan StatusEvent]struct{}{},
+	}
+}
+
+// statusHub is the process-wide hub behind /api/events.
+var statusHub = NewStatusHub()
+
+// lastID returns the ID of the newest event. Callers must hold h.mu.
+func (h *StatusHub) lastID() string {
+	return h.epoch + "-" + strconv.FormatUint(h.seq, 10)
+}
+
+// poll fetches the status list and publishes a StatusEvent for every
+// tunnel whose state changed. The first successful poll only records the
+// state.
+func (h *StatusHub) poll() error {
+	h.pollMu.Lock()
+	defer h.pollMu.Unlock()
+
+	var list []TunnelStatus
+	start := time.Now()
+	err := getBackendJSON("/status", &list)
+
+	h.mu.Lock()
+	at := time.Now()
+	h.polledAt, h.pollTook = at, at.Sub(start)
+	if err != nil {
+		if h.pollErr == nil {
+			logMsg("WARN", "WEB", "Tunnel status poll failed: %v", err)
+		}
+		h.pollErr = err
+		h.mu.Unlock()
+		h.notify(at, nil, err)
+		return err
+	}
+	if h.pollErr != nil {
+		logMsg("INFO", "WEB", "Tunnel status poll recovered")
+		h.pollErr = nil
+	}
+
+	next := make(map[string]TunnelStatus, len(list))
+	for _, t := range list {
+		if t.Hash != "" {
+			next[t.Hash] = t
+		}
+	}
+	if h.state != nil {
+		for _, e := range diffStatus(h.state, next) {
+			h.seq++
+			e.ID = h.lastID()
+			e.Time = at
+			h.publish(e)
+		}
+	}
+	h.state = next
+	h.mu.Unlock()
+	h.notify(at, next, nil)
+	return nil
+}
+
+// Observe registers fn to be called after every poll and keeps the hub
+// polling when no browser is subscribed. Call it before Run.
+func (h *StatusHub) Observe(fn StatusObserver) {
+	h.pollMu.Lock()
+	defer h.pollMu.Unlock()
+	h.observers = append(h.observers, fn)
+}
+
+// notify passes a poll result to the observers. Callers must hold
+// h.pollMu; state must not be modified.
+func (h *StatusHub) notify(at time.Time, state map[string]TunnelStatus, err error) {
+	for _, fn := range h.observers {
+		fn(at, state, err)
+	}
+}
+
+// diffStatus returns the transitions from before to after, ordered by hash.
+func diffStatus(before, after map[string]TunnelStatus) []StatusEvent {
+	var events []StatusEvent
+	for hash, t := range after {
+		if prev, ok := before[hash]; !ok || prev.Status != t.Status {
+			from := "STOPPED"
+			if ok {
+				from = prev.Status
+			}
+			events = append(events, StatusEvent{Hash: hash, Name: t.Name, From: from, To: t.Status})
+		}
+	}
+	for hash, t := range before {
+		if _, ok := after[hash]; !ok && t.Status != "STOPPED" {
+			events = append(events, StatusEvent{Hash: hash, Name: t.Name, From: t.Status, To: "STOPPED"})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Hash < events[j].Hash })
+	return events
+}
+
+// publish records e and hands it to every subscriber. A subscriber too far
+// behind is dropped; its browser reconnects and resumes from the backlog.
+// Callers must hold h.mu.
+func (h *StatusHub) publish(e StatusEvent) {
+	h.backlog = append(h.backlog, e)
+	if len(h.backlog) > statusEventBacklog {
+		h.backlog = h.backlog[len(h.backlog)-statusEventBacklog:]
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// ensureFresh polls unless the state is younger than the poll interval.
+func (h *StatusHub) ensureFresh() error {
+	h.mu.Lock()
+	fresh := h.state != nil && time.Since(h.polledAt) < statusPollInterval
+	h.mu.Unlock()
+	if fresh {
+		return nil
+	}
+	return h.poll()
+}
+
+// lastPoll returns when the latest poll finished, how long it took and why
+// it failed. at is zero before the first poll.
+func (h *StatusHub) lastPoll() (at time.Time, took time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.polledAt, h.pollTook, h.pollErr
+}
+
+// subscribe registers a subscriber. When lastEventID names an event still
+// in the backlog, the events after it are returned for replay; otherwise
+// replay is nil and the caller should send a snapshot.
+func (h *StatusHub) subscribe(lastEventID string) (ch chan StatusEvent, replay []StatusEvent, resumed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch = make(chan StatusEvent, 32)
+	if h.closed {
+		close(ch)
+		return ch, nil, false
+	}
+	h.subs[ch] = struct{}{}
+
+	if lastEventID == h.lastID() {
+		return ch, nil, true
+	}
+	for i, e := range h.backlog {
+		if e.ID == lastEventID {
+			return ch, append([]StatusEvent(nil), h.backlog[i+1:]...), true
+		}
+	}
+	return ch, nil, false
+}
+
+// unsubscribe removes ch if the hub has not dropped it already.
+func (h *StatusHub) unsubscribe(ch chan StatusEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// snapshot returns the running tunnels and the ID of the newest event.
+func (h *StatusHub) snapshot() ([]TunnelStatus, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := make([]TunnelStatus, 0, len(h.state))
+	for _, t := range h.state {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Hash < list[j].Hash })
+	return list, h.lastID()
+}
+
+// Run polls every statusPollInterval while there are subscribers or
+// observers, until stop is closed.
+func (h *StatusHub) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(statusPollInterval)
+	defer ticker.Stop()
+	h.pollMu.Lock()
+	observed := len(h.observers) > 0
+	h.pollMu.Unlock()
+	if observed {
+		h.poll()
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.mu.Lock()
+			active := observed || len(h.subs) > 0
+			h.mu.Unlock()
+			if active {
+				h.poll()
+			}
+		}
+	}
+}
+
+// Close ends every stream and turns away new subscribers, so server
+// shutdown does not wait on them.
+func (h *StatusHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// writeSSE writes one server-sent event.
+func writeSSE(w http.ResponseWriter, event, id string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if id != "" {
+		fmt.Fprintf(&b, "id: %s\n", id)
+	}
+	fmt.Fprintf(&b, "event: %s\ndata: %s\n\n", event, payload)
+	_, err = w.Write([]byte(b.String()))
+	return err
+}
+
+// eventsHandler serves GET /api/events, a Server-Sent Events stream of
+// tunnel status. A new stream starts with a "snapshot" event listing the
+// running tunnels; "status" events follow as tunnels change state. A client
+// reconnecting with Last-Event-ID gets the events it missed instead.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	// The stream is the status list, kept current
+	if !checkAccess(w, r, apiAccessRules, "/status") {
+		return
+	}
+	rc := http.NewResponseController(w)
+	if err := statusHub.ensureFresh(); err != nil {
+		writeJSONError(w, http.StatusBadGateway, "Tunnel status unavailable")
+		return
+	}
+
+	ch, replay, resumed := statusHub.subscribe(r.Header.Get("Last-Event-ID"))
+	defer statusHub.unsubscribe(ch)
+
+	// The stream outlives the server's read and write timeouts
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+
+	if resumed {
+		for _, e := range replay {
+			writeSSE(w, "status", e.ID, e)
+		}
+	} else {
+		list, id := statusHub.snapshot()
+		writeSSE(w, "snapshot", id, map[string]interface{}{"tunnels": list})
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if writeSSE(w, "status", e.ID, e) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// loadEventsFromEnv reads WEB_STATUS_POLL_INTERVAL.
+func loadEventsFromEnv() error {
+	if v := os.Getenv("WEB_STATUS_POLL_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			return fmt.Errorf("invalid WEB_STATUS_POLL_INTERVAL %q (minimum 1s)", v)
+		}
+		statusPollInterval = d
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiffStatus(t *testing.T) {
+	before := map[string]TunnelStatus{
+		"a": {Hash: "a", Name: "db", Status: "NORMAL"},
+		"b": {Hash: "b", Name: "web", Status: "NORMAL"},
+	}
+	after := map[string]TunnelStatus{
+		"a": {Hash: "a", Name: "db", Status: "DEAD"},
+		"c": {Hash: "c", Name: "cache", Status: "STARTING"},
+	}
+	got := diffStatus(before, after)
+	want := []StatusEvent{
+		{Hash: "a", Name: "db", From: "NORMAL", To: "DEAD"},
+		{Hash: "b", Name: "web", From: "NORMAL", To: "STOPPED"},
+		{Hash: "c", Name: "cache", From: "STOPPED", To: "STARTING"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("diffStatus = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// fakeStatusAPI serves /status from a list the test can change.
+type fakeStatusAPI struct {
+	mu     sync.Mutex
+	list   []TunnelStatus
+	polled int
+}
+
+func (f *fakeStatusAPI) set(list ...TunnelStatus) {
+	f.mu.Lock()
+	f.list = list
+	f.mu.Unlock()
+}
+
+func (f *fakeStatusAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.polled++
+	json.NewEncoder(w).Encode(append([]TunnelStatus{}, f.list...))
+}
+
+// withStatusHub points a fresh hub at a fake status API.
+func withStatusHub(t *testing.T) *fakeStatusAPI {
+	t.Helper()
+	oldHub, oldBase := statusHub, apiBaseURL
+	t.Cleanup(func() { statusHub, apiBaseURL = oldHub, oldBase })
+	api := &fakeStatusAPI{}
+	backend := httptest.NewServer(api)
+	t.Cleanup(backend.Close)
+	statusHub, apiBaseURL = NewStatusHub(), backend.URL
+	return api
+}
+
+type sseEvent struct {
+	event, id, data string
+}
+
+// readSSE returns the next event on the stream, skipping comments and
+// retry hints.
+func readSSE(t *testing.T, br *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.event != "":
+			return e
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	api := withStatusHub(t)
+	api.set(TunnelStatus{Hash: "abc", Name: "db", Status: "NORMAL"})
+
+	// Short server timeouts must not end the stream
+	server := httptest.NewUnstartedServer(http.HandlerFunc(eventsHandler))
+	server.Config.ReadTimeout = 200 * time.Millisecond
+	server.Config.WriteTimeout = 200 * time.Millisecond
+	server.Start()
+	t.Cleanup(server.Close)
+
+	open := func(lastEventID string) (*http.Response, *bufio.Reader) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	resp, br := open("")
+	snap := readSSE(t, br)
+	if snap.event != "snapshot" || !strings.Contains(snap.data, `"hash":"abc"`) {
+		t.Fatalf("first event = %+v, want a snapshot", snap)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	api.set(TunnelStatus{Hash: "abc", Name: "db", Status: "DEAD"})
+	statusHub.poll()
+	e := readSSE(t, br)
+	var change StatusEvent
+	json.Unmarshal([]byte(e.data), &change)
+	if e.event != "status" || change.Hash != "abc" || change.From != "NORMAL" || change.To != "DEAD" || e.id != change.ID {
+		t.Fatalf("change event = %+v", e)
+	}
+	resp.Body.Close()
+
+	// Missed events are replayed to a client resuming from its last ID
+	api.set()
+	statusHub.poll()
+	_, br = open(e.id)
+	missed := readSSE(t, br)
+	if missed.event != "status" || !strings.Contains(missed.data, `"to":"STOPPED"`) {
+		t.Errorf("resumed stream starts with %+v, want the missed event", missed)
+	}
+
+	// An ID from before a restart gets a fresh snapshot
+	_, br = open("stale-7")
+	if e := readSSE(t, br); e.event != "snapshot" || !strings.Contains(e.data, `"tunnels":[]`) {
+		t.Errorf("stale ID: first event = %+v, want an empty snapshot", e)
+	}
+
+	// Streams opened within the poll interval share the last poll
+	api.mu.Lock()
+	polled := api.polled
+	api.mu.Unlock()
+	if polled != 3 {
+		t.Errorf("backend polled %d times for 3 streams and 2 changes, want 3", polled)
+	}
+}
+
+func TestStatusHub_Close(t *testing.T) {
+	withStatusHub(t)
+	statusHub.ensureFresh()
+	ch, _, _ := statusHub.subscribe("")
+	statusHub.Close()
+	if _, ok := <-ch; ok {
+		t.Error("subscriber channel still open after Close")
+	}
+	ch, _, _ = statusHub.subscribe("")
+	if _, ok := <-ch; ok {
+		t.Error("new subscriber accepted after Close")
+	}
+}
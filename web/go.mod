@@ -1,5 +1,16 @@
 module app
 
-go 1.24
+go 1.24.0
 
-require github.com/gorilla/websocket v1.5.3
+require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/gorilla/websocket v1.5.3
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.45.0
+	otlptrace v0.0.0
+)
+
+require golang.org/x/sys v0.38.0 // indirect
+
+replace otlptrace => ../otlptrace
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readyTimeout bounds each dependency check of /readyz, and readyCacheTTL
+// is how long a result is reused, so frequent probes do not each reach the
+// backend.
+var (
+	readyTimeout  = 3 * time.Second
+	readyCacheTTL = 2 * time.Second
+)
+
+// readyCache holds the last /readyz result. Its lock is held during a
+// check, so concurrent probes wait for one check instead of each running
+// their own.
+var readyCache struct {
+	sync.Mutex
+	at     time.Time
+	result readiness
+}
+
+// dependencyCheck is one dependency's result in /readyz.
+type dependencyCheck struct {
+	Status    string `json:"status"` // "up" or "down"
+	URL       string `json:"url,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// readiness is the /readyz response.
+type readiness struct {
+	Status string                     `json:"status"` // "ready" or "not_ready"
+	Checks map[string]dependencyCheck `json:"checks"`
+}
+
+// healthzHandler reports that the process is up and serving.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// readyzHandler checks the default backend's autossh API and, when one is
+// configured, its ws-server. It answers 503 while a dependency is down.
+// Addresses and errors are only shown to signed-in users.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready := cachedReadiness(r.Context())
+	if authEnabled() && currentSession(r) == nil && tokenSession(r) == nil {
+		for name, c := range ready.Checks {
+			c.URL, c.Error = "", ""
+			ready.Checks[name] = c
+		}
+	}
+	status := http.StatusOK
+	if ready.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ready)
+}
+
+// cachedReadiness returns a copy of the last result when it is recent and
+// checks again otherwise. The check outlives a caller that goes away, as
+// others may be waiting for it.
+func cachedReadiness(ctx context.Context) readiness {
+	readyCache.Lock()
+	defer readyCache.Unlock()
+	if readyCache.at.IsZero() || time.Since(readyCache.at) >= readyCacheTTL {
+		readyCache.result = checkReadiness(context.WithoutCancel(ctx))
+		readyCache.at = time.Now()
+	}
+	ready := readyCache.result
+	ready.Checks = make(map[string]dependencyCheck, len(readyCache.result.Checks))
+	for name, c := range readyCache.result.Checks {
+		ready.Checks[name] = c
+	}
+	return ready
+}
+
+// wsHTTPURL returns the HTTP URL of the ws-server at raw, a ws(s) URL.
+func wsHTTPURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "http"
+	case "wss", "https":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("%q is not a ws(s) URL", raw)
+	}
+	return u, nil
+}
+
+// checkReadiness runs the dependency checks in parallel.
+func checkReadiness(ctx context.Context) readiness {
+	b := defaultBackend()
+	checks := map[string]func(context.Context) dependencyCheck{
+		"api": func(ctx context.Context) dependencyCheck {
+			if b.APIURL == "" {
+				return dependencyCheck{Status: "down", Error: "API_BASE_URL not set"}
+			}
+			// /health answers without running the status script
+			return probeDependency(ctx, strings.TrimSuffix(b.APIURL, "/")+"/health", b.APIKey)
+		},
+	}
+	if b.WSURL != "" {
+		checks["ws"] = func(ctx context.Context) dependencyCheck {
+			// The ws-server answers plain HTTP on /health
+			u, err := wsHTTPURL(b.WSURL)
+			if err != nil {
+				return dependencyCheck{Status: "down", Error: err.Error()}
+			}
+			u.Path = strings.TrimSuffix(u.Path, "/") + "/health"
+			return probeDependency(ctx, u.String(), "")
+		}
+	}
+
+	ready := readiness{Status: "ready", Checks: map[string]dependencyCheck{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+			defer cancel()
+			result := check(ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			ready.Checks[name] = result
+			if result.Status != "up" {
+				ready.Status = "not_ready"
+			}
+		}()
+	}
+	wg.Wait()
+	return ready
+}
+
+// probeDependency GETs target and expects a 2xx answer.
+func probeDependency(ctx context.Context, target, key string) dependencyCheck {
+	c := dependencyCheck{Status: "down", URL: target}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	start := time.Now()
+	resp, err := backendClient.Do(req)
+	c.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("no answer within %s", readyTimeout)
+		}
+		c.Error = err.Error()
+		return c
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		c.Error = "HTTP " + resp.Status
+		return c
+	}
+	c.Status = "up"
+	return c
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	api, apiURL := newFakeBackendAPI(t, nil)
+	var wsDown atomic.Bool
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || wsDown.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	t.Cleanup(ws.Close)
+	oldBase, oldWS, oldKey, oldTTL := apiBaseURL, wsBaseURL, apiKey, readyCacheTTL
+	t.Cleanup(func() { apiBaseURL, wsBaseURL, apiKey, readyCacheTTL = oldBase, oldWS, oldKey, oldTTL })
+	apiBaseURL, wsBaseURL, apiKey = apiURL, "ws"+strings.TrimPrefix(ws.URL, "http"), "k"
+	readyCache.at, readyCacheTTL = time.Time{}, 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	server := httptest.NewServer(requireAuth(mux))
+	t.Cleanup(server.Close)
+	get := func(path string) (int, readiness) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body readiness
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	if code, body := get("/healthz"); code != http.StatusOK || body.Status != "ok" {
+		t.Errorf("/healthz = %d %+v", code, body)
+	}
+	code, body := get("/readyz")
+	if code != http.StatusOK || body.Status != "ready" || body.Checks["api"].Status != "up" || body.Checks["ws"].Status != "up" {
+		t.Errorf("/readyz with both up = %d %+v", code, body)
+	}
+	if api.lastAuth() != "Bearer k" || api.healthChecks() != 1 || api.status.polled != 0 {
+		t.Errorf("API check sent %q to /health %d times and /status %d times, want /health once",
+			api.lastAuth(), api.healthChecks(), api.status.polled)
+	}
+
+	// Probes close together share one check
+	readyCacheTTL = time.Minute
+	readyCache.at = time.Time{}
+	get("/readyz")
+	wsDown.Store(true)
+	if code, body := get("/readyz"); code != http.StatusOK || body.Checks["ws"].Status != "up" || api.healthChecks() != 2 {
+		t.Errorf("/readyz within the cache TTL = %d %+v after %d checks, want the cached result", code, body, api.healthChecks())
+	}
+	readyCacheTTL = 0
+
+	code, body = get("/readyz")
+	if code != http.StatusServiceUnavailable || body.Status != "not_ready" || body.Checks["api"].Status != "up" ||
+		body.Checks["ws"].Status != "down" || !strings.Contains(body.Checks["ws"].Error, "503") {
+		t.Errorf("/readyz with the ws-server down = %d %+v", code, body)
+	}
+
+	// A hung API is given up on
+	oldTimeout := readyTimeout
+	t.Cleanup(func() { readyTimeout = oldTimeout })
+	readyTimeout = 50 * time.Millisecond
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	t.Cleanup(hung.Close)
+	t.Cleanup(func() { close(release) })
+	apiBaseURL, wsBaseURL = hung.URL, ""
+	code, body = get("/readyz")
+	if _, ok := body.Checks["ws"]; code != http.StatusServiceUnavailable || ok || !strings.Contains(body.Checks["api"].Error, "no answer") {
+		t.Errorf("/readyz with a hung API = %d %+v", code, body)
+	}
+
+	// Strangers learn what is down, not where or why
+	withTrustedProxy(t, "192.0.2.1", "")
+	code, body = get("/readyz")
+	if c := body.Checks["api"]; code != http.StatusServiceUnavailable || c.Status != "down" || c.URL != "" || c.Error != "" {
+		t.Errorf("/readyz without a session = %d %+v", code, body)
+	}
+}
+
+func TestWSHTTPURL(t *testing.T) {
+	for raw, want := range map[string]string{
+		"ws://ws-server:8022":             "http://ws-server:8022",
+		"wss://news.example/ws":           "https://news.example/ws",
+		"WSS://ws.example:443/autossh/ws": "https://ws.example:443/autossh/ws",
+		"http://ws-server:8022":           "http://ws-server:8022",
+	} {
+		if u, err := wsHTTPURL(raw); err != nil || u.String() != want {
+			t.Errorf("wsHTTPURL(%q) = %v, %v; want %s", raw, u, err, want)
+		}
+	}
+	for _, raw := range []string{"ftp://ws-server", "ws-server:8022", "://"} {
+		if u, err := wsHTTPURL(raw); err == nil {
+			t.Errorf("wsHTTPURL(%q) = %v, want an error", raw, u)
+		}
+	}
+}
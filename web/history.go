@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Status history configuration
+var (
+	historyRetention  = 30 * 24 * time.Hour
+	historyHeartbeat  = time.Minute // how often liveness is written
+	historyPruneEvery = time.Hour
+)
+
+// statusUnknown marks time the panel could not see a tunnel: the backend
+// was unreachable or the panel itself was not running.
+const statusUnknown = "UNKNOWN"
+
+var (
+	transitionsBucket = []byte("transitions") // one sub-bucket per tunnel hash
+	metaBucket        = []byte("meta")
+	heartbeatKey      = []byte("heartbeat")
+)
+
+// Transition is a tunnel entering a state.
+type Transition struct {
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+	Name   string    `json:"name,omitempty"`
+}
+
+// HistoryStore records tunnel state transitions in a bbolt database. It
+// observes the status hub, so it sees every poll.
+type HistoryStore struct {
+	db *bolt.DB
+
+	mu       sync.Mutex
+	last     map[string]Transition // newest transition per tunnel
+	beatAt   time.Time
+	prunedAt time.Time
+}
+
+// history is nil when WEB_HISTORY_FILE is unset, which disables it.
+var history *HistoryStore
+
+// timeKey encodes t so keys sort chronologically.
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
+
+func keyTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+}
+
+// NewHistoryStore opens the database at path. Tunnels that were being
+// watched when the panel last stopped are marked UNKNOWN from its last
+// heartbeat, so the downtime is not credited to their previous state.
+func NewHistoryStore(path string) (*HistoryStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &HistoryStore{db: db, last: map[string]Transition{}}
+	err = db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists(transitionsBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		var beat time.Time
+		if v := meta.Get(heartbeatKey); len(v) == 8 {
+			beat = keyTime(v)
+		}
+		return root.ForEachBucket(func(hash []byte) error {
+			b := root.Bucket(hash)
+			k, v := b.Cursor().Last()
+			var t Transition
+			if k == nil || json.Unmarshal(v, &t) != nil {
+				return nil
+			}
+			t.Time = keyTime(k)
+			if t.Status != statusUnknown && beat.After(t.Time) {
+				t = Transition{Time: beat, Status: statusUnknown, Name: t.Name}
+				if err := putTransition(b, t); err != nil {
+					return err
+				}
+			}
+			s.last[string(hash)] = t
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func putTransition(b *bolt.Bucket, t Transition) error {
+	v, err := json.Marshal(Transition{Status: t.Status, Name: t.Name})
+	if err != nil {
+		return err
+	}
+	return b.Put(timeKey(t.Time), v)
+}
+
+// Close closes the database.
+func (s *HistoryStore) Close() error {
+	return s.db.Close()
+}
+
+// Last returns the newest transition recorded for the tunnel with hash.
+func (s *HistoryStore) Last(hash string) (Transition, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.last[hash]
+	return t, ok
+}
+
+// Record is a StatusObserver. It stores a transition for every tunnel whose
+// state differs from the last one recorded; tunnels no longer running are
+// STOPPED, and a failed poll makes every tunnel UNKNOWN.
+func (s *HistoryStore) Record(at time.Time, state map[string]TunnelStatus, pollErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changes []struct {
+		hash string
+		t    Transition
+	}
+	change := func(hash, status, name string) {
+		if last, ok := s.last[hash]; ok && last.Status == status {
+			return
+		} else if name == "" {
+			name = last.Name
+		}
+		changes = append(changes, struct {
+			hash string
+			t    Transition
+		}{hash, Transition{Time: at, Status: status, Name: name}})
+	}
+	if pollErr != nil {
+		for hash := range s.last {
+			change(hash, statusUnknown, "")
+		}
+	} else {
+		for hash, t := range state {
+			change(hash, t.Status, t.Name)
+		}
+		for hash := range s.last {
+			if _, ok := state[hash]; !ok {
+				change(hash, "STOPPED", "")
+			}
+		}
+	}
+
+	beat := at.Sub(s.beatAt) >= historyHeartbeat
+	if len(changes) == 0 && !beat {
+		return
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(transitionsBucket)
+		for _, c := range changes {
+			b, err := root.CreateBucketIfNotExists([]byte(c.hash))
+			if err != nil {
+				return err
+			}
+			if err := putTransition(b, c.t); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Put(heartbeatKey, timeKey(at))
+	})
+	if err != nil {
+		logMsg("ERROR", "HISTORY", "Failed to record tunnel status: %v", err)
+		return
+	}
+	for _, c := range changes {
+		s.last[c.hash] = c.t
+	}
+	s.beatAt = at
+
+	if at.Sub(s.prunedAt) >= historyPruneEvery {
+		s.prunedAt = at
+		if err := s.prune(at.Add(-historyRetention)); err != nil {
+			logMsg("ERROR", "HISTORY", "Failed to prune status history: %v", err)
+		}
+	}
+}
+
+// prune deletes transitions older than cutoff, keeping the newest of them
+// as each tunnel's state at the cutoff. Tunnels that have been stopped or
+// unseen since before the cutoff are dropped entirely. Callers must hold
+// s.mu.
+func (s *HistoryStore) prune(cutoff time.Time) error {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(transitionsBucket)
+		var gone [][]byte
+		err := root.ForEachBucket(func(hash []byte) error {
+			b := root.Bucket(hash)
+			c := b.Cursor()
+			if k, v := c.Last(); k != nil && keyTime(k).Before(cutoff) {
+				var t Transition
+				json.Unmarshal(v, &t)
+				if t.Status == "STOPPED" || t.Status == statusUnknown {
+					gone = append(gone, append([]byte(nil), hash...))
+					return nil
+				}
+			}
+			var old [][]byte
+			for k, _ := c.First(); k != nil && keyTime(k).Before(cutoff); k, _ = c.Next() {
+				old = append(old, append([]byte(nil), k...))
+			}
+			// Keep the last transition before the cutoff
+			for i := 0; i < len(old)-1; i++ {
+				if err := b.Delete(old[i]); err != nil {
+					return err
+				}
+				removed++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, hash := range gone {
+			if err := root.DeleteBucket(hash); err != nil {
+				return err
+			}
+			delete(s.last, string(hash))
+		}
+		return nil
+	})
+	if err == nil && removed > 0 {
+		logMsg("DEBUG", "HISTORY", "Pruned %d status transition(s) older than %s", removed, cutoff.Format(time.RFC3339))
+	}
+	return err
+}
+
+// Query returns the transitions of the tunnel with hash between since and
+// until, preceded by the last one before since, which gives the state at
+// since.
+func (s *HistoryStore) Query(hash string, since, until time.Time) ([]Transition, error) {
+	var out []Transition
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(transitionsBucket).Bucket([]byte(hash))
+		if b == nil {
+			return nil
+		}
+		// Start from the last transition at or before since
+		c := b.Cursor()
+		k, v := c.Seek(timeKey(since))
+		if k == nil {
+			k, v = c.Last()
+		} else if keyTime(k).After(since) {
+			if pk, pv := c.Prev(); pk != nil {
+				k, v = pk, pv
+			} else {
+				k, v = c.First()
+			}
+		}
+		for ; k != nil && !keyTime(k).After(until); k, v = c.Next() {
+			var t Transition
+			if json.Unmarshal(v, &t) != nil {
+				continue
+			}
+			t.Time = keyTime(k)
+			out = append(out, t)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// HistorySegment is a stretch of time a tunnel spent in one state.
+type HistorySegment struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Status string    `json:"status"`
+}
+
+// UptimeReport summarizes a tunnel's history over a window. Uptime counts
+// running time against running plus outage time; time stopped on purpose
+// or unknown to the panel counts for neither.
+type UptimeReport struct {
+	Hash                 string           `json:"hash"`
+	Name                 string           `json:"name,omitempty"`
+	Since                time.Time        `json:"since"`
+	Until                time.Time        `json:"until"`
+	Segments             []HistorySegment `json:"segments"`
+	Uptime               *float64         `json:"uptime"` // percent; null without running or outage time
+	UpSeconds            float64          `json:"up_seconds"`
+	OutageSeconds        float64          `json:"outage_seconds"`
+	Failures             int              `json:"failures"`
+	MTBFSeconds          *float64         `json:"mtbf_seconds"` // null without failures
+	LongestOutageSeconds float64          `json:"longest_outage_seconds"`
+}
+
+// statusClass groups autossh states: "up", "outage", "stopped" or
+// "unknown".
+func statusClass(status string) string {
+	switch status {
+	case "NORMAL", "RUNNING":
+		return "up"
+	case "STOPPED":
+		return "stopped"
+	case statusUnknown, "":
+		return "unknown"
+	}
+	return "outage"
+}
+
+// buildReport computes the report for transitions (as returned by Query)
+// over [since, until). A failure is a move from running into an outage
+// state; consecutive outage states count as one outage.
+func buildReport(transitions []Transition, since, until time.Time) UptimeReport {
+	r := UptimeReport{Since: since, Until: until, Segments: []HistorySegment{}}
+	status, start := statusUnknown, since
+	var outageStart time.Time
+	inOutage := false
+
+	// endSegment closes the current segment at end and accounts for it
+	endSegment := func(end time.Time) {
+		if !end.After(start) {
+			return
+		}
+		r.Segments = append(r.Segments, HistorySegment{Start: start, End: end, Status: status})
+		d := end.Sub(start).Seconds()
+		switch statusClass(status) {
+		case "up":
+			r.UpSeconds += d
+		case "outage":
+			r.OutageSeconds += d
+		}
+	}
+	endOutage := func(end time.Time) {
+		if inOutage {
+			if d := end.Sub(outageStart).Seconds(); d > r.LongestOutageSeconds {
+				r.LongestOutageSeconds = d
+			}
+			inOutage = false
+		}
+	}
+
+	for _, t := range transitions {
+		if t.Name != "" {
+			r.Name = t.Name
+		}
+		at := t.Time
+		if at.Before(since) {
+			at = since
+		}
+		if !at.Before(until) {
+			break
+		}
+		if t.Status == status {
+			continue
+		}
+		endSegment(at)
+		from, to := statusClass(status), statusClass(t.Status)
+		if to == "outage" && !inOutage {
+			if from == "up" && t.Time.After(since) {
+				r.Failures++
+			}
+			inOutage, outageStart = true, at
+		} else if to != "outage" {
+			endOutage(at)
+		}
+		status, start = t.Status, at
+	}
+	endSegment(until)
+	endOutage(until)
+
+	if total := r.UpSeconds + r.OutageSeconds; total > 0 {
+		uptime := 100 * r.UpSeconds / total
+		r.Uptime = &uptime
+	}
+	if r.Failures > 0 {
+		mtbf := r.UpSeconds / float64(r.Failures)
+		r.MTBFSeconds = &mtbf
+	}
+	return r
+}
+
+// parseWindow parses a report window such as "24h" or "7d".
+func parseWindow(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid window %q", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid window %q", v)
+	}
+	return d, nil
+}
+
+// historyAccessRules covers /api/history.
+var historyAccessRules = []accessRule{
+	{http.MethodGet, "/api/history/*", RoleViewer, ScopeRead},
+}
+
+// historyHandler serves GET /api/history/{hash}?window=7d with the
+// tunnel's state timeline, uptime, MTBF and longest outage. The window
+// defaults to 24h and is capped at the retention period.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if history == nil {
+		writeJSONError(w, http.StatusNotFound, "Status history is not enabled")
+		return
+	}
+	hash := strings.TrimPrefix(r.URL.Path, "/api/history/")
+	if hash == "" || strings.Contains(hash, "/") {
+		writeJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	if !checkAccess(w, r, historyAccessRules, r.URL.Path) {
+		return
+	}
+
+	window := 24 * time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := parseWindow(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		window = d
+	}
+	if window > historyRetention {
+		window = historyRetention
+	}
+
+	until := time.Now()
+	since := until.Add(-window)
+	transitions, err := history.Query(hash, since, until)
+	if err != nil {
+		logMsg("ERROR", "HISTORY", "Failed to read status history: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read status history")
+		return
+	}
+	report := buildReport(transitions, since, until)
+	report.Hash = hash
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// loadHistoryFromEnv opens WEB_HISTORY_FILE when set and reads
+// WEB_HISTORY_RETENTION.
+func loadHistoryFromEnv() error {
+	if v := os.Getenv("WEB_HISTORY_RETENTION"); v != "" {
+		d, err := parseWindow(v)
+		if err != nil {
+			return fmt.Errorf("invalid WEB_HISTORY_RETENTION %q", v)
+		}
+		historyRetention = d
+	}
+	f := os.Getenv("WEB_HISTORY_FILE")
+	if f == "" {
+		return nil
+	}
+	s, err := NewHistoryStore(f)
+	if err != nil {
+		return err
+	}
+	history = s
+	return nil
+}
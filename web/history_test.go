@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withHistory(t *testing.T) (*HistoryStore, string) {
+	t.Helper()
+	old := history
+	t.Cleanup(func() { history = old })
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := NewHistoryStore(path)
+	if err != nil {
+		t.Fatalf("NewHistoryStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	history = s
+	return s, path
+}
+
+func TestBuildReport(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	transitions := []Transition{
+		{Time: at(-30), Status: "NORMAL", Name: "db"}, // state at the window start
+		{Time: at(10), Status: "DEAD"},
+		{Time: at(12), Status: "STARTING"},
+		{Time: at(15), Status: "NORMAL"},
+		{Time: at(40), Status: "DEAD"},
+		{Time: at(41), Status: "NORMAL"},
+		{Time: at(50), Status: "STOPPED"},
+		{Time: at(55), Status: statusUnknown},
+	}
+	r := buildReport(transitions, at(0), at(60))
+
+	if r.Name != "db" || len(r.Segments) != 8 || r.Segments[0].Start != at(0) || r.Segments[7].End != at(60) {
+		t.Fatalf("segments = %+v", r.Segments)
+	}
+	// Up 10+25+9 minutes, out 5+1; stopped and unknown time is not counted
+	if r.UpSeconds != 44*60 || r.OutageSeconds != 6*60 {
+		t.Errorf("up %v s, outage %v s", r.UpSeconds, r.OutageSeconds)
+	}
+	if r.Uptime == nil || *r.Uptime != 88 {
+		t.Errorf("uptime = %v, want 88", r.Uptime)
+	}
+	if r.Failures != 2 || r.MTBFSeconds == nil || *r.MTBFSeconds != 22*60 {
+		t.Errorf("failures %d, MTBF %v", r.Failures, r.MTBFSeconds)
+	}
+	// DEAD then STARTING is one five-minute outage
+	if r.LongestOutageSeconds != 5*60 {
+		t.Errorf("longest outage = %v s, want 300", r.LongestOutageSeconds)
+	}
+
+	empty := buildReport(nil, at(0), at(60))
+	if empty.Uptime != nil || empty.MTBFSeconds != nil || len(empty.Segments) != 1 || empty.Segments[0].Status != statusUnknown {
+		t.Errorf("report without history = %+v", empty)
+	}
+}
+
+func TestHistoryStore(t *testing.T) {
+	s, path := withHistory(t)
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	running := func(status string) map[string]TunnelStatus {
+		return map[string]TunnelStatus{"abc": {Hash: "abc", Name: "db", Status: status}}
+	}
+
+	s.Record(at(0), running("NORMAL"), nil)
+	s.Record(at(1), running("NORMAL"), nil) // no change
+	s.Record(at(2), running("DEAD"), nil)
+	s.Record(at(3), nil, errors.New("backend down"))
+	s.Record(at(4), map[string]TunnelStatus{}, nil)
+
+	got, err := s.Query("abc", at(1), at(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"NORMAL", "DEAD", statusUnknown, "STOPPED"}
+	if len(got) != len(want) {
+		t.Fatalf("Query = %+v, want statuses %v", got, want)
+	}
+	for i, status := range want {
+		if got[i].Status != status || got[i].Name != "db" {
+			t.Errorf("transition %d = %+v, want %s", i, got[i], status)
+		}
+	}
+	if !got[0].Time.Equal(at(0)) {
+		t.Errorf("first transition at %v, want the one before the window (%v)", got[0].Time, at(0))
+	}
+
+	// Reopening after a gap marks running tunnels UNKNOWN from the last
+	// heartbeat
+	s.Record(at(5), running("NORMAL"), nil)
+	s.Record(at(6), running("NORMAL"), nil) // heartbeat only
+	s.Close()
+	s, err = NewHistoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	got, _ = s.Query("abc", at(5), at(60))
+	if len(got) != 2 || got[1].Status != statusUnknown || !got[1].Time.Equal(at(6)) {
+		t.Errorf("after reopening: %+v", got)
+	}
+
+	// Pruning keeps the state at the cutoff and drops long-gone tunnels
+	s.Record(at(7), map[string]TunnelStatus{
+		"abc": {Hash: "abc", Name: "db", Status: "NORMAL"},
+		"old": {Hash: "old", Name: "retired", Status: "NORMAL"},
+	}, nil)
+	s.Record(at(8), running("NORMAL"), nil)
+	s.mu.Lock()
+	err = s.prune(at(9))
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.Query("abc", at(0), at(60)); len(got) != 1 || got[0].Status != "NORMAL" {
+		t.Errorf("abc after pruning: %+v", got)
+	}
+	if got, _ := s.Query("old", at(0), at(60)); len(got) != 0 {
+		t.Errorf("stopped tunnel kept after pruning: %+v", got)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	s, _ := withHistory(t)
+	now := time.Now()
+	s.Record(now.Add(-2*time.Hour), map[string]TunnelStatus{"abc": {Hash: "abc", Name: "db", Status: "NORMAL"}}, nil)
+	s.Record(now.Add(-30*time.Minute), map[string]TunnelStatus{"abc": {Hash: "abc", Name: "db", Status: "DEAD"}}, nil)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		historyHandler(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	w := get("/api/history/abc?window=1h")
+	var r UptimeReport
+	json.NewDecoder(w.Body).Decode(&r)
+	if w.Code != http.StatusOK || r.Hash != "abc" || r.Name != "db" || r.Uptime == nil || *r.Uptime < 49 || *r.Uptime > 51 {
+		t.Errorf("1h report: %d %+v", w.Code, r)
+	}
+	if r.Failures != 1 || len(r.Segments) != 2 {
+		t.Errorf("1h report: failures %d, segments %+v", r.Failures, r.Segments)
+	}
+
+	if w := get("/api/history/abc?window=soon"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad window: status %d, want 400", w.Code)
+	}
+	history = nil
+	if w := get("/api/history/abc"); w.Code != http.StatusNotFound {
+		t.Errorf("history disabled: status %d, want 404", w.Code)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for in, want := range map[string]time.Duration{"24h": 24 * time.Hour, "7d": 7 * 24 * time.Hour, "90m": 90 * time.Minute} {
+		if got, err := parseWindow(in); err != nil || got != want {
+			t.Errorf("parseWindow(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "0d", "-1h", "week"} {
+		if _, err := parseWindow(in); err == nil {
+			t.Errorf("parseWindow(%q) succeeded", in)
+		}
+	}
+}
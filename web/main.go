@@ -2,19 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
-	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 const (
@@ -27,6 +24,7 @@ var version = "dev"
 var apiBaseURL string
 var apiKey string
 var wsBaseURL string
+var wsAuthMode string
 
 func printBanner() {
 	line1 := fmt.Sprintf("AutoSSH Tunnel Manager  %s", version)
@@ -43,9 +41,7 @@ func printBanner() {
 }
 
 func logMsg(level, component, format string, v ...interface{}) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	msg := fmt.Sprintf(format, v...)
-	fmt.Printf("[%s] [%s] [%s] %s\n", timestamp, level, component, msg)
+	logLine(level, component, fmt.Sprintf(format, v...), nil)
 }
 
 type Language struct {
@@ -55,34 +51,55 @@ type Language struct {
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	logMsg("INFO", "WEB", "GET / from %s", r.RemoteAddr)
-	tmpl := template.Must(template.ParseFiles(filepath.Join(templatesDir, "index.html")))
-	tmpl.Execute(w, nil)
+	renderTemplate(w, http.StatusOK, "index.html", nil)
 }
 
 func helpHandler(w http.ResponseWriter, r *http.Request) {
 	logMsg("INFO", "WEB", "GET /help from %s", r.RemoteAddr)
-	tmpl := template.Must(template.ParseFiles(filepath.Join(templatesDir, "help.html")))
-	tmpl.Execute(w, nil)
+	renderTemplate(w, http.StatusOK, "help.html", nil)
+}
+
+func auditPageHandler(w http.ResponseWriter, r *http.Request) {
+	logMsg("INFO", "WEB", "GET /audit from %s", r.RemoteAddr)
+	renderTemplate(w, http.StatusOK, "audit.html", nil)
 }
 
 func tunnelDetailHandler(w http.ResponseWriter, r *http.Request) {
 	logMsg("INFO", "WEB", "GET /tunnel-detail?%s from %s", r.URL.RawQuery, r.RemoteAddr)
-	tmpl := template.Must(template.ParseFiles(filepath.Join(templatesDir, "tunnel-detail.html")))
-	tmpl.Execute(w, nil)
+	renderTemplate(w, http.StatusOK, "tunnel-detail.html", nil)
 }
 
-// APIConfigResponse contains API configuration for frontend
+// APIConfigResponse contains API configuration for frontend. The backend
+// API key is injected by the proxies and never sent to the browser.
 type APIConfigResponse struct {
-	APIKey    string `json:"api_key,omitempty"`
-	WSEnabled bool   `json:"ws_enabled"`
+	WSEnabled   bool   `json:"ws_enabled"`
+	WSAuthMode  string `json:"ws_auth_mode"`
+	AuthEnabled bool   `json:"auth_enabled"`
+	User        string `json:"user,omitempty"`
+	Role        string `json:"role,omitempty"`
+	AuthSource  string `json:"auth_source,omitempty"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+	History     bool   `json:"history_enabled"`
+	Agents      bool   `json:"agents_enabled"`
+	CSRFToken   string `json:"csrf_token,omitempty"`
 }
 
 // getAPIConfigHandler returns API configuration for frontend
 func getAPIConfigHandler(w http.ResponseWriter, r *http.Request) {
 	logMsg("DEBUG", "WEB", "GET /api/config/api from %s", r.RemoteAddr)
 	config := APIConfigResponse{
-		APIKey:    apiKey,
-		WSEnabled: wsBaseURL != "",
+		WSEnabled:   wsBaseURL != "",
+		WSAuthMode:  wsAuthMode,
+		AuthEnabled: authEnabled(),
+		TOTPEnabled: totp != nil,
+		History:     history != nil,
+		Agents:      tokenStore != nil,
+	}
+	if sess := currentSession(r); sess != nil {
+		config.User = sess.User
+		config.Role = sess.Role
+		config.AuthSource = sess.Source
+		config.CSRFToken = sess.CSRFToken
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(config)
@@ -90,17 +107,13 @@ func getAPIConfigHandler(w http.ResponseWriter, r *http.Request) {
 
 func getLanguagesHandler(w http.ResponseWriter, r *http.Request) {
 	logMsg("DEBUG", "WEB", "GET /api/languages from %s", r.RemoteAddr)
-	localesDir := filepath.Join(staticDir, "locales")
-
-	// Check if locales directory exists
-	if _, err := os.Stat(localesDir); os.IsNotExist(err) {
-		logMsg("ERROR", "WEB", "Locales directory not found: %s", localesDir)
+	// Read directory contents
+	files, err := fs.ReadDir(staticFS, "locales")
+	if errors.Is(err, fs.ErrNotExist) {
+		logMsg("ERROR", "WEB", "Locales directory not found")
 		http.Error(w, "Locales directory not found", http.StatusNotFound)
 		return
 	}
-
-	// Read directory contents
-	files, err := os.ReadDir(localesDir)
 	if err != nil {
 		http.Error(w, "Failed to read locales directory", http.StatusInternalServerError)
 		return
@@ -143,167 +156,308 @@ func getLanguagesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(languages)
 }
 
-// WebSocket upgrader for client connections
-var wsUpgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for now; in production, you may want to restrict this
-		return true
-	},
+// newAPIProxyHandler creates an HTTP reverse proxy that forwards requests
+// from /api/autossh/* (and /api/backends/<default>/autossh/*) to the default
+// backend's autossh API server.
+func newAPIProxyHandler(targetURL string) http.Handler {
+	return newBackendProxyHandler(nil, targetURL, "/api/autossh", "/api/backends/"+defaultBackendName+"/autossh")
 }
 
-// wsProxyHandler proxies WebSocket connections to the backend ws-server
-func wsProxyHandler(w http.ResponseWriter, r *http.Request) {
-	if wsBaseURL == "" {
-		logMsg("ERROR", "WEB", "WebSocket proxy requested but WS_BASE_URL not configured")
-		http.Error(w, "WebSocket not configured", http.StatusServiceUnavailable)
-		return
-	}
-
-	// Extract hash from URL path: /ws/auth/{hash}
-	path := strings.TrimPrefix(r.URL.Path, "/ws/auth/")
-	hash := strings.TrimSuffix(path, "/")
-
-	logMsg("INFO", "WEB", "WebSocket proxy request for hash %s from %s", hash, r.RemoteAddr)
-
-	// Build backend WebSocket URL
-	backendURL, err := url.Parse(wsBaseURL)
-	if err != nil {
-		logMsg("ERROR", "WEB", "Invalid WS_BASE_URL: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	backendURL.Path = "/ws/auth/" + hash
-
-	// Forward query parameters (including token)
-	backendURL.RawQuery = r.URL.RawQuery
-
-	// Upgrade client connection
-	clientConn, err := wsUpgrader.Upgrade(w, r, nil)
+// newBackendProxyHandler creates an HTTP reverse proxy that forwards
+// requests under one of prefixes to the autossh API server at targetURL.
+// A nil b is the default backend, read afresh for every request.
+func newBackendProxyHandler(b *Backend, targetURL string, prefixes ...string) http.Handler {
+	target, err := url.Parse(targetURL)
 	if err != nil {
-		logMsg("ERROR", "WEB", "Failed to upgrade client WebSocket: %v", err)
-		return
-	}
-	defer clientConn.Close()
-
-	// Build headers for backend connection
-	backendHeaders := http.Header{}
-	if auth := r.Header.Get("Authorization"); auth != "" {
-		backendHeaders.Set("Authorization", auth)
+		logMsg("ERROR", "WEB", "Invalid API URL for proxy: %v", err)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeAPIError(w, http.StatusBadGateway, codeProxyMisconfigured, "API proxy misconfigured")
+		})
 	}
-
-	// Connect to backend ws-server
-	backendConn, _, err := websocket.DefaultDialer.Dial(backendURL.String(), backendHeaders)
-	if err != nil {
-		logMsg("ERROR", "WEB", "Failed to connect to backend WebSocket: %v", err)
-		clientConn.WriteMessage(websocket.TextMessage, []byte(`{"type":"status","code":"error","message":"Failed to connect to authentication server"}`))
-		return
+	backend := func() *Backend {
+		if b == nil {
+			return defaultBackend()
+		}
+		return b
 	}
-	defer backendConn.Close()
-
-	logMsg("INFO", "WEB", "WebSocket proxy established for hash %s", hash)
-
-	// Bidirectional proxy
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// Client -> Backend
-	go func() {
-		defer wg.Done()
-		for {
-			messageType, data, err := clientConn.ReadMessage()
-			if err != nil {
-				if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
-					logMsg("DEBUG", "WEB", "Client read error for hash %s: %v", hash, err)
-				}
-				backendConn.Close()
-				return
-			}
-			if err := backendConn.WriteMessage(messageType, data); err != nil {
-				logMsg("DEBUG", "WEB", "Backend write error for hash %s: %v", hash, err)
-				return
+	stripPrefix := func(p string) string {
+		for _, prefix := range prefixes {
+			if p == prefix || strings.HasPrefix(p, prefix+"/") {
+				p = strings.TrimPrefix(p, prefix)
+				break
 			}
 		}
-	}()
-
-	// Backend -> Client
-	go func() {
-		defer wg.Done()
-		for {
-			messageType, data, err := backendConn.ReadMessage()
-			if err != nil {
-				if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
-					logMsg("DEBUG", "WEB", "Backend read error for hash %s: %v", hash, err)
-				}
-				clientConn.Close()
-				return
-			}
-			if err := clientConn.WriteMessage(messageType, data); err != nil {
-				logMsg("DEBUG", "WEB", "Client write error for hash %s: %v", hash, err)
-				return
-			}
+		if p == "" {
+			p = "/"
 		}
-	}()
-
-	wg.Wait()
-	logMsg("INFO", "WEB", "WebSocket proxy closed for hash %s", hash)
-}
-
-// newAPIProxyHandler creates an HTTP reverse proxy that forwards requests
-// from /api/autossh/* to the backend autossh API server.
-func newAPIProxyHandler(targetURL string) http.Handler {
-	target, err := url.Parse(targetURL)
-	if err != nil {
-		logMsg("ERROR", "WEB", "Invalid API_BASE_URL for proxy: %v", err)
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "API proxy misconfigured", http.StatusBadGateway)
-		})
+		return p
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	base := http.DefaultTransport
+	if b != nil && b.transport != nil {
+		base = b.transport
+	}
+	proxy.Transport = &resilientTransport{base: base, backend: backend}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if b == nil {
+			// Silences apply to the tunnels alerts are evaluated for
+			if err := annotateStatus(resp); err != nil {
+				return err
+			}
+		}
+		return rememberResponse(backend().Name, resp)
+	}
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
+		// Strip the panel's prefix
+		req.URL.Path = stripPrefix(req.URL.Path)
+		req.URL.RawPath = ""
 		originalDirector(req)
-		// Strip the /api/autossh prefix
-		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/api/autossh")
-		if req.URL.Path == "" {
-			req.URL.Path = "/"
-		}
 		req.Host = target.Host
+		setTraceHeaders(req.Header, req)
+
+		// The browser authenticates to the panel; the panel authenticates
+		// to the backend with its own key
+		req.Header.Del("Authorization")
+		req.Header.Del("Cookie")
+		req.Header.Del(csrfHeaderName)
+		if key := backend().APIKey; key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		setForwardedIdentity(req.Header, req)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if r.Context().Err() != nil {
+			logMsg("DEBUG", "WEB", "API proxy: %s %s abandoned by the client", r.Method, r.URL.Path)
+			return
+		}
+		name := backend().Name
+		logMsg("ERROR", "WEB", "API proxy: %s %s to backend %s failed: %v", r.Method, r.URL.Path, name, err)
+		// While the backend is down, reads of the tunnel status get the
+		// last answer it gave
+		uri := stripPrefix(r.URL.Path)
+		if r.URL.RawQuery != "" {
+			uri += "?" + r.URL.RawQuery
+		}
+		if r.Method == http.MethodGet && stalePaths[stripPrefix(r.URL.Path)] && serveStale(w, name, uri) {
+			logMsg("WARN", "WEB", "API proxy: served the last known %s of backend %s", uri, name)
+			return
+		}
+		writeProxyError(w, err)
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logMsg("DEBUG", "WEB", "API proxy: %s %s -> %s%s from %s",
-			r.Method, r.URL.Path, targetURL, strings.TrimPrefix(r.URL.Path, "/api/autossh"), r.RemoteAddr)
+		user := "-"
+		if sess := currentSession(r); sess != nil {
+			user = sess.User
+		}
+		backendPath := stripPrefix(r.URL.Path)
+		be := backend()
+		logMsg("DEBUG", "WEB", "API proxy: %s %s -> %s%s from %s (user %s)",
+			r.Method, r.URL.Path, targetURL, backendPath, r.RemoteAddr, user)
+		if !checkAccessOn(w, r, be.tunnels, apiAccessRules, backendPath) {
+			return
+		}
+		if isMutating(r.Method) {
+			serveAudited(proxy, w, r, be, backendPath)
+			return
+		}
 		proxy.ServeHTTP(w, r)
 	})
 }
 
 func main() {
+	// "app hash-password" prints a bcrypt hash for the users file
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		runHashPassword()
+		return
+	}
+
 	// Configure logging to match the unified format
 	// [YYYY-MM-DD HH:MM:SS] [LEVEL] [COMPONENT] Message
 	log.SetFlags(0) // Disable default flags
 	log.SetOutput(os.Stdout)
 
-	printBanner()
+	if err := loadLoggingFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "%v", err)
+		os.Exit(1)
+	}
+	if !logJSON {
+		// Log collectors expect nothing but JSON lines
+		printBanner()
+	}
+
+	if err := loadBasePathFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "%v", err)
+		os.Exit(1)
+	}
+	loadAssetsFromEnv()
+	if err := parseTemplates(); err != nil {
+		logMsg("ERROR", "WEB", "Failed to parse templates: %v", err)
+		os.Exit(1)
+	}
 
 	apiBaseURL = os.Getenv("API_BASE_URL")
 	apiKey = os.Getenv("API_KEY")
 	wsBaseURL = os.Getenv("WS_BASE_URL")
 
+	// "native" uses the ws-server's built-in SSH client for interactive auth,
+	// "pty" (default) drives autossh-cli auth through a terminal
+	wsAuthMode = os.Getenv("WS_AUTH_MODE")
+	if wsAuthMode != "native" {
+		wsAuthMode = "pty"
+	}
+
+	// Further backends; the first becomes the default without API_BASE_URL
+	if err := loadBackendsFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Failed to load backends: %v", err)
+		os.Exit(1)
+	}
+	for _, b := range backendRegistry {
+		logMsg("INFO", "WEB", "Backend %s: %s", b.Name, b.APIURL)
+	}
+
 	if apiKey != "" {
 		logMsg("INFO", "WEB", "API key authentication enabled")
 	}
 
+	// Local accounts for the panel itself
+	if ttl := os.Getenv("WEB_SESSION_TTL"); ttl != "" {
+		if d, err := time.ParseDuration(ttl); err == nil && d > 0 {
+			sessionTTL = d
+		}
+	}
+	cookieSecure = os.Getenv("WEB_COOKIE_SECURE") == "true"
+	if f := os.Getenv("WEB_USERS_FILE"); f != "" {
+		store, err := NewUserStore(f)
+		if err != nil {
+			logMsg("ERROR", "WEB", "Failed to load users file %s: %v", f, err)
+			os.Exit(1)
+		}
+		users = store
+		logMsg("INFO", "WEB", "Login required (session lifetime: %s)", sessionTTL)
+	}
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		provider, err := newOIDCProviderFromEnv(issuer)
+		if err != nil {
+			logMsg("ERROR", "WEB", "OIDC setup failed: %v", err)
+			os.Exit(1)
+		}
+		oidc = provider
+		logMsg("INFO", "WEB", "SSO login enabled, issuer: %s", issuer)
+	}
+	if err := loadProxyAuthFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Trusted proxy setup failed: %v", err)
+		os.Exit(1)
+	}
+	if f := os.Getenv("WEB_TOKENS_FILE"); f != "" {
+		store, err := NewTokenStore(f)
+		if err != nil {
+			logMsg("ERROR", "WEB", "Failed to load tokens file %s: %v", f, err)
+			os.Exit(1)
+		}
+		tokenStore = store
+		logMsg("INFO", "WEB", "API tokens enabled, %d token(s) in %s", len(store.List()), f)
+	}
+	if err := loadTOTPFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "TOTP setup failed: %v", err)
+		os.Exit(1)
+	}
+	if totp != nil {
+		logMsg("INFO", "WEB", "Second factor available for password logins")
+	}
+	if err := loadServerFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "%v", err)
+		os.Exit(1)
+	}
+	if err := loadEventsFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "%v", err)
+		os.Exit(1)
+	}
+	if err := loadHistoryFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Failed to open status history: %v", err)
+		os.Exit(1)
+	}
+	if history != nil {
+		statusHub.Observe(history.Record)
+		logMsg("INFO", "WEB", "Recording tunnel status history (retention %s)", historyRetention)
+	}
+	if err := loadSilencesFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Failed to load silences: %v", err)
+		os.Exit(1)
+	}
+	if err := loadAlertsFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Failed to load alert rules: %v", err)
+		os.Exit(1)
+	}
+	if alerts != nil {
+		statusHub.Observe(alerts.Evaluate)
+		logMsg("INFO", "WEB", "Alerting enabled with %d notifier(s)", len(alerts.notifiers))
+	}
+	loadMetricsFromEnv()
+	if metrics != nil {
+		// After history, so tunnels first seen take their transition time
+		statusHub.Observe(metrics.Observe)
+		logMsg("INFO", "WEB", "Prometheus metrics enabled at /metrics")
+	}
+	if err := loadAgentFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Agent setup failed: %v", err)
+		os.Exit(1)
+	}
+	if agentClient != nil {
+		logMsg("INFO", "WEB", "Agent mode: serving this backend to %s as %s", agentClient.URL, agentClient.Name)
+	}
+	if err := loadTracingFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Tracing setup failed: %v", err)
+		os.Exit(1)
+	}
+	if tracer != nil {
+		logMsg("INFO", "WEB", "Exporting traces to %s as %s", tracer.Endpoint(), tracer.Service())
+	}
+	if err := loadTLSFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "TLS setup failed: %v", err)
+		os.Exit(1)
+	}
+	if err := loadAuditFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Failed to open audit log: %v", err)
+		os.Exit(1)
+	}
+	if err := loadRoleScopesFromEnv(); err != nil {
+		logMsg("ERROR", "WEB", "Invalid WEB_ROLE_SCOPES: %v", err)
+		os.Exit(1)
+	}
+	if proxyAuthEnabled() {
+		logMsg("INFO", "WEB", "Trusting %s from %d proxy network(s)", proxyUserHeader, len(trustedProxies))
+	}
+	if err := checkTokenConfig(); err != nil {
+		logMsg("ERROR", "WEB", "%v", err)
+		os.Exit(1)
+	}
+	if !authEnabled() {
+		logMsg("WARN", "WEB", "None of WEB_USERS_FILE, OIDC_ISSUER or WEB_TRUSTED_PROXIES set, the panel is open to anyone who can reach it")
+	}
+
 	if apiBaseURL == "" {
 		logMsg("WARN", "WEB", "API_BASE_URL not set, API proxy will not work")
 	} else {
 		logMsg("INFO", "WEB", "API proxy enabled, backend URL: %s", apiBaseURL)
 	}
 
+	// Route table for /ws/*; see parseWSRoutes for the format
+	if routes := os.Getenv("WS_PROXY_ROUTES"); routes != "" {
+		wsRoutes = parseWSRoutes(routes)
+	}
+	wsAllowedOrigins = parseAllowedOrigins(os.Getenv("WS_ALLOWED_ORIGINS"))
+	if c := os.Getenv("WS_TOKEN_COOKIE"); c != "" {
+		wsTokenCookie = c
+	}
+
 	if wsBaseURL != "" {
-		logMsg("INFO", "WEB", "WebSocket proxy enabled, backend URL: %s", wsBaseURL)
+		logMsg("INFO", "WEB", "WebSocket proxy enabled, backend URL: %s (auth mode: %s)", wsBaseURL, wsAuthMode)
+		for _, route := range wsRoutes {
+			logMsg("INFO", "WEB", "WebSocket route: %s -> %s", route.Prefix, route.Backend)
+		}
 	} else {
 		logMsg("INFO", "WEB", "WebSocket proxy disabled (WS_BASE_URL not set)")
 	}
@@ -316,27 +470,75 @@ func main() {
 		listenAddr = p
 	}
 
-	fs := http.FileServer(http.Dir(staticDir))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	http.HandleFunc("/static/", staticHandler)
 
 	http.HandleFunc("/", homeHandler)
 	http.HandleFunc("/help", helpHandler)
 	http.HandleFunc("/tunnel-detail", tunnelDetailHandler)
+	http.HandleFunc("/audit", auditPageHandler)
 	http.HandleFunc("/api/languages", getLanguagesHandler)
 	http.HandleFunc("/api/config/api", getAPIConfigHandler)
+	http.HandleFunc("/api/tokens", tokensHandler)
+	http.HandleFunc("/api/tokens/", tokensHandler)
+	http.HandleFunc("/api/audit", auditHandler)
+	http.HandleFunc("/api/events", eventsHandler)
+	http.HandleFunc("/api/history/", historyHandler)
+	http.HandleFunc("/api/alerts", alertsHandler)
+	http.HandleFunc("/api/alerts/", alertsHandler)
+	http.HandleFunc("/api/silences", silencesHandler)
+	http.HandleFunc("/api/silences/", silencesHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/login/totp", loginTOTPHandler)
+	http.HandleFunc("/account/totp", accountTOTPHandler)
+	http.HandleFunc("/auth/login", oidcLoginHandler)
+	http.HandleFunc("/auth/callback", oidcCallbackHandler)
 	if apiBaseURL != "" {
-		http.Handle("/api/autossh/", newAPIProxyHandler(apiBaseURL))
-	} else {
-		http.HandleFunc("/api/autossh/", func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "API_BASE_URL not configured", http.StatusBadGateway)
-		})
+		defaultAPIProxy = newAPIProxyHandler(apiBaseURL)
+	}
+	http.Handle("/api/autossh/", defaultAPIProxy)
+	http.HandleFunc("/api/backends", backendsHandler)
+	http.HandleFunc("/api/backends/", backendsHandler)
+	http.HandleFunc("/api/fleet", fleetHandler)
+	http.HandleFunc("/api/agents", agentsHandler)
+	http.HandleFunc("/api/agents/", agentsHandler)
+	http.HandleFunc("/ws/", wsProxyHandler)
+
+	stopEvents := make(chan struct{})
+	defer close(stopEvents)
+	defer tracer.Flush()
+	go statusHub.Run(stopEvents)
+	if alerts != nil && wsBaseURL != "" {
+		go followReauthEvents(alerts, stopEvents)
+	}
+	if agentClient != nil {
+		go agentClient.Run(stopEvents)
+	}
+	if tracer != nil {
+		go tracer.Run(stopEvents)
 	}
-	http.HandleFunc("/ws/auth/", wsProxyHandler)
 
-	logMsg("INFO", "WEB", "Starting server on %s", listenAddr)
+	server := newHTTPServer(listenAddr, withAccessLog(withHSTS(mountAtBase(requireAuth(http.DefaultServeMux)))))
+	server.TLSConfig = tlsConfig
+	servers := []*http.Server{server}
+	if tlsConfig != nil {
+		logMsg("INFO", "WEB", "Starting HTTPS server on %s", listenAddr)
+	} else {
+		logMsg("INFO", "WEB", "Starting server on %s", listenAddr)
+	}
+	if basePath != "" {
+		logMsg("INFO", "WEB", "Serving the panel under %s/", basePath)
+	}
 	logMsg("INFO", "WEB", "All API requests are proxied through /api/autossh/ to backend")
-	err := http.ListenAndServe(listenAddr, nil)
-	if err != nil {
+	if tlsConfig != nil && httpRedirectAddr != "" {
+		logMsg("INFO", "WEB", "Redirecting HTTP on %s to HTTPS", httpRedirectAddr)
+		servers = append(servers, newHTTPServer(httpRedirectAddr, httpsRedirectHandler(listenAddr)))
+	}
+
+	if err := serveUntilSignal(servers...); err != nil {
 		logMsg("ERROR", "WEB", "Server failed: %v", err)
 		os.Exit(1)
 	}
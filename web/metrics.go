@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelCounters is what TunnelMetrics has seen of one tunnel.
+type tunnelCounters struct {
+	name      string
+	status    string
+	changedAt time.Time // zero until a change is seen or known from history
+	restarts  uint64
+	failures  uint64
+}
+
+// tunnelInfo is the part of a tunnel's configuration exported as labels.
+type tunnelInfo struct {
+	Name        string `json:"name"`
+	Hash        string `json:"hash"`
+	Direction   string `json:"direction"`
+	Interactive bool   `json:"interactive"`
+}
+
+// TunnelMetrics exports tunnel state in the Prometheus text format. It
+// observes the status hub, so restarts and failures are counted between
+// scrapes, and reads the configuration for the direction and interactive
+// labels.
+type TunnelMetrics struct {
+	mu           sync.Mutex
+	tunnels      map[string]*tunnelCounters // by hash
+	statusErrors uint64
+
+	config       []tunnelInfo // last fetched; kept when a fetch fails
+	configAt     time.Time
+	configTook   time.Duration
+	configErr    error
+	configErrors uint64
+}
+
+// metrics is nil unless WEB_METRICS is "true".
+var metrics *TunnelMetrics
+
+// NewTunnelMetrics returns metrics that have seen no polls.
+func NewTunnelMetrics() *TunnelMetrics {
+	return &TunnelMetrics{tunnels: map[string]*tunnelCounters{}}
+}
+
+// Observe is a StatusObserver. Tunnels missing from state are STOPPED. The
+// first poll only records the state; a tunnel first seen in the state the
+// history store has for it takes the time of that transition.
+func (m *TunnelMetrics) Observe(at time.Time, state map[string]TunnelStatus, pollErr error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pollErr != nil {
+		m.statusErrors++
+		return
+	}
+	for hash, t := range state {
+		m.update(hash, t.Name, t.Status, at)
+	}
+	for hash, c := range m.tunnels {
+		if _, ok := state[hash]; !ok {
+			m.update(hash, c.name, "STOPPED", at)
+		}
+	}
+}
+
+// update moves the tunnel with hash to status. Coming up from any other
+// state is a restart; dropping from running into an outage state is a
+// failure. Callers must hold m.mu.
+func (m *TunnelMetrics) update(hash, name, status string, at time.Time) {
+	c, ok := m.tunnels[hash]
+	if !ok {
+		c = &tunnelCounters{name: name, status: status}
+		if history != nil {
+			if t, ok := history.Last(hash); ok && t.Status == status {
+				c.changedAt = t.Time
+			}
+		}
+		m.tunnels[hash] = c
+		return
+	}
+	if name != "" {
+		c.name = name
+	}
+	if c.status == status {
+		return
+	}
+	from, to := statusClass(c.status), statusClass(status)
+	switch {
+	case to == "up" && from != "up":
+		c.restarts++
+	case from == "up" && to == "outage":
+		c.failures++
+	}
+	c.status, c.changedAt = status, at
+}
+
+// refreshConfig fetches the tunnel configuration unless the copy held is
+// younger than the status poll interval.
+func (m *TunnelMetrics) refreshConfig() {
+	m.mu.Lock()
+	fresh := time.Since(m.configAt) < statusPollInterval
+	m.mu.Unlock()
+	if fresh {
+		return
+	}
+
+	var config struct {
+		Tunnels []tunnelInfo `json:"tunnels"`
+	}
+	start := time.Now()
+	err := getBackendJSON("/config", &config)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.configAt = time.Now()
+	m.configTook = m.configAt.Sub(start)
+	if err != nil {
+		if m.configErr == nil {
+			logMsg("WARN", "WEB", "Tunnel configuration fetch for metrics failed: %v", err)
+		}
+		m.configErr = err
+		m.configErrors++
+		return
+	}
+	m.configErr = nil
+	m.config = config.Tunnels
+	// Forget stopped tunnels that were removed from the configuration
+	configured := make(map[string]bool, len(config.Tunnels))
+	for _, t := range config.Tunnels {
+		configured[t.Hash] = true
+	}
+	for hash, c := range m.tunnels {
+		if !configured[hash] && c.status == "STOPPED" {
+			delete(m.tunnels, hash)
+		}
+	}
+}
+
+// metricWriter writes the Prometheus text exposition format.
+type metricWriter struct {
+	strings.Builder
+}
+
+// family starts a metric family.
+func (w *metricWriter) family(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample; labels are name, value pairs.
+func (w *metricWriter) sample(name string, value float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// boolValue is 1 for true and 0 for false.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// render writes every metric as of now. Tunnel state is left out while the
+// status poll is failing, so a broken backend does not read as every
+// tunnel down; autossh_backend_up says why.
+func (m *TunnelMetrics) render(now time.Time) string {
+	polledAt, pollTook, pollErr := statusHub.lastPoll()
+	statusOK := pollErr == nil && !polledAt.IsZero()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Every configured tunnel, plus running ones the configuration does not
+	// list (yet)
+	type row struct {
+		hash string
+		info tunnelInfo
+		c    *tunnelCounters
+	}
+	rows := map[string]*row{}
+	for _, t := range m.config {
+		rows[t.Hash] = &row{hash: t.Hash, info: t}
+	}
+	for hash, c := range m.tunnels {
+		if r, ok := rows[hash]; ok {
+			r.c = c
+		} else if c.status != "STOPPED" {
+			rows[hash] = &row{hash: hash, info: tunnelInfo{Name: c.name, Hash: hash}, c: c}
+		}
+	}
+	list := make([]*row, 0, len(rows))
+	for _, r := range rows {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].info.Name != list[j].info.Name {
+			return list[i].info.Name < list[j].info.Name
+		}
+		return list[i].hash < list[j].hash
+	})
+
+	var w metricWriter
+	w.family("autossh_backend_up", "gauge", "Whether the latest request to the autossh API endpoint succeeded.")
+	w.sample("autossh_backend_up", boolValue(statusOK), "endpoint", "status")
+	w.sample("autossh_backend_up", boolValue(m.configErr == nil && !m.configAt.IsZero()), "endpoint", "config")
+	w.family("autossh_backend_scrape_duration_seconds", "gauge", "How long the latest request to the autossh API endpoint took.")
+	w.sample("autossh_backend_scrape_duration_seconds", pollTook.Seconds(), "endpoint", "status")
+	w.sample("autossh_backend_scrape_duration_seconds", m.configTook.Seconds(), "endpoint", "config")
+	w.family("autossh_backend_scrape_errors_total", "counter", "Failed requests to the autossh API endpoint.")
+	w.sample("autossh_backend_scrape_errors_total", float64(m.statusErrors), "endpoint", "status")
+	w.sample("autossh_backend_scrape_errors_total", float64(m.configErrors), "endpoint", "config")
+
+	status := func(r *row) string {
+		if r.c == nil {
+			return "STOPPED"
+		}
+		return r.c.status
+	}
+	if statusOK {
+		w.family("autossh_tunnel_up", "gauge", "Whether the tunnel is running (NORMAL or RUNNING).")
+		for _, r := range list {
+			interactive := ""
+			if r.info.Direction != "" {
+				interactive = strconv.FormatBool(r.info.Interactive)
+			}
+			w.sample("autossh_tunnel_up", boolValue(statusClass(status(r)) == "up"),
+				"hash", r.hash, "name", r.info.Name, "direction", r.info.Direction, "interactive", interactive)
+		}
+		w.family("autossh_tunnel_status", "gauge", "The tunnel's current status, as reported by autossh-cli.")
+		for _, r := range list {
+			w.sample("autossh_tunnel_status", 1, "hash", r.hash, "name", r.info.Name, "status", status(r))
+		}
+		w.family("autossh_tunnel_last_change_timestamp_seconds", "gauge", "When the tunnel entered its current status, in seconds since the epoch.")
+		for _, r := range list {
+			if r.c != nil && !r.c.changedAt.IsZero() {
+				w.sample("autossh_tunnel_last_change_timestamp_seconds", float64(r.c.changedAt.UnixMilli())/1000, "hash", r.hash, "name", r.info.Name)
+			}
+		}
+		w.family("autossh_tunnel_state_duration_seconds", "gauge", "How long the tunnel has been in its current status.")
+		for _, r := range list {
+			if r.c != nil && !r.c.changedAt.IsZero() {
+				w.sample("autossh_tunnel_state_duration_seconds", now.Sub(r.c.changedAt).Round(time.Millisecond).Seconds(), "hash", r.hash, "name", r.info.Name)
+			}
+		}
+	}
+	w.family("autossh_tunnel_restarts_total", "counter", "Times the tunnel came up after being down or stopped.")
+	for _, r := range list {
+		var n uint64
+		if r.c != nil {
+			n = r.c.restarts
+		}
+		w.sample("autossh_tunnel_restarts_total", float64(n), "hash", r.hash, "name", r.info.Name)
+	}
+	w.family("autossh_tunnel_failures_total", "counter", "Times the tunnel dropped from running into a failed state.")
+	for _, r := range list {
+		var n uint64
+		if r.c != nil {
+			n = r.c.failures
+		}
+		w.sample("autossh_tunnel_failures_total", float64(n), "hash", r.hash, "name", r.info.Name)
+	}
+	return w.String()
+}
+
+// metricsAccessRules covers /metrics.
+var metricsAccessRules = []accessRule{
+	{http.MethodGet, "/metrics", RoleViewer, ScopeRead},
+}
+
+// metricsHandler serves GET /metrics for Prometheus.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if metrics == nil {
+		writeJSONError(w, http.StatusNotFound, "Metrics are not enabled")
+		return
+	}
+	if !checkAccess(w, r, metricsAccessRules, r.URL.Path) {
+		return
+	}
+	// The hub polls on its own once metrics observe it; this only matters
+	// for a scrape racing the first poll
+	statusHub.ensureFresh()
+	metrics.refreshConfig()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(metrics.render(time.Now())))
+}
+
+// loadMetricsFromEnv reads WEB_METRICS.
+func loadMetricsFromEnv() {
+	if os.Getenv("WEB_METRICS") == "true" {
+		metrics = NewTunnelMetrics()
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withMetrics points a fresh hub with metrics observing it at a fake
+// autossh API configured with db (a1) and web (b2).
+func withMetrics(t *testing.T) *fakeStatusAPI {
+	t.Helper()
+	oldMetrics, oldHub, oldBase, oldHistory := metrics, statusHub, apiBaseURL, history
+	t.Cleanup(func() { metrics, statusHub, apiBaseURL, history = oldMetrics, oldHub, oldBase, oldHistory })
+	api := &fakeStatusAPI{}
+	mux := http.NewServeMux()
+	mux.Handle("/status", api)
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"tunnels": [
+			{"name": "db", "hash": "a1", "direction": "local", "interactive": false},
+			{"name": "web", "hash": "b2", "direction": "remote", "interactive": true}
+		]}`))
+	})
+	backend := httptest.NewServer(mux)
+	t.Cleanup(backend.Close)
+	metrics, statusHub, apiBaseURL, history = NewTunnelMetrics(), NewStatusHub(), backend.URL, nil
+	statusHub.Observe(metrics.Observe)
+	return api
+}
+
+func TestMetricsHandler(t *testing.T) {
+	api := withMetrics(t)
+	for _, list := range [][]TunnelStatus{
+		{{Hash: "a1", Name: "db", Status: "NORMAL"}, {Hash: "b2", Name: "web", Status: "STARTING"}},
+		{{Hash: "a1", Name: "db", Status: "DEAD"}, {Hash: "b2", Name: "web", Status: "NORMAL"}},
+		{{Hash: "a1", Name: "db", Status: "NORMAL"}},
+	} {
+		api.set(list...)
+		if err := statusHub.poll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Fatalf("scrape: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		return w.Body.String()
+	}
+	body := scrape()
+	for _, line := range []string{
+		`autossh_backend_up{endpoint="status"} 1`,
+		`autossh_backend_up{endpoint="config"} 1`,
+		`autossh_tunnel_up{hash="a1",name="db",direction="local",interactive="false"} 1`,
+		`autossh_tunnel_up{hash="b2",name="web",direction="remote",interactive="true"} 0`,
+		`autossh_tunnel_status{hash="b2",name="web",status="STOPPED"} 1`,
+		// db failed once and came back; web came up from STARTING
+		`autossh_tunnel_failures_total{hash="a1",name="db"} 1`,
+		`autossh_tunnel_restarts_total{hash="a1",name="db"} 1`,
+		`autossh_tunnel_failures_total{hash="b2",name="web"} 0`,
+		`autossh_tunnel_restarts_total{hash="b2",name="web"} 1`,
+		`# TYPE autossh_tunnel_restarts_total counter`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %s\n%s", line, body)
+		}
+	}
+	if !strings.Contains(body, `autossh_tunnel_last_change_timestamp_seconds{hash="a1",name="db"} `) {
+		t.Errorf("metrics missing db's last change\n%s", body)
+	}
+
+	// Backend gone: tunnel state is withheld, counters stay
+	apiBaseURL = "http://127.0.0.1:1"
+	metrics.configAt = metrics.configAt.AddDate(0, 0, -1)
+	statusHub.poll()
+	body = scrape()
+	for _, line := range []string{
+		`autossh_backend_up{endpoint="status"} 0`,
+		`autossh_backend_up{endpoint="config"} 0`,
+		`autossh_backend_scrape_errors_total{endpoint="status"} 1`,
+		`autossh_tunnel_restarts_total{hash="a1",name="db"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %s\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "autossh_tunnel_up{") {
+		t.Errorf("tunnel_up reported while the backend is down\n%s", body)
+	}
+
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabel = %s", got)
+	}
+}
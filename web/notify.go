@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds one notification attempt.
+var notifyTimeout = 15 * time.Second
+
+// Notifier delivers alert notifications.
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// notifierConfig is one entry under "notifiers" in the alerts file. Type
+// selects which of the other fields apply.
+type notifierConfig struct {
+	Type string `json:"type"` // "webhook", "slack" or "smtp"
+
+	// webhook and slack
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// smtp
+	Addr     string   `json:"addr,omitempty"` // host:port
+	TLS      bool     `json:"tls,omitempty"`  // implicit TLS (port 465); STARTTLS is used when offered
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// expandEnv replaces ${NAME} in the URL, header values and SMTP
+// credentials with the environment variable NAME, so secrets can stay out
+// of the alerts file.
+func (c *notifierConfig) expandEnv() {
+	c.URL = expandEnvRefs(c.URL)
+	if c.Headers != nil {
+		headers := make(map[string]string, len(c.Headers))
+		for k, v := range c.Headers {
+			headers[k] = expandEnvRefs(v)
+		}
+		c.Headers = headers
+	}
+	c.Username, c.Password = expandEnvRefs(c.Username), expandEnvRefs(c.Password)
+}
+
+// newNotifier builds the notifier c describes.
+func newNotifier(c notifierConfig) (Notifier, error) {
+	switch c.Type {
+	case "webhook", "slack":
+		if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+			return nil, fmt.Errorf("%s notifier needs an http(s) url", c.Type)
+		}
+		if c.Type == "slack" {
+			return &slackNotifier{url: c.URL}, nil
+		}
+		return &webhookNotifier{url: c.URL, headers: c.Headers}, nil
+	case "smtp":
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			return nil, fmt.Errorf("smtp notifier needs addr as host:port")
+		}
+		if c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("smtp notifier needs from and to")
+		}
+		return &smtpNotifier{config: c}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+}
+
+// alertSubject is the one-line description of a notification.
+func alertSubject(a Alert) string {
+	return fmt.Sprintf("[%s] %s: %s", strings.ToUpper(a.State), a.displayName(), a.Rule)
+}
+
+// alertText is the plain-text body of a notification.
+func alertText(a Alert) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", a.Summary)
+	fmt.Fprintf(&b, "Tunnel:  %s (%s)\n", a.displayName(), a.Hash)
+	fmt.Fprintf(&b, "Rule:    %s\n", a.Rule)
+	fmt.Fprintf(&b, "Started: %s\n", a.StartsAt.Format(time.RFC3339))
+	if a.EndsAt != nil {
+		fmt.Fprintf(&b, "Ended:   %s (after %s)\n", a.EndsAt.Format(time.RFC3339), a.EndsAt.Sub(a.StartsAt).Round(time.Second))
+	}
+	return b.String()
+}
+
+// postJSON posts v to url and fails on a non-2xx response.
+func postJSON(ctx context.Context, url string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookNotifier posts the alert as JSON.
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, a Alert) error {
+	return postJSON(ctx, n.url, n.headers, a)
+}
+
+// slackNotifier posts a message to a Slack-compatible incoming webhook
+// (Slack, Mattermost, Rocket.Chat).
+type slackNotifier struct {
+	url string
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, a Alert) error {
+	icon := ":red_circle:"
+	if a.State == alertResolved {
+		icon = ":large_green_circle:"
+	}
+	text := fmt.Sprintf("%s *%s*\n%s", icon, alertSubject(a), a.Summary)
+	return postJSON(ctx, n.url, nil, map[string]string{"text": text})
+}
+
+// smtpNotifier sends the alert by mail.
+type smtpNotifier struct {
+	config notifierConfig
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, a Alert) error {
+	c := n.config
+	host, _, _ := net.SplitHostPort(c.Addr)
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if c.TLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", c.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if !c.TLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", alertSubject(a))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(alertText(a), "\n", "\r\n"))
+	if _, err := w.Write([]byte(msg.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDC errors
+var (
+	ErrOIDCState      = errors.New("unknown or expired login state")
+	ErrOIDCToken      = errors.New("invalid ID token")
+	ErrOIDCNoRole     = errors.New("no panel role for this user")
+	ErrOIDCUnknownKey = errors.New("unknown signing key")
+)
+
+// oidcStateCookie holds the state of the SSO login the browser started.
+const oidcStateCookie = "autossh_oidc_state"
+
+// oidcLoginTTL is how long a started SSO login waits for its callback.
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcMaxPending caps the SSO logins waiting for their callback, since
+// anyone can start one. Past it the oldest is dropped.
+var oidcMaxPending = 1000
+
+// pendingLogin is an authorization request waiting for its callback.
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	next     string
+	expires  time.Time
+}
+
+// OIDCProvider performs authorization-code login with PKCE against an
+// OpenID Connect identity provider.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // empty: derived from the request host
+	Scopes       []string
+	UsernameKey  string            // claim holding the user name
+	RoleClaim    string            // claim holding groups/roles; dots descend into objects
+	RoleMap      map[string]string // group -> role; "*" matches everyone
+	DefaultRole  string            // role when RoleMap is empty
+
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+	client        *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	pending map[string]pendingLogin
+}
+
+// oidc is nil when OIDC_ISSUER is unset.
+var oidc *OIDCProvider
+
+// newOIDCProviderFromEnv configures a provider from OIDC_* variables and
+// runs discovery against issuer.
+func newOIDCProviderFromEnv(issuer string) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields("openid profile email"),
+		UsernameKey:  "preferred_username",
+		RoleClaim:    "groups",
+		DefaultRole:  RoleViewer,
+	}
+	if p.ClientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID is required")
+	}
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		p.Scopes = strings.Fields(strings.ReplaceAll(scopes, ",", " "))
+	}
+	if claim := os.Getenv("OIDC_USERNAME_CLAIM"); claim != "" {
+		p.UsernameKey = claim
+	}
+	if claim := os.Getenv("OIDC_ROLE_CLAIM"); claim != "" {
+		p.RoleClaim = claim
+	}
+	if role := os.Getenv("OIDC_DEFAULT_ROLE"); role != "" {
+		if roleRank[role] == 0 {
+			return nil, fmt.Errorf("invalid OIDC_DEFAULT_ROLE %q", role)
+		}
+		p.DefaultRole = role
+	}
+	roleMap, err := parseRoleMap(os.Getenv("OIDC_ROLE_MAP"))
+	if err != nil {
+		return nil, err
+	}
+	p.RoleMap = roleMap
+
+	if err := p.Discover(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseRoleMap parses "group=role,group2=role2".
+func parseRoleMap(spec string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(entry, "=")
+		group, role = strings.TrimSpace(group), strings.TrimSpace(role)
+		if !ok || group == "" || roleRank[role] == 0 {
+			return nil, fmt.Errorf("invalid role mapping %q", entry)
+		}
+		m[group] = role
+	}
+	return m, nil
+}
+
+// Discover loads the provider metadata from the issuer.
+func (p *OIDCProvider) Discover() error {
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	p.pending = make(map[string]pendingLogin)
+
+	var meta struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(wellKnown, &meta); err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	if meta.Issuer != p.Issuer {
+		return fmt.Errorf("discovery: issuer %q does not match %q", meta.Issuer, p.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return errors.New("discovery: incomplete provider metadata")
+	}
+	p.authEndpoint = meta.AuthorizationEndpoint
+	p.tokenEndpoint = meta.TokenEndpoint
+	p.jwksURI = meta.JWKSURI
+	return p.refreshKeys()
+}
+
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// refreshKeys reloads the provider's signing keys.
+func (p *OIDCProvider) refreshKeys() error {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURI, &set); err != nil {
+		return fmt.Errorf("jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	return nil
+}
+
+// key returns the signing key kid, refreshing the key set once if the
+// provider has rotated keys.
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	k, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return k, nil
+	}
+	if err := p.refreshKeys(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, ErrOIDCUnknownKey
+}
+
+// redirectURL returns the callback URL registered with the provider.
+func (p *OIDCProvider) redirectURL(r *http.Request) string {
+	if p.RedirectURL != "" {
+		return p.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + withBase("/auth/callback")
+}
+
+// AuthURL records a pending login and returns the provider URL to send the
+// browser to, and the login's state.
+func (p *OIDCProvider) AuthURL(r *http.Request, next string) (authURL, state string) {
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	challenge := sha256.Sum256([]byte(verifier))
+
+	p.mu.Lock()
+	now := time.Now()
+	oldest := ""
+	for s, pl := range p.pending {
+		if now.After(pl.expires) {
+			delete(p.pending, s)
+		} else if oldest == "" || pl.expires.Before(p.pending[oldest].expires) {
+			oldest = s
+		}
+	}
+	if len(p.pending) >= oidcMaxPending && oldest != "" {
+		delete(p.pending, oldest)
+		logMsg("WARN", "AUTH", "Too many SSO logins waiting for their callback, dropped the oldest")
+	}
+	p.pending[state] = pendingLogin{verifier: verifier, nonce: nonce, next: next, expires: now.Add(oidcLoginTTL)}
+	p.mu.Unlock()
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.redirectURL(r)},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authEndpoint, "?") {
+		sep = "&"
+	}
+	return p.authEndpoint + sep + q.Encode(), state
+}
+
+// OIDCIdentity is the outcome of a successful login.
+type OIDCIdentity struct {
+	User string
+	Role string
+	Next string
+}
+
+// Exchange completes the login for a callback with state and code.
+func (p *OIDCProvider) Exchange(r *http.Request, state, code string) (*OIDCIdentity, error) {
+	p.mu.Lock()
+	pl, ok := p.pending[state]
+	delete(p.pending, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(pl.expires) {
+		return nil, ErrOIDCState
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL(r)},
+		"client_id":     {p.ClientID},
+		"code_verifier": {pl.verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return nil, fmt.Errorf("token request: %s %s %s", resp.Status, tok.Error, tok.ErrorDescription)
+	}
+
+	claims, err := p.verifyIDToken(tok.IDToken, pl.nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	user, _ := claims[p.UsernameKey].(string)
+	if user == "" {
+		user, _ = claims["sub"].(string)
+	}
+	role := p.mapRole(claims)
+	if role == "" {
+		return nil, fmt.Errorf("%w: %s", ErrOIDCNoRole, user)
+	}
+	return &OIDCIdentity{User: user, Role: role, Next: pl.next}, nil
+}
+
+// verifyIDToken checks the signature and standard claims of an ID token.
+func (p *OIDCProvider) verifyIDToken(raw, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrOIDCToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrOIDCToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrOIDCToken
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(header.Alg, key, digest[:], sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrOIDCToken)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrOIDCToken
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q", ErrOIDCToken, iss)
+	}
+	if !audienceContains(claims["aud"], p.ClientID) {
+		return nil, fmt.Errorf("%w: audience", ErrOIDCToken)
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, fmt.Errorf("%w: expired", ErrOIDCToken)
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("%w: nonce", ErrOIDCToken)
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks a SHA-256 JWS signature (RS256 or ES256).
+func verifySignature(alg string, key crypto.PublicKey, digest, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if s, _ := a.(string); s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimValues returns the strings at a dotted claim path, such as "groups"
+// or Keycloak's "realm_access.roles".
+func claimValues(claims map[string]interface{}, path string) []string {
+	var cur interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = obj[key]
+	}
+	switch v := cur.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// mapRole returns the most privileged role the claims map to, or "" if the
+// user is not allowed in.
+func (p *OIDCProvider) mapRole(claims map[string]interface{}) string {
+	return roleForGroups(p.RoleMap, claimValues(claims, p.RoleClaim), p.DefaultRole)
+}
+
+// oidcLoginHandler starts an SSO login.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	next := safeRedirect(r.URL.Query().Get("next"))
+	logMsg("INFO", "AUTH", "Starting SSO login from %s", r.RemoteAddr)
+	authURL, state := oidc.AuthURL(r, next)
+	setOIDCStateCookie(w, r, state)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// setOIDCStateCookie binds a login's state to the browser that started it,
+// so a callback URL cannot be replayed in another browser; "" clears it.
+// Lax, not Strict: the callback is a cross-site navigation from the
+// provider.
+func setOIDCStateCookie(w http.ResponseWriter, r *http.Request, state string) {
+	c := &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     withBase("/auth"),
+		HttpOnly: true,
+		Secure:   cookieSecure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+	}
+	if state == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// oidcCallbackHandler finishes an SSO login and starts a session.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	if errCode := q.Get("error"); errCode != "" {
+		logMsg("WARN", "AUTH", "SSO login failed at provider: %s %s", errCode, q.Get("error_description"))
+		renderLogin(w, http.StatusUnauthorized, newLoginPage(withBase("/"), "sso_failed"))
+		return
+	}
+
+	var id *OIDCIdentity
+	c, err := r.Cookie(oidcStateCookie)
+	setOIDCStateCookie(w, r, "")
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(q.Get("state"))) != 1 {
+		// The login was started in another browser
+		err = fmt.Errorf("%w: not started by this browser", ErrOIDCState)
+	} else {
+		id, err = oidc.Exchange(r, q.Get("state"), q.Get("code"))
+	}
+	if err != nil {
+		logMsg("WARN", "AUTH", "SSO login from %s rejected: %v", r.RemoteAddr, err)
+		reason := "sso_failed"
+		if errors.Is(err, ErrOIDCNoRole) {
+			reason = "sso_forbidden"
+		}
+		renderLogin(w, http.StatusForbidden, newLoginPage(withBase("/"), reason))
+		return
+	}
+
+	sess := sessions.Create(id.User, id.Role, SourceSSO)
+	setSessionCookie(w, r, sess)
+	logMsg("INFO", "AUTH", "User %q logged in via SSO as %s from %s", id.User, id.Role, r.RemoteAddr)
+	http.Redirect(w, r, id.Next, http.StatusSeeOther)
+}
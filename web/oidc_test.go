@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIdP is a stand-in OpenID Connect provider implementing discovery,
+// JWKS, authorization with PKCE and the token endpoint.
+type testIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	user   string
+	groups []string
+
+	mu     sync.Mutex
+	codes  map[string]url.Values // code -> authorization request
+	tamper bool                  // corrupt the ID token signature
+}
+
+func startTestIdP(t *testing.T, user string, groups ...string) *testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	idp := &testIdP{key: key, user: user, groups: groups, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "PKCE required", http.StatusBadRequest)
+			return
+		}
+		code := randomToken()
+		idp.mu.Lock()
+		idp.codes[code] = q
+		idp.mu.Unlock()
+		back, _ := url.Parse(q.Get("redirect_uri"))
+		back.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, back.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		authReq, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != authReq.Get("code_challenge") ||
+			r.PostForm.Get("redirect_uri") != authReq.Get("redirect_uri") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "unused",
+			"token_type":   "Bearer",
+			"id_token":     idp.idToken(t, authReq.Get("client_id"), authReq.Get("nonce")),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdP) idToken(t *testing.T, aud, nonce string) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":                idp.URL,
+		"sub":                "0000-1111",
+		"aud":                aud,
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              nonce,
+		"preferred_username": idp.user,
+		"groups":             idp.groups,
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	if idp.tamper {
+		sig[0] ^= 0xff
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// withOIDC points the panel at idp and serves the gated routes.
+func withOIDC(t *testing.T, idp *testIdP, roleMap string) (*httptest.Server, *http.Client) {
+	t.Helper()
+	oldUsers, oldOIDC := users, oidc
+	t.Cleanup(func() { users, oidc = oldUsers, oldOIDC })
+
+	m, err := parseRoleMap(roleMap)
+	if err != nil {
+		t.Fatalf("parseRoleMap: %v", err)
+	}
+	users = nil
+	oidc = &OIDCProvider{
+		Issuer:      idp.URL,
+		ClientID:    "autossh-panel",
+		Scopes:      []string{"openid"},
+		UsernameKey: "preferred_username",
+		RoleClaim:   "groups",
+		RoleMap:     m,
+		DefaultRole: RoleViewer,
+	}
+	if err := oidc.Discover(); err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "home") })
+	mux.HandleFunc("/api/config/api", getAPIConfigHandler)
+	mux.HandleFunc("/auth/login", oidcLoginHandler)
+	mux.HandleFunc("/auth/callback", oidcCallbackHandler)
+	server := httptest.NewServer(requireAuth(mux))
+	t.Cleanup(server.Close)
+
+	jar, _ := cookiejar.New(nil)
+	return server, &http.Client{Jar: jar}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := startTestIdP(t, "alice", "/tunnel-admins", "staff")
+	server, client := withOIDC(t, idp, "tunnel-admins=admin,staff=viewer")
+
+	// The gated page is unavailable before login
+	resp, err := client.Get(server.URL + "/api/config/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("before login: status %d, want 401", resp.StatusCode)
+	}
+
+	resp, err = client.Get(server.URL + "/auth/login?next=/tunnel-detail?hash=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/tunnel-detail" || resp.Request.URL.Query().Get("hash") != "abc" {
+		t.Errorf("landed on %s, want /tunnel-detail?hash=abc", resp.Request.URL)
+	}
+
+	resp, err = client.Get(server.URL + "/api/config/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var cfg APIConfigResponse
+	json.NewDecoder(resp.Body).Decode(&cfg)
+	if cfg.User != "alice" || cfg.Role != RoleAdmin || cfg.CSRFToken == "" {
+		t.Errorf("config = %+v, want alice as admin with a CSRF token", cfg)
+	}
+}
+
+func TestOIDCLogin_NoMappedRole(t *testing.T) {
+	idp := startTestIdP(t, "mallory", "contractors")
+	server, client := withOIDC(t, idp, "tunnel-admins=admin")
+
+	resp, err := client.Get(server.URL + "/auth/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d, want 403", resp.StatusCode)
+	}
+	if len(sessionCookies(client, server.URL)) != 0 {
+		t.Error("session cookie set for a user without a role")
+	}
+}
+
+func TestOIDCLogin_DefaultRole(t *testing.T) {
+	idp := startTestIdP(t, "bob")
+	server, client := withOIDC(t, idp, "")
+
+	resp, err := client.Get(server.URL + "/auth/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	sess := sessions.Get(sessionCookies(client, server.URL)[0].Value)
+	if sess == nil || sess.User != "bob" || sess.Role != RoleViewer {
+		t.Errorf("session = %+v, want bob as viewer", sess)
+	}
+}
+
+func TestOIDCLogin_BadSignature(t *testing.T) {
+	idp := startTestIdP(t, "alice", "tunnel-admins")
+	idp.tamper = true
+	server, client := withOIDC(t, idp, "tunnel-admins=admin")
+
+	resp, err := client.Get(server.URL + "/auth/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestOIDCProvider_PendingCap(t *testing.T) {
+	idp := startTestIdP(t, "alice", "staff")
+	withOIDC(t, idp, "staff=viewer")
+	old := oidcMaxPending
+	t.Cleanup(func() { oidcMaxPending = old })
+	oidcMaxPending = 3
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/login", nil)
+	var states []string
+	for i := 0; i < 5; i++ {
+		_, state := oidc.AuthURL(r, "/")
+		states = append(states, state)
+	}
+	oidc.mu.Lock()
+	n := len(oidc.pending)
+	_, newest := oidc.pending[states[4]]
+	oidc.mu.Unlock()
+	if n != 3 || !newest {
+		t.Fatalf("%d logins pending, newest kept %v; want the 3 newest", n, newest)
+	}
+	if _, err := oidc.Exchange(r, states[0], "code"); err != ErrOIDCState {
+		t.Errorf("Exchange for a dropped login: %v, want %v", err, ErrOIDCState)
+	}
+
+	// Expired logins make room before anything else is dropped
+	oidc.mu.Lock()
+	for s, pl := range oidc.pending {
+		pl.expires = time.Now().Add(-time.Second)
+		oidc.pending[s] = pl
+	}
+	oidc.mu.Unlock()
+	_, state := oidc.AuthURL(r, "/")
+	oidc.mu.Lock()
+	defer oidc.mu.Unlock()
+	if _, ok := oidc.pending[state]; len(oidc.pending) != 1 || !ok {
+		t.Errorf("%d logins pending after the others expired", len(oidc.pending))
+	}
+}
+
+func TestOIDCCallback_UnknownState(t *testing.T) {
+	idp := startTestIdP(t, "alice", "tunnel-admins")
+	server, client := withOIDC(t, idp, "tunnel-admins=admin")
+
+	resp, err := client.Get(server.URL + "/auth/callback?code=x&state=forged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestOIDCCallback_OtherBrowser(t *testing.T) {
+	idp := startTestIdP(t, "mallory", "tunnel-admins")
+	server, attacker := withOIDC(t, idp, "tunnel-admins=admin")
+
+	// The attacker starts a login and stops before the callback...
+	var callback string
+	attacker.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/auth/callback" {
+			callback = req.URL.String()
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	resp, err := attacker.Get(server.URL + "/auth/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if callback == "" {
+		t.Fatal("the provider did not redirect to the callback")
+	}
+
+	// ...and the victim's browser, which never started it, opens it
+	victim := newJarClient()
+	resp, err = victim.Get(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || len(sessionCookies(victim, server.URL)) != 0 {
+		t.Errorf("callback from another browser: status %d with %d session cookies, want 403 and none",
+			resp.StatusCode, len(sessionCookies(victim, server.URL)))
+	}
+}
+
+func TestClaimValues(t *testing.T) {
+	claims := map[string]interface{}{
+		"groups":       []interface{}{"a", "b", 3},
+		"role":         "ops",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"groups", "a,b"},
+		{"role", "ops"},
+		{"realm_access.roles", "admin"},
+		{"missing", ""},
+		{"role.nested", ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(claimValues(claims, tt.path), ","); got != tt.want {
+			t.Errorf("claimValues(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func sessionCookies(client *http.Client, rawURL string) []*http.Cookie {
+	u, _ := url.Parse(rawURL)
+	var found []*http.Cookie
+	for _, c := range client.Jar.Cookies(u) {
+		if c.Name == sessionCookieName {
+			found = append(found, c)
+		}
+	}
+	return found
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Identity headers the panel sends to the autossh API and ws-server. Copies
+// supplied by clients are always removed first.
+const (
+	forwardedUserHeader = "X-Forwarded-User"
+	forwardedRoleHeader = "X-Forwarded-Role"
+)
+
+// Trusted reverse-proxy authentication (oauth2-proxy, Authelia, ...). The
+// identity headers are only believed from a peer inside trustedProxies.
+var (
+	trustedProxies    []*net.IPNet
+	proxyUserHeader   = "X-Forwarded-User"
+	proxyGroupsHeader = "X-Forwarded-Groups"
+	proxyRoleMap      map[string]string
+	proxyDefaultRole  = RoleViewer
+)
+
+// proxyAuthEnabled reports whether a trusted proxy may authenticate users.
+func proxyAuthEnabled() bool {
+	return len(trustedProxies) > 0
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs or single
+// addresses.
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// loadProxyAuthFromEnv reads the WEB_TRUSTED_PROXIES and WEB_PROXY_*
+// variables.
+func loadProxyAuthFromEnv() error {
+	nets, err := parseTrustedProxies(os.Getenv("WEB_TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+	trustedProxies = nets
+	if h := os.Getenv("WEB_PROXY_USER_HEADER"); h != "" {
+		proxyUserHeader = h
+	}
+	if h := os.Getenv("WEB_PROXY_GROUPS_HEADER"); h != "" {
+		proxyGroupsHeader = h
+	}
+	if role := os.Getenv("WEB_PROXY_DEFAULT_ROLE"); role != "" {
+		if roleRank[role] == 0 {
+			return fmt.Errorf("invalid WEB_PROXY_DEFAULT_ROLE %q", role)
+		}
+		proxyDefaultRole = role
+	}
+	proxyRoleMap, err = parseRoleMap(os.Getenv("WEB_PROXY_ROLE_MAP"))
+	return err
+}
+
+// isTrustedProxy reports whether the direct peer of r is a trusted proxy.
+func isTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ipTrusted(ip)
+}
+
+// ipTrusted reports whether ip is in WEB_TRUSTED_PROXIES.
+func ipTrusted(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyIdentity returns the user and groups asserted by a trusted proxy.
+// ok is false when proxy authentication is off, the peer is not trusted or
+// the proxy sent no user.
+func proxyIdentity(r *http.Request) (user string, groups []string, ok bool) {
+	if !proxyAuthEnabled() || !isTrustedProxy(r) {
+		return "", nil, false
+	}
+	user = strings.TrimSpace(r.Header.Get(proxyUserHeader))
+	if user == "" {
+		return "", nil, false
+	}
+	for _, g := range strings.Split(r.Header.Get(proxyGroupsHeader), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return user, groups, true
+}
+
+// setForwardedIdentity replaces any identity headers in h with the panel
+// user of r, if there is one.
+func setForwardedIdentity(h http.Header, r *http.Request) {
+	h.Del(forwardedUserHeader)
+	h.Del(forwardedRoleHeader)
+	h.Del(proxyUserHeader)
+	h.Del(proxyGroupsHeader)
+	if sess := currentSession(r); sess != nil {
+		h.Set(forwardedUserHeader, sess.User)
+		if sess.Role != "" {
+			h.Set(forwardedRoleHeader, sess.Role)
+		}
+	}
+}
+
+// clientIP returns the address of the client behind any trusted proxies.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(r) {
+		return host
+	}
+	// Walk X-Forwarded-For from the nearest hop, skipping our own proxies
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !ipTrusted(ip) {
+			break
+		}
+	}
+	return host
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+)
+
+// withTrustedProxy serves the gated routes with proxy authentication from
+// trusted and an API backend that records the identity headers it receives.
+func withTrustedProxy(t *testing.T, trusted, roleMap string) (*httptest.Server, *http.Header) {
+	t.Helper()
+	oldUsers, oldOIDC, oldTrusted, oldMap := users, oidc, trustedProxies, proxyRoleMap
+	t.Cleanup(func() { users, oidc, trustedProxies, proxyRoleMap = oldUsers, oldOIDC, oldTrusted, oldMap })
+
+	var err error
+	users, oidc = nil, nil
+	if trustedProxies, err = parseTrustedProxies(trusted); err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+	if proxyRoleMap, err = parseRoleMap(roleMap); err != nil {
+		t.Fatalf("parseRoleMap: %v", err)
+	}
+
+	seen := new(http.Header)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*seen = r.Header.Clone()
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(backend.Close)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/config/api", getAPIConfigHandler)
+	mux.Handle("/api/autossh/", newAPIProxyHandler(backend.URL))
+	server := httptest.NewServer(requireAuth(mux))
+	t.Cleanup(server.Close)
+	return server, seen
+}
+
+func proxiedGet(t *testing.T, client *http.Client, url, user, groups string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if user != "" {
+		req.Header.Set("X-Forwarded-User", user)
+	}
+	if groups != "" {
+		req.Header.Set("X-Forwarded-Groups", groups)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestProxyAuth_TrustedProxy(t *testing.T) {
+	server, seen := withTrustedProxy(t, "127.0.0.0/8,::1", "tunnel-ops=operator,tunnel-admins=admin")
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	resp := proxiedGet(t, client, server.URL+"/api/config/api", "alice", "staff, tunnel-ops")
+	var cfg APIConfigResponse
+	json.NewDecoder(resp.Body).Decode(&cfg)
+	if cfg.User != "alice" || cfg.Role != RoleOperator || cfg.AuthSource != SourceProxy || cfg.CSRFToken == "" {
+		t.Errorf("config = %+v, want alice as operator from the proxy", cfg)
+	}
+
+	resp = proxiedGet(t, client, server.URL+"/api/autossh/status", "alice", "tunnel-ops")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("API status %d, want 200", resp.StatusCode)
+	}
+	if seen.Get("X-Forwarded-User") != "alice" || seen.Get("X-Forwarded-Role") != RoleOperator {
+		t.Errorf("backend saw user %q role %q, want alice operator",
+			seen.Get("X-Forwarded-User"), seen.Get("X-Forwarded-Role"))
+	}
+	if seen.Get("X-Forwarded-Groups") != "" {
+		t.Errorf("backend saw raw groups header %q", seen.Get("X-Forwarded-Groups"))
+	}
+
+	// The session cookie alone does not outlive the proxy's assertion
+	resp = proxiedGet(t, client, server.URL+"/api/config/api", "", "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without proxy header: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestProxyAuth_UntrustedPeer(t *testing.T) {
+	server, _ := withTrustedProxy(t, "10.0.0.0/8", "")
+
+	resp := proxiedGet(t, http.DefaultClient, server.URL+"/api/config/api", "alice", "tunnel-admins")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401 for identity headers from an untrusted peer", resp.StatusCode)
+	}
+}
+
+func TestProxyAuth_NoRole(t *testing.T) {
+	server, _ := withTrustedProxy(t, "127.0.0.1,::1", "tunnel-admins=admin")
+
+	resp := proxiedGet(t, http.DefaultClient, server.URL+"/api/config/api", "mallory", "contractors")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestProxyAuth_ClientHeadersStripped(t *testing.T) {
+	// With no login configured at all, forged identity headers must still
+	// not reach the backend
+	server, seen := withTrustedProxy(t, "", "")
+
+	resp := proxiedGet(t, http.DefaultClient, server.URL+"/api/autossh/status", "admin", "tunnel-admins")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if seen.Get("X-Forwarded-User") != "" || seen.Get("X-Forwarded-Groups") != "" {
+		t.Errorf("backend saw forged identity %q %q", seen.Get("X-Forwarded-User"), seen.Get("X-Forwarded-Groups"))
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := parseTrustedProxies(" 10.0.0.0/8, 192.168.1.5 ,fd00::/8")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+	if len(nets) != 3 || nets[1].String() != "192.168.1.5/32" {
+		t.Errorf("nets = %v", nets)
+	}
+	for _, bad := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded, want error", bad)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API token scopes.
+const (
+	ScopeRead    = "read"
+	ScopeControl = "control"
+	ScopeConfig  = "config"
+	ScopeAuth    = "auth"
+	ScopeAgent   = "agent" // connecting as an agent
+)
+
+// accessRule gives the role a user, or the scope an API token, needs for
+// requests matching Method and Pattern. A "*" segment in Pattern matches a
+// tunnel hash (or hash prefix).
+type accessRule struct {
+	Method  string // "" matches any method
+	Pattern string
+	Role    string
+	Scope   string
+}
+
+// defaultAccessRule applies to requests no rule matches.
+var defaultAccessRule = accessRule{Role: RoleAdmin, Scope: ScopeConfig}
+
+// apiAccessRules covers the autossh API behind /api/autossh. The first
+// matching rule applies.
+var apiAccessRules = []accessRule{
+	{http.MethodGet, "/status", RoleViewer, ScopeRead},
+	{http.MethodGet, "/list", RoleViewer, ScopeRead},
+	{http.MethodGet, "/logs", RoleViewer, ScopeRead},
+	{http.MethodGet, "/logs/*", RoleViewer, ScopeRead},
+	// The panel builds its tunnel list from the configuration
+	{http.MethodGet, "/config", RoleViewer, ScopeRead},
+	{http.MethodGet, "/config/*", RoleViewer, ScopeRead},
+	{"", "/start", RoleOperator, ScopeControl},
+	{"", "/stop", RoleOperator, ScopeControl},
+	{"", "/start/*", RoleOperator, ScopeControl},
+	{"", "/stop/*", RoleOperator, ScopeControl},
+	{"", "/reconnect/*", RoleOperator, ScopeControl},
+}
+
+// wsAccessRules covers the ws-server routes behind /ws.
+var wsAccessRules = []accessRule{
+	{"", "/ws/auth/*", RoleOperator, ScopeAuth},
+	{"", "/ws/events", RoleViewer, ScopeRead},
+}
+
+// roleBelow steps down one privilege level.
+var roleBelow = map[string]string{RoleAdmin: RoleOperator, RoleOperator: RoleViewer}
+
+// roleScopes limits a role to tunnels whose name matches one of its globs.
+// Outside its scope a user keeps only the rights of the next lower role.
+// Roles without an entry apply to every tunnel.
+var roleScopes map[string][]string
+
+// parseRoleScopes parses "role=glob|glob,role=glob".
+func parseRoleScopes(spec string) (map[string][]string, error) {
+	scopes := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		role, globs, ok := strings.Cut(entry, "=")
+		role = strings.TrimSpace(role)
+		if !ok || roleRank[role] == 0 {
+			return nil, fmt.Errorf("invalid role scope %q", entry)
+		}
+		patterns, err := parseTunnelGlobs(strings.Split(globs, "|"))
+		if err != nil {
+			return nil, err
+		}
+		scopes[role] = append(scopes[role], patterns...)
+	}
+	return scopes, nil
+}
+
+// parseTunnelGlobs trims and validates tunnel name patterns.
+func parseTunnelGlobs(globs []string) ([]string, error) {
+	var patterns []string
+	for _, glob := range globs {
+		glob = strings.TrimSpace(glob)
+		if _, err := path.Match(glob, ""); err != nil || glob == "" {
+			return nil, fmt.Errorf("invalid tunnel pattern %q", glob)
+		}
+		patterns = append(patterns, glob)
+	}
+	return patterns, nil
+}
+
+// matchRule returns the rule for method and path, and the tunnel hash the
+// request is about ("" for requests not about one tunnel).
+func matchRule(rules []accessRule, method, urlPath string) (rule accessRule, hash string) {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	segments := strings.Split(strings.TrimSuffix(urlPath, "/"), "/")
+	for _, rule := range rules {
+		if rule.Method != "" && rule.Method != method {
+			continue
+		}
+		pattern := strings.Split(rule.Pattern, "/")
+		if len(pattern) != len(segments) {
+			continue
+		}
+		matched, captured := true, ""
+		for i, p := range pattern {
+			if p == "*" && segments[i] != "" {
+				captured = segments[i]
+			} else if p != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule, captured
+		}
+	}
+	return defaultAccessRule, ""
+}
+
+// effectiveRole returns the role a user holding role has for the tunnel
+// with hash in dir, after applying roleScopes.
+func effectiveRole(dir *TunnelDirectory, role, hash string) string {
+	for role != "" {
+		globs, scoped := roleScopes[role]
+		if !scoped {
+			return role
+		}
+		if hash != "" && dir.Matches(hash, globs) {
+			return role
+		}
+		role = roleBelow[role]
+	}
+	return ""
+}
+
+// allowed reports whether sess may make the request described by method
+// and path under rules, resolving tunnel hashes in dir.
+func allowed(dir *TunnelDirectory, sess *Session, rules []accessRule, method, urlPath string) bool {
+	rule, hash := matchRule(rules, method, urlPath)
+	if sess.Token != nil {
+		return sess.Token.Allows(dir, rule, hash)
+	}
+	if hash == "" && rule.Role == RoleViewer {
+		// Scopes restrict actions on single tunnels; lists stay visible
+		return roleRank[sess.Role] > 0
+	}
+	return roleRank[effectiveRole(dir, sess.Role, hash)] >= roleRank[rule.Role]
+}
+
+// Matches reports whether the tunnel with hash has a name matching one of
+// globs.
+func (d *TunnelDirectory) Matches(hash string, globs []string) bool {
+	name, ok := d.Name(hash)
+	if !ok {
+		return false
+	}
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess enforces rules for the logged-in user and writes 403 when the
+// request is not allowed. Without login everything is allowed, except to
+// API tokens, which keep to their scopes.
+func checkAccess(w http.ResponseWriter, r *http.Request, rules []accessRule, urlPath string) bool {
+	return checkAccessOn(w, r, tunnels, rules, urlPath)
+}
+
+// checkAccessOn is checkAccess for a request about the tunnels in dir;
+// checkAccess resolves hashes against the default backend.
+func checkAccessOn(w http.ResponseWriter, r *http.Request, dir *TunnelDirectory, rules []accessRule, urlPath string) bool {
+	sess := currentSession(r)
+	if !authEnabled() && (sess == nil || sess.Token == nil) {
+		return true
+	}
+	if sess == nil {
+		writeJSONError(w, http.StatusUnauthorized, "Login required")
+		return false
+	}
+	if !allowed(dir, sess, rules, r.Method, urlPath) {
+		logMsg("WARN", "AUTH", "Denied %s %s to user %q (%s)", r.Method, urlPath, sess.User, sess.Role)
+		writeJSONError(w, http.StatusForbidden, "Permission denied")
+		return false
+	}
+	return true
+}
+
+// TunnelDirectory maps tunnel hashes to names for scoped roles. It reads
+// the configuration from the autossh API and caches it briefly.
+type TunnelDirectory struct {
+	fetch func(path string, v interface{}) error // nil reads the default backend
+
+	mu      sync.Mutex
+	names   map[string]string // hash -> name
+	fetched time.Time
+}
+
+// Global tunnel directory
+var tunnels = &TunnelDirectory{}
+
+// tunnelCacheTTL bounds how stale the hash-to-name mapping may be.
+const tunnelCacheTTL = 30 * time.Second
+
+// Name returns the name of the tunnel with hash or a unique hash prefix.
+func (d *TunnelDirectory) Name(hash string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	name, ok := d.lookup(hash)
+	// Refresh when stale, or on a miss that a new tunnel could explain
+	if time.Since(d.fetched) > tunnelCacheTTL || (!ok && time.Since(d.fetched) > 2*time.Second) {
+		if err := d.refresh(); err != nil {
+			logMsg("ERROR", "AUTH", "Failed to load tunnel names: %v", err)
+		}
+		name, ok = d.lookup(hash)
+	}
+	return name, ok
+}
+
+// lookup resolves hash against the cached names. Callers must hold d.mu.
+func (d *TunnelDirectory) lookup(hash string) (string, bool) {
+	if name, ok := d.names[hash]; ok {
+		return name, true
+	}
+	found, name := 0, ""
+	for h, n := range d.names {
+		if strings.HasPrefix(h, hash) {
+			found, name = found+1, n
+		}
+	}
+	return name, found == 1
+}
+
+// refresh reloads the names from the autossh API. Callers must hold d.mu.
+func (d *TunnelDirectory) refresh() error {
+	d.fetched = time.Now()
+	var config struct {
+		Tunnels []struct {
+			Name string `json:"name"`
+			Hash string `json:"hash"`
+		} `json:"tunnels"`
+	}
+	fetch := d.fetch
+	if fetch == nil {
+		fetch = getBackendJSON
+	}
+	if err := fetch("/config", &config); err != nil {
+		return err
+	}
+	names := make(map[string]string, len(config.Tunnels))
+	for _, t := range config.Tunnels {
+		names[t.Hash] = t.Name
+	}
+	d.names = names
+	return nil
+}
+
+// loadRoleScopesFromEnv reads WEB_ROLE_SCOPES.
+func loadRoleScopesFromEnv() error {
+	scopes, err := parseRoleScopes(os.Getenv("WEB_ROLE_SCOPES"))
+	if err != nil {
+		return err
+	}
+	roleScopes = scopes
+	return nil
+}
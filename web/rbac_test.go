@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// withTunnels fills the tunnel directory with hash -> name entries.
+func withTunnels(t *testing.T, names map[string]string) {
+	t.Helper()
+	old := tunnels
+	t.Cleanup(func() { tunnels = old })
+	tunnels = &TunnelDirectory{names: names, fetched: time.Now().Add(time.Hour)}
+}
+
+func withRoleScopes(t *testing.T, spec string) {
+	t.Helper()
+	old := roleScopes
+	t.Cleanup(func() { roleScopes = old })
+	scopes, err := parseRoleScopes(spec)
+	if err != nil {
+		t.Fatalf("parseRoleScopes: %v", err)
+	}
+	roleScopes = scopes
+}
+
+func TestMatchRule(t *testing.T) {
+	tests := []struct {
+		method, path string
+		role, hash   string
+	}{
+		{"GET", "/status", RoleViewer, ""},
+		{"HEAD", "/logs/abc", RoleViewer, "abc"},
+		{"GET", "/config", RoleViewer, ""},
+		{"POST", "/config", RoleAdmin, ""},
+		{"GET", "/config/abc", RoleViewer, "abc"},
+		{"PUT", "/config/abc", RoleAdmin, ""},
+		{"POST", "/config/abc/delete", RoleAdmin, ""},
+		{"POST", "/config/new", RoleAdmin, ""},
+		{"POST", "/stop", RoleOperator, ""},
+		{"POST", "/stop/abc", RoleOperator, "abc"},
+		{"POST", "/reconnect/abc/", RoleOperator, "abc"},
+		{"POST", "/unknown", RoleAdmin, ""},
+	}
+	for _, tt := range tests {
+		rule, hash := matchRule(apiAccessRules, tt.method, tt.path)
+		if rule.Role != tt.role || hash != tt.hash {
+			t.Errorf("matchRule(%s %s) = %s %q, want %s %q", tt.method, tt.path, rule.Role, hash, tt.role, tt.hash)
+		}
+	}
+}
+
+func TestAllowed_Scopes(t *testing.T) {
+	withTunnels(t, map[string]string{"aaaa1111": "dev-db", "bbbb2222": "prod-db"})
+	withRoleScopes(t, "operator=dev-*,admin=dev-*|lab-*")
+
+	operator := &Session{User: "o", Role: RoleOperator}
+	admin := &Session{User: "a", Role: RoleAdmin}
+	tests := []struct {
+		sess         *Session
+		method, path string
+		want         bool
+	}{
+		{operator, "POST", "/stop/aaaa1111", true},
+		{operator, "POST", "/stop/aaaa", true}, // hash prefix
+		{operator, "POST", "/stop/bbbb2222", false},
+		{operator, "GET", "/logs/bbbb2222", true}, // still a viewer there
+		{operator, "GET", "/status", true},
+		{operator, "POST", "/stop", false}, // all tunnels is out of scope
+		{admin, "PUT", "/config/aaaa1111", false},
+		{admin, "POST", "/start/bbbb2222", false}, // falls through to scoped operator
+		{admin, "POST", "/config/new", false},
+	}
+	for _, tt := range tests {
+		if got := allowed(tunnels, tt.sess, apiAccessRules, tt.method, tt.path); got != tt.want {
+			t.Errorf("allowed(%s, %s %s) = %v, want %v", tt.sess.Role, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseRoleScopes_Invalid(t *testing.T) {
+	for _, spec := range []string{"owner=dev-*", "operator", "operator=", "operator=[dev"} {
+		if _, err := parseRoleScopes(spec); err == nil {
+			t.Errorf("parseRoleScopes(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestAPIProxy_EnforcesRoles(t *testing.T) {
+	// A trusted proxy range nobody connects from turns login on
+	server, _ := withTrustedProxy(t, "10.255.255.255", "")
+	withRoleScopes(t, "")
+
+	tests := []struct {
+		role, method, path string
+		want               int
+	}{
+		{RoleViewer, "GET", "/api/autossh/status", http.StatusOK},
+		{RoleViewer, "POST", "/api/autossh/stop/abc", http.StatusForbidden},
+		{RoleOperator, "POST", "/api/autossh/stop/abc", http.StatusOK},
+		{RoleOperator, "POST", "/api/autossh/config/abc/delete", http.StatusForbidden},
+		{RoleAdmin, "POST", "/api/autossh/config/abc/delete", http.StatusOK},
+	}
+	for _, tt := range tests {
+		sess := sessions.Create("u", tt.role, SourcePassword)
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.ID})
+		req.Header.Set(csrfHeaderName, sess.CSRFToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s %s: status %d, want %d", tt.role, tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestWSProxy_EnforcesRoles(t *testing.T) {
+	withTrustedProxy(t, "10.255.255.255", "")
+	oldBase := wsBaseURL
+	t.Cleanup(func() { wsBaseURL = oldBase })
+	wsBaseURL = "ws://127.0.0.1:1"
+
+	sess := sessions.Create("v", RoleViewer, SourcePassword)
+	r := httptest.NewRequest("GET", "/ws/auth/abc", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.ID})
+	w := httptest.NewRecorder()
+	wsProxyHandler(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("viewer on /ws/auth: status %d, want 403", w.Code)
+	}
+}
+
+func TestUserStore_Roles(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	path := filepath.Join(t.TempDir(), "users")
+	content := "alice:" + string(hash) + "\n" +
+		"bob:" + string(hash) + ":viewer\n" +
+		"eve:" + string(hash) + ":root\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewUserStore(path)
+	if err != nil {
+		t.Fatalf("NewUserStore: %v", err)
+	}
+
+	for user, want := range map[string]string{"alice": RoleAdmin, "bob": RoleViewer} {
+		if role, ok := store.Authenticate(user, "pw"); !ok || role != want {
+			t.Errorf("Authenticate(%s) = %q %v, want %q", user, role, ok, want)
+		}
+	}
+	if _, ok := store.Authenticate("eve", "pw"); ok {
+		t.Error("user with an unknown role was accepted")
+	}
+	if _, ok := store.Authenticate("bob", "wrong"); ok {
+		t.Error("wrong password was accepted")
+	}
+}
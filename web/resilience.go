@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// API proxy resilience tuning
+var (
+	proxyRetries      = 2                      // extra attempts for idempotent requests
+	proxyRetryBackoff = 250 * time.Millisecond // doubled after each attempt
+	breakerThreshold  = 5                      // failed requests in a row that open the circuit
+	breakerCooldown   = 30 * time.Second       // how long an open circuit fails fast
+)
+
+// Stable codes for proxy errors, for clients to act on and the UI to
+// translate.
+const (
+	codeBackendUnreachable   = "backend_unreachable"
+	codeBackendTimeout       = "backend_timeout"
+	codeCircuitOpen          = "circuit_open"
+	codeBackendNotConfigured = "backend_not_configured"
+	codeProxyMisconfigured   = "proxy_misconfigured"
+)
+
+// staleHeader marks a response served from the last known good copy; its
+// value is when that copy was fetched.
+const staleHeader = "X-Autossh-Stale"
+
+// stalePaths are the backend API reads kept for when the backend is down.
+var stalePaths = map[string]bool{"/status": true, "/list": true}
+
+// errCircuitOpen is returned without contacting a backend whose circuit is
+// open.
+type errCircuitOpen struct {
+	backend    string
+	retryAfter time.Duration
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("backend %s failed repeatedly; not retrying for %s", e.backend, e.retryAfter.Round(time.Second))
+}
+
+// circuitBreaker stops requests to a backend that keeps failing. After
+// breakerThreshold failures in a row it opens for breakerCooldown; then a
+// single request is let through and its outcome closes or reopens it.
+type circuitBreaker struct {
+	name string
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// breakers holds one circuit breaker per backend name.
+var breakers = struct {
+	sync.Mutex
+	m map[string]*circuitBreaker
+}{m: map[string]*circuitBreaker{}}
+
+func breakerFor(name string) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	cb, ok := breakers.m[name]
+	if !ok {
+		cb = &circuitBreaker{name: name}
+		breakers.m[name] = cb
+	}
+	return cb
+}
+
+// Allow reports whether a request may go to the backend now, and if not,
+// how long until it may.
+func (cb *circuitBreaker) Allow() (bool, time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.openUntil.IsZero() {
+		return true, 0
+	}
+	if wait := time.Until(cb.openUntil); wait > 0 {
+		return false, wait
+	}
+	if cb.probing {
+		return false, time.Second
+	}
+	cb.probing = true
+	return true, 0
+}
+
+// Record counts the outcome of a request that Allow let through.
+func (cb *circuitBreaker) Record(ok bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	wasOpen := !cb.openUntil.IsZero()
+	cb.probing = false
+	if ok {
+		if wasOpen {
+			logMsg("INFO", "WEB", "Backend %s is answering again; circuit closed", cb.name)
+		}
+		cb.failures, cb.openUntil = 0, time.Time{}
+		return
+	}
+	cb.failures++
+	if wasOpen || cb.failures >= breakerThreshold {
+		if !wasOpen {
+			logMsg("WARN", "WEB", "Backend %s failed %d requests in a row; circuit open for %s", cb.name, cb.failures, breakerCooldown)
+		}
+		cb.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+// Release gives up a request Allow let through without counting it.
+func (cb *circuitBreaker) Release() {
+	cb.mu.Lock()
+	cb.probing = false
+	cb.mu.Unlock()
+}
+
+// resilientTransport retries idempotent requests that fail to reach the
+// backend and consults the backend's circuit breaker.
+type resilientTransport struct {
+	base    http.RoundTripper
+	backend func() *Backend
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cb := breakerFor(t.backend().Name)
+	if ok, wait := cb.Allow(); !ok {
+		return nil, &errCircuitOpen{backend: cb.name, retryAfter: wait}
+	}
+	attempts := 1
+	if isSafeMethod(req.Method) && (req.Body == nil || req.Body == http.NoBody) {
+		attempts += proxyRetries
+	}
+	backoff := proxyRetryBackoff
+	for i := 1; ; i++ {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil && !isGatewayError(resp.StatusCode) {
+			cb.Record(true)
+			return resp, nil
+		}
+		if i >= attempts || req.Context().Err() != nil {
+			if req.Context().Err() != nil {
+				// A client that went away says nothing about the backend
+				cb.Release()
+			} else {
+				cb.Record(false)
+			}
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		logMsg("DEBUG", "WEB", "API proxy: retrying %s %s on backend %s (attempt %d failed)", req.Method, req.URL.Path, cb.name, i)
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+		}
+		backoff *= 2
+	}
+}
+
+// isGatewayError reports whether status means the backend, or something in
+// front of it, is unavailable.
+func isGatewayError(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// staleEntry is the last good response to a read in stalePaths.
+type staleEntry struct {
+	body        []byte
+	contentType string
+	fetched     time.Time
+}
+
+// staleCache keeps staleEntry values by backend and path.
+var staleCache = struct {
+	sync.Mutex
+	m map[string]staleEntry
+}{m: map[string]staleEntry{}}
+
+// rememberResponse keeps a copy of a good response to a read in stalePaths.
+func rememberResponse(backend string, resp *http.Response) error {
+	req := resp.Request
+	if req.Method != http.MethodGet || !stalePaths[req.URL.Path] || resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	staleCache.Lock()
+	staleCache.m[backend+" "+req.URL.RequestURI()] = staleEntry{body, resp.Header.Get("Content-Type"), time.Now()}
+	staleCache.Unlock()
+	return nil
+}
+
+// serveStale answers a read with its last good copy, if there is one.
+func serveStale(w http.ResponseWriter, backend, uri string) bool {
+	staleCache.Lock()
+	entry, ok := staleCache.m[backend+" "+uri]
+	staleCache.Unlock()
+	if !ok {
+		return false
+	}
+	if entry.contentType != "" {
+		w.Header().Set("Content-Type", entry.contentType)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.fetched).Seconds())))
+	w.Header().Set(staleHeader, entry.fetched.UTC().Format(time.RFC3339))
+	w.Write(entry.body)
+	return true
+}
+
+// writeProxyError answers a request the backend could not serve.
+func writeProxyError(w http.ResponseWriter, err error) {
+	var open *errCircuitOpen
+	var netErr net.Error
+	switch {
+	case errors.As(err, &open):
+		w.Header().Set("Retry-After", strconv.Itoa(int(open.retryAfter.Seconds())+1))
+		writeAPIError(w, http.StatusServiceUnavailable, codeCircuitOpen, "The autossh API failed repeatedly; requests are paused")
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		writeAPIError(w, http.StatusGatewayTimeout, codeBackendTimeout, "The autossh API did not answer in time")
+	default:
+		writeAPIError(w, http.StatusBadGateway, codeBackendUnreachable, "The autossh API is unreachable")
+	}
+}
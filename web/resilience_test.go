@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withResilience gives the test fresh circuit breakers and stale copies,
+// with short retry and cooldown times.
+func withResilience(t *testing.T) {
+	t.Helper()
+	oldRetries, oldBackoff, oldThreshold, oldCooldown := proxyRetries, proxyRetryBackoff, breakerThreshold, breakerCooldown
+	t.Cleanup(func() {
+		proxyRetries, proxyRetryBackoff, breakerThreshold, breakerCooldown = oldRetries, oldBackoff, oldThreshold, oldCooldown
+	})
+	proxyRetries, proxyRetryBackoff, breakerThreshold, breakerCooldown = 2, time.Millisecond, 3, 200*time.Millisecond
+	reset := func() {
+		breakers.Lock()
+		breakers.m = map[string]*circuitBreaker{}
+		breakers.Unlock()
+		staleCache.Lock()
+		staleCache.m = map[string]staleEntry{}
+		staleCache.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// flakyBackend answers according to mode: "ok", "busy" (503) or "down"
+// (the connection is dropped). It counts the requests under test; the
+// panel itself may read /status and /config in the background.
+type flakyBackend struct {
+	mode atomic.Value
+	hits atomic.Int32
+}
+
+func (f *flakyBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/status" && r.URL.Path != "/config" {
+		f.hits.Add(1)
+	}
+	switch f.mode.Load() {
+	case "busy":
+		writeJSONError(w, http.StatusServiceUnavailable, "Server busy, please retry")
+	case "down":
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"hash":"h1","name":"db","status":"NORMAL"}]`))
+	}
+}
+
+func TestAPIProxy_Resilience(t *testing.T) {
+	withResilience(t)
+	backend := &flakyBackend{}
+	backend.mode.Store("ok")
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+	oldBase := apiBaseURL
+	t.Cleanup(func() { apiBaseURL = oldBase })
+	apiBaseURL = server.URL
+	proxy := httptest.NewServer(newAPIProxyHandler(server.URL))
+	t.Cleanup(proxy.Close)
+
+	call := func(method, path string) (*http.Response, map[string]string) {
+		req, _ := http.NewRequest(method, proxy.URL+"/api/autossh"+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		var fields map[string]string
+		json.Unmarshal(body, &fields)
+		return resp, fields
+	}
+
+	// A good /status is kept
+	if resp, _ := call("GET", "/status"); resp.StatusCode != http.StatusOK || resp.Header.Get(staleHeader) != "" {
+		t.Fatalf("GET /status = %d", resp.StatusCode)
+	}
+
+	// Reads are retried while the backend is busy; writes are not
+	backend.mode.Store("busy")
+	backend.hits.Store(0)
+	if resp, _ := call("GET", "/logs/h1"); resp.StatusCode != http.StatusServiceUnavailable || backend.hits.Load() != 3 {
+		t.Errorf("busy GET: status %d after %d attempts, want 503 after 3", resp.StatusCode, backend.hits.Load())
+	}
+	backend.mode.Store("ok")
+	backend.hits.Store(0)
+	if resp, _ := call("POST", "/start/h1"); resp.StatusCode != http.StatusOK || backend.hits.Load() != 1 {
+		t.Errorf("POST after busy: status %d after %d attempts", resp.StatusCode, backend.hits.Load())
+	}
+
+	// While the backend is down, /status comes from the last good copy and
+	// everything else gets a coded error
+	backend.mode.Store("down")
+	resp, _ := call("GET", "/status")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(staleHeader) == "" {
+		t.Errorf("GET /status while down = %d, stale %q", resp.StatusCode, resp.Header.Get(staleHeader))
+	}
+	resp, fields := call("GET", "/logs/h1")
+	if resp.StatusCode != http.StatusBadGateway || fields["code"] != codeBackendUnreachable {
+		t.Errorf("GET /logs while down = %d %v", resp.StatusCode, fields)
+	}
+
+	// After breakerThreshold failures the circuit opens and requests fail
+	// fast without reaching the backend
+	call("POST", "/stop/h1")
+	backend.hits.Store(0)
+	resp, fields = call("POST", "/stop/h1")
+	if resp.StatusCode != http.StatusServiceUnavailable || fields["code"] != codeCircuitOpen ||
+		resp.Header.Get("Retry-After") == "" || backend.hits.Load() != 0 {
+		t.Errorf("open circuit: %d %v, Retry-After %q, %d backend hits", resp.StatusCode, fields,
+			resp.Header.Get("Retry-After"), backend.hits.Load())
+	}
+
+	// Once the cooldown is over a request goes through and closes it
+	backend.mode.Store("ok")
+	time.Sleep(breakerCooldown)
+	if resp, _ := call("GET", "/config"); resp.StatusCode != http.StatusOK {
+		t.Errorf("after cooldown: %d", resp.StatusCode)
+	}
+	if resp, _ := call("GET", "/status"); resp.StatusCode != http.StatusOK || resp.Header.Get(staleHeader) != "" {
+		t.Errorf("GET /status after recovery: %d, stale %q", resp.StatusCode, resp.Header.Get(staleHeader))
+	}
+}
+
+func TestAPIProxy_NotConfigured(t *testing.T) {
+	rec := httptest.NewRecorder()
+	defaultAPIProxy.ServeHTTP(rec, httptest.NewRequest("GET", "/api/autossh/status", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"code":"`+codeBackendNotConfigured+`"`) {
+		t.Errorf("unconfigured proxy = %d %s", rec.Code, rec.Body.String())
+	}
+}
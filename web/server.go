@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HTTP server timeouts. WebSocket connections clear the read and write
+// deadlines once upgraded, so only the handshake is bound by them.
+var (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 60 * time.Second
+	idleTimeout       = 120 * time.Second
+	shutdownTimeout   = 8 * time.Second // within Docker's default 10s stop timeout
+)
+
+// loadServerFromEnv reads the timeouts from WEB_READ_TIMEOUT,
+// WEB_WRITE_TIMEOUT, WEB_IDLE_TIMEOUT and WEB_SHUTDOWN_TIMEOUT.
+func loadServerFromEnv() error {
+	for _, setting := range []struct {
+		env string
+		v   *time.Duration
+	}{
+		{"WEB_READ_TIMEOUT", &readTimeout},
+		{"WEB_WRITE_TIMEOUT", &writeTimeout},
+		{"WEB_IDLE_TIMEOUT", &idleTimeout},
+		{"WEB_SHUTDOWN_TIMEOUT", &shutdownTimeout},
+	} {
+		s := os.Getenv(setting.env)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %q", setting.env, s)
+		}
+		*setting.v = d
+	}
+	return nil
+}
+
+// newHTTPServer returns a server for handler with the configured timeouts.
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// wsProxy is one proxied WebSocket: the browser side and the ws-server side.
+type wsProxy struct {
+	client, backend *websocket.Conn
+}
+
+// wsProxyTracker records active WebSocket proxies. http.Server.Shutdown
+// does not wait for hijacked connections, so shutdown closes them here.
+type wsProxyTracker struct {
+	mu      sync.Mutex
+	proxies map[*wsProxy]struct{}
+	closing bool
+	wg      sync.WaitGroup
+}
+
+var activeWSProxies = &wsProxyTracker{proxies: map[*wsProxy]struct{}{}}
+
+// add registers p, or reports false if the server is shutting down.
+func (t *wsProxyTracker) add(p *wsProxy) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closing {
+		return false
+	}
+	t.proxies[p] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+// remove unregisters p when its proxy loop has ended.
+func (t *wsProxyTracker) remove(p *wsProxy) {
+	t.mu.Lock()
+	delete(t.proxies, p)
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// shutdown refuses new proxies, sends a "going away" close frame to both
+// ends of every active one and waits for them to finish. Proxies still open
+// when ctx is done are closed outright.
+func (t *wsProxyTracker) shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.closing = true
+	proxies := make([]*wsProxy, 0, len(t.proxies))
+	for p := range t.proxies {
+		proxies = append(proxies, p)
+	}
+	t.mu.Unlock()
+
+	if len(proxies) > 0 {
+		logMsg("INFO", "WEB", "Closing %d WebSocket proxy connection(s)", len(proxies))
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(time.Second)
+	for _, p := range proxies {
+		p.client.WriteControl(websocket.CloseMessage, msg, deadline)
+		p.backend.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		t.mu.Lock()
+		for p := range t.proxies {
+			p.client.Close()
+			p.backend.Close()
+		}
+		t.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// serveUntilSignal runs servers until one fails or SIGTERM/SIGINT arrives,
+// then drains HTTP requests and WebSocket proxies for up to
+// shutdownTimeout. Servers with a TLSConfig
+// serve HTTPS.
+func serveUntilSignal(servers ...*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			var err error
+			if s.TLSConfig != nil {
+				err = s.ListenAndServeTLS("", "")
+			} else {
+				err = s.ListenAndServe()
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("%s: %w", s.Addr, err)
+			}
+		}(s)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigChan)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigChan:
+		logMsg("INFO", "WEB", "Received signal %v, shutting down...", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Event streams never finish on their own
+	statusHub.Close()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				logMsg("WARN", "WEB", "HTTP requests on %s still active at shutdown deadline: %v", s.Addr, err)
+			}
+		}(s)
+	}
+	if err := activeWSProxies.shutdown(ctx); err != nil {
+		logMsg("WARN", "WEB", "WebSocket proxies still active at shutdown deadline, closed them")
+	}
+	wg.Wait()
+	logMsg("INFO", "WEB", "Server stopped")
+	return nil
+}
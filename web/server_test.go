@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withWSProxy serves wsProxyHandler with short server timeouts in front of
+// a backend that echoes messages, or never reads on paths ending in
+// "/stuck". It returns the panel's ws:// URL and the close codes the
+// backend received.
+func withWSProxy(t *testing.T) (string, chan int) {
+	t.Helper()
+	oldBase, oldTracker := wsBaseURL, activeWSProxies
+	t.Cleanup(func() { wsBaseURL, activeWSProxies = oldBase, oldTracker })
+	activeWSProxies = &wsProxyTracker{proxies: map[*wsProxy]struct{}{}}
+
+	closes := make(chan int, 4)
+	stop := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if strings.HasSuffix(r.URL.Path, "/stuck") {
+			<-stop
+			return
+		}
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				var ce *websocket.CloseError
+				if errors.As(err, &ce) {
+					closes <- ce.Code
+				}
+				return
+			}
+			conn.WriteMessage(mt, data)
+		}
+	}))
+	t.Cleanup(backend.Close)
+	t.Cleanup(func() { close(stop) })
+	wsBaseURL = "ws" + strings.TrimPrefix(backend.URL, "http")
+
+	panel := httptest.NewUnstartedServer(http.HandlerFunc(wsProxyHandler))
+	panel.Config.ReadTimeout = 200 * time.Millisecond
+	panel.Config.WriteTimeout = 200 * time.Millisecond
+	panel.Start()
+	t.Cleanup(panel.Close)
+	return "ws" + strings.TrimPrefix(panel.URL, "http"), closes
+}
+
+func dialWS(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWSProxy_OutlivesServerTimeouts(t *testing.T) {
+	panelURL, _ := withWSProxy(t)
+	conn := dialWS(t, panelURL+"/ws/auth/abc")
+
+	time.Sleep(400 * time.Millisecond)
+	conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "ping" {
+		t.Fatalf("after the server timeouts: %q, %v", data, err)
+	}
+}
+
+func TestWSProxyTracker_Shutdown(t *testing.T) {
+	panelURL, closes := withWSProxy(t)
+	conn := dialWS(t, panelURL+"/ws/auth/abc")
+	conn.WriteMessage(websocket.TextMessage, []byte("ping"))
+	conn.ReadMessage()
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		readErr <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := activeWSProxies.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-readErr; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("client: %v, want a going away close frame", err)
+	}
+	select {
+	case code := <-closes:
+		if code != websocket.CloseGoingAway {
+			t.Errorf("backend close code %d, want %d", code, websocket.CloseGoingAway)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("backend was not sent a close frame")
+	}
+
+	// New connections are turned away while shutting down
+	late := dialWS(t, panelURL+"/ws/auth/abc")
+	late.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := late.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("late client: %v, want a going away close frame", err)
+	}
+}
+
+func TestWSProxyTracker_ShutdownDeadline(t *testing.T) {
+	panelURL, _ := withWSProxy(t)
+	// Neither end answers the close frame
+	dialWS(t, panelURL+"/ws/auth/stuck")
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// Returning at all means the proxy was closed and its handler ended
+	if err := activeWSProxies.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown = %v, want the deadline", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s after a 300ms deadline", elapsed)
+	}
+}
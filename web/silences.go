@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// silenceKeepExpired is how long expired silences stay listed.
+const silenceKeepExpired = 7 * 24 * time.Hour
+
+// Silence store errors
+var (
+	ErrSilenceNotFound = errors.New("silence not found")
+	ErrSilenceInvalid  = errors.New("invalid silence")
+)
+
+// tunnelTags groups tunnels by name glob, so silences can cover several
+// tunnels at once.
+var tunnelTags map[string][]string
+
+// Silence mutes alert notifications for the tunnels it matches. A one-off
+// silence or maintenance window runs from StartsAt to EndsAt; a recurring
+// window opens whenever its cron Schedule matches and stays open for
+// Duration, from StartsAt until EndsAt if set.
+type Silence struct {
+	ID        string     `json:"id"`
+	Tunnel    string     `json:"tunnel,omitempty"` // name glob
+	Hash      string     `json:"hash,omitempty"`
+	Tag       string     `json:"tag,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	Schedule  string     `json:"schedule,omitempty"` // "minute hour day month weekday"
+	Duration  string     `json:"duration,omitempty"` // window length for Schedule
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	cron   *cronSchedule
+	window time.Duration
+}
+
+// compile parses Schedule and Duration.
+func (s *Silence) compile() error {
+	if s.Schedule == "" {
+		return nil
+	}
+	c, err := parseCron(s.Schedule)
+	if err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(s.Duration)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid duration %q", s.Duration)
+	}
+	s.cron, s.window = c, d
+	return nil
+}
+
+// Matches reports whether the silence covers the tunnel. Every scope that
+// is set must match.
+func (s *Silence) Matches(hash, name string) bool {
+	if s.Hash != "" && s.Hash != hash {
+		return false
+	}
+	if s.Tunnel != "" {
+		if matched, _ := path.Match(s.Tunnel, name); !matched {
+			return false
+		}
+	}
+	if s.Tag != "" {
+		tagged := false
+		for _, glob := range tunnelTags[s.Tag] {
+			if matched, _ := path.Match(glob, name); matched {
+				tagged = true
+			}
+		}
+		if !tagged {
+			return false
+		}
+	}
+	return true
+}
+
+// Expired reports whether the silence will never be active again.
+func (s *Silence) Expired(at time.Time) bool {
+	return s.EndsAt != nil && !at.Before(*s.EndsAt)
+}
+
+// Active reports whether the silence is in effect at at.
+func (s *Silence) Active(at time.Time) bool {
+	if at.Before(s.StartsAt) || s.Expired(at) {
+		return false
+	}
+	if s.cron == nil {
+		return true
+	}
+	start, ok := s.cron.prev(at, at.Add(-s.window))
+	return ok && at.Before(start.Add(s.window))
+}
+
+// NextStart returns when the silence next becomes active after at.
+func (s *Silence) NextStart(at time.Time) (time.Time, bool) {
+	if s.Expired(at) {
+		return time.Time{}, false
+	}
+	if s.cron == nil {
+		return s.StartsAt, s.StartsAt.After(at)
+	}
+	from := at
+	if s.StartsAt.After(from) {
+		from = s.StartsAt.Add(-time.Minute)
+	}
+	next, ok := s.cron.next(from, from.AddDate(1, 0, 1))
+	if !ok || (s.EndsAt != nil && !next.Before(*s.EndsAt)) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// SilenceStore keeps silences in a JSON file, or only in memory when it
+// has no path.
+type SilenceStore struct {
+	mu       sync.Mutex
+	path     string
+	silences []*Silence
+}
+
+// silences always exists; WEB_SILENCES_FILE makes it persistent.
+var silences = &SilenceStore{}
+
+// NewSilenceStore loads the silences file at path; a missing file is empty.
+func NewSilenceStore(path string) (*SilenceStore, error) {
+	s := &SilenceStore{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.silences); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, sil := range s.silences {
+		if err := sil.compile(); err != nil {
+			return nil, fmt.Errorf("silence %s: %w", sil.ID, err)
+		}
+	}
+	return s, nil
+}
+
+// save drops long-expired silences and writes the file. Callers must hold
+// s.mu.
+func (s *SilenceStore) save() error {
+	cutoff := time.Now().Add(-silenceKeepExpired)
+	kept := s.silences[:0]
+	for _, sil := range s.silences {
+		if !sil.Expired(cutoff) {
+			kept = append(kept, sil)
+		}
+	}
+	s.silences = kept
+	if s.path == "" {
+		return nil
+	}
+	return writeJSONFile(s.path, s.silences)
+}
+
+// Create validates and stores sil.
+func (s *SilenceStore) Create(sil *Silence) error {
+	if sil.Tunnel == "" && sil.Hash == "" && sil.Tag == "" {
+		return fmt.Errorf("%w: one of tunnel, hash or tag is required", ErrSilenceInvalid)
+	}
+	if sil.Tunnel != "" {
+		if _, err := parseTunnelGlobs([]string{sil.Tunnel}); err != nil {
+			return fmt.Errorf("%w: %v", ErrSilenceInvalid, err)
+		}
+	}
+	if _, ok := tunnelTags[sil.Tag]; sil.Tag != "" && !ok {
+		return fmt.Errorf("%w: unknown tag %q", ErrSilenceInvalid, sil.Tag)
+	}
+	if err := sil.compile(); err != nil {
+		return fmt.Errorf("%w: %v", ErrSilenceInvalid, err)
+	}
+	if sil.cron == nil && sil.EndsAt == nil {
+		return fmt.Errorf("%w: ends_at or duration is required", ErrSilenceInvalid)
+	}
+	if sil.EndsAt != nil && !sil.EndsAt.After(sil.StartsAt) {
+		return fmt.Errorf("%w: ends_at must be after starts_at", ErrSilenceInvalid)
+	}
+	sil.ID = randomToken()[:12]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.silences = append(s.silences, sil)
+	if err := s.save(); err != nil {
+		s.silences = s.silences[:len(s.silences)-1]
+		return err
+	}
+	return nil
+}
+
+// Expire ends the silence with id at at; a recurring window stops
+// recurring.
+func (s *SilenceStore) Expire(id string, at time.Time) (*Silence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sil := range s.silences {
+		if sil.ID != id {
+			continue
+		}
+		if sil.Expired(at) {
+			return sil, nil
+		}
+		old := sil.EndsAt
+		sil.EndsAt = &at
+		if err := s.save(); err != nil {
+			sil.EndsAt = old
+			return nil, err
+		}
+		return sil, nil
+	}
+	return nil, ErrSilenceNotFound
+}
+
+// List returns the silences, newest first, leaving out expired ones unless
+// all is set.
+func (s *SilenceStore) List(at time.Time, all bool) []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []Silence
+	for _, sil := range s.silences {
+		if all || !sil.Expired(at) {
+			list = append(list, *sil)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Active returns the silences covering the tunnel at at.
+func (s *SilenceStore) Active(hash, name string, at time.Time) []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []Silence
+	for _, sil := range s.silences {
+		if sil.Active(at) && sil.Matches(hash, name) {
+			list = append(list, *sil)
+		}
+	}
+	return list
+}
+
+// silenceView is how a silence is shown by the API.
+type silenceView struct {
+	Silence
+	Active    bool       `json:"active"`
+	Expired   bool       `json:"expired"`
+	NextStart *time.Time `json:"next_start,omitempty"`
+}
+
+func newSilenceView(sil Silence, at time.Time) silenceView {
+	v := silenceView{Silence: sil, Active: sil.Active(at), Expired: sil.Expired(at)}
+	if next, ok := sil.NextStart(at); ok {
+		v.NextStart = &next
+	}
+	return v
+}
+
+// silenceAccessRules covers /api/silences. Silences are not about one
+// tunnel, so scoped roles apply as for lists.
+var silenceAccessRules = []accessRule{
+	{http.MethodGet, "/api/silences", RoleViewer, ScopeRead},
+	{http.MethodPost, "/api/silences", RoleOperator, ScopeControl},
+	{http.MethodDelete, "/api/silences", RoleOperator, ScopeControl},
+}
+
+// silencesHandler serves GET /api/silences (?all=true includes expired
+// ones), POST /api/silences and DELETE /api/silences/{id}, which expires
+// the silence.
+func silencesHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkAccess(w, r, silenceAccessRules, "/api/silences") {
+		return
+	}
+	actor := "-"
+	if sess := currentSession(r); sess != nil {
+		actor = sess.User
+	}
+	now := time.Now()
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/silences"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+		views := []silenceView{}
+		for _, sil := range silences.List(now, all) {
+			views = append(views, newSilenceView(sil, now))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(views)
+
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			Tunnel   string     `json:"tunnel"`
+			Hash     string     `json:"hash"`
+			Tag      string     `json:"tag"`
+			Comment  string     `json:"comment"`
+			StartsAt *time.Time `json:"starts_at"` // default now
+			EndsAt   *time.Time `json:"ends_at"`
+			Schedule string     `json:"schedule"`
+			Duration string     `json:"duration"` // without schedule: ends_at = starts_at + duration
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+		sil := &Silence{
+			Tunnel:    req.Tunnel,
+			Hash:      req.Hash,
+			Tag:       req.Tag,
+			Comment:   req.Comment,
+			StartsAt:  now.UTC().Truncate(time.Second),
+			EndsAt:    req.EndsAt,
+			Schedule:  req.Schedule,
+			Duration:  req.Duration,
+			CreatedBy: actor,
+			CreatedAt: now.UTC().Truncate(time.Second),
+		}
+		if req.StartsAt != nil {
+			sil.StartsAt = *req.StartsAt
+		}
+		if req.Schedule == "" && req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 || req.EndsAt != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid duration; give either ends_at or duration")
+				return
+			}
+			ends := sil.StartsAt.Add(d)
+			sil.EndsAt, sil.Duration = &ends, ""
+		}
+		err := silences.Create(sil)
+		if errors.Is(err, ErrSilenceInvalid) {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			logMsg("ERROR", "ALERT", "Failed to save silences: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to save silence")
+			return
+		}
+		logMsg("INFO", "ALERT", "User %q created silence %s (%s)", actor, sil.ID, silenceScope(sil))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newSilenceView(*sil, now))
+
+	case id != "" && r.Method == http.MethodDelete:
+		sil, err := silences.Expire(id, now.UTC().Truncate(time.Second))
+		if errors.Is(err, ErrSilenceNotFound) {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			logMsg("ERROR", "ALERT", "Failed to save silences: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to expire silence")
+			return
+		}
+		logMsg("INFO", "ALERT", "User %q expired silence %s (%s)", actor, sil.ID, silenceScope(sil))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newSilenceView(*sil, now))
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// silenceScope describes what a silence covers, for logs.
+func silenceScope(sil *Silence) string {
+	var parts []string
+	for _, p := range [][2]string{{"tunnel", sil.Tunnel}, {"hash", sil.Hash}, {"tag", sil.Tag}} {
+		if p[1] != "" {
+			parts = append(parts, p[0]+"="+p[1])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// annotateStatus adds the active silences to each tunnel in a /status
+// response from the autossh API, as "silences": [{id, comment, ends_at}].
+func annotateStatus(resp *http.Response) error {
+	if resp.Request.URL.Path != "/status" || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	var list []map[string]interface{}
+	if json.Unmarshal(body, &list) == nil {
+		now := time.Now()
+		for _, t := range list {
+			hash, _ := t["hash"].(string)
+			name, _ := t["name"].(string)
+			type silenceRef struct {
+				ID      string     `json:"id"`
+				Comment string     `json:"comment,omitempty"`
+				EndsAt  *time.Time `json:"ends_at,omitempty"`
+			}
+			var refs []silenceRef
+			for _, sil := range silences.Active(hash, name, now) {
+				refs = append(refs, silenceRef{sil.ID, sil.Comment, sil.EndsAt})
+			}
+			if refs != nil {
+				t["silences"] = refs
+			}
+		}
+		if annotated, err := json.Marshal(list); err == nil {
+			body = annotated
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// parseTunnelTags parses "tag=glob|glob,tag=glob".
+func parseTunnelTags(spec string) (map[string][]string, error) {
+	tags := make(map[string][]string)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tag, globs, ok := strings.Cut(entry, "=")
+		tag = strings.TrimSpace(tag)
+		if !ok || tag == "" {
+			return nil, fmt.Errorf("invalid tunnel tag %q", entry)
+		}
+		patterns, err := parseTunnelGlobs(strings.Split(globs, "|"))
+		if err != nil {
+			return nil, err
+		}
+		tags[tag] = append(tags[tag], patterns...)
+	}
+	return tags, nil
+}
+
+// loadSilencesFromEnv reads WEB_TUNNEL_TAGS and opens WEB_SILENCES_FILE.
+func loadSilencesFromEnv() error {
+	tags, err := parseTunnelTags(os.Getenv("WEB_TUNNEL_TAGS"))
+	if err != nil {
+		return fmt.Errorf("invalid WEB_TUNNEL_TAGS: %w", err)
+	}
+	tunnelTags = tags
+	if f := os.Getenv("WEB_SILENCES_FILE"); f != "" {
+		s, err := NewSilenceStore(f)
+		if err != nil {
+			return err
+		}
+		silences = s
+	}
+	return nil
+}
+
+// cronSchedule is a parsed five-field cron expression, evaluated in the
+// local time zone.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit n set when value n matches
+	domAny, dowAny                bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week" with *,
+// lists, ranges and steps, or one of the @hourly style macros. As in cron,
+// a day matches either day field when both are restricted.
+func parseCron(spec string) (*cronSchedule, error) {
+	if m, ok := cronMacros[spec]; ok {
+		spec = m
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: want 5 fields", spec)
+	}
+	c := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		bits, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", spec, err)
+		}
+		*sets[i] = bits
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(a)
+			hi = lo
+			if isRange {
+				hi, err2 = strconv.Atoi(b)
+			} else if hasStep {
+				hi = max
+			}
+			if err1 != nil || err2 != nil || lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// prev returns the latest matching minute at or before t, stopping at
+// limit.
+func (c *cronSchedule) prev(t, limit time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	for !t.Before(limit) {
+		y, mo, d := t.Date()
+		switch {
+		case c.month&(1<<uint(mo)) == 0:
+			t = time.Date(y, mo, 1, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case !c.dayMatches(t):
+			t = time.Date(y, mo, d, 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, mo, d, t.Hour(), 0, 0, 0, t.Location()).Add(-time.Minute)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(-time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// next returns the first matching minute after t, stopping at limit.
+func (c *cronSchedule) next(t, limit time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		switch {
+		case c.month&(1<<uint(mo)) == 0:
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, mo, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withSilences gives the test an empty silence store backed by a temp file
+// and the tag "prod" for db-* and web-*.
+func withSilences(t *testing.T) string {
+	t.Helper()
+	oldStore, oldTags := silences, tunnelTags
+	t.Cleanup(func() { silences, tunnelTags = oldStore, oldTags })
+	path := filepath.Join(t.TempDir(), "silences.json")
+	s, err := NewSilenceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	silences = s
+	tunnelTags = map[string][]string{"prod": {"db-*", "web-*"}}
+	return path
+}
+
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		spec, from, prev, next string
+	}{
+		// 2026-03-04 is a Wednesday
+		{"0 2 * * 0", "2026-03-04 12:00", "2026-03-01 02:00", "2026-03-08 02:00"},
+		{"@daily", "2026-03-04 12:00", "2026-03-04 00:00", "2026-03-05 00:00"},
+		{"*/15 9-17 * * 1-5", "2026-03-06 17:50", "2026-03-06 17:45", "2026-03-09 09:00"},
+		{"30 1 1,15 * *", "2026-03-04 12:00", "2026-03-01 01:30", "2026-03-15 01:30"},
+		// Both day fields restricted: either matches
+		{"0 0 13 * 5", "2026-03-04 12:00", "2026-02-27 00:00", "2026-03-06 00:00"},
+		{"0 0 * * 7", "2026-03-04 12:00", "2026-03-01 00:00", "2026-03-08 00:00"},
+	} {
+		c, err := parseCron(tc.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tc.spec, err)
+			continue
+		}
+		from := at(tc.from)
+		if got, ok := c.prev(from, from.AddDate(0, -1, 0)); !ok || !got.Equal(at(tc.prev)) {
+			t.Errorf("%q prev(%s) = %v, %v; want %s", tc.spec, tc.from, got, ok, tc.prev)
+		}
+		if got, ok := c.next(from, from.AddDate(0, 1, 0)); !ok || !got.Equal(at(tc.next)) {
+			t.Errorf("%q next(%s) = %v, %v; want %s", tc.spec, tc.from, got, ok, tc.next)
+		}
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@often"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestSilence_Active(t *testing.T) {
+	withSilences(t)
+	now := time.Now()
+	ends := now.Add(time.Hour)
+	oneOff := &Silence{Tag: "prod", StartsAt: now.Add(-time.Minute), EndsAt: &ends}
+	// Open for 90 minutes from the top of every hour
+	recurring := &Silence{Tunnel: "lab-*", StartsAt: now.Add(-24 * time.Hour), Schedule: "0 * * * *", Duration: "90m"}
+	// Open for 10 minutes at the top of every hour
+	short := &Silence{Hash: "abc", StartsAt: now.Add(-24 * time.Hour), Schedule: "0 * * * *", Duration: "10m"}
+	for _, s := range []*Silence{recurring, short} {
+		if err := s.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !oneOff.Active(now) || oneOff.Active(ends) || !oneOff.Matches("x", "web-1") || oneOff.Matches("x", "lab-1") {
+		t.Error("one-off silence scoped to the prod tag")
+	}
+	if !recurring.Active(now) || !recurring.Matches("x", "lab-1") {
+		t.Error("overlapping recurring windows should always be active")
+	}
+	top := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	if !short.Active(top.Add(5*time.Minute)) || short.Active(top.Add(15*time.Minute)) {
+		t.Error("short window open for the wrong minutes")
+	}
+	if next, ok := short.NextStart(top.Add(15 * time.Minute)); !ok || !next.Equal(top.Add(time.Hour)) {
+		t.Errorf("NextStart = %v, %v; want %v", next, ok, top.Add(time.Hour))
+	}
+	if short.Matches("abcd", "") {
+		t.Error("hash scope matched another hash")
+	}
+}
+
+func TestSilencesHandler(t *testing.T) {
+	path := withSilences(t)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		silencesHandler(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	w := do("POST", "/api/silences", `{"tag": "prod", "duration": "2h", "comment": "DB upgrade"}`)
+	var created silenceView
+	json.NewDecoder(w.Body).Decode(&created)
+	if w.Code != http.StatusCreated || !created.Active || created.EndsAt == nil || created.EndsAt.Sub(created.StartsAt) != 2*time.Hour {
+		t.Fatalf("create: %d %+v", w.Code, created)
+	}
+	w = do("POST", "/api/silences", `{"tunnel": "lab-*", "schedule": "0 3 * * 6", "duration": "4h"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create recurring: %d %s", w.Code, w.Body)
+	}
+
+	for _, body := range []string{
+		`{"duration": "1h"}`,
+		`{"tag": "staging", "duration": "1h"}`,
+		`{"tunnel": "db-1"}`,
+		`{"tunnel": "db-1", "schedule": "0 3 * * *"}`,
+		`{"tunnel": "db-1", "schedule": "daily", "duration": "1h"}`,
+		`{"tunnel": "db-1", "duration": "1h", "ends_at": "2030-01-01T00:00:00Z"}`,
+	} {
+		if w := do("POST", "/api/silences", body); w.Code != http.StatusBadRequest {
+			t.Errorf("create %s: status %d, want 400", body, w.Code)
+		}
+	}
+
+	// Silences survive a restart
+	reopened, err := NewSilenceStore(path)
+	if err != nil || len(reopened.List(time.Now(), false)) != 2 {
+		t.Fatalf("reopened store: %v", err)
+	}
+	silences = reopened
+
+	if w := do("DELETE", "/api/silences/"+created.ID, ""); w.Code != http.StatusOK {
+		t.Fatalf("expire: %d %s", w.Code, w.Body)
+	}
+	if w := do("DELETE", "/api/silences/nope", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expire unknown: status %d, want 404", w.Code)
+	}
+	var list []silenceView
+	json.NewDecoder(do("GET", "/api/silences", "").Body).Decode(&list)
+	if len(list) != 1 || list[0].Schedule == "" || list[0].NextStart == nil {
+		t.Errorf("list = %+v, want the recurring window with its next start", list)
+	}
+	json.NewDecoder(do("GET", "/api/silences?all=true", "").Body).Decode(&list)
+	if len(list) != 2 {
+		t.Errorf("list all = %+v, want the expired silence too", list)
+	}
+}
+
+func TestAnnotateStatus(t *testing.T) {
+	withSilences(t)
+	ends := time.Now().Add(time.Hour)
+	silences.Create(&Silence{Tunnel: "db-*", Comment: "upgrade", StartsAt: time.Now(), EndsAt: &ends})
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Request:    &http.Request{URL: &url.URL{Path: "/status"}},
+		Body:       io.NopCloser(strings.NewReader(`[{"hash":"a1","name":"db-1","status":"DEAD"},{"hash":"b2","name":"web","status":"NORMAL"}]`)),
+	}
+	if err := annotateStatus(resp); err != nil {
+		t.Fatal(err)
+	}
+	var list []struct {
+		Hash     string `json:"hash"`
+		Status   string `json:"status"`
+		Silences []struct {
+			ID      string `json:"id"`
+			Comment string `json:"comment"`
+		} `json:"silences"`
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &list); err != nil || resp.ContentLength != int64(len(body)) {
+		t.Fatalf("annotated body %s: %v", body, err)
+	}
+	if len(list) != 2 || len(list[0].Silences) != 1 || list[0].Silences[0].Comment != "upgrade" || list[0].Status != "DEAD" || list[1].Silences != nil {
+		t.Errorf("annotated status = %+v", list)
+	}
+}
+
+func TestAlertManager_Silences(t *testing.T) {
+	withSilences(t)
+	sent := withAlerts(t, `{"notifiers": {"ops": {"type": "webhook", "url": "http://ops.example"}}, "defaults": {"down_for": "0s"}}`)
+	now := time.Now()
+	ends := now.Add(10 * time.Minute)
+	silence := &Silence{Tag: "prod", StartsAt: now.Add(-time.Minute), EndsAt: &ends}
+	silences.Create(silence)
+
+	dead := map[string]TunnelStatus{"abc": {Hash: "abc", Name: "db-1", Status: "DEAD"}}
+	alerts.Evaluate(now, dead, nil)
+	if active := alerts.Active(); len(*sent) != 0 || len(active) != 1 || !active[0].Silenced {
+		t.Fatalf("during the silence: sent %+v, active %+v", *sent, active)
+	}
+
+	// Still failing when the silence is expired: notify now
+	silences.Expire(silence.ID, now.Add(time.Minute))
+	alerts.Evaluate(now.Add(2*time.Minute), dead, nil)
+	if len(*sent) != 1 || (*sent)[0].State != alertFiring || (*sent)[0].Silenced {
+		t.Errorf("after the silence: sent %+v", *sent)
+	}
+}
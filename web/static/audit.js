@@ -0,0 +1,174 @@
+// Audit Log Page JavaScript
+
+document.addEventListener("DOMContentLoaded", () => {
+    const form = document.getElementById('auditFilters');
+    const resetBtn = document.getElementById('resetFilters');
+    const tbody = document.getElementById('auditBody');
+    const emptyEl = document.getElementById('auditEmpty');
+    const fields = {
+        user: document.getElementById('filterUser'),
+        tunnel: document.getElementById('filterTunnel'),
+        action: document.getElementById('filterAction'),
+        since: document.getElementById('filterSince'),
+        until: document.getElementById('filterUntil'),
+    };
+
+    // URL prefix the panel is served under, set by the page template
+    const basePath = window.BASE_PATH || '';
+
+    let entries = [];
+    let emptyKey = 'audit.empty';
+
+    function getTranslation(key, fallback) {
+        if (window.i18n && window.i18n.isReady) {
+            return window.i18n.t(key);
+        }
+        return fallback;
+    }
+
+    function escapeHtml(text) {
+        const div = document.createElement('div');
+        div.textContent = text;
+        return div.innerHTML;
+    }
+
+    // datetime-local values are local time; the API wants RFC 3339
+    function toRFC3339(value) {
+        return value ? new Date(value).toISOString() : '';
+    }
+
+    function fromRFC3339(value) {
+        if (!value) return '';
+        const d = new Date(value);
+        if (isNaN(d)) return '';
+        const local = new Date(d.getTime() - d.getTimezoneOffset() * 60000);
+        return local.toISOString().slice(0, 16);
+    }
+
+    // Fill the form from the page URL so filtered views can be shared
+    function readFilters() {
+        const params = new URLSearchParams(window.location.search);
+        fields.user.value = params.get('user') || '';
+        fields.tunnel.value = params.get('tunnel') || '';
+        fields.action.value = params.get('action') || '';
+        fields.since.value = fromRFC3339(params.get('since'));
+        fields.until.value = fromRFC3339(params.get('until'));
+    }
+
+    function filterParams() {
+        const params = new URLSearchParams();
+        const values = {
+            user: fields.user.value.trim(),
+            tunnel: fields.tunnel.value.trim(),
+            action: fields.action.value,
+            since: toRFC3339(fields.since.value),
+            until: toRFC3339(fields.until.value),
+        };
+        for (const [key, value] of Object.entries(values)) {
+            if (value) params.set(key, value);
+        }
+        return params;
+    }
+
+    async function loadEntries() {
+        const params = filterParams();
+        const query = params.toString();
+        history.replaceState(null, '', basePath + '/audit' + (query ? '?' + query : ''));
+
+        try {
+            const response = await fetch(basePath + '/api/audit' + (query ? '?' + query : ''));
+            if (response.status === 401) {
+                window.location.href = basePath + '/login?next=' + encodeURIComponent(window.location.pathname + window.location.search);
+                return;
+            }
+            if (response.status === 403) {
+                entries = [];
+                emptyKey = 'audit.forbidden';
+            } else if (!response.ok) {
+                throw new Error(`HTTP error! status: ${response.status}`);
+            } else {
+                entries = await response.json();
+                emptyKey = 'audit.empty';
+            }
+        } catch (error) {
+            console.error('Failed to load audit log:', error);
+            entries = [];
+            emptyKey = 'audit.load_failed';
+        }
+        render();
+    }
+
+    function actionLabel(action) {
+        const key = 'audit.actions.' + action.replace('.', '_');
+        const label = getTranslation(key, action);
+        return label === key ? action : label;
+    }
+
+    function formatValue(value) {
+        if (value === undefined || value === null) return '∅';
+        return String(value);
+    }
+
+    function renderChanges(changes) {
+        if (!changes || changes.length === 0) return '';
+        const items = changes.map(c => {
+            const field = c.tunnel ? `${c.tunnel}.${c.field}` : c.field;
+            return `<li><span class="audit-field-name">${escapeHtml(field)}</span> ` +
+                `<span class="audit-before">${escapeHtml(formatValue(c.before))}</span> → ` +
+                `<span class="audit-after">${escapeHtml(formatValue(c.after))}</span></li>`;
+        });
+        return `<ul class="audit-changes">${items.join('')}</ul>`;
+    }
+
+    // Entries for other backends than the default one carry its name
+    function renderTunnel(entry) {
+        const backend = entry.backend ? `<span class="audit-backend">${escapeHtml(entry.backend)}</span> ` : '';
+        if (!entry.tunnel) {
+            return backend + (entry.action.startsWith('config') ? '' : escapeHtml(getTranslation('audit.all_tunnels', 'All tunnels')));
+        }
+        const name = entry.tunnel_name || entry.tunnel.slice(0, 8);
+        const query = 'hash=' + encodeURIComponent(entry.tunnel) + (entry.backend ? '&backend=' + encodeURIComponent(entry.backend) : '');
+        return `${backend}<a href="${basePath}/tunnel-detail?${query}" title="${escapeHtml(entry.tunnel)}">${escapeHtml(name)}</a>`;
+    }
+
+    function render() {
+        tbody.innerHTML = '';
+        if (entries.length === 0) {
+            emptyEl.textContent = getTranslation(emptyKey, 'No matching entries.');
+            emptyEl.style.display = '';
+            return;
+        }
+        emptyEl.style.display = 'none';
+
+        for (const entry of entries) {
+            const row = document.createElement('tr');
+            const statusClass = entry.status < 300 ? 'audit-ok' : 'audit-failed';
+            row.innerHTML = `
+                <td class="audit-time">${escapeHtml(new Date(entry.time).toLocaleString())}</td>
+                <td>${escapeHtml(entry.user)}</td>
+                <td>${escapeHtml(actionLabel(entry.action))}</td>
+                <td>${renderTunnel(entry)}</td>
+                <td class="audit-client">${escapeHtml(entry.client_ip || '')}</td>
+                <td><span class="audit-status ${statusClass}">${entry.status}</span></td>
+                <td>${renderChanges(entry.changes)}</td>
+            `;
+            tbody.appendChild(row);
+        }
+    }
+
+    form.addEventListener('submit', (event) => {
+        event.preventDefault();
+        loadEntries();
+    });
+
+    resetBtn.addEventListener('click', () => {
+        form.reset();
+        loadEntries();
+    });
+
+    window.addEventListener('languageChanged', render);
+    window.addEventListener('i18nReady', render);
+
+    readFilters();
+    loadEntries();
+});
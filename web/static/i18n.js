@@ -60,7 +60,7 @@ class I18n {
         }
 
         try {
-            const response = await fetch(`/static/locales/${lang}.json`);
+            const response = await fetch(`${window.BASE_PATH || ''}/static/locales/${lang}.json`);
             if (!response.ok) {
                 throw new Error(`Failed to load ${lang} translations`);
             }
@@ -160,7 +160,7 @@ class I18n {
      */
     async loadSupportedLanguages() {
         try {
-            const response = await fetch('/api/languages');
+            const response = await fetch((window.BASE_PATH || '') + '/api/languages');
             if (!response.ok) {
                 throw new Error('Failed to load supported languages');
             }
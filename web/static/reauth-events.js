@@ -0,0 +1,100 @@
+/**
+ * ReauthEvents — listens on /ws/events for interactive tunnels that dropped
+ * after authenticating and need the user to authenticate again.
+ *
+ * Usage:
+ *   const events = new ReauthEvents({
+ *     showMessage: (text, type) => {},
+ *     onEvent: (event) => {},
+ *     getTranslation: (key, fallback) => string,
+ *   });
+ *   events.start();
+ */
+(function () {
+  'use strict';
+
+  var MIN_BACKOFF = 2000;
+  var MAX_BACKOFF = 60000;
+
+  function ReauthEvents(options) {
+    this._options = options || {};
+    this._ws = null;
+    this._backoff = MIN_BACKOFF;
+    this._retryTimer = null;
+    this._seen = {};
+  }
+
+  ReauthEvents.prototype.start = function () {
+    this._connect();
+  };
+
+  ReauthEvents.prototype._connect = function () {
+    var protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+    var wsUrl = protocol + '//' + window.location.host + (window.BASE_PATH || '') + '/ws/events';
+
+    var self = this;
+    this._ws = new WebSocket(wsUrl);
+
+    this._ws.onopen = function () {
+      self._backoff = MIN_BACKOFF;
+    };
+
+    this._ws.onmessage = function (e) {
+      var event;
+      try {
+        event = JSON.parse(e.data);
+      } catch (err) {
+        return;
+      }
+      if (event.type === 'reauth_required') {
+        self._handleEvent(event);
+      }
+    };
+
+    this._ws.onclose = function () {
+      self._ws = null;
+      self._retryTimer = setTimeout(function () {
+        self._connect();
+      }, self._backoff);
+      self._backoff = Math.min(self._backoff * 2, MAX_BACKOFF);
+    };
+  };
+
+  ReauthEvents.prototype._handleEvent = function (event) {
+    // Pending events are replayed on every reconnect; notify once per drop
+    var key = event.hash + '@' + event.detected_at;
+    if (this._seen[key]) return;
+    this._seen[key] = true;
+
+    if (this._options.showMessage) {
+      var text = this._t('terminal.reauth_required',
+        'Tunnel {{name}} dropped after {{uptime}} and needs re-authentication.');
+      text = text
+        .replace('{{name}}', event.name || event.hash.substring(0, 8))
+        .replace('{{uptime}}', formatUptime(event.uptime_seconds || 0));
+      this._options.showMessage(text, 'error');
+    }
+    if (this._options.onEvent) {
+      this._options.onEvent(event);
+    }
+  };
+
+  ReauthEvents.prototype._t = function (key, fallback) {
+    if (this._options.getTranslation) {
+      var text = this._options.getTranslation(key, fallback);
+      if (text && text !== key) return text;
+    }
+    return fallback;
+  };
+
+  function formatUptime(seconds) {
+    var h = Math.floor(seconds / 3600);
+    var m = Math.floor((seconds % 3600) / 60);
+    var s = seconds % 60;
+    if (h > 0) return h + 'h ' + m + 'm';
+    if (m > 0) return m + 'm ' + s + 's';
+    return s + 's';
+  }
+
+  window.ReauthEvents = ReauthEvents;
+})();
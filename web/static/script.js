@@ -1,17 +1,40 @@
 document.addEventListener("DOMContentLoaded", () => {
+    // URL prefix the panel is served under, set by the page template
+    const basePath = window.BASE_PATH || '';
+
     const tableBody = document.querySelector("#tunnelTable tbody");
-    let apiConfig = { api_key: '', ws_enabled: false };
+    let apiConfig = { ws_enabled: false, ws_auth_mode: 'pty', auth_enabled: false, csrf_token: '' };
     let autoRefreshInterval = null;
-    const AUTO_REFRESH_INTERVAL = 5000; // 5 seconds
+    let statusEvents = null; // live status stream, when available
+    const AUTO_REFRESH_INTERVAL = 5000; // 5 seconds, when polling
     let isConfigSaving = false; // Flag to prevent clicks during save/reload
 
+    // Backends the panel manages; the selected one fills the table. The
+    // status stream and re-authentication events follow the default backend.
+    let backends = [];
+    let currentBackend = null;
+    let defaultWsEnabled = false;
+    let fleetInterval = null;
+    const FLEET_REFRESH_INTERVAL = 30000; // 30 seconds
+    const backendSelect = document.getElementById('backendSelect');
+    const fleetCard = document.getElementById('fleetCard');
+    const fleetList = document.getElementById('fleetList');
+
+    // Dependency banner, driven by /readyz
+    const dependencyBanner = document.getElementById('dependencyBanner');
+    let readinessTimer = null;
+    let lastReadiness = null;
+    const READINESS_RETRY_INTERVAL = 15000; // 15 seconds, while a dependency is down
+
     // Terminal modal for interactive auth (initialized after config loads)
     let terminalModal = null;
 
     // Load API config first, then load configuration
-    loadAPIConfig().then(() => {
+    loadAPIConfig().then(loadBackends).then(() => {
         // Initialize terminal modal if WebSocket is enabled
-        if (apiConfig.ws_enabled && typeof TerminalModal === 'function') {
+        // Agents may bring a ws-server along once they connect
+        if ((defaultWsEnabled || apiConfig.agents_enabled || backends.some(b => b.ws_enabled)) &&
+            typeof TerminalModal === 'function') {
             terminalModal = new TerminalModal({
                 getApiConfig: () => apiConfig,
                 showMessage: showMessage,
@@ -21,9 +44,24 @@ document.addEventListener("DOMContentLoaded", () => {
             });
         }
 
+        // Notify when authenticated interactive tunnels drop
+        if (defaultWsEnabled && typeof ReauthEvents === 'function') {
+            new ReauthEvents({
+                showMessage: showMessage,
+                onEvent: () => refreshStatuses(),
+                getTranslation: getTranslation,
+            }).start();
+        }
+
+        checkReadiness();
         loadConfiguration();
         // Start auto-refresh by default after initial load
         startAutoRefresh();
+
+        if (backends.length > 1 || apiConfig.agents_enabled) {
+            loadFleet();
+            fleetInterval = setInterval(loadFleet, FLEET_REFRESH_INTERVAL);
+        }
     });
 
     // Listen for i18n ready event to update translations
@@ -34,6 +72,8 @@ document.addEventListener("DOMContentLoaded", () => {
     // Listen for language change event to update translations
     window.addEventListener('languageChanged', () => {
         updateAllRowTranslations();
+        renderFleet();
+        renderReadiness();
     });
 
     // Helper function to get translation with fallback
@@ -112,28 +152,295 @@ document.addEventListener("DOMContentLoaded", () => {
     // Load API configuration
     async function loadAPIConfig() {
         try {
-            const response = await fetch('/api/config/api');
+            const response = await fetch(basePath + '/api/config/api');
+            if (response.status === 401) {
+                redirectToLogin();
+                return;
+            }
             if (response.ok) {
                 const data = await response.json();
-                apiConfig.api_key = data.api_key || '';
                 apiConfig.ws_enabled = data.ws_enabled || false;
+                defaultWsEnabled = apiConfig.ws_enabled;
+                apiConfig.ws_auth_mode = data.ws_auth_mode || 'pty';
+                apiConfig.auth_enabled = data.auth_enabled || false;
+                apiConfig.csrf_token = data.csrf_token || '';
+                apiConfig.role = data.role || '';
+                apiConfig.auth_source = data.auth_source || '';
+                apiConfig.totp_enabled = data.totp_enabled || false;
+                apiConfig.agents_enabled = data.agents_enabled || false;
+                setupLogout();
             }
         } catch (error) {
             console.warn('Failed to load API config:', error);
         }
     }
 
-    // Helper function to make authenticated API calls (proxied through web panel)
-    function apiCall(endpoint, options = {}) {
-        const url = '/api/autossh' + endpoint;
+    // Load the backend list and select the one named in the page URL, the
+    // one used last, or the default
+    async function loadBackends() {
+        try {
+            const response = await fetch(basePath + '/api/backends');
+            if (response.ok) {
+                backends = await response.json();
+            }
+        } catch (error) {
+            console.warn('Failed to load backends:', error);
+        }
+        const wanted = new URLSearchParams(window.location.search).get('backend') ||
+            localStorage.getItem('autossh-backend');
+        currentBackend = backends.find(b => b.name === wanted) || backends.find(b => b.default) || null;
+        applyBackend();
+        renderBackendSelect();
+        if (backendSelect) {
+            backendSelect.addEventListener('change', () => selectBackend(backendSelect.value));
+        }
+    }
+
+    // Fill the backend selector; it and the fleet card show once there is
+    // more than one backend
+    function renderBackendSelect() {
+        if (!backendSelect || backends.length < 2) return;
+        backendSelect.innerHTML = '';
+        backends.forEach(b => {
+            const option = document.createElement('option');
+            option.value = b.name;
+            option.textContent = b.name;
+            backendSelect.appendChild(option);
+        });
+        backendSelect.value = currentBackend ? currentBackend.name : '';
+        fleetCard.hidden = false;
+    }
+
+    // Point API calls and the terminal at the selected backend
+    function applyBackend() {
+        const nonDefault = currentBackend && !currentBackend.default;
+        apiConfig.ws_enabled = nonDefault ? currentBackend.ws_enabled : defaultWsEnabled;
+        apiConfig.ws_prefix = nonDefault ? backendPrefix() + '/ws' : '/ws';
+    }
+
+    // API path prefix for the selected backend
+    function backendPrefix() {
+        if (currentBackend && !currentBackend.default) {
+            return '/api/backends/' + encodeURIComponent(currentBackend.name);
+        }
+        return '/api';
+    }
+
+    // Detail page link for a tunnel of the selected backend
+    function detailUrl(hash) {
+        let url = `${basePath}/tunnel-detail?hash=${encodeURIComponent(hash)}`;
+        if (currentBackend && !currentBackend.default) {
+            url += '&backend=' + encodeURIComponent(currentBackend.name);
+        }
+        return url;
+    }
+
+    function selectBackend(name) {
+        const backend = backends.find(b => b.name === name);
+        if (!backend || backend === currentBackend) return;
+        currentBackend = backend;
+        localStorage.setItem('autossh-backend', name);
+        if (backendSelect) backendSelect.value = name;
+        const url = new URL(window.location);
+        if (backend.default) {
+            url.searchParams.delete('backend');
+        } else {
+            url.searchParams.set('backend', name);
+        }
+        window.history.replaceState({}, '', url);
+
+        stopAutoRefresh();
+        applyBackend();
+        loadConfiguration();
+        const autoRefreshCheckbox = document.getElementById('autoRefresh');
+        if (autoRefreshCheckbox && autoRefreshCheckbox.checked) startAutoRefresh();
+        renderFleet();
+    }
+
+    // Fleet overview: every backend's health and tunnel counts
+    let fleet = null;
+
+    async function loadFleet() {
+        try {
+            const response = await fetch(basePath + '/api/fleet');
+            if (!response.ok) return;
+            fleet = await response.json();
+            // Agents come and go; keep the selector in step
+            const names = fleet.backends.map(b => b.name).join('\n');
+            if (names !== backends.map(b => b.name).join('\n')) {
+                backends = fleet.backends.map(b => ({ name: b.name, default: b.default, ws_enabled: b.ws_enabled, agent: b.agent }));
+                if (currentBackend) {
+                    currentBackend = backends.find(b => b.name === currentBackend.name) || currentBackend;
+                }
+                renderBackendSelect();
+            }
+            renderFleet();
+        } catch (error) {
+            console.warn('Failed to load fleet status:', error);
+        }
+    }
+
+    function renderFleet() {
+        if (!fleetList || !fleet) return;
+        fleetList.innerHTML = '';
+        fleet.backends.forEach(b => {
+            const item = document.createElement('button');
+            item.type = 'button';
+            const offline = b.agent && !b.agent.connected;
+            item.className = 'fleet-backend' + (b.up ? (b.failed ? ' fleet-degraded' : '') : ' fleet-down') +
+                (currentBackend && currentBackend.name === b.name ? ' active' : '');
+            item.title = b.error || '';
+            if (b.agent && b.agent.remote_addr) {
+                item.title = getTranslation('fleet.agent', 'Agent at {{addr}}').replace('{{addr}}', b.agent.remote_addr) +
+                    (item.title ? '\n' + item.title : '');
+            }
+
+            const icon = document.createElement('i');
+            icon.className = 'material-icons';
+            icon.textContent = b.up ? (b.failed ? 'warning' : 'check_circle') : (offline ? 'link_off' : 'cloud_off');
+            const name = document.createElement('span');
+            name.className = 'fleet-name';
+            name.textContent = b.name;
+            const counts = document.createElement('span');
+            counts.className = 'fleet-counts';
+            counts.textContent = b.up
+                ? getTranslation('fleet.counts', '{{running}}/{{total}} running, {{failed}} failed')
+                    .replace('{{running}}', b.running).replace('{{total}}', b.tunnels).replace('{{failed}}', b.failed)
+                : offline
+                    ? getTranslation('fleet.agentOffline', 'Agent disconnected')
+                    : getTranslation('fleet.unreachable', 'Unreachable');
+
+            item.append(icon, name, counts);
+            item.addEventListener('click', () => selectBackend(b.name));
+            fleetList.appendChild(item);
+        });
+    }
+
+    // Check the panel's own dependencies and show a banner naming the ones
+    // that are down; while any is, check again every so often
+    async function checkReadiness() {
+        clearTimeout(readinessTimer);
+        readinessTimer = null;
+        try {
+            const response = await fetch(basePath + '/readyz');
+            lastReadiness = await response.json();
+        } catch (error) {
+            console.warn('Failed to check readiness:', error);
+            return;
+        }
+        renderReadiness();
+        if (lastReadiness.status !== 'ready') {
+            readinessTimer = setTimeout(checkReadiness, READINESS_RETRY_INTERVAL);
+        }
+    }
+
+    function renderReadiness() {
+        if (!dependencyBanner || !lastReadiness) return;
+        const names = {
+            api: getTranslation('health.api', 'The autossh API'),
+            ws: getTranslation('health.ws', 'The WebSocket server for interactive authentication'),
+        };
+        const lines = Object.entries(lastReadiness.checks || {})
+            .filter(([, check]) => check.status !== 'up')
+            .map(([name, check]) => {
+                let line = getTranslation('health.down', '{{name}} is unreachable')
+                    .replace('{{name}}', names[name] || name);
+                if (check.error) line += ': ' + check.error;
+                return line;
+            });
+        document.getElementById('dependencyBannerText').textContent = lines.join('\n');
+        dependencyBanner.hidden = lines.length === 0;
+    }
+
+    // Send the browser to the login page, returning here afterwards
+    function redirectToLogin() {
+        window.location.href = basePath + '/login?next=' + encodeURIComponent(window.location.pathname + window.location.search);
+    }
+
+    // Show the logout button when the panel requires login
+    function setupLogout() {
+        const logoutBtn = document.getElementById('logoutButton');
+        // Second factors apply to password logins only
+        const totpLink = document.getElementById('totpLink');
+        if (totpLink && apiConfig.totp_enabled && apiConfig.auth_source === 'password') {
+            totpLink.style.display = '';
+        }
+        // The audit log is for admins
+        const auditLink = document.getElementById('auditLink');
+        if (auditLink && (!apiConfig.auth_enabled || apiConfig.role === 'admin')) {
+            auditLink.style.display = '';
+        }
+        // Users signed in by a trusted proxy log out at the proxy
+        if (!logoutBtn || !apiConfig.auth_enabled || apiConfig.auth_source === 'proxy') return;
+        logoutBtn.style.display = '';
+        logoutBtn.addEventListener('click', async () => {
+            await fetch(basePath + '/logout', {
+                method: 'POST',
+                headers: { 'X-CSRF-Token': apiConfig.csrf_token },
+            });
+            window.location.href = basePath + '/login';
+        });
+    }
+
+    // Helper function to make API calls (proxied through web panel, which
+    // adds the backend API key)
+    async function apiCall(endpoint, options = {}) {
+        const url = basePath + backendPrefix() + '/autossh' + endpoint;
         const headers = options.headers || {};
 
-        // Add Bearer token if API key is configured
-        if (apiConfig.api_key) {
-            headers['Authorization'] = 'Bearer ' + apiConfig.api_key;
+        // Mutating requests must carry the session's CSRF token
+        const method = (options.method || 'GET').toUpperCase();
+        if (method !== 'GET' && method !== 'HEAD' && apiConfig.csrf_token) {
+            headers['X-CSRF-Token'] = apiConfig.csrf_token;
         }
 
-        return fetch(url, { ...options, headers });
+        const response = await fetch(url, { ...options, headers });
+        if (response.status === 401 && apiConfig.auth_enabled) {
+            redirectToLogin();
+        } else if (response.status === 403 && apiConfig.auth_enabled) {
+            showMessage(getTranslation('messages.permission_denied',
+                'Your role does not allow this action.'), 'error');
+        } else if (response.status >= 502 && response.status <= 504 && backendPrefix() === '/api' && !readinessTimer) {
+            checkReadiness();
+        }
+        await noteProxyProblem(response);
+        return response;
+    }
+
+    // The proxy answers with a stable error code when the backend cannot
+    // be reached, or with the last known status marked as stale. Say so
+    // once when that changes, not on every refresh.
+    let proxyProblem = null;
+    const PROXY_ERROR_FALLBACKS = {
+        backend_unreachable: 'The autossh API is unreachable.',
+        backend_timeout: 'The autossh API did not answer in time.',
+        circuit_open: 'The autossh API failed repeatedly; requests are paused for a moment.',
+        backend_not_configured: 'No autossh API is configured (API_BASE_URL).',
+        proxy_misconfigured: 'The API proxy is misconfigured.',
+    };
+
+    async function noteProxyProblem(response) {
+        let problem = null;
+        const staleSince = response.headers.get('X-Autossh-Stale');
+        if (staleSince) {
+            problem = 'stale';
+        } else if (response.status >= 502 && response.status <= 504) {
+            try {
+                problem = (await response.clone().json()).code || null;
+            } catch (error) {
+                problem = null;
+            }
+        }
+        // A stale status adds nothing to an error already shown
+        if (problem === proxyProblem || (problem === 'stale' && proxyProblem)) return;
+        proxyProblem = problem;
+        if (problem === 'stale') {
+            showMessage(getTranslation('proxy_errors.stale',
+                'The autossh API is unreachable; showing the status from {{time}}.')
+                .replace('{{time}}', new Date(staleSince).toLocaleTimeString()), 'info');
+        } else if (problem && PROXY_ERROR_FALLBACKS[problem]) {
+            showMessage(getTranslation('proxy_errors.' + problem, PROXY_ERROR_FALLBACKS[problem]), 'error');
+        }
     }
 
     // Fetch tunnel statuses from API server
@@ -185,8 +492,11 @@ document.addEventListener("DOMContentLoaded", () => {
             }
         } catch (error) {
             console.error("Error loading configuration:", error);
-            const errorMsg = window.i18n ? window.i18n.t('messages.config_load_failed') : 'Failed to load configuration';
-            showMessage(errorMsg, "error");
+            // Proxy errors have been reported already
+            if (!proxyProblem) {
+                const errorMsg = window.i18n ? window.i18n.t('messages.config_load_failed') : 'Failed to load configuration';
+                showMessage(errorMsg, "error");
+            }
         } finally {
             if (!isConfigSaving) {
                 showLoading(false);
@@ -389,7 +699,7 @@ document.addEventListener("DOMContentLoaded", () => {
                     showMessage(waitMsg, 'info');
                     return;
                 }
-                window.location.href = `/tunnel-detail?hash=${tunnelHash}`;
+                window.location.href = detailUrl(tunnelHash);
             });
             statusIndicator.style.transition = "transform 0.2s ease";
             statusIndicator.addEventListener("mouseenter", () => {
@@ -540,7 +850,7 @@ document.addEventListener("DOMContentLoaded", () => {
                     showMessage(waitMsg, 'info');
                     return;
                 }
-                window.location.href = `/tunnel-detail?hash=${newHash}`;
+                window.location.href = detailUrl(newHash);
             });
 
             newStatusIndicator.style.transition = "transform 0.2s ease";
@@ -839,6 +1149,7 @@ document.addEventListener("DOMContentLoaded", () => {
         if (refreshBtn) {
             refreshBtn.addEventListener('click', () => {
                 refreshStatuses();
+                if (fleetInterval) loadFleet();
             });
         }
 
@@ -870,6 +1181,11 @@ document.addEventListener("DOMContentLoaded", () => {
         }
 
         // Valid response (may be empty if no tunnels are running)
+        applyStatuses(statuses);
+    }
+
+    // Update every row from a map of running tunnels; others are stopped
+    function applyStatuses(statuses) {
         const rows = tableBody.querySelectorAll('tr');
         rows.forEach(row => {
             const statusIndicator = row.querySelector('.status-indicator');
@@ -882,6 +1198,14 @@ document.addEventListener("DOMContentLoaded", () => {
         });
     }
 
+    // Update the row of one tunnel after a status event
+    function applyStatusChange(event) {
+        const statusIndicator = tableBody.querySelector(`.status-indicator[data-hash="${CSS.escape(event.hash)}"]`);
+        if (statusIndicator) {
+            updateStatusIndicator(statusIndicator, event.to);
+        }
+    }
+
     // Update a single status indicator
     function updateStatusIndicator(indicator, status) {
         let statusColor = "var(--text-secondary)";
@@ -917,8 +1241,26 @@ document.addEventListener("DOMContentLoaded", () => {
         indicator.title = statusTooltip;
     }
 
-    // Start auto-refresh
+    // Start auto-refresh: follow the server's status stream, or poll
+    // when it is unavailable or another backend is selected
     function startAutoRefresh() {
+        if (statusEvents || autoRefreshInterval) return;
+        if (typeof StatusEvents === 'function' && (!currentBackend || currentBackend.default)) {
+            statusEvents = new StatusEvents({
+                onSnapshot: applyStatuses,
+                onChange: applyStatusChange,
+                onUnavailable: () => {
+                    statusEvents = null;
+                    startPolling();
+                },
+            });
+            statusEvents.start();
+            return;
+        }
+        startPolling();
+    }
+
+    function startPolling() {
         if (autoRefreshInterval) return;
         autoRefreshInterval = setInterval(() => {
             refreshStatuses();
@@ -927,6 +1269,10 @@ document.addEventListener("DOMContentLoaded", () => {
 
     // Stop auto-refresh
     function stopAutoRefresh() {
+        if (statusEvents) {
+            statusEvents.stop();
+            statusEvents = null;
+        }
         if (autoRefreshInterval) {
             clearInterval(autoRefreshInterval);
             autoRefreshInterval = null;
@@ -0,0 +1,84 @@
+/**
+ * StatusEvents — follows tunnel status over the /api/events stream. The
+ * panel polls the backend once for every open tab and pushes changes.
+ *
+ * Usage:
+ *   const events = new StatusEvents({
+ *     onSnapshot: (statuses) => {},  // { hash: status } of running tunnels
+ *     onChange: (event) => {},       // { hash, name, from, to, time }
+ *     onUnavailable: () => {},       // stream refused; fall back to polling
+ *   });
+ *   events.start();
+ *   events.stop();
+ */
+(function () {
+  'use strict';
+
+  function StatusEvents(options) {
+    this._options = options || {};
+    this._source = null;
+  }
+
+  StatusEvents.supported = function () {
+    return typeof window.EventSource === 'function';
+  };
+
+  StatusEvents.prototype.start = function () {
+    if (this._source) return;
+    if (!StatusEvents.supported()) {
+      this._call('onUnavailable');
+      return;
+    }
+
+    var self = this;
+    var source = new EventSource((window.BASE_PATH || '') + '/api/events');
+    this._source = source;
+
+    source.addEventListener('snapshot', function (e) {
+      var data = parse(e.data);
+      if (!data) return;
+      var statuses = {};
+      (data.tunnels || []).forEach(function (t) {
+        if (t.hash) statuses[t.hash] = t.status;
+      });
+      self._call('onSnapshot', statuses);
+    });
+
+    source.addEventListener('status', function (e) {
+      var event = parse(e.data);
+      if (event) self._call('onChange', event);
+    });
+
+    // The browser reconnects on its own and resumes with Last-Event-ID;
+    // a closed source means the server refused the stream
+    source.onerror = function () {
+      if (source.readyState === EventSource.CLOSED) {
+        self.stop();
+        self._call('onUnavailable');
+      }
+    };
+  };
+
+  StatusEvents.prototype.stop = function () {
+    if (this._source) {
+      this._source.close();
+      this._source = null;
+    }
+  };
+
+  StatusEvents.prototype._call = function (name, arg) {
+    if (this._options[name]) {
+      this._options[name](arg);
+    }
+  };
+
+  function parse(text) {
+    try {
+      return JSON.parse(text);
+    } catch (err) {
+      return null;
+    }
+  }
+
+  window.StatusEvents = StatusEvents;
+})();
@@ -33,6 +33,8 @@
     this._statusReceived = false;
     this._currentHash = null;
     this._autoCloseTimer = null;
+    this._nativeMode = false;
+    this._prompt = null;
 
     this._createDOM();
     this._bindGlobalEvents();
@@ -162,10 +164,21 @@
 
   TerminalModal.prototype._connect = function (hash, apiConfig) {
     var protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    var wsUrl = protocol + '//' + window.location.host + '/ws/auth/' + hash;
-
-    if (apiConfig.api_key) {
-      wsUrl += '?token=' + encodeURIComponent(apiConfig.api_key);
+    // Tunnels of other backends than the default one go through that
+    // backend's WebSocket path
+    var wsUrl = protocol + '//' + window.location.host + (window.BASE_PATH || '') +
+      (apiConfig.ws_prefix || '/ws') + '/auth/' + hash;
+    var params = [];
+
+    // Native mode: the server performs SSH auth itself and sends each
+    // challenge as a structured prompt instead of raw PTY output
+    this._nativeMode = apiConfig.ws_auth_mode === 'native';
+    this._prompt = null;
+    if (this._nativeMode) {
+      params.push('mode=native');
+    }
+    if (params.length) {
+      wsUrl += '?' + params.join('&');
     }
 
     this._ws = new WebSocket(wsUrl);
@@ -190,6 +203,10 @@
           var msg = JSON.parse(event.data);
           if (msg.type === 'status') {
             self._handleStatus(msg);
+          } else if (msg.type === 'prompt') {
+            self._handlePrompt(msg);
+          } else if (msg.type === 'info') {
+            self._term.write(msg.message.replace(/\r?\n/g, '\r\n') + '\r\n');
           }
         } catch (e) {
           // Not JSON — write as plain text
@@ -218,12 +235,65 @@
 
     // Wire terminal input → WebSocket
     this._term.onData(function (data) {
+      if (self._nativeMode) {
+        self._handlePromptInput(data);
+        return;
+      }
       if (self._ws && self._ws.readyState === WebSocket.OPEN) {
         self._ws.send(new TextEncoder().encode(data));
       }
     });
   };
 
+  // ---- Native mode prompts ----
+
+  TerminalModal.prototype._handlePrompt = function (msg) {
+    if (msg.name) this._term.write(msg.name + '\r\n');
+    if (msg.instruction) this._term.write(msg.instruction.replace(/\r?\n/g, '\r\n') + '\r\n');
+
+    this._prompt = { questions: msg.questions || [], index: 0, answers: [], buffer: '' };
+    this._showQuestion();
+  };
+
+  TerminalModal.prototype._showQuestion = function () {
+    var q = this._prompt.questions[this._prompt.index];
+    this._term.write(q.prompt);
+  };
+
+  TerminalModal.prototype._handlePromptInput = function (data) {
+    var p = this._prompt;
+    if (!p) return;
+    var q = p.questions[p.index];
+
+    for (var i = 0; i < data.length; i++) {
+      var ch = data[i];
+      if (ch === '\r' || ch === '\n') {
+        this._term.write('\r\n');
+        p.answers.push(p.buffer);
+        p.buffer = '';
+        p.index++;
+        if (p.index < p.questions.length) {
+          this._showQuestion();
+          q = p.questions[p.index];
+        } else {
+          this._prompt = null;
+          if (this._ws && this._ws.readyState === WebSocket.OPEN) {
+            this._ws.send(JSON.stringify({ type: 'answers', answers: p.answers }));
+          }
+          return;
+        }
+      } else if (ch === '\x7f' || ch === '\b') {
+        if (p.buffer.length > 0) {
+          p.buffer = p.buffer.slice(0, -1);
+          if (q.echo) this._term.write('\b \b');
+        }
+      } else if (ch >= ' ') {
+        p.buffer += ch;
+        if (q.echo) this._term.write(ch);
+      }
+    }
+  };
+
   // ---- Status message handling ----
 
   TerminalModal.prototype._handleStatus = function (msg) {
@@ -237,7 +307,9 @@
         this._updateStatus('success');
         this._term.write('\r\n\x1b[32m\u2713 ' + msg.message + '\x1b[0m\r\n');
         this._showMessage(
-          this._t('terminal.auth_success', 'Authentication successful! Tunnel is now running.'),
+          msg.method === 'control_master'
+            ? this._t('terminal.reused_master', 'Tunnel restored through the existing SSH connection, no re-authentication needed.')
+            : this._t('terminal.auth_success', 'Authentication successful! Tunnel is now running.'),
           'success'
         );
         this._autoCloseTimer = setTimeout(function () {
@@ -321,6 +393,7 @@
     this._sessionActive = false;
     this._statusReceived = false;
     this._currentHash = null;
+    this._prompt = null;
   };
 
   // ---- Theme ----
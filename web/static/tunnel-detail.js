@@ -1,13 +1,22 @@
 // Tunnel Detail Page JavaScript
 
 document.addEventListener("DOMContentLoaded", () => {
+    // URL prefix the panel is served under, set by the page template
+    const basePath = window.BASE_PATH || '';
+
     // API configuration - will be loaded from server
-    let apiConfig = { api_key: '', ws_enabled: false };
+    let apiConfig = { ws_enabled: false, ws_auth_mode: 'pty', auth_enabled: false, csrf_token: '' };
 
     // Auto refresh settings
     let autoRefreshInterval = null;
+    let statusEvents = null; // live status stream, when available
     const AUTO_REFRESH_INTERVAL = 5000; // 5 seconds
 
+    // Status history, when the panel records it
+    let historyReport = null;
+    let historyInterval = null;
+    const HISTORY_REFRESH_INTERVAL = 60000; // 1 minute
+
     // Get tunnel hash from URL parameter
     const urlParams = new URLSearchParams(window.location.search);
     const tunnelHash = urlParams.get('hash');
@@ -17,6 +26,12 @@ document.addEventListener("DOMContentLoaded", () => {
         return;
     }
 
+    // Tunnels of other backends than the default one name it. The status
+    // stream, history and re-authentication events follow the default
+    // backend only.
+    const backendName = urlParams.get('backend') || '';
+    const apiPrefix = backendName ? '/api/backends/' + encodeURIComponent(backendName) : '/api';
+
     // DOM Elements
     const tunnelNameInput = document.getElementById('tunnelName');
     const tunnelHashEl = document.getElementById('tunnelHash');
@@ -35,6 +50,8 @@ document.addEventListener("DOMContentLoaded", () => {
     const clearLogsBtn = document.getElementById('clearLogsBtn');
     const autoRefreshCheckbox = document.getElementById('autoRefresh');
     const copyHashBtn = document.getElementById('copyHashBtn');
+    const historyCard = document.getElementById('historyCard');
+    const historyWindowSelect = document.getElementById('historyWindow');
 
     let currentTunnel = null;
     let currentHash = tunnelHash; // Track current hash (may change after save)
@@ -60,9 +77,29 @@ document.addEventListener("DOMContentLoaded", () => {
             });
         }
 
+        // Notify when this tunnel drops and needs re-authentication
+        if (apiConfig.ws_enabled && !backendName && typeof ReauthEvents === 'function') {
+            new ReauthEvents({
+                showMessage: showMessage,
+                onEvent: (event) => {
+                    if (event.hash === currentHash) {
+                        refreshTunnelStatus();
+                        loadLogs();
+                    }
+                },
+                getTranslation: getTranslation,
+            }).start();
+        }
+
         loadTunnelDetails();
         // Start auto-refresh by default
         startAutoRefresh();
+
+        if (apiConfig.history_enabled) {
+            historyCard.hidden = false;
+            loadHistory();
+            historyInterval = setInterval(loadHistory, HISTORY_REFRESH_INTERVAL);
+        }
     });
 
     // Set up event listeners
@@ -75,6 +112,7 @@ document.addEventListener("DOMContentLoaded", () => {
         loadLogs();
     });
     clearLogsBtn.addEventListener('click', clearLogs);
+    historyWindowSelect.addEventListener('change', loadHistory);
 
     // Interactive toggle event
     interactiveToggle.addEventListener('click', () => {
@@ -129,6 +167,9 @@ document.addEventListener("DOMContentLoaded", () => {
             updateControlButtonTitles();
             updateStatusDisplay(currentTunnel.status || 'STOPPED');
         }
+        if (historyReport) {
+            displayHistory(historyReport);
+        }
     });
 
     // Listen for language change event to update translations
@@ -138,6 +179,9 @@ document.addEventListener("DOMContentLoaded", () => {
             updateControlButtonTitles();
             updateStatusDisplay(currentTunnel.status || 'STOPPED');
         }
+        if (historyReport) {
+            displayHistory(historyReport);
+        }
     });
 
     // Update control button titles based on interactive state
@@ -170,28 +214,93 @@ document.addEventListener("DOMContentLoaded", () => {
     // Load API configuration
     async function loadAPIConfig() {
         try {
-            const response = await fetch('/api/config/api');
+            const response = await fetch(basePath + '/api/config/api');
+            if (response.status === 401) {
+                redirectToLogin();
+                return;
+            }
             if (response.ok) {
                 const data = await response.json();
-                apiConfig.api_key = data.api_key || '';
                 apiConfig.ws_enabled = data.ws_enabled || false;
+                apiConfig.ws_auth_mode = data.ws_auth_mode || 'pty';
+                apiConfig.auth_enabled = data.auth_enabled || false;
+                apiConfig.csrf_token = data.csrf_token || '';
+                apiConfig.auth_source = data.auth_source || '';
+                apiConfig.totp_enabled = data.totp_enabled || false;
+                apiConfig.history_enabled = data.history_enabled || false;
+                setupLogout();
+            }
+            if (backendName) {
+                await loadBackend();
             }
         } catch (error) {
             console.warn('Failed to load API config:', error);
         }
     }
 
-    // Helper function to make authenticated API calls (proxied through web panel)
-    function apiCall(endpoint, options = {}) {
-        const url = '/api/autossh' + endpoint;
+    // Take WebSocket support from the tunnel's backend and keep it selected
+    // on the way back to the tunnel list
+    async function loadBackend() {
+        apiConfig.history_enabled = false;
+        apiConfig.ws_enabled = false;
+        apiConfig.ws_prefix = apiPrefix + '/ws';
+        const backLink = document.querySelector('.header-back');
+        if (backLink) {
+            backLink.href = basePath + '/?backend=' + encodeURIComponent(backendName);
+        }
+        const response = await fetch(basePath + '/api/backends');
+        if (!response.ok) return;
+        const backend = (await response.json()).find(b => b.name === backendName);
+        if (backend) {
+            apiConfig.ws_enabled = backend.ws_enabled;
+        }
+    }
+
+    // Send the browser to the login page, returning here afterwards
+    function redirectToLogin() {
+        window.location.href = basePath + '/login?next=' + encodeURIComponent(window.location.pathname + window.location.search);
+    }
+
+    // Show the logout button when the panel requires login
+    function setupLogout() {
+        const logoutBtn = document.getElementById('logoutButton');
+        // Second factors apply to password logins only
+        const totpLink = document.getElementById('totpLink');
+        if (totpLink && apiConfig.totp_enabled && apiConfig.auth_source === 'password') {
+            totpLink.style.display = '';
+        }
+        // Users signed in by a trusted proxy log out at the proxy
+        if (!logoutBtn || !apiConfig.auth_enabled || apiConfig.auth_source === 'proxy') return;
+        logoutBtn.style.display = '';
+        logoutBtn.addEventListener('click', async () => {
+            await fetch(basePath + '/logout', {
+                method: 'POST',
+                headers: { 'X-CSRF-Token': apiConfig.csrf_token },
+            });
+            window.location.href = basePath + '/login';
+        });
+    }
+
+    // Helper function to make API calls (proxied through web panel, which
+    // adds the backend API key)
+    async function apiCall(endpoint, options = {}) {
+        const url = basePath + apiPrefix + '/autossh' + endpoint;
         const headers = options.headers || {};
 
-        // Add Bearer token if API key is configured
-        if (apiConfig.api_key) {
-            headers['Authorization'] = 'Bearer ' + apiConfig.api_key;
+        // Mutating requests must carry the session's CSRF token
+        const method = (options.method || 'GET').toUpperCase();
+        if (method !== 'GET' && method !== 'HEAD' && apiConfig.csrf_token) {
+            headers['X-CSRF-Token'] = apiConfig.csrf_token;
         }
 
-        return fetch(url, { ...options, headers });
+        const response = await fetch(url, { ...options, headers });
+        if (response.status === 401 && apiConfig.auth_enabled) {
+            redirectToLogin();
+        } else if (response.status === 403 && apiConfig.auth_enabled) {
+            showMessage(getTranslation('messages.permission_denied',
+                'Your role does not allow this action.'), 'error');
+        }
+        return response;
     }
 
     async function loadTunnelDetails(retryCount = 0) {
@@ -664,23 +773,128 @@ document.addEventListener("DOMContentLoaded", () => {
         logBox.innerHTML = '<div class="log-placeholder"><i class="material-icons">info</i><p>Logs cleared</p></div>';
     }
 
-    // Start auto-refresh
+    // Start auto-refresh: status follows the server's status stream when
+    // available; logs are always polled
     function startAutoRefresh() {
         if (autoRefreshInterval) return;
+        if (!backendName && typeof StatusEvents === 'function' && StatusEvents.supported()) {
+            statusEvents = new StatusEvents({
+                onSnapshot: (statuses) => applyStatus(statuses[currentHash] || 'STOPPED'),
+                onChange: (event) => {
+                    if (event.hash === currentHash) {
+                        applyStatus(event.to);
+                        loadLogs();
+                        if (historyInterval) loadHistory();
+                    }
+                },
+                onUnavailable: () => { statusEvents = null; },
+            });
+            statusEvents.start();
+        }
         autoRefreshInterval = setInterval(() => {
-            refreshTunnelStatus();
+            if (!statusEvents) {
+                refreshTunnelStatus();
+            }
             loadLogs();
         }, AUTO_REFRESH_INTERVAL);
     }
 
     // Stop auto-refresh
     function stopAutoRefresh() {
+        if (statusEvents) {
+            statusEvents.stop();
+            statusEvents = null;
+        }
         if (autoRefreshInterval) {
             clearInterval(autoRefreshInterval);
             autoRefreshInterval = null;
         }
     }
 
+    function applyStatus(status) {
+        if (!currentTunnel) return;
+        currentTunnel.status = status;
+        updateStatusDisplay(status);
+    }
+
+    // Load the status history report for the selected window
+    async function loadHistory() {
+        try {
+            const url = basePath + '/api/history/' + encodeURIComponent(currentHash) +
+                '?window=' + encodeURIComponent(historyWindowSelect.value);
+            const response = await fetch(url);
+            if (response.status === 401 && apiConfig.auth_enabled) {
+                redirectToLogin();
+                return;
+            }
+            if (!response.ok) {
+                throw new Error(`HTTP error! status: ${response.status}`);
+            }
+            historyReport = await response.json();
+            displayHistory(historyReport);
+        } catch (error) {
+            console.warn('Failed to load status history:', error);
+        }
+    }
+
+    function displayHistory(report) {
+        const notAvailable = getTranslation('history.not_available', 'n/a');
+        document.getElementById('historyUptime').textContent =
+            report.uptime === null ? notAvailable : report.uptime.toFixed(2) + '%';
+        document.getElementById('historyFailures').textContent = report.failures;
+        document.getElementById('historyMtbf').textContent =
+            report.mtbf_seconds === null ? notAvailable : formatDuration(report.mtbf_seconds);
+        document.getElementById('historyLongestOutage').textContent =
+            report.longest_outage_seconds > 0 ? formatDuration(report.longest_outage_seconds) : notAvailable;
+
+        // One bar per segment, sized by its share of the window
+        const timeline = document.getElementById('historyTimeline');
+        const since = Date.parse(report.since);
+        const total = Date.parse(report.until) - since;
+        timeline.innerHTML = '';
+        report.segments.forEach((segment) => {
+            const start = Date.parse(segment.start);
+            const end = Date.parse(segment.end);
+            const bar = document.createElement('div');
+            bar.className = 'history-segment ' + statusClass(segment.status);
+            bar.style.left = ((start - since) / total * 100) + '%';
+            bar.style.width = ((end - start) / total * 100) + '%';
+            bar.title = `${segment.status}: ${new Date(start).toLocaleString()} – ${new Date(end).toLocaleString()}`;
+            timeline.appendChild(bar);
+        });
+    }
+
+    // Matches statusClass in history.go
+    function statusClass(status) {
+        switch (status) {
+            case 'NORMAL':
+            case 'RUNNING':
+                return 'up';
+            case 'STOPPED':
+                return 'stopped';
+            case 'UNKNOWN':
+            case '':
+                return 'unknown';
+            default:
+                return 'outage';
+        }
+    }
+
+    // Format seconds as e.g. "3d 4h", "2h 5m" or "40s"
+    function formatDuration(seconds) {
+        const units = [['d', 86400], ['h', 3600], ['m', 60], ['s', 1]];
+        const parts = [];
+        let rest = Math.round(seconds);
+        for (const [unit, size] of units) {
+            if (rest >= size || (parts.length === 0 && unit === 's')) {
+                parts.push(Math.floor(rest / size) + unit);
+                rest %= size;
+            }
+            if (parts.length === 2) break;
+        }
+        return parts.join(' ');
+    }
+
     // Get or create toast container
     function getToastContainer() {
         let container = document.querySelector('.toast-container');
@@ -814,7 +1028,7 @@ document.addEventListener("DOMContentLoaded", () => {
                 <div class="card-content" style="text-align: center; padding: 40px;">
                     <i class="material-icons" style="font-size: 64px; color: var(--error);">error</i>
                     <h2 style="margin-top: 16px; color: var(--error);">${text}</h2>
-                    <a href="/" class="btn btn-primary" style="margin-top: 24px; display: inline-flex;">
+                    <a href="${basePath}/" class="btn btn-primary" style="margin-top: 24px; display: inline-flex;">
                         Back to Home
                     </a>
                 </div>
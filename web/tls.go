@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPS configuration. With WEB_TLS=true the panel serves TLS from
+// WEB_TLS_CERT/WEB_TLS_KEY, or from a self-signed pair it generates in
+// WEB_TLS_DIR when those are unset.
+var (
+	tlsConfig         *tls.Config // nil serves plain HTTP
+	httpRedirectAddr  string      // plain HTTP listener redirecting to HTTPS
+	hstsMaxAge        = 365 * 24 * time.Hour
+	certCheckInterval = 10 * time.Second
+)
+
+// Self-signed certificates are valid for 825 days, the most some browsers
+// accept, and are replaced once less than 30 days remain.
+const (
+	selfSignedValidity = 825 * 24 * time.Hour
+	selfSignedRenewal  = 30 * 24 * time.Hour
+)
+
+// certReloader serves a certificate pair from disk and picks up a new pair
+// when either file changes, so renewed certificates apply without a
+// restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	checked  time.Time
+}
+
+// newCertReloader loads the pair at certFile and keyFile.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload re-reads the pair if either file changed since the last read.
+// Callers must hold c.mu or own c exclusively.
+func (c *certReloader) reload() error {
+	var modTimes [2]time.Time
+	for i, f := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if c.cert != nil && modTimes == c.modTimes {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTimes = modTimes
+	if c.checked.IsZero() {
+		logMsg("INFO", "WEB", "Loaded TLS certificate %s", c.certFile)
+	} else {
+		logMsg("INFO", "WEB", "Reloaded TLS certificate %s", c.certFile)
+	}
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. The files are
+// checked at most every certCheckInterval; a pair that fails to load keeps
+// the previous certificate in service.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		if err := c.reload(); err != nil {
+			logMsg("WARN", "WEB", "Failed to reload TLS certificate %s, keeping the current one: %v", c.certFile, err)
+		}
+		c.checked = time.Now()
+	}
+	return c.cert, nil
+}
+
+// parseTLSHosts splits a comma-separated list of DNS names and IP
+// addresses into certificate SANs.
+func parseTLSHosts(spec string) (dnsNames []string, ips []net.IP) {
+	for _, h := range strings.Split(spec, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if ip := net.ParseIP(h); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, strings.ToLower(h))
+		}
+	}
+	return dnsNames, ips
+}
+
+// selfSignedHosts returns the SANs for a generated certificate: the
+// configured hosts plus the machine's hostname and loopback addresses.
+func selfSignedHosts(spec string) (dnsNames []string, ips []net.IP) {
+	defaults := "localhost,127.0.0.1,::1"
+	if name, err := os.Hostname(); err == nil && name != "" {
+		defaults += "," + name
+	}
+	seen := map[string]bool{}
+	all, allIPs := parseTLSHosts(spec + "," + defaults)
+	for _, name := range all {
+		if !seen[name] {
+			seen[name] = true
+			dnsNames = append(dnsNames, name)
+		}
+	}
+	for _, ip := range allIPs {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			ips = append(ips, ip)
+		}
+	}
+	return dnsNames, ips
+}
+
+// selfSignedCurrent reports whether the certificate at certFile is still
+// usable: readable, not close to expiry and covering every wanted host.
+func selfSignedCurrent(certFile string, dnsNames []string, ips []net.IP) bool {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || time.Until(cert.NotAfter) < selfSignedRenewal {
+		return false
+	}
+	have := map[string]bool{}
+	for _, name := range cert.DNSNames {
+		have[name] = true
+	}
+	for _, ip := range cert.IPAddresses {
+		have[ip.String()] = true
+	}
+	for _, name := range dnsNames {
+		if !have[name] {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if !have[ip.String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// ensureSelfSigned writes a self-signed certificate and key to dir unless
+// a current one is already there, and returns their paths.
+func ensureSelfSigned(dir, hostSpec string) (certFile, keyFile string, err error) {
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	dnsNames, ips := selfSignedHosts(hostSpec)
+	if _, err := os.Stat(keyFile); err == nil && selfSignedCurrent(certFile, dnsNames, ips) {
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: dnsNames[0], Organization: []string{"SSH Tunnel Manager (self-signed)"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+	// A reload between the two writes fails to pair the files and keeps
+	// serving the current certificate
+	if err := writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return "", "", err
+	}
+	logMsg("INFO", "WEB", "Generated a self-signed TLS certificate for %s", strings.Join(append(dnsNames, ipStrings(ips)...), ", "))
+	return certFile, keyFile, nil
+}
+
+func ipStrings(ips []net.IP) []string {
+	var s []string
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+// withHSTS adds a Strict-Transport-Security header to responses served
+// over TLS.
+func withHSTS(h http.Handler) http.Handler {
+	if hstsMaxAge <= 0 {
+		return h
+	}
+	value := "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirectHandler sends plain HTTP requests to the same URL on the
+// HTTPS listener at tlsAddr.
+func httpsRedirectHandler(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "" && port != "443" {
+			host += ":" + port
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// loadTLSFromEnv sets up HTTPS when WEB_TLS is true.
+func loadTLSFromEnv() error {
+	if os.Getenv("WEB_TLS") != "true" {
+		return nil
+	}
+
+	certFile, keyFile := os.Getenv("WEB_TLS_CERT"), os.Getenv("WEB_TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("WEB_TLS_CERT and WEB_TLS_KEY must be set together")
+	}
+	if certFile == "" {
+		dir := os.Getenv("WEB_TLS_DIR")
+		if dir == "" {
+			dir = "tls"
+		}
+		var err error
+		if certFile, keyFile, err = ensureSelfSigned(dir, os.Getenv("WEB_TLS_HOSTS")); err != nil {
+			return fmt.Errorf("generating self-signed certificate in %s: %w", dir, err)
+		}
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if v := os.Getenv("WEB_HSTS_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid WEB_HSTS_MAX_AGE %q", v)
+		}
+		hstsMaxAge = d
+	}
+	if p := os.Getenv("WEB_HTTP_REDIRECT_PORT"); p != "" {
+		if !strings.HasPrefix(p, ":") {
+			p = ":" + p
+		}
+		httpRedirectAddr = p
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnsureSelfSigned(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	certFile, keyFile, err := ensureSelfSigned(dir, "tunnels.lan, 192.168.1.10")
+	if err != nil {
+		t.Fatalf("ensureSelfSigned: %v", err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("generated pair does not load: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(pair.Certificate[0])
+	for _, host := range []string{"tunnels.lan", "192.168.1.10", "localhost", "127.0.0.1"} {
+		if err := cert.VerifyHostname(host); err != nil {
+			t.Errorf("certificate does not cover %s: %v", host, err)
+		}
+	}
+	if info, _ := os.Stat(keyFile); info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	// A current certificate is kept; a new host replaces it
+	before, _ := os.ReadFile(certFile)
+	ensureSelfSigned(dir, "192.168.1.10,tunnels.lan")
+	if after, _ := os.ReadFile(certFile); !bytes.Equal(before, after) {
+		t.Error("certificate regenerated although it covers every host")
+	}
+	ensureSelfSigned(dir, "tunnels.lan,192.168.1.10,tunnels.example.com")
+	if after, _ := os.ReadFile(certFile); bytes.Equal(before, after) {
+		t.Error("certificate kept although a host was added")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	oldInterval := certCheckInterval
+	t.Cleanup(func() { certCheckInterval = oldInterval })
+	certCheckInterval = 0
+
+	dir := t.TempDir()
+	certFile, keyFile, err := ensureSelfSigned(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := c.GetCertificate(nil)
+
+	// A broken pair keeps the current certificate in service
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	if got, _ := c.GetCertificate(nil); got != first {
+		t.Error("broken key replaced the certificate")
+	}
+
+	// Regenerating gives new files, picked up without a restart
+	os.Remove(keyFile)
+	if _, _, err := ensureSelfSigned(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	second, _ := c.GetCertificate(nil)
+	if second == first || bytes.Equal(second.Certificate[0], first.Certificate[0]) {
+		t.Error("new certificate was not loaded")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		tlsAddr, host, target, want string
+	}{
+		{":5443", "panel.lan:5000", "/tunnels/audit?user=alice", "https://panel.lan:5443/tunnels/audit?user=alice"},
+		{":443", "panel.lan", "/", "https://panel.lan/"},
+		{":5443", "[::1]:5000", "/", "https://[::1]:5443/"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		httpsRedirectHandler(tt.tlsAddr).ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s%s: %d %q, want %q", tt.host, tt.target, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
+
+func TestHSTS(t *testing.T) {
+	h := withHSTS(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS sent over plain HTTP")
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("Strict-Transport-Security = %q", got)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiTokenPrefix marks panel-issued tokens so they can be told apart from
+// the backend API key.
+const apiTokenPrefix = "ast_"
+
+var validScopes = map[string]bool{ScopeRead: true, ScopeControl: true, ScopeConfig: true, ScopeAuth: true, ScopeAgent: true}
+
+// APIToken is a named credential for scripts and CI jobs. Only the SHA-256
+// of the secret is kept.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scopes    []string   `json:"scopes"`
+	Tunnels   []string   `json:"tunnels,omitempty"` // name globs; empty means all
+	Agent     string     `json:"agent,omitempty"`   // the one agent name an agent token may connect as
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the token is past its expiry.
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// HasScope reports whether the token was issued with scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the token may make a request matching rule about
+// the tunnel with hash in dir ("" for requests not about one tunnel).
+func (t *APIToken) Allows(dir *TunnelDirectory, rule accessRule, hash string) bool {
+	granted := t.HasScope(rule.Scope)
+	if !granted || len(t.Tunnels) == 0 {
+		return granted
+	}
+	if hash == "" {
+		// Lists stay readable; actions on every tunnel are out of reach
+		return rule.Scope == ScopeRead
+	}
+	return dir.Matches(hash, t.Tunnels)
+}
+
+// TokenStore keeps API tokens in a JSON file.
+type TokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens []*APIToken
+}
+
+// tokenStore is nil when WEB_TOKENS_FILE is unset, which disables tokens.
+var tokenStore *TokenStore
+
+// Token store errors
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenInvalid  = errors.New("invalid token request")
+)
+
+// NewTokenStore loads the tokens file at path; a missing file is empty.
+func NewTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.tokens); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// save writes the tokens file. Callers must hold s.mu.
+func (s *TokenStore) save() error {
+	return writeJSONFile(s.path, s.tokens)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues a token and returns it with its secret, which is not
+// stored and cannot be shown again.
+func (s *TokenStore) Create(name string, scopes, tunnelGlobs []string, agent string, ttl time.Duration, createdBy string) (*APIToken, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", fmt.Errorf("%w: name is required", ErrTokenInvalid)
+	}
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("%w: at least one scope is required", ErrTokenInvalid)
+	}
+	hasAgentScope := false
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return nil, "", fmt.Errorf("%w: unknown scope %q", ErrTokenInvalid, scope)
+		}
+		hasAgentScope = hasAgentScope || scope == ScopeAgent
+	}
+	globs, err := parseTunnelGlobs(tunnelGlobs)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+	}
+	switch {
+	case hasAgentScope && agent == "":
+		return nil, "", fmt.Errorf("%w: the agent scope needs the agent name the token is for", ErrTokenInvalid)
+	case hasAgentScope && !backendNamePattern.MatchString(agent):
+		return nil, "", fmt.Errorf("%w: invalid agent name %q", ErrTokenInvalid, agent)
+	case !hasAgentScope && agent != "":
+		return nil, "", fmt.Errorf("%w: an agent name needs the agent scope", ErrTokenInvalid)
+	}
+	if ttl < 0 {
+		return nil, "", fmt.Errorf("%w: negative lifetime", ErrTokenInvalid)
+	}
+
+	secret := apiTokenPrefix + randomToken()
+	t := &APIToken{
+		ID:        randomToken()[:12],
+		Name:      name,
+		Hash:      hashToken(secret),
+		Scopes:    scopes,
+		Tunnels:   globs,
+		Agent:     agent,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	if ttl > 0 {
+		expires := t.CreatedAt.Add(ttl)
+		t.ExpiresAt = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = append(s.tokens, t)
+	if err := s.save(); err != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		return nil, "", err
+	}
+	return t, secret, nil
+}
+
+// Revoke deletes the token with id.
+func (s *TokenStore) Revoke(id string) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.tokens {
+		if t.ID != id {
+			continue
+		}
+		rest := append(append([]*APIToken{}, s.tokens[:i]...), s.tokens[i+1:]...)
+		old := s.tokens
+		s.tokens = rest
+		if err := s.save(); err != nil {
+			s.tokens = old
+			return nil, err
+		}
+		return t, nil
+	}
+	return nil, ErrTokenNotFound
+}
+
+// List returns the tokens, newest first.
+func (s *TokenStore) List() []*APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := append([]*APIToken{}, s.tokens...)
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Verify returns the live token matching secret, or nil.
+func (s *TokenStore) Verify(secret string) *APIToken {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil
+	}
+	hash := hashToken(secret)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.Hash == hash && !t.Expired() {
+			return t
+		}
+	}
+	return nil
+}
+
+// checkTokenConfig refuses a token store on a panel without login: there
+// would be nobody to manage the tokens, and requests without one would get
+// past their scopes.
+func checkTokenConfig() error {
+	if tokenStore != nil && !authEnabled() {
+		return errors.New("WEB_TOKENS_FILE needs a login method: set WEB_USERS_FILE, OIDC_ISSUER or WEB_TRUSTED_PROXIES")
+	}
+	return nil
+}
+
+// tokenSession returns a request-scoped session for a valid API token in
+// the Authorization header, or nil.
+func tokenSession(r *http.Request) *Session {
+	if tokenStore == nil {
+		return nil
+	}
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	t := tokenStore.Verify(strings.TrimSpace(secret))
+	if t == nil {
+		return nil
+	}
+	return &Session{User: "token:" + t.Name, Source: SourceToken, Token: t}
+}
+
+// tokenView is how a token is shown by the API; the hash stays private.
+type tokenView struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Tunnels   []string   `json:"tunnels,omitempty"`
+	Agent     string     `json:"agent,omitempty"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Expired   bool       `json:"expired"`
+	Token     string     `json:"token,omitempty"` // only when created
+}
+
+func newTokenView(t *APIToken) tokenView {
+	return tokenView{
+		ID:        t.ID,
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		Tunnels:   t.Tunnels,
+		Agent:     t.Agent,
+		CreatedBy: t.CreatedBy,
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+		Expired:   t.Expired(),
+	}
+}
+
+// tokensHandler serves GET/POST /api/tokens and DELETE /api/tokens/{id}.
+// Managing tokens needs an admin session; tokens cannot manage tokens.
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	if tokenStore == nil {
+		writeJSONError(w, http.StatusNotFound, "API tokens are disabled")
+		return
+	}
+	sess := currentSession(r)
+	if sess == nil || sess.Token != nil || sess.Role != RoleAdmin {
+		writeJSONError(w, http.StatusForbidden, "Permission denied")
+		return
+	}
+	actor := sess.User
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tokens"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		views := []tokenView{}
+		for _, t := range tokenStore.List() {
+			views = append(views, newTokenView(t))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(views)
+
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			Tunnels   []string `json:"tunnels"`
+			Agent     string   `json:"agent"`      // required with the agent scope
+			ExpiresIn string   `json:"expires_in"` // Go duration, e.g. "720h"; empty never expires
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+		var ttl time.Duration
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "Invalid expires_in")
+				return
+			}
+			ttl = d
+		}
+		t, secret, err := tokenStore.Create(req.Name, req.Scopes, req.Tunnels, req.Agent, ttl, actor)
+		if errors.Is(err, ErrTokenInvalid) {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			logMsg("ERROR", "AUTH", "Failed to save API token: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to save token")
+			return
+		}
+		logMsg("INFO", "AUTH", "User %q created API token %q (%s) with scopes %s",
+			actor, t.Name, t.ID, strings.Join(t.Scopes, ","))
+		view := newTokenView(t)
+		view.Token = secret
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(view)
+
+	case id != "" && r.Method == http.MethodDelete:
+		t, err := tokenStore.Revoke(id)
+		if errors.Is(err, ErrTokenNotFound) {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			logMsg("ERROR", "AUTH", "Failed to save API tokens: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to revoke token")
+			return
+		}
+		logMsg("INFO", "AUTH", "User %q revoked API token %q (%s)", actor, t.Name, t.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
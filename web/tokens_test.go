@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withTokenStore(t *testing.T) *TokenStore {
+	t.Helper()
+	old := tokenStore
+	t.Cleanup(func() { tokenStore = old })
+	store, err := NewTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("NewTokenStore: %v", err)
+	}
+	tokenStore = store
+	return store
+}
+
+func TestTokenStore_Lifecycle(t *testing.T) {
+	store := withTokenStore(t)
+
+	tok, secret, err := store.Create("ci", []string{ScopeRead}, nil, "", time.Hour, "alice")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if !strings.HasPrefix(secret, apiTokenPrefix) || store.Verify(secret) != tok {
+		t.Fatal("new token does not verify")
+	}
+	if store.Verify(secret+"x") != nil {
+		t.Error("wrong secret verified")
+	}
+
+	// Only the hash is written to disk, and it survives a reload
+	data, _ := os.ReadFile(store.path)
+	if bytes.Contains(data, []byte(secret)) {
+		t.Error("secret stored in plain text")
+	}
+	reloaded, err := NewTokenStore(store.path)
+	if err != nil || reloaded.Verify(secret) == nil {
+		t.Fatalf("token lost on reload: %v", err)
+	}
+
+	if _, err := store.Revoke(tok.ID); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if store.Verify(secret) != nil {
+		t.Error("revoked token still verifies")
+	}
+	if _, err := store.Revoke(tok.ID); err != ErrTokenNotFound {
+		t.Errorf("second Revoke = %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestTokenStore_Expired(t *testing.T) {
+	store := withTokenStore(t)
+	tok, secret, err := store.Create("old", []string{ScopeRead}, nil, "", time.Hour, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	tok.ExpiresAt = &past
+	if store.Verify(secret) != nil {
+		t.Error("expired token verifies")
+	}
+}
+
+func TestTokenStore_CreateInvalid(t *testing.T) {
+	store := withTokenStore(t)
+	tests := []struct {
+		name    string
+		scopes  []string
+		tunnels []string
+		agent   string
+	}{
+		{"", []string{ScopeRead}, nil, ""},
+		{"x", nil, nil, ""},
+		{"x", []string{"root"}, nil, ""},
+		{"x", []string{ScopeRead}, []string{"[bad"}, ""},
+		{"x", []string{ScopeAgent}, nil, ""},
+		{"x", []string{ScopeAgent}, nil, "a/b"},
+		{"x", []string{ScopeRead}, nil, "edge"},
+	}
+	for _, tt := range tests {
+		if _, _, err := store.Create(tt.name, tt.scopes, tt.tunnels, tt.agent, 0, "alice"); err == nil {
+			t.Errorf("Create(%q, %v, %v, %q) succeeded, want error", tt.name, tt.scopes, tt.tunnels, tt.agent)
+		}
+	}
+}
+
+func TestAPIToken_Allows(t *testing.T) {
+	withTunnels(t, map[string]string{"aaaa1111": "ci-runner", "bbbb2222": "prod-db"})
+	tok := &APIToken{Scopes: []string{ScopeRead, ScopeControl}, Tunnels: []string{"ci-*"}}
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/status", true},
+		{"POST", "/stop/aaaa1111", true},
+		{"POST", "/stop/bbbb2222", false},
+		{"GET", "/logs/bbbb2222", false},
+		{"POST", "/stop", false},
+		{"POST", "/config/new", false},
+	}
+	for _, tt := range tests {
+		rule, hash := matchRule(apiAccessRules, tt.method, tt.path)
+		if got := tok.Allows(tunnels, rule, hash); got != tt.want {
+			t.Errorf("Allows(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAPIProxy_AcceptsTokens(t *testing.T) {
+	server, seen := withTrustedProxy(t, "10.255.255.255", "")
+	store := withTokenStore(t)
+	oldKey := apiKey
+	t.Cleanup(func() { apiKey = oldKey })
+	apiKey = "master"
+
+	_, secret, err := store.Create("monitoring", []string{ScopeRead}, nil, "", 0, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/api/autossh/status", secret, http.StatusOK},
+		{"POST", "/api/autossh/stop", secret, http.StatusForbidden},
+		{"GET", "/api/autossh/status", apiTokenPrefix + "forged", http.StatusUnauthorized},
+		{"GET", "/api/tokens", secret, http.StatusUnauthorized}, // tokens only work on proxied routes
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+	if got := seen.Get("Authorization"); got != "Bearer master" {
+		t.Errorf("backend saw Authorization %q, want the master key", got)
+	}
+	if got := seen.Get("X-Forwarded-User"); got != "token:monitoring" {
+		t.Errorf("backend saw user %q, want token:monitoring", got)
+	}
+}
+
+func TestTokensHandler(t *testing.T) {
+	withTrustedProxy(t, "10.255.255.255", "")
+	withTokenStore(t)
+
+	call := func(sess *Session, method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if sess != nil {
+			r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sess.ID})
+			r.Header.Set(csrfHeaderName, sess.CSRFToken)
+		}
+		w := httptest.NewRecorder()
+		requireAuth(http.HandlerFunc(tokensHandler)).ServeHTTP(w, r)
+		return w
+	}
+	admin := sessions.Create("alice", RoleAdmin, SourcePassword)
+	viewer := sessions.Create("bob", RoleViewer, SourcePassword)
+
+	if w := call(viewer, "GET", "/api/tokens", ""); w.Code != http.StatusForbidden {
+		t.Errorf("viewer list: status %d, want 403", w.Code)
+	}
+
+	w := call(admin, "POST", "/api/tokens", `{"name":"ci","scopes":["read","control"],"expires_in":"24h"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var created tokenView
+	json.NewDecoder(w.Body).Decode(&created)
+	if created.Token == "" || created.ExpiresAt == nil || created.CreatedBy != "alice" {
+		t.Errorf("created = %+v", created)
+	}
+
+	w = call(admin, "GET", "/api/tokens", "")
+	var list []map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 1 || list[0]["token"] != nil || list[0]["hash"] != nil {
+		t.Errorf("list = %v, want one token without secret or hash", list)
+	}
+
+	if w := call(admin, "POST", "/api/tokens", `{"name":"x","scopes":["everything"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("bad scope: status %d, want 400", w.Code)
+	}
+	if w := call(admin, "DELETE", "/api/tokens/"+created.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("revoke: status %d, want 204", w.Code)
+	}
+	if w := call(admin, "DELETE", "/api/tokens/"+created.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second revoke: status %d, want 404", w.Code)
+	}
+}
+
+func TestTokens_WithoutLogin(t *testing.T) {
+	server, _ := withTrustedProxy(t, "", "")
+	store := withTokenStore(t)
+	if err := checkTokenConfig(); err == nil {
+		t.Error("a token store without a login method was accepted")
+	}
+
+	// Nobody can mint tokens on such a panel...
+	w := httptest.NewRecorder()
+	requireAuth(http.HandlerFunc(tokensHandler)).ServeHTTP(w,
+		httptest.NewRequest("POST", "/api/tokens", strings.NewReader(`{"name":"x","scopes":["agent"]}`)))
+	if w.Code != http.StatusForbidden || len(store.List()) != 0 {
+		t.Errorf("anonymous create: status %d, %d tokens", w.Code, len(store.List()))
+	}
+
+	// ...and tokens keep to their scopes
+	_, secret, _ := store.Create("monitoring", []string{ScopeRead}, nil, "", 0, "alice")
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/api/autossh/status", http.StatusOK},
+		{"POST", "/api/autossh/stop", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s with a read token: status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// TOTP parameters (RFC 6238 defaults, understood by every authenticator app)
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // accept codes one period early or late
+	totpRecoveryCodes = 10
+	totpMaxAttempts   = 5 // wrong codes in a row before the user is locked out
+	mfaCookieName     = "autossh_mfa"
+	rememberCookie    = "autossh_mfa_device"
+)
+
+// TOTP configuration
+var (
+	totpIssuer        = "SSH Tunnel Manager"
+	totpRequiredRoles = map[string]bool{}
+	totpRememberTTL   = 30 * 24 * time.Hour // 0 disables "remember this device"
+	mfaLoginTTL       = 5 * time.Minute
+	totpLockout       = 15 * time.Minute // doubled for each lockout in a row
+	totpMaxLockout    = 24 * time.Hour
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code for secret at time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// newTOTPSecret returns a random 160-bit secret, base32 encoded.
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return b32.EncodeToString(b)
+}
+
+// matchTOTP returns the time step code is valid for near now, or 0.
+func matchTOTP(secret, code string, now time.Time) int64 {
+	key, err := b32.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// provisioningURI returns the otpauth:// URI authenticator apps import.
+func provisioningURI(user, secret string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	label := url.PathEscape(totpIssuer + ":" + user)
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// normalizeCode strips the spaces and dashes people type into codes.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// TOTPUser is one user's second factor.
+type TOTPUser struct {
+	Secret     string               `json:"secret"`
+	Recovery   []string             `json:"recovery"`          // SHA-256 of unused recovery codes
+	LastStep   int64                `json:"last_step"`         // codes cannot be replayed
+	Devices    map[string]time.Time `json:"devices,omitempty"` // SHA-256 of remember tokens -> expiry
+	EnrolledAt time.Time            `json:"enrolled_at"`
+}
+
+// TOTPStore keeps TOTP enrolments in a JSON file.
+type TOTPStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]*TOTPUser
+}
+
+// totp is nil when WEB_TOTP_FILE is unset, which disables second factors.
+var totp *TOTPStore
+
+// ErrTOTPNotEnrolled is returned for users without a second factor.
+var ErrTOTPNotEnrolled = errors.New("TOTP not enrolled")
+
+// NewTOTPStore loads the TOTP file at path; a missing file is empty.
+func NewTOTPStore(path string) (*TOTPStore, error) {
+	s := &TOTPStore{path: path, users: make(map[string]*TOTPUser)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Enrolled reports whether user has a second factor.
+func (s *TOTPStore) Enrolled(user string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.users[user]
+	return ok
+}
+
+// Required reports whether a password login by user with role needs a
+// second factor.
+func (s *TOTPStore) Required(user, role string) bool {
+	return totpRequiredRoles[role] || s.Enrolled(user)
+}
+
+// Enroll stores secret for user once code proves the authenticator has it,
+// and returns fresh recovery codes.
+func (s *TOTPStore) Enroll(user, secret, code string) ([]string, bool, error) {
+	step := matchTOTP(secret, normalizeCode(code), time.Now())
+	if step == 0 {
+		return nil, false, nil
+	}
+	codes := make([]string, totpRecoveryCodes)
+	hashes := make([]string, totpRecoveryCodes)
+	b := make([]byte, 5)
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, false, err
+		}
+		raw := strings.ToLower(b32.EncodeToString(b))
+		codes[i] = raw[:4] + "-" + raw[4:]
+		hashes[i] = hashToken(raw)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, had := s.users[user]
+	s.users[user] = &TOTPUser{Secret: secret, Recovery: hashes, LastStep: step, EnrolledAt: time.Now().UTC()}
+	if err := s.save(); err != nil {
+		if had {
+			s.users[user] = old
+		} else {
+			delete(s.users, user)
+		}
+		return nil, false, err
+	}
+	return codes, true, nil
+}
+
+// Disable removes the second factor of user.
+func (s *TOTPStore) Disable(user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[user]
+	if !ok {
+		return ErrTOTPNotEnrolled
+	}
+	delete(s.users, user)
+	if err := s.save(); err != nil {
+		s.users[user] = old
+		return err
+	}
+	return nil
+}
+
+// Verify checks a TOTP or recovery code for user. Used recovery codes and
+// time steps are consumed.
+func (s *TOTPStore) Verify(user, code string) (ok, recovery bool) {
+	code = normalizeCode(code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, enrolled := s.users[user]
+	if !enrolled {
+		return false, false
+	}
+
+	if step := matchTOTP(u.Secret, code, time.Now()); step != 0 && step > u.LastStep {
+		u.LastStep = step
+		s.saveOrLog()
+		return true, false
+	}
+	hash := hashToken(code)
+	for i, h := range u.Recovery {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			u.Recovery = append(u.Recovery[:i:i], u.Recovery[i+1:]...)
+			s.saveOrLog()
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// RecoveryLeft returns how many unused recovery codes user has.
+func (s *TOTPStore) RecoveryLeft(user string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[user]; ok {
+		return len(u.Recovery)
+	}
+	return 0
+}
+
+// Remember issues a device token that skips the second factor for user
+// until it expires.
+func (s *TOTPStore) Remember(user string) (string, time.Time, error) {
+	token := randomToken()
+	expires := time.Now().Add(totpRememberTTL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[user]
+	if !ok {
+		return "", time.Time{}, ErrTOTPNotEnrolled
+	}
+	if u.Devices == nil {
+		u.Devices = make(map[string]time.Time)
+	}
+	for h, exp := range u.Devices {
+		if time.Now().After(exp) {
+			delete(u.Devices, h)
+		}
+	}
+	u.Devices[hashToken(token)] = expires
+	return token, expires, s.save()
+}
+
+// Remembered reports whether token is a live device token of user.
+func (s *TOTPStore) Remembered(user, token string) bool {
+	if token == "" || totpRememberTTL <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[user]
+	if !ok {
+		return false
+	}
+	exp, ok := u.Devices[hashToken(token)]
+	return ok && time.Now().Before(exp)
+}
+
+// save writes the TOTP file. Callers must hold s.mu.
+func (s *TOTPStore) save() error {
+	return writeJSONFile(s.path, s.users)
+}
+
+func (s *TOTPStore) saveOrLog() {
+	if err := s.save(); err != nil {
+		logMsg("ERROR", "AUTH", "Failed to save TOTP file: %v", err)
+	}
+}
+
+// loadTOTPFromEnv reads the WEB_TOTP_* variables.
+func loadTOTPFromEnv() error {
+	path := os.Getenv("WEB_TOTP_FILE")
+	if path == "" {
+		return nil
+	}
+	store, err := NewTOTPStore(path)
+	if err != nil {
+		return err
+	}
+	for _, role := range strings.Split(os.Getenv("WEB_TOTP_REQUIRED_ROLES"), ",") {
+		if role = strings.TrimSpace(role); role == "" {
+			continue
+		}
+		if roleRank[role] == 0 {
+			return fmt.Errorf("invalid role %q in WEB_TOTP_REQUIRED_ROLES", role)
+		}
+		totpRequiredRoles[role] = true
+	}
+	if v := os.Getenv("WEB_TOTP_REMEMBER"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid WEB_TOTP_REMEMBER %q", v)
+		}
+		totpRememberTTL = d
+	}
+	if v := os.Getenv("WEB_TOTP_ISSUER"); v != "" {
+		totpIssuer = v
+	}
+	totp = store
+	return nil
+}
+
+// mfaLogin is a password login waiting for its second factor.
+type mfaLogin struct {
+	User    string
+	Role    string
+	Next    string
+	Secret  string // set while enrolling
+	Expires time.Time
+}
+
+// mfaFailures counts a user's wrong codes across pending logins, so a new
+// password login does not buy more guesses.
+type mfaFailures struct {
+	count       int
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// MFALogins holds logins between the password and the TOTP step, and the
+// wrong codes of each user.
+type MFALogins struct {
+	mu       sync.Mutex
+	logins   map[string]*mfaLogin
+	failures map[string]*mfaFailures
+}
+
+var mfaLogins = &MFALogins{logins: make(map[string]*mfaLogin), failures: make(map[string]*mfaFailures)}
+
+// Start records a login that passed the password check.
+func (m *MFALogins) Start(user, role, next string) string {
+	id := randomToken()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, l := range m.logins {
+		if now.After(l.Expires) {
+			delete(m.logins, k)
+		}
+	}
+	m.logins[id] = &mfaLogin{User: user, Role: role, Next: next, Expires: now.Add(mfaLoginTTL)}
+	return id
+}
+
+// Get returns a copy of the pending login with id.
+func (m *MFALogins) Get(id string) (mfaLogin, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.logins[id]
+	if !ok || time.Now().After(l.Expires) {
+		delete(m.logins, id)
+		return mfaLogin{}, false
+	}
+	return *l, true
+}
+
+// SetSecret stores the secret being enrolled for the pending login.
+func (m *MFALogins) SetSecret(id, secret string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.logins[id]; ok {
+		l.Secret = secret
+	}
+}
+
+// LockedFor reports how long user's second factor stays locked, or 0.
+func (m *MFALogins) LockedFor(user string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f, ok := m.failures[user]; ok {
+		if wait := time.Until(f.lockedUntil); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// Fail counts a wrong code for the pending login with id and reports
+// whether its user may try again. Once the user is locked out the login
+// ends.
+func (m *MFALogins) Fail(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.logins[id]
+	if !ok {
+		return false
+	}
+	if !m.fail(l.User) {
+		delete(m.logins, id)
+		return false
+	}
+	return true
+}
+
+// FailUser counts a wrong code entered by user outside a login, such as
+// when turning the second factor off, and reports whether they may try
+// again.
+func (m *MFALogins) FailUser(user string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fail(user)
+}
+
+// fail counts a wrong code for user. After totpMaxAttempts wrong codes in
+// a row the user is locked out, for longer each time. m.mu is held.
+func (m *MFALogins) fail(user string) bool {
+	f, ok := m.failures[user]
+	if !ok {
+		f = &mfaFailures{}
+		m.failures[user] = f
+	}
+	f.count++
+	if f.count < totpMaxAttempts {
+		return true
+	}
+	lockout := totpLockout << f.lockouts
+	if lockout > totpMaxLockout || lockout <= 0 {
+		lockout = totpMaxLockout
+	}
+	f.count = 0
+	f.lockouts++
+	f.lockedUntil = time.Now().Add(lockout)
+	logMsg("WARN", "AUTH", "Second factor for user %q locked for %s after %d wrong codes", user, lockout, totpMaxAttempts)
+	return false
+}
+
+// Finish drops the pending login with id.
+func (m *MFALogins) Finish(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.logins, id)
+}
+
+// Passed forgets user's wrong codes after a right one.
+func (m *MFALogins) Passed(user string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, user)
+}
+
+// TOTPPage is the data for templates/totp.html.
+type TOTPPage struct {
+	Mode          string // "verify", "enroll", "recovery" or "manage"
+	Error         string // "invalid" or "locked"
+	User          string
+	Action        string
+	Next          string
+	CSRFToken     string
+	Secret        string
+	URI           string
+	QR            template.URL
+	RecoveryCodes []string
+	RecoveryLeft  int
+	Remember      bool // offer "remember this device"
+	RememberDays  int
+}
+
+func renderTOTP(w http.ResponseWriter, status int, page TOTPPage) {
+	w.Header().Set("Cache-Control", "no-store")
+	renderTemplate(w, status, "totp.html", page)
+}
+
+// enrollPage fills in the provisioning details for secret.
+func enrollPage(page TOTPPage, secret string) TOTPPage {
+	page.Mode = "enroll"
+	page.Secret = secret
+	page.URI = provisioningURI(page.User, secret)
+	if png, err := qrcode.Encode(page.URI, qrcode.Medium, 220); err == nil {
+		page.QR = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	return page
+}
+
+// setMFACookie writes or clears the pending-login cookie.
+func setMFACookie(w http.ResponseWriter, r *http.Request, id string) {
+	c := &http.Cookie{
+		Name:     mfaCookieName,
+		Value:    id,
+		Path:     withBase("/login"),
+		HttpOnly: true,
+		Secure:   cookieSecure || r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(mfaLoginTTL.Seconds()),
+	}
+	if id == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// startMFA decides whether a password login needs its second factor. It
+// returns false when the login may go ahead; otherwise it has redirected
+// to the TOTP step.
+func startMFA(w http.ResponseWriter, r *http.Request, user, role, next string) bool {
+	if totp == nil || !totp.Required(user, role) {
+		return false
+	}
+	if c, err := r.Cookie(rememberCookie); err == nil && totp.Remembered(user, c.Value) {
+		logMsg("INFO", "AUTH", "Second factor for %q skipped on a remembered device", user)
+		return false
+	}
+	setMFACookie(w, r, mfaLogins.Start(user, role, next))
+	http.Redirect(w, r, withBase("/login/totp"), http.StatusSeeOther)
+	return true
+}
+
+// loginTOTPHandler is the second step of a password login: it verifies a
+// code, or enrols users whose role requires a second factor.
+func loginTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if totp == nil {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := r.Cookie(mfaCookieName)
+	if err != nil {
+		http.Redirect(w, r, withBase("/login"), http.StatusSeeOther)
+		return
+	}
+	id := c.Value
+	login, ok := mfaLogins.Get(id)
+	if !ok {
+		setMFACookie(w, r, "")
+		http.Redirect(w, r, withBase("/login"), http.StatusSeeOther)
+		return
+	}
+
+	page := TOTPPage{
+		Mode:         "verify",
+		User:         login.User,
+		Action:       withBase("/login/totp"),
+		Remember:     totpRememberTTL > 0,
+		RememberDays: int(totpRememberTTL.Hours() / 24),
+	}
+	enrolled := totp.Enrolled(login.User)
+	if !enrolled {
+		if login.Secret == "" {
+			login.Secret = newTOTPSecret()
+			mfaLogins.SetSecret(id, login.Secret)
+		}
+		page = enrollPage(page, login.Secret)
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		renderTOTP(w, http.StatusOK, page)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !checkWSOrigin(r) {
+		http.Error(w, "Forbidden origin", http.StatusForbidden)
+		return
+	}
+	if wait := mfaLogins.LockedFor(login.User); wait > 0 {
+		// Not even a right code gets in while locked
+		logMsg("WARN", "AUTH", "Second factor for user %q tried from %s while locked for %s", login.User, r.RemoteAddr, wait.Round(time.Second))
+		mfaLogins.Finish(id)
+		setMFACookie(w, r, "")
+		renderLogin(w, http.StatusTooManyRequests, newLoginPage(withBase("/"), "totp_locked"))
+		return
+	}
+	code := r.PostFormValue("code")
+	var recoveryCodes []string
+	if enrolled {
+		ok, usedRecovery := totp.Verify(login.User, code)
+		if ok && usedRecovery {
+			logMsg("WARN", "AUTH", "User %q used a recovery code, %d left", login.User, totp.RecoveryLeft(login.User))
+		}
+		if !ok {
+			failTOTP(w, r, id, login.User, page)
+			return
+		}
+	} else {
+		codes, ok, err := totp.Enroll(login.User, login.Secret, code)
+		if err != nil {
+			logMsg("ERROR", "AUTH", "Failed to save TOTP enrolment for %q: %v", login.User, err)
+			http.Error(w, "Failed to save enrolment", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			failTOTP(w, r, id, login.User, page)
+			return
+		}
+		logMsg("INFO", "AUTH", "User %q enrolled a second factor", login.User)
+		recoveryCodes = codes
+	}
+
+	mfaLogins.Finish(id)
+	mfaLogins.Passed(login.User)
+	setMFACookie(w, r, "")
+	if page.Remember && r.PostFormValue("remember") != "" {
+		if token, expires, err := totp.Remember(login.User); err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     rememberCookie,
+				Value:    token,
+				Path:     withBase("/login"),
+				Expires:  expires,
+				HttpOnly: true,
+				Secure:   cookieSecure || r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+		} else {
+			logMsg("ERROR", "AUTH", "Failed to remember device for %q: %v", login.User, err)
+		}
+	}
+	sess := sessions.Create(login.User, login.Role, SourcePassword)
+	setSessionCookie(w, r, sess)
+	logMsg("INFO", "AUTH", "User %q logged in with second factor as %s from %s", login.User, login.Role, r.RemoteAddr)
+
+	if recoveryCodes != nil {
+		renderTOTP(w, http.StatusOK, TOTPPage{Mode: "recovery", User: login.User, Next: login.Next, RecoveryCodes: recoveryCodes})
+		return
+	}
+	http.Redirect(w, r, login.Next, http.StatusSeeOther)
+}
+
+// failTOTP answers a wrong code, ending the login after too many.
+func failTOTP(w http.ResponseWriter, r *http.Request, id, user string, page TOTPPage) {
+	logMsg("WARN", "AUTH", "Wrong second factor for user %q from %s", user, r.RemoteAddr)
+	if !mfaLogins.Fail(id) {
+		setMFACookie(w, r, "")
+		renderLogin(w, http.StatusUnauthorized, newLoginPage(withBase("/"), "totp_locked"))
+		return
+	}
+	page.Error = "invalid"
+	renderTOTP(w, http.StatusUnauthorized, page)
+}
+
+// accountTOTPHandler lets a logged-in local user enrol or remove a second
+// factor. requireAuth has already checked the CSRF token of posts.
+func accountTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	sess := currentSession(r)
+	if totp == nil || sess == nil || sess.Source != SourcePassword {
+		http.NotFound(w, r)
+		return
+	}
+	page := TOTPPage{
+		Mode:         "manage",
+		User:         sess.User,
+		Action:       withBase("/account/totp"),
+		CSRFToken:    sess.CSRFToken,
+		RecoveryLeft: totp.RecoveryLeft(sess.User),
+	}
+	enrolled := totp.Enrolled(sess.User)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !enrolled {
+			page = enrollPage(page, newTOTPSecret())
+		}
+		renderTOTP(w, http.StatusOK, page)
+
+	case http.MethodPost:
+		code := r.PostFormValue("code")
+		if !enrolled {
+			// The secret round-trips through the form of the user's own session
+			secret := r.PostFormValue("secret")
+			if _, err := b32.DecodeString(secret); err != nil || len(secret) < 16 {
+				http.Error(w, "Invalid secret", http.StatusBadRequest)
+				return
+			}
+			codes, ok, err := totp.Enroll(sess.User, secret, code)
+			if err != nil {
+				logMsg("ERROR", "AUTH", "Failed to save TOTP enrolment for %q: %v", sess.User, err)
+				http.Error(w, "Failed to save enrolment", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				page = enrollPage(page, secret)
+				page.Error = "invalid"
+				renderTOTP(w, http.StatusUnauthorized, page)
+				return
+			}
+			logMsg("INFO", "AUTH", "User %q enrolled a second factor", sess.User)
+			renderTOTP(w, http.StatusOK, TOTPPage{Mode: "recovery", User: sess.User, Next: withBase("/"), RecoveryCodes: codes})
+			return
+		}
+
+		if totpRequiredRoles[sess.Role] {
+			http.Error(w, "A second factor is required for your role", http.StatusForbidden)
+			return
+		}
+		// Wrong codes count towards the same lockout as at login, so a
+		// session cookie does not give unlimited guesses
+		if wait := mfaLogins.LockedFor(sess.User); wait > 0 {
+			logMsg("WARN", "AUTH", "User %q tried to remove their second factor from %s while locked for %s", sess.User, r.RemoteAddr, wait.Round(time.Second))
+			page.Error = "locked"
+			renderTOTP(w, http.StatusTooManyRequests, page)
+			return
+		}
+		if ok, _ := totp.Verify(sess.User, code); !ok {
+			logMsg("WARN", "AUTH", "Wrong second factor for user %q from %s", sess.User, r.RemoteAddr)
+			page.Error = "invalid"
+			status := http.StatusUnauthorized
+			if !mfaLogins.FailUser(sess.User) {
+				page.Error, status = "locked", http.StatusTooManyRequests
+			}
+			renderTOTP(w, status, page)
+			return
+		}
+		mfaLogins.Passed(sess.User)
+		if err := totp.Disable(sess.User); err != nil {
+			logMsg("ERROR", "AUTH", "Failed to remove TOTP for %q: %v", sess.User, err)
+			http.Error(w, "Failed to remove second factor", http.StatusInternalServerError)
+			return
+		}
+		logMsg("INFO", "AUTH", "User %q removed their second factor", sess.User)
+		http.Redirect(w, r, withBase("/account/totp"), http.StatusSeeOther)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
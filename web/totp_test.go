@@ -0,0 +1,294 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(provisioningURI("alice", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Query().Get("secret") != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("URI = %s", u)
+	}
+	if !strings.HasSuffix(u.Path, ":alice") {
+		t.Errorf("label = %q, want issuer:alice", u.Path)
+	}
+}
+
+// codeFor returns the code valid for secret steps periods from now.
+func codeFor(t *testing.T, secret string, steps int64) string {
+	t.Helper()
+	key, err := b32.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod+steps)
+}
+
+// withTOTPLogin serves password login with TOTP required for admins.
+func withTOTPLogin(t *testing.T) *httptest.Server {
+	t.Helper()
+	oldUsers, oldOIDC, oldTOTP, oldRequired := users, oidc, totp, totpRequiredRoles
+	oldLogins := mfaLogins
+	t.Cleanup(func() {
+		users, oidc, totp, totpRequiredRoles = oldUsers, oldOIDC, oldTOTP, oldRequired
+		mfaLogins = oldLogins
+	})
+	mfaLogins = &MFALogins{logins: make(map[string]*mfaLogin), failures: make(map[string]*mfaFailures)}
+
+	dir := t.TempDir()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pw"), bcrypt.MinCost)
+	usersFile := filepath.Join(dir, "users")
+	os.WriteFile(usersFile, []byte("alice:"+string(hash)+"\nbob:"+string(hash)+":viewer\n"), 0600)
+	var err error
+	if users, err = NewUserStore(usersFile); err != nil {
+		t.Fatal(err)
+	}
+	if totp, err = NewTOTPStore(filepath.Join(dir, "totp.json")); err != nil {
+		t.Fatal(err)
+	}
+	oidc = nil
+	totpRequiredRoles = map[string]bool{RoleAdmin: true}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "home") })
+	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/login/totp", loginTOTPHandler)
+	mux.HandleFunc("/account/totp", accountTOTPHandler)
+	server := httptest.NewServer(requireAuth(mux))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newJarClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+func postForm(t *testing.T, client *http.Client, target string, form url.Values) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.PostForm(target, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+var secretPattern = regexp.MustCompile(`class="totp-secret"><code>([A-Z2-7]+)</code>`)
+var recoveryPattern = regexp.MustCompile(`<li><code>([a-z2-7]{4}-[a-z2-7]{4})</code></li>`)
+
+func TestTOTPLogin_EnrolThenVerify(t *testing.T) {
+	server := withTOTPLogin(t)
+	login := url.Values{"username": {"alice"}, "password": {"pw"}, "next": {"/"}}
+
+	// Admins must enrol before their first session
+	client := newJarClient()
+	resp, body := postForm(t, client, server.URL+"/login", login)
+	if resp.Request.URL.Path != "/login/totp" || len(sessionCookies(client, server.URL)) != 0 {
+		t.Fatalf("landed on %s with a session before the second factor", resp.Request.URL)
+	}
+	m := secretPattern.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("no secret on the enrolment page")
+	}
+	secret := m[1]
+
+	resp, body = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {"000000"}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong code: status %d, want 401", resp.StatusCode)
+	}
+	enrolCode := codeFor(t, secret, 0)
+	resp, body = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {enrolCode}})
+	codes := recoveryPattern.FindAllStringSubmatch(body, -1)
+	if resp.StatusCode != http.StatusOK || len(codes) != totpRecoveryCodes {
+		t.Fatalf("enrol: status %d with %d recovery codes", resp.StatusCode, len(codes))
+	}
+	if len(sessionCookies(client, server.URL)) != 1 {
+		t.Fatal("no session after enrolment")
+	}
+
+	// Next login: the enrolment code cannot be replayed
+	client = newJarClient()
+	postForm(t, client, server.URL+"/login", login)
+	resp, _ = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {enrolCode}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replayed code: status %d, want 401", resp.StatusCode)
+	}
+	resp, _ = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {codeFor(t, secret, 1)}, "remember": {"1"}})
+	if resp.Request.URL.Path != "/" || len(sessionCookies(client, server.URL)) != 1 {
+		t.Errorf("valid code: landed on %s", resp.Request.URL)
+	}
+
+	// The remembered device skips the second step
+	resp, _ = postForm(t, client, server.URL+"/login", login)
+	if resp.Request.URL.Path != "/" {
+		t.Errorf("remembered device: landed on %s, want /", resp.Request.URL)
+	}
+
+	// A recovery code works exactly once
+	recovery := strings.ToUpper(codes[0][1])
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		client = newJarClient()
+		postForm(t, client, server.URL+"/login", login)
+		resp, _ = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {recovery}})
+		if resp.StatusCode != want {
+			t.Errorf("recovery code use %d: status %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	if left := totp.RecoveryLeft("alice"); left != totpRecoveryCodes-1 {
+		t.Errorf("RecoveryLeft = %d, want %d", left, totpRecoveryCodes-1)
+	}
+}
+
+func TestTOTPLogin_NotRequired(t *testing.T) {
+	server := withTOTPLogin(t)
+	client := newJarClient()
+	resp, _ := postForm(t, client, server.URL+"/login", url.Values{"username": {"bob"}, "password": {"pw"}, "next": {"/"}})
+	if resp.Request.URL.Path != "/" || len(sessionCookies(client, server.URL)) != 1 {
+		t.Errorf("viewer without TOTP landed on %s", resp.Request.URL)
+	}
+}
+
+func TestTOTPLogin_Lockout(t *testing.T) {
+	server := withTOTPLogin(t)
+	client := newJarClient()
+	postForm(t, client, server.URL+"/login", url.Values{"username": {"alice"}, "password": {"pw"}})
+
+	var resp *http.Response
+	for i := 0; i < totpMaxAttempts; i++ {
+		resp, _ = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {"000000"}})
+	}
+	if resp.Request.URL.Path != "/login/totp" || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("last attempt: %s %d", resp.Request.URL.Path, resp.StatusCode)
+	}
+	// The pending login is gone; the step sends the browser back to /login
+	resp, _ = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {"000000"}})
+	if resp.Request.URL.Path != "/login" {
+		t.Errorf("after lockout: landed on %s, want /login", resp.Request.URL.Path)
+	}
+
+	// Signing in again with the password buys no more guesses: not even the
+	// right code gets in while the user is locked out
+	_, body := postForm(t, client, server.URL+"/login", url.Values{"username": {"alice"}, "password": {"pw"}})
+	resp, _ = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {codeFor(t, secretPattern.FindStringSubmatch(body)[1], 0)}})
+	if resp.StatusCode != http.StatusTooManyRequests || len(sessionCookies(client, server.URL)) != 0 {
+		t.Errorf("right code while locked: status %d, %d session cookies", resp.StatusCode, len(sessionCookies(client, server.URL)))
+	}
+
+	// Once the lockout is over a right code gets in
+	mfaLogins.mu.Lock()
+	mfaLogins.failures["alice"].lockedUntil = time.Now()
+	mfaLogins.mu.Unlock()
+	_, body = postForm(t, client, server.URL+"/login", url.Values{"username": {"alice"}, "password": {"pw"}})
+	resp, _ = postForm(t, client, server.URL+"/login/totp", url.Values{"code": {codeFor(t, secretPattern.FindStringSubmatch(body)[1], 0)}})
+	if resp.StatusCode != http.StatusOK || len(sessionCookies(client, server.URL)) != 1 {
+		t.Errorf("right code after the lockout: status %d, %d session cookies", resp.StatusCode, len(sessionCookies(client, server.URL)))
+	}
+}
+
+func TestTOTPAccount_DisableLockout(t *testing.T) {
+	server := withTOTPLogin(t)
+	client := noRedirectClient()
+	postForm(t, client, server.URL+"/login", url.Values{"username": {"bob"}, "password": {"pw"}, "next": {"/"}})
+	csrf := sessionOf(t, client, server.URL).CSRFToken
+
+	resp, err := client.Get(server.URL + "/account/totp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	secret := secretPattern.FindStringSubmatch(string(body))[1]
+	resp, _ = postForm(t, client, server.URL+"/account/totp", url.Values{"secret": {secret}, "code": {codeFor(t, secret, 0)}, csrfFormField: {csrf}})
+	if resp.StatusCode != http.StatusOK || !totp.Enrolled("bob") {
+		t.Fatalf("enrol: status %d", resp.StatusCode)
+	}
+
+	// Wrong codes to turn the second factor off lock it like at login
+	disable := func(code string) int {
+		resp, _ := postForm(t, client, server.URL+"/account/totp", url.Values{"code": {code}, csrfFormField: {csrf}})
+		return resp.StatusCode
+	}
+	for i := 1; i < totpMaxAttempts; i++ {
+		if code := disable("000000"); code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: status %d, want 401", i, code)
+		}
+	}
+	if code := disable("000000"); code != http.StatusTooManyRequests {
+		t.Errorf("last wrong code: status %d, want 429", code)
+	}
+	if code := disable(codeFor(t, secret, 1)); code != http.StatusTooManyRequests || !totp.Enrolled("bob") {
+		t.Errorf("right code while locked: status %d, enrolled %v", code, totp.Enrolled("bob"))
+	}
+
+	// The lockout is the user's, so logging in again does not lift it
+	resp, _ = postForm(t, newJarClient(), server.URL+"/login", url.Values{"username": {"bob"}, "password": {"pw"}})
+	if resp.Request.URL.Path != "/login/totp" {
+		t.Fatalf("login landed on %s", resp.Request.URL.Path)
+	}
+	if wait := mfaLogins.LockedFor("bob"); wait <= 0 {
+		t.Error("bob is not locked out at login")
+	}
+
+	mfaLogins.mu.Lock()
+	mfaLogins.failures["bob"].lockedUntil = time.Now()
+	mfaLogins.mu.Unlock()
+	if code := disable(codeFor(t, secret, 1)); code != http.StatusSeeOther || totp.Enrolled("bob") {
+		t.Errorf("right code after the lockout: status %d, enrolled %v", code, totp.Enrolled("bob"))
+	}
+}
+
+func TestMFALogins_LockoutGrows(t *testing.T) {
+	m := &MFALogins{logins: make(map[string]*mfaLogin), failures: make(map[string]*mfaFailures)}
+	lockedFor := func() time.Duration {
+		id := m.Start("alice", RoleAdmin, "/")
+		for m.Fail(id) {
+		}
+		wait := m.LockedFor("alice")
+		m.failures["alice"].lockedUntil = time.Now()
+		return wait
+	}
+	first, second := lockedFor(), lockedFor()
+	if first <= totpLockout-time.Second || second <= 2*totpLockout-time.Second {
+		t.Errorf("lockouts %s then %s, want %s then twice that", first, second, totpLockout)
+	}
+	m.Passed("alice")
+	if third := lockedFor(); third > totpLockout {
+		t.Errorf("lockout after a right code = %s, want %s again", third, totpLockout)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "otlptrace"
+
+// tracer is nil unless an OTLP endpoint is configured.
+var tracer *otlptrace.Tracer
+
+// loadTracingFromEnv sets up trace export from the standard OpenTelemetry
+// variables (see otlptrace.FromEnv), as service autossh-web.
+func loadTracingFromEnv() error {
+	t, err := otlptrace.FromEnv("autossh-web", version, func(level, format string, args ...interface{}) {
+		logMsg(level, "TRACE", format, args...)
+	})
+	if err != nil {
+		return err
+	}
+	tracer = t
+	return nil
+}
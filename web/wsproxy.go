@@ -0,0 +1,302 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsRoute maps a WebSocket path on the web panel to a path on the ws-server.
+type wsRoute struct {
+	Prefix  string // request path; a trailing "/" also matches everything below it
+	Backend string // backend path that replaces Prefix
+}
+
+// defaultWSRoutes are the ws-server endpoints the panel itself uses.
+const defaultWSRoutes = "/ws/auth/,/ws/events"
+
+// WebSocket proxy configuration
+var (
+	wsRoutes         = parseWSRoutes(defaultWSRoutes)
+	wsAllowedOrigins []string
+	wsTokenCookie    = "autossh_token"
+)
+
+// parseWSRoutes parses a comma-separated route table. Each entry is either
+// "path", proxied to the same path on the backend, or "path=backend_path".
+func parseWSRoutes(spec string) []wsRoute {
+	var routes []wsRoute
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, backend, found := strings.Cut(entry, "=")
+		prefix, backend = strings.TrimSpace(prefix), strings.TrimSpace(backend)
+		if !found {
+			backend = prefix
+		}
+		if !strings.HasPrefix(prefix, "/ws/") || !strings.HasPrefix(backend, "/") {
+			logMsg("WARN", "WEB", "Ignoring invalid WebSocket route %q (paths must start with /ws/)", entry)
+			continue
+		}
+		routes = append(routes, wsRoute{Prefix: prefix, Backend: backend})
+	}
+	return routes
+}
+
+// matchWSRoute returns the backend path for a request path using the longest
+// matching route.
+func matchWSRoute(path string) (string, bool) {
+	var best *wsRoute
+	for i := range wsRoutes {
+		route := &wsRoutes[i]
+		matched := path == route.Prefix ||
+			(strings.HasSuffix(route.Prefix, "/") && strings.HasPrefix(path, route.Prefix))
+		if matched && (best == nil || len(route.Prefix) > len(best.Prefix)) {
+			best = route
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.Backend + strings.TrimPrefix(path, best.Prefix), true
+}
+
+// parseAllowedOrigins parses a comma-separated list of allowed origins.
+func parseAllowedOrigins(origins string) []string {
+	var result []string
+	for _, p := range strings.Split(origins, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// checkWSOrigin validates the Origin of a WebSocket upgrade. With
+// WS_ALLOWED_ORIGINS set the origin must be listed (full origin or host, "*"
+// allows any); otherwise its host must match the one the panel was reached on.
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Non-browser clients do not send Origin
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		logMsg("WARN", "WEB", "Invalid WebSocket origin %q from %s", origin, r.RemoteAddr)
+		return false
+	}
+
+	if len(wsAllowedOrigins) > 0 {
+		for _, allowed := range wsAllowedOrigins {
+			if allowed == "*" || origin == allowed || originURL.Host == allowed {
+				return true
+			}
+		}
+		logMsg("WARN", "WEB", "WebSocket origin %s not in allowed list", origin)
+		return false
+	}
+
+	// Compare host names only, since a reverse proxy may change the port
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !strings.EqualFold(originURL.Hostname(), strings.Trim(host, "[]")) {
+		logMsg("WARN", "WEB", "WebSocket origin %s does not match host %s", origin, r.Host)
+		return false
+	}
+	return true
+}
+
+// WebSocket upgrader for client connections
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkWSOrigin,
+}
+
+// backendWSHeaders builds the headers for the backend handshake. The
+// backend's API key is used when configured; otherwise the token comes from
+// the Authorization header or, for browsers that cannot set headers on
+// WebSockets, from the token cookie.
+func backendWSHeaders(r *http.Request, key string) http.Header {
+	headers := http.Header{}
+	if key != "" {
+		headers.Set("Authorization", "Bearer "+key)
+	} else if auth := r.Header.Get("Authorization"); auth != "" {
+		headers.Set("Authorization", auth)
+	} else if c, err := r.Cookie(wsTokenCookie); err == nil && c.Value != "" {
+		headers.Set("Authorization", "Bearer "+c.Value)
+	}
+
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		clientIP = prior + ", " + clientIP
+	}
+	headers.Set("X-Forwarded-For", clientIP)
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	headers.Set("X-Forwarded-Proto", proto)
+	headers.Set("X-Forwarded-Host", r.Host)
+	setForwardedIdentity(headers, r)
+	setTraceHeaders(headers, r)
+	return headers
+}
+
+// wsProxyHandler proxies WebSocket connections to the default backend's
+// ws-server according to the route table.
+func wsProxyHandler(w http.ResponseWriter, r *http.Request) {
+	proxyWebSocket(w, r, defaultBackend(), r.URL.Path)
+}
+
+// proxyWebSocket proxies a WebSocket connection to b's ws-server. wsPath is
+// the request path as it would be under /ws/ on the default backend.
+func proxyWebSocket(w http.ResponseWriter, r *http.Request, b *Backend, wsPath string) {
+	if !b.wsEnabled() {
+		logMsg("ERROR", "WEB", "WebSocket proxy requested but backend %s has no ws-server URL", b.Name)
+		http.Error(w, "WebSocket not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	backendPath, ok := matchWSRoute(wsPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !checkWSOrigin(r) {
+		http.Error(w, "Forbidden origin", http.StatusForbidden)
+		return
+	}
+	if !checkAccessOn(w, r, b.tunnels, wsAccessRules, wsPath) {
+		return
+	}
+	target := strings.TrimPrefix(wsPath, "/ws/")
+	if !b.isDefault() {
+		target = b.Name + ":" + target
+	}
+
+	logMsg("INFO", "WEB", "WebSocket proxy request for %s from %s", target, r.RemoteAddr)
+
+	// Build backend WebSocket URL
+	backendURL, err := url.Parse(b.WSURL)
+	if err != nil {
+		logMsg("ERROR", "WEB", "Invalid ws-server URL for backend %s: %v", b.Name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	backendURL.Path = strings.TrimSuffix(backendURL.Path, "/") + backendPath
+
+	// Forward query parameters; a token from the browser is replaced by
+	// the panel's key
+	query := r.URL.Query()
+	if b.APIKey != "" {
+		query.Del("token")
+	}
+	backendURL.RawQuery = query.Encode()
+
+	// Connect to the backend first so its chosen subprotocol can be returned
+	// to the client
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		Subprotocols:     websocket.Subprotocols(r),
+	}
+	if b.agent != nil {
+		dialer.Proxy, dialer.NetDialContext = nil, b.agent.dial
+	}
+	backendConn, _, backendErr := dialer.Dial(backendURL.String(), backendWSHeaders(r, b.APIKey))
+
+	var upgradeHeader http.Header
+	if backendErr == nil && backendConn.Subprotocol() != "" {
+		upgradeHeader = http.Header{"Sec-Websocket-Protocol": {backendConn.Subprotocol()}}
+	}
+
+	// Upgrade client connection
+	clientConn, err := wsUpgrader.Upgrade(w, r, upgradeHeader)
+	if err != nil {
+		logMsg("ERROR", "WEB", "Failed to upgrade client WebSocket: %v", err)
+		if backendConn != nil {
+			backendConn.Close()
+		}
+		return
+	}
+	defer clientConn.Close()
+	// The server's read and write timeouts cover the handshake only
+	clientConn.NetConn().SetDeadline(time.Time{})
+
+	if backendErr != nil {
+		logMsg("ERROR", "WEB", "Failed to connect to backend WebSocket: %v", backendErr)
+		clientConn.WriteMessage(websocket.TextMessage, []byte(`{"type":"status","code":"error","message":"Failed to connect to authentication server"}`))
+		return
+	}
+	defer backendConn.Close()
+
+	proxy := &wsProxy{client: clientConn, backend: backendConn}
+	if !activeWSProxies.add(proxy) {
+		clientConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+		return
+	}
+	defer activeWSProxies.remove(proxy)
+
+	logMsg("INFO", "WEB", "WebSocket proxy established for %s (request %s)", target, requestID(r))
+
+	// Bidirectional proxy
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Client -> Backend
+	go func() {
+		defer wg.Done()
+		for {
+			messageType, data, err := clientConn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					logMsg("DEBUG", "WEB", "Client read error for %s: %v", target, err)
+				}
+				backendConn.Close()
+				return
+			}
+			if err := backendConn.WriteMessage(messageType, data); err != nil {
+				logMsg("DEBUG", "WEB", "Backend write error for %s: %v", target, err)
+				return
+			}
+		}
+	}()
+
+	// Backend -> Client
+	go func() {
+		defer wg.Done()
+		for {
+			messageType, data, err := backendConn.ReadMessage()
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					logMsg("DEBUG", "WEB", "Backend read error for %s: %v", target, err)
+				}
+				clientConn.Close()
+				return
+			}
+			if err := clientConn.WriteMessage(messageType, data); err != nil {
+				logMsg("DEBUG", "WEB", "Client write error for %s: %v", target, err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	logMsg("INFO", "WEB", "WebSocket proxy closed for %s (request %s)", target, requestID(r))
+}
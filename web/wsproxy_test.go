@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsHandshake is what the backend saw of a proxied WebSocket handshake.
+type wsHandshake struct {
+	path, query, auth string
+}
+
+// withWSBackend points the default backend at a ws-server that records each
+// handshake, and serves wsProxyHandler with the given route table. It
+// returns the panel's URL.
+func withWSBackend(t *testing.T, routes, key string) (string, <-chan wsHandshake) {
+	t.Helper()
+	oldBase, oldKey, oldRoutes, oldOrigins := wsBaseURL, apiKey, wsRoutes, wsAllowedOrigins
+	t.Cleanup(func() { wsBaseURL, apiKey, wsRoutes, wsAllowedOrigins = oldBase, oldKey, oldRoutes, oldOrigins })
+
+	seen := make(chan wsHandshake, 8)
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- wsHandshake{r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization")}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(backend.Close)
+	wsBaseURL, apiKey, wsRoutes, wsAllowedOrigins = "ws"+strings.TrimPrefix(backend.URL, "http"), key, parseWSRoutes(routes), nil
+
+	panel := httptest.NewServer(http.HandlerFunc(wsProxyHandler))
+	t.Cleanup(panel.Close)
+	return panel.URL, seen
+}
+
+// dialStatus dials path on the panel and returns the handshake's HTTP status.
+func dialStatus(t *testing.T, panelURL, path string, header http.Header) int {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(panelURL, "http")+path, header)
+	if err == nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("dial %s: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestMatchWSRoute(t *testing.T) {
+	old := wsRoutes
+	t.Cleanup(func() { wsRoutes = old })
+	wsRoutes = parseWSRoutes(" /ws/auth/ , /ws/auth/native/=/ws/native/, /ws/events, /api/x, /ws/bad=relative ")
+
+	if len(wsRoutes) != 3 {
+		t.Errorf("parseWSRoutes kept %+v, want the three /ws/ routes", wsRoutes)
+	}
+	for path, want := range map[string]string{
+		"/ws/auth/abc":        "/ws/auth/abc",
+		"/ws/auth/native/abc": "/ws/native/abc",
+		"/ws/events":          "/ws/events",
+		"/ws/events/x":        "",
+		"/ws/other":           "",
+	} {
+		got, ok := matchWSRoute(path)
+		if got != want || ok != (want != "") {
+			t.Errorf("matchWSRoute(%q) = %q, %v; want %q", path, got, ok, want)
+		}
+	}
+}
+
+func TestWSProxy_Routes(t *testing.T) {
+	panelURL, seen := withWSBackend(t, "/ws/auth/,/ws/auth/native/=/ws/native/", "")
+
+	if code := dialStatus(t, panelURL, "/ws/auth/native/abc?mode=x", nil); code != http.StatusSwitchingProtocols {
+		t.Fatalf("routed path = %d", code)
+	}
+	if h := <-seen; h.path != "/ws/native/abc" || h.query != "mode=x" {
+		t.Errorf("backend saw %+v, want the longest route's path and the query", h)
+	}
+
+	if code := dialStatus(t, panelURL, "/ws/events", nil); code != http.StatusNotFound {
+		t.Errorf("unlisted path = %d, want 404", code)
+	}
+	select {
+	case h := <-seen:
+		t.Errorf("unlisted path reached the backend: %+v", h)
+	default:
+	}
+}
+
+func TestWSProxy_Origin(t *testing.T) {
+	panelURL, seen := withWSBackend(t, defaultWSRoutes, "")
+	origin := func(o string) http.Header { return http.Header{"Origin": {o}} }
+
+	if code := dialStatus(t, panelURL, "/ws/auth/abc", origin("http://evil.example")); code != http.StatusForbidden {
+		t.Errorf("cross-origin = %d, want 403", code)
+	}
+	if code := dialStatus(t, panelURL, "/ws/auth/abc", origin("http://127.0.0.1:9999")); code != http.StatusSwitchingProtocols {
+		t.Errorf("same host on another port = %d", code)
+	}
+	<-seen
+
+	wsAllowedOrigins = parseAllowedOrigins("https://panel.example")
+	if code := dialStatus(t, panelURL, "/ws/auth/abc", origin("http://127.0.0.1")); code != http.StatusForbidden {
+		t.Errorf("own host not in WS_ALLOWED_ORIGINS = %d, want 403", code)
+	}
+	if code := dialStatus(t, panelURL, "/ws/auth/abc", origin("https://panel.example")); code != http.StatusSwitchingProtocols {
+		t.Errorf("allowed origin = %d", code)
+	}
+}
+
+func TestWSProxy_BackendToken(t *testing.T) {
+	cookie := http.Header{"Cookie": {wsTokenCookie + "=client-token"}}
+
+	// The browser's token is passed on when the panel has no key...
+	panelURL, seen := withWSBackend(t, defaultWSRoutes, "")
+	dialStatus(t, panelURL, "/ws/auth/abc", cookie)
+	if h := <-seen; h.auth != "Bearer client-token" {
+		t.Errorf("without a key the backend got %q, want the cookie's token", h.auth)
+	}
+
+	// ...and replaced by the backend key when it has one
+	panelURL, seen = withWSBackend(t, defaultWSRoutes, "backend-key")
+	dialStatus(t, panelURL, "/ws/auth/abc?token=client-token&mode=native", cookie)
+	if h := <-seen; h.auth != "Bearer backend-key" || h.query != "mode=native" {
+		t.Errorf("with a key the backend saw %+v, want only the key", h)
+	}
+}
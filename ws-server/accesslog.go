@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"otlptrace"
+)
+
+// logJSON switches logf to one JSON object per line (WS_LOG_FORMAT=json).
+var logJSON bool
+
+// requestIDHeader carries the panel's request ID, so a browser action can
+// be followed from the panel's access log into this server's.
+const requestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// logLine writes one log line. In JSON mode fields are added to the
+// object; in text mode they are left out.
+func logLine(level, msg string, fields map[string]interface{}) {
+	now := time.Now()
+	if !logJSON {
+		log.Printf("[%s] [%s] [WS] %s", now.Format("2006-01-02 15:04:05"), level, msg)
+		return
+	}
+	entry := map[string]interface{}{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["component"] = "WS"
+	entry["msg"] = msg
+	line, _ := json.Marshal(entry)
+	log.Print(string(line))
+}
+
+// requestInfo follows a request through the server.
+type requestInfo struct {
+	ID   string
+	Span *otlptrace.Span
+}
+
+type requestInfoKey struct{}
+
+// requestID is the request's ID, or "-" outside withAccessLog.
+func requestID(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.ID
+	}
+	return "-"
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessWriter records the status and size of a response.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack hands over the connection to the WebSocket upgrader.
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (w *accessWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAccessLog takes the request ID from the panel, or makes one, starts
+// a server span under the panel's trace and logs the request when it is
+// done. WebSocket sessions are logged when they end, so the latency is
+// the session's length.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		info := &requestInfo{ID: id, Span: tracer.Start(r.Header.Get("traceparent"), r.Method, otlptrace.SpanKindServer)}
+		w.Header().Set(requestIDHeader, id)
+
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		took := time.Since(start)
+		remote := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+		span := info.Span
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("http.response.status_code", status)
+		span.SetAttr("client.address", remote)
+		span.SetAttr("request.id", id)
+		if user := panelUser(r); user != "-" {
+			span.SetAttr("enduser.id", user)
+		}
+		if status >= 500 {
+			span.SetError()
+		}
+		span.End()
+
+		msg := fmt.Sprintf("%s %s %q %d %dB %s id=%s", remote, panelUser(r), r.Method+" "+r.URL.Path,
+			status, aw.bytes, took.Round(time.Microsecond), id)
+		if traceID := span.TraceID(); traceID != "" {
+			msg += " trace=" + traceID
+		}
+		logLine("INFO", msg, map[string]interface{}{
+			"request_id":  id,
+			"trace_id":    span.TraceID(),
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      status,
+			"bytes":       aw.bytes,
+			"duration_ms": float64(took.Microseconds()) / 1000,
+			"remote":      remote,
+			"user":        panelUser(r),
+		})
+	})
+}
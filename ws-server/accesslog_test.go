@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"otlptrace"
+)
+
+// --- Request IDs and access log ---
+
+func TestAccessLog_WebSocketSession(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stdout)
+		log.SetFlags(log.LstdFlags)
+	})
+	oldJSON := logJSON
+	logJSON = true
+	t.Cleanup(func() { logJSON = oldJSON })
+
+	seen := make(chan string, 1)
+	logged := make(chan struct{})
+	handler := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- requestID(r)
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		close(logged)
+	}))
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set(requestIDHeader, "panel-42")
+	header.Set("X-Forwarded-User", "alice")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/auth/x", header)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Close()
+	if got := <-seen; got != "panel-42" {
+		t.Errorf("requestID = %q, want the panel's", got)
+	}
+
+	// The session is logged once the handler returns
+	<-logged
+	var entry map[string]interface{}
+	if err := json.Unmarshal(bytes.TrimSpace(out.Bytes()), &entry); err != nil {
+		t.Fatalf("access log %q: %v", out.String(), err)
+	}
+	if entry["request_id"] != "panel-42" || entry["status"] != float64(http.StatusSwitchingProtocols) ||
+		entry["user"] != "alice" || entry["path"] != "/ws/auth/x" || entry["component"] != "WS" {
+		t.Errorf("access log entry = %v", entry)
+	}
+}
+
+func TestAccessLog_GeneratesRequestID(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	t.Cleanup(func() { log.SetOutput(os.Stdout) })
+
+	handler := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(requestID(r)))
+	}))
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set(requestIDHeader, "spaces are not allowed")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	id := rec.Header().Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) || id != rec.Body.String() || len(id) != 24 {
+		t.Errorf("generated ID %q, handler saw %q", id, rec.Body.String())
+	}
+}
+
+func TestAccessLog_Tracing(t *testing.T) {
+	log.SetOutput(&bytes.Buffer{})
+	t.Cleanup(func() { log.SetOutput(os.Stdout) })
+
+	var mu sync.Mutex
+	var exports []otlptrace.Request
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body otlptrace.Request
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		exports = append(exports, body)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+	old := tracer
+	t.Cleanup(func() { tracer = old })
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_SERVICE_NAME", "")
+	if err := loadTracingFromEnv(); err != nil || tracer == nil || tracer.Service() != "autossh-ws-server" {
+		t.Fatalf("loadTracingFromEnv: %v, %+v", err, tracer)
+	}
+
+	handler := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no tunnel", http.StatusBadGateway)
+	}))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/ws/auth/x", nil)
+		req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	tracer.Flush()
+
+	// Both requests' spans go out in one export, under the panel's trace
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exports) != 1 || len(exports[0].ResourceSpans) != 1 || len(exports[0].ResourceSpans[0].ScopeSpans[0].Spans) != 2 {
+		t.Fatalf("exports = %+v, want one with both spans", exports)
+	}
+	span := exports[0].ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.TraceID != "0af7651916cd43dd8448eb211c80319c" || span.ParentSpanID != "b7ad6b7169203331" ||
+		span.Kind != otlptrace.SpanKindServer || span.Status.Code == 0 {
+		t.Errorf("span = %+v, want a failed server span in the panel's trace", span)
+	}
+}
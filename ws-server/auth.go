@@ -112,3 +112,13 @@ func verifyAPIKey(r *http.Request) bool {
 func validateHash(hash string) bool {
 	return hashRegex.MatchString(hash)
 }
+
+// panelUser returns the web panel user the request was made for, or "-".
+// The panel sets X-Forwarded-User after authenticating the browser; it is
+// only meaningful on requests that passed verifyAPIKey.
+func panelUser(r *http.Request) string {
+	if user := r.Header.Get("X-Forwarded-User"); user != "" {
+		return user
+	}
+	return "-"
+}
@@ -322,3 +322,16 @@ func TestCheckOrigin_IPAddress(t *testing.T) {
 		t.Error("checkOrigin should reject different IP origin")
 	}
 }
+
+// --- panelUser ---
+
+func TestPanelUser(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws/auth/abc", nil)
+	if got := panelUser(r); got != "-" {
+		t.Errorf("panelUser without header = %q, want \"-\"", got)
+	}
+	r.Header.Set("X-Forwarded-User", "alice")
+	if got := panelUser(r); got != "alice" {
+		t.Errorf("panelUser = %q, want \"alice\"", got)
+	}
+}
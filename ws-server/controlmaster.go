@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Authentication paths reported in the "method" field of status messages.
+const (
+	MethodControlMaster = "control_master" // forward restored through a live ControlMaster
+	MethodInteractive   = "interactive"    // autossh-cli auth in a PTY
+	MethodNative        = "native"         // Go SSH client with structured prompts
+)
+
+// controlCheckCommand builds "ssh -O check" against a control socket.
+var controlCheckCommand = func(socket string) *exec.Cmd {
+	return exec.Command("ssh", "-S", socket, "-O", "check", "ignored-host")
+}
+
+// reconnectCommand builds "autossh-cli reconnect <hash>", which re-adds the
+// tunnel's forward through its ControlMaster and records it in the state file.
+var reconnectCommand = func(hash string) *exec.Cmd {
+	return exec.Command("/usr/local/bin/autossh-cli", "reconnect", hash)
+}
+
+// controlSocketPath returns the ControlMaster socket interactive_auth.sh
+// creates for a tunnel.
+func controlSocketPath(hash string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = filepath.Dir(sshConfigDir)
+	}
+	return filepath.Join(home, ".autossh-sockets", hash)
+}
+
+// controlMasterAlive reports whether a live ControlMaster exists for hash.
+func controlMasterAlive(hash string) bool {
+	socket := controlSocketPath(hash)
+	if _, err := os.Stat(socket); err != nil {
+		return false
+	}
+	out, err := controlCheckCommand(socket).CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "Master running") {
+		logf("DEBUG", "Control master check failed for hash %s: %s", hash, strings.TrimSpace(string(out)))
+		return false
+	}
+	return true
+}
+
+// tryControlMaster restores the tunnel through its live ControlMaster without
+// prompting. It returns false when there is no usable master, in which case
+// the caller falls back to an interactive authentication session.
+func tryControlMaster(hash string) bool {
+	if !controlMasterAlive(hash) {
+		return false
+	}
+
+	cmd := reconnectCommand(hash)
+	cmd.Env = os.Environ()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logf("WARN", "Failed to restore tunnel %s through control master: %v: %s", hash, err, strings.TrimSpace(string(out)))
+		return false
+	}
+	logf("INFO", "Tunnel %s restored through existing control master", hash)
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withControlMaster fakes the ControlMaster socket and the ssh/autossh-cli
+// commands. checkOutput is printed by "ssh -O check" and reconnectExit is the
+// exit code of "autossh-cli reconnect". The returned counter records how many
+// times reconnect ran.
+func withControlMaster(t *testing.T, hash string, socket bool, checkOutput string, reconnectExit string) *int {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if socket {
+		os.MkdirAll(filepath.Join(home, ".autossh-sockets"), 0700)
+		os.WriteFile(filepath.Join(home, ".autossh-sockets", hash), nil, 0600)
+	}
+
+	calls := 0
+	oldCheck, oldReconnect := controlCheckCommand, reconnectCommand
+	controlCheckCommand = func(socket string) *exec.Cmd {
+		return exec.Command("sh", "-c", "echo '"+checkOutput+"'")
+	}
+	reconnectCommand = func(h string) *exec.Cmd {
+		calls++
+		return exec.Command("sh", "-c", "exit "+reconnectExit)
+	}
+	t.Cleanup(func() { controlCheckCommand, reconnectCommand = oldCheck, oldReconnect })
+	return &calls
+}
+
+func TestTryControlMaster_NoSocket(t *testing.T) {
+	hash := "aaaabbbbccccddddeeeeffffaaaabbbb"
+	calls := withControlMaster(t, hash, false, "Master running (pid=123)", "0")
+
+	if tryControlMaster(hash) {
+		t.Error("tryControlMaster = true without a control socket")
+	}
+	if *calls != 0 {
+		t.Errorf("reconnect ran %d times, want 0", *calls)
+	}
+}
+
+func TestTryControlMaster_MasterGone(t *testing.T) {
+	hash := "aaaabbbbccccddddeeeeffffaaaabbbb"
+	calls := withControlMaster(t, hash, true, "Control socket connect: Connection refused", "0")
+
+	if tryControlMaster(hash) {
+		t.Error("tryControlMaster = true for dead master")
+	}
+	if *calls != 0 {
+		t.Errorf("reconnect ran %d times, want 0", *calls)
+	}
+}
+
+func TestTryControlMaster_Restored(t *testing.T) {
+	hash := "aaaabbbbccccddddeeeeffffaaaabbbb"
+	calls := withControlMaster(t, hash, true, "Master running (pid=123)", "0")
+
+	if !tryControlMaster(hash) {
+		t.Error("tryControlMaster = false for live master")
+	}
+	if *calls != 1 {
+		t.Errorf("reconnect ran %d times, want 1", *calls)
+	}
+}
+
+func TestTryControlMaster_ReconnectFails(t *testing.T) {
+	hash := "aaaabbbbccccddddeeeeffffaaaabbbb"
+	withControlMaster(t, hash, true, "Master running (pid=123)", "2")
+
+	if tryControlMaster(hash) {
+		t.Error("tryControlMaster = true when autossh-cli reconnect fails")
+	}
+}
+
+func TestWsAuthHandler_ControlMasterStatus(t *testing.T) {
+	setupTestTracker(t, 5)
+	withAPIKey(t, "")
+	withAllowedOrigins(t, []string{"*"})
+
+	hash := "ddddeeeeffffaaaabbbbccccddddeeee"
+	withControlMaster(t, hash, true, "Master running (pid=123)", "0")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/auth/", wsAuthHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/auth/" + hash
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	var status StatusMessage
+	json.Unmarshal(data, &status)
+	if status.Code != "success" || status.Method != MethodControlMaster {
+		t.Errorf("status = %+v, want success via control_master", status)
+	}
+
+	// Wait for the handler to release its slot
+	time.Sleep(50 * time.Millisecond)
+	if connTracker.IsActive(hash) {
+		t.Error("connection slot not released after control master reuse")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ReauthEvent is raised when an authenticated interactive tunnel drops.
+type ReauthEvent struct {
+	Type            string    `json:"type"`
+	Hash            string    `json:"hash"`
+	Name            string    `json:"name"`
+	RemoteHost      string    `json:"remote_host,omitempty"`
+	Method          string    `json:"method,omitempty"`
+	AuthenticatedAt time.Time `json:"authenticated_at"`
+	DetectedAt      time.Time `json:"detected_at"`
+	UptimeSeconds   int64     `json:"uptime_seconds"`
+	LogTail         []string  `json:"log_tail"`
+}
+
+// EventHub fans events out to subscribed /ws/events clients. Reauth events
+// stay pending until the tunnel is authenticated again, so clients that
+// connect later still see which tunnels need attention.
+type EventHub struct {
+	mu      sync.Mutex
+	subs    map[chan ReauthEvent]struct{}
+	pending map[string]ReauthEvent
+}
+
+// NewEventHub creates an empty event hub.
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subs:    make(map[chan ReauthEvent]struct{}),
+		pending: make(map[string]ReauthEvent),
+	}
+}
+
+// Global event hub
+var eventHub = NewEventHub()
+
+// Subscribe registers a subscriber and returns its channel together with
+// the currently pending events.
+func (h *EventHub) Subscribe() (chan ReauthEvent, []ReauthEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan ReauthEvent, 16)
+	h.subs[ch] = struct{}{}
+	pending := make([]ReauthEvent, 0, len(h.pending))
+	for _, ev := range h.pending {
+		pending = append(pending, ev)
+	}
+	return ch, pending
+}
+
+// Unsubscribe removes a subscriber.
+func (h *EventHub) Unsubscribe(ch chan ReauthEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+// Publish records ev as pending and delivers it to all subscribers.
+// Slow subscribers drop events rather than block the watcher.
+func (h *EventHub) Publish(ev ReauthEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending[ev.Hash] = ev
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Resolve clears the pending event for hash.
+func (h *EventHub) Resolve(hash string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.pending, hash)
+}
+
+// Pending returns the number of unresolved events.
+func (h *EventHub) Pending() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.pending)
+}
+
+// wsEventsHandler streams reauth events to the browser.
+func wsEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !verifyAPIKey(r) {
+		logf("WARN", "Unauthorized events request from %s", r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logf("ERROR", "WebSocket upgrade failed for events: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ch, pending := eventHub.Subscribe()
+	defer eventHub.Unsubscribe(ch)
+
+	// Detect client disconnects; the client never sends anything we need
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(ev ReauthEvent) bool {
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return true
+		}
+		return conn.WriteMessage(websocket.TextMessage, data) == nil
+	}
+
+	for _, ev := range pending {
+		if !send(ev) {
+			return
+		}
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-clientDone:
+			return
+		case ev := <-ch:
+			if !send(ev) {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
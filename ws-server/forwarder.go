@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrForwarderExists is returned when a forwarder is already registered for a hash.
+var ErrForwarderExists = errors.New("forwarder already running for this tunnel")
+
+// Keepalive settings matching the ServerAliveInterval/ServerAliveCountMax
+// options used by interactive_auth.sh.
+var (
+	keepaliveInterval = 30 * time.Second
+	keepaliveMaxMiss  = 3
+)
+
+// holderCommand builds the placeholder process whose PID is written to the
+// state file for an in-process forwarder. Stopping the tunnel through
+// autossh-cli kills this process, which in turn shuts the forwarder down,
+// without autossh-cli ever signalling the ws-server itself.
+var holderCommand = func(hash string) *exec.Cmd {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	return exec.Command(exe, "hold", hash)
+}
+
+// runHolder is the body of the "ws-server hold <hash>" placeholder process.
+// It exits when killed or when its parent ws-server goes away.
+func runHolder() {
+	parent := os.Getppid()
+	for os.Getppid() == parent {
+		time.Sleep(time.Second)
+	}
+}
+
+// Forwarder relays a tunnel's port forward over an authenticated SSH client.
+type Forwarder struct {
+	Tunnel    TunnelConfig
+	StartedAt time.Time
+
+	client    *ssh.Client
+	listener  net.Listener
+	holder    *exec.Cmd
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ForwarderRegistry tracks the in-process forwarders by tunnel hash.
+type ForwarderRegistry struct {
+	mu         sync.Mutex
+	forwarders map[string]*Forwarder
+}
+
+// NewForwarderRegistry creates an empty forwarder registry.
+func NewForwarderRegistry() *ForwarderRegistry {
+	return &ForwarderRegistry{forwarders: make(map[string]*Forwarder)}
+}
+
+// Global forwarder registry
+var forwarders = NewForwarderRegistry()
+
+// Get returns the forwarder for hash, or nil.
+func (fr *ForwarderRegistry) Get(hash string) *Forwarder {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.forwarders[hash]
+}
+
+// Count returns the number of running forwarders.
+func (fr *ForwarderRegistry) Count() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return len(fr.forwarders)
+}
+
+// CloseAll stops every registered forwarder.
+func (fr *ForwarderRegistry) CloseAll() {
+	fr.mu.Lock()
+	all := make([]*Forwarder, 0, len(fr.forwarders))
+	for _, f := range fr.forwarders {
+		all = append(all, f)
+	}
+	fr.mu.Unlock()
+
+	for _, f := range all {
+		f.Close()
+	}
+}
+
+func (fr *ForwarderRegistry) add(f *Forwarder) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if _, exists := fr.forwarders[f.Tunnel.Hash]; exists {
+		return ErrForwarderExists
+	}
+	fr.forwarders[f.Tunnel.Hash] = f
+	return nil
+}
+
+func (fr *ForwarderRegistry) remove(f *Forwarder) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.forwarders[f.Tunnel.Hash] == f {
+		delete(fr.forwarders, f.Tunnel.Hash)
+	}
+}
+
+// Start opens the tunnel's listener over client, registers the forwarder in
+// fr and in the shared state file, and serves connections until the SSH
+// connection drops or the forwarder is closed. On error the client is closed.
+func (fr *ForwarderRegistry) Start(client *ssh.Client, t *TunnelConfig) (*Forwarder, error) {
+	f := &Forwarder{
+		Tunnel:    *t,
+		StartedAt: time.Now(),
+		client:    client,
+		done:      make(chan struct{}),
+	}
+	if err := fr.add(f); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	localHost, localPort := splitBindSpec(t.LocalPort)
+	targetHost, targetPort := splitBindSpec(t.RemotePort)
+	localAddr := net.JoinHostPort(localHost, localPort)
+	targetAddr := net.JoinHostPort(targetHost, targetPort)
+
+	var err error
+	var dial func() (net.Conn, error)
+	if t.Direction == "local_to_remote" {
+		// Remote forwarding (-R): listen on the SSH server, dial locally
+		f.listener, err = client.Listen("tcp", targetAddr)
+		dial = func() (net.Conn, error) { return net.DialTimeout("tcp", localAddr, 10*time.Second) }
+		appendTunnelLog(t.Hash, "INFO", "Forwarding: %s -> %s:%s", localAddr, t.RemoteHost, targetAddr)
+	} else {
+		// Local forwarding (-L): listen locally, dial through the SSH server
+		f.listener, err = net.Listen("tcp", localAddr)
+		dial = func() (net.Conn, error) { return client.Dial("tcp", targetAddr) }
+		appendTunnelLog(t.Hash, "INFO", "Forwarding: %s <- %s:%s", localAddr, t.RemoteHost, targetAddr)
+	}
+	if err != nil {
+		fr.remove(f)
+		client.Close()
+		appendTunnelLog(t.Hash, "ERROR", "Failed to open forward: %v", err)
+		return nil, err
+	}
+
+	f.holder = holderCommand(t.Hash)
+	if err := f.holder.Start(); err != nil {
+		f.listener.Close()
+		fr.remove(f)
+		client.Close()
+		return nil, err
+	}
+	if err := appendTunnelState(t, f.holder.Process.Pid); err != nil {
+		logf("WARN", "Failed to record tunnel %s in state file: %v", t.Hash, err)
+	}
+
+	go func() {
+		f.holder.Wait()
+		f.Close()
+	}()
+	go func() {
+		client.Wait()
+		f.stop("SSH connection lost")
+	}()
+	go f.keepalive()
+	go f.serve(dial)
+	go func() {
+		<-f.done
+		fr.remove(f)
+	}()
+
+	logf("INFO", "Native forwarder started for %s (%s), holder PID %d", t.Name, t.Hash, f.holder.Process.Pid)
+	appendTunnelLog(t.Hash, "INFO", "Tunnel '%s' is now running (holder PID: %d)", t.Name, f.holder.Process.Pid)
+	return f, nil
+}
+
+// Done is closed once the forwarder has stopped.
+func (f *Forwarder) Done() <-chan struct{} {
+	return f.done
+}
+
+// Close stops the forwarder, its SSH connection and its holder process, and
+// removes the holder's state file entry.
+func (f *Forwarder) Close() {
+	f.stop("")
+}
+
+// stop stops the forwarder once. dropped is why its SSH connection failed,
+// or "" for a deliberate stop; a drop is reported to the reauth watcher
+// straight away, as it cannot tell one from a stop once the state entry
+// is gone.
+func (f *Forwarder) stop(dropped string) {
+	f.closeOnce.Do(func() {
+		f.listener.Close()
+		f.client.Close()
+		if dropped != "" {
+			appendTunnelLog(f.Tunnel.Hash, "ERROR", "Tunnel '%s' dropped: %s", f.Tunnel.Name, dropped)
+			reauthWatcher.Dropped(f.Tunnel.Hash)
+		}
+		if f.holder != nil && f.holder.Process != nil {
+			f.holder.Process.Kill()
+			if err := removeTunnelState(f.Tunnel.Hash, f.holder.Process.Pid); err != nil {
+				logf("WARN", "Failed to remove tunnel %s from state file: %v", f.Tunnel.Hash, err)
+			}
+		}
+		close(f.done)
+		logf("INFO", "Native forwarder stopped for %s (%s)", f.Tunnel.Name, f.Tunnel.Hash)
+		appendTunnelLog(f.Tunnel.Hash, "INFO", "Tunnel '%s' stopped after %s", f.Tunnel.Name, time.Since(f.StartedAt).Round(time.Second))
+	})
+}
+
+// serve accepts connections on the listener and pipes each to a new
+// connection obtained from dial.
+func (f *Forwarder) serve(dial func() (net.Conn, error)) {
+	for {
+		src, err := f.listener.Accept()
+		if err != nil {
+			f.stop("listener closed: " + err.Error())
+			return
+		}
+		go func() {
+			defer src.Close()
+			dst, err := dial()
+			if err != nil {
+				logf("DEBUG", "Forward dial failed for %s: %v", f.Tunnel.Hash, err)
+				return
+			}
+			defer dst.Close()
+			pipe(src, dst)
+		}()
+	}
+}
+
+// keepalive sends OpenSSH-style keepalive requests and closes the forwarder
+// after too many consecutive failures.
+func (f *Forwarder) keepalive() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := f.client.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+			var err error
+			select {
+			case err = <-reply:
+			case <-time.After(keepaliveInterval):
+				err = errors.New("keepalive timed out")
+			}
+			if err != nil {
+				missed++
+				if missed >= keepaliveMaxMiss {
+					f.stop("server not responding to keepalives")
+					return
+				}
+				continue
+			}
+			missed = 0
+		}
+	}
+}
+
+// pipe copies data in both directions until either side is done.
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+}
@@ -1,8 +1,14 @@
 module ws-server
 
-go 1.24
+go 1.24.0
 
 require (
 	github.com/creack/pty v1.1.24
 	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.45.0
+	otlptrace v0.0.0
 )
+
+require golang.org/x/sys v0.38.0 // indirect
+
+replace otlptrace => ../otlptrace
@@ -21,6 +21,7 @@ type StatusMessage struct {
 	Type     string `json:"type"`
 	Code     string `json:"code"`
 	Message  string `json:"message"`
+	Method   string `json:"method,omitempty"`
 	ExitCode int    `json:"exit_code,omitempty"`
 }
 
@@ -70,9 +71,24 @@ func wsAuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	logf("INFO", "WebSocket connection established for hash: %s", hash)
+	logf("INFO", "WebSocket connection established for hash: %s (user %s, request %s)", hash, panelUser(r), requestID(r))
 
-	// Handle the session
+	// A live ControlMaster lets the tunnel come back without prompting
+	if tryControlMaster(hash) {
+		sendStatus(conn, "success", "Tunnel restored through existing SSH connection", MethodControlMaster, 0)
+		reauthWatcher.Track(hash, MethodControlMaster)
+		conn.Close()
+		connTracker.Release(hash)
+		logf("INFO", "WebSocket connection closed for hash: %s", hash)
+		return
+	}
+
+	// Handle the session: "native" authenticates with the Go SSH client,
+	// anything else drives autossh-cli auth through a PTY
+	if r.URL.Query().Get("mode") == "native" {
+		handleNativeAuthSession(conn, hash)
+		return
+	}
 	handleAuthSession(conn, hash)
 }
 
@@ -111,7 +127,7 @@ func handleAuthSession(conn *websocket.Conn, hash string) {
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
 		logf("ERROR", "Failed to start PTY for hash %s: %v", hash, err)
-		sendStatus(conn, "error", "Failed to start authentication session", 0)
+		sendStatus(conn, "error", "Failed to start authentication session", MethodInteractive, 0)
 		return
 	}
 
@@ -249,7 +265,7 @@ func handleAuthSession(conn *websocket.Conn, hash string) {
 	}
 
 	if timedOut.Load() {
-		sendStatus(conn, "timeout", "Session timed out", exitCode)
+		sendStatus(conn, "timeout", "Session timed out", MethodInteractive, exitCode)
 	} else if exitCode == 0 {
 		// ssh -f forks after successful auth, parent exits with code 0.
 		// The forked SSH child needs time to setsid() and fully detach from
@@ -261,9 +277,10 @@ func handleAuthSession(conn *websocket.Conn, hash string) {
 		// child has detached.
 		time.Sleep(2 * time.Second)
 		keepPTY = true
-		sendStatus(conn, "success", "Tunnel authenticated and running", exitCode)
+		sendStatus(conn, "success", "Tunnel authenticated and running", MethodInteractive, exitCode)
+		reauthWatcher.Track(hash, MethodInteractive)
 	} else {
-		sendStatus(conn, "error", "Authentication failed", exitCode)
+		sendStatus(conn, "error", "Authentication failed", MethodInteractive, exitCode)
 	}
 
 	// Close PTY master unless the session succeeded (ssh -f child needs it)
@@ -276,11 +293,13 @@ func handleAuthSession(conn *websocket.Conn, hash string) {
 }
 
 // sendStatus sends a JSON status message over the WebSocket connection.
-func sendStatus(conn *websocket.Conn, code, message string, exitCode int) {
+// method records which authentication path produced the result.
+func sendStatus(conn *websocket.Conn, code, message, method string, exitCode int) {
 	status := StatusMessage{
 		Type:    "status",
 		Code:    code,
 		Message: message,
+		Method:  method,
 	}
 	if code == "error" {
 		status.ExitCode = exitCode
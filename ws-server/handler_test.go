@@ -37,6 +37,27 @@ func TestStatusMessage_SuccessJSON(t *testing.T) {
 	if _, exists := parsed["exit_code"]; exists {
 		t.Error("exit_code should be omitted for success status")
 	}
+	// method is omitted when unset
+	if _, exists := parsed["method"]; exists {
+		t.Error("method should be omitted when empty")
+	}
+}
+
+func TestStatusMessage_MethodJSON(t *testing.T) {
+	msg := StatusMessage{
+		Type:    "status",
+		Code:    "success",
+		Message: "Tunnel restored through existing SSH connection",
+		Method:  MethodControlMaster,
+	}
+	data, _ := json.Marshal(msg)
+
+	var parsed map[string]interface{}
+	json.Unmarshal(data, &parsed)
+
+	if parsed["method"] != "control_master" {
+		t.Errorf("method = %v, want 'control_master'", parsed["method"])
+	}
 }
 
 func TestStatusMessage_ErrorJSON(t *testing.T) {
@@ -1,5 +1,6 @@
 // Package main provides a WebSocket server for interactive SSH authentication sessions.
-// It spawns autossh-cli auth <hash> with a PTY and pipes I/O to the browser.
+// It spawns autossh-cli auth <hash> with a PTY and pipes I/O to the browser, or
+// in native mode authenticates with a Go SSH client and forwards in-process.
 package main
 
 import (
@@ -29,9 +30,7 @@ var connTracker *ConnTracker
 
 // logf formats and prints a log message with timestamp and level.
 func logf(level, format string, args ...interface{}) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	msg := fmt.Sprintf(format, args...)
-	log.Printf("[%s] [%s] [WS] %s", timestamp, level, msg)
+	logLine(level, fmt.Sprintf(format, args...), nil)
 }
 
 // loadConfig reads configuration from environment variables.
@@ -43,6 +42,7 @@ func loadConfig() {
 	}
 
 	apiKey = os.Getenv("API_KEY")
+	logJSON = os.Getenv("WS_LOG_FORMAT") == "json"
 
 	if maxConn := os.Getenv("WS_MAX_CONNECTIONS"); maxConn != "" {
 		if m, err := strconv.Atoi(maxConn); err == nil && m > 0 {
@@ -63,17 +63,48 @@ func loadConfig() {
 	}
 
 	allowedOrigins = parseAllowedOrigins(os.Getenv("WS_ALLOWED_ORIGINS"))
+
+	// Shared with the shell scripts
+	if f := os.Getenv("AUTOSSH_CONFIG_FILE"); f != "" {
+		configFile = f
+	}
+	if f := os.Getenv("AUTOSSH_STATE_FILE"); f != "" {
+		stateFile = f
+	}
+	if d := os.Getenv("SSH_CONFIG_DIR"); d != "" {
+		sshConfigDir = d
+	}
+
+	// Re-authentication reminders
+	if poll := os.Getenv("WS_REAUTH_POLL_INTERVAL"); poll != "" {
+		if d, err := time.ParseDuration(poll); err == nil && d > 0 {
+			reauthPollInterval = d
+		}
+	}
+	reauthWebhookURL = os.Getenv("WS_REAUTH_WEBHOOK_URL")
+	reauthWebhookToken = os.Getenv("WS_REAUTH_WEBHOOK_TOKEN")
+	if n := os.Getenv("WS_REAUTH_LOG_LINES"); n != "" {
+		if l, err := strconv.Atoi(n); err == nil && l >= 0 {
+			reauthLogLines = l
+		}
+	}
 }
 
 // healthHandler returns the server health status.
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status":"ok","connections":%d,"max_connections":%d}`,
-		connTracker.Count(), maxConnections)
+	fmt.Fprintf(w, `{"status":"ok","connections":%d,"max_connections":%d,"forwarders":%d,"pending_reauth":%d}`,
+		connTracker.Count(), maxConnections, forwarders.Count(), eventHub.Pending())
 }
 
 func main() {
+	// "ws-server hold <hash>" is the placeholder process for a native forwarder
+	if len(os.Args) > 1 && os.Args[1] == "hold" {
+		runHolder()
+		return
+	}
+
 	// Configure log output
 	log.SetFlags(0)
 	log.SetOutput(os.Stdout)
@@ -81,6 +112,14 @@ func main() {
 	// Load configuration
 	loadConfig()
 
+	if err := loadTracingFromEnv(); err != nil {
+		logf("ERROR", "Tracing setup failed: %v", err)
+		os.Exit(1)
+	}
+	if tracer != nil {
+		logf("INFO", "Exporting traces to %s as %s", tracer.Endpoint(), tracer.Service())
+	}
+
 	// Initialize connection tracker
 	connTracker = NewConnTracker(maxConnections)
 
@@ -92,17 +131,24 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", healthHandler)
 	mux.HandleFunc("/ws/auth/", wsAuthHandler)
+	mux.HandleFunc("/ws/events", wsEventsHandler)
 
 	// Create server with timeouts
 	server := &http.Server{
 		Addr:              fmt.Sprintf(":%d", wsPort),
-		Handler:           mux,
+		Handler:           withAccessLog(mux),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
 	// Channel to signal shutdown
 	done := make(chan struct{})
 
+	// Watch authenticated interactive tunnels for drops
+	go reauthWatcher.Run(done)
+	if tracer != nil {
+		go tracer.Run(done)
+	}
+
 	// Handle graceful shutdown
 	go func() {
 		sigChan := make(chan os.Signal, 1)
@@ -117,6 +163,7 @@ func main() {
 		if err := server.Shutdown(ctx); err != nil {
 			logf("ERROR", "Server shutdown error: %v", err)
 		}
+		forwarders.CloseAll()
 		close(done)
 	}()
 
@@ -128,5 +175,6 @@ func main() {
 	}
 
 	<-done
+	tracer.Flush()
 	logf("INFO", "Server stopped")
 }
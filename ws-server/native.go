@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Errors returned while waiting for the browser to answer a prompt.
+var (
+	ErrClientGone     = errors.New("client disconnected")
+	ErrPromptTimeout  = errors.New("timed out waiting for answer")
+	ErrAnswerMismatch = errors.New("answer count does not match question count")
+)
+
+// PromptQuestion is a single challenge line shown to the user.
+type PromptQuestion struct {
+	Prompt string `json:"prompt"`
+	Echo   bool   `json:"echo"`
+}
+
+// PromptMessage relays a keyboard-interactive or password challenge to the client.
+type PromptMessage struct {
+	Type        string           `json:"type"`
+	Name        string           `json:"name,omitempty"`
+	Instruction string           `json:"instruction,omitempty"`
+	Questions   []PromptQuestion `json:"questions"`
+}
+
+// AnswerMessage carries the client's answers to the last PromptMessage.
+type AnswerMessage struct {
+	Type    string   `json:"type"`
+	Answers []string `json:"answers"`
+}
+
+// InfoMessage carries informational text (progress, server banners) to the client.
+type InfoMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// nativeSession performs SSH authentication with a Go SSH client, relaying
+// each challenge to the browser as structured JSON instead of through a PTY.
+type nativeSession struct {
+	conn       *websocket.Conn
+	hash       string
+	answers    chan []string
+	clientDone chan struct{}
+	timedOut   atomic.Bool
+}
+
+func newNativeSession(conn *websocket.Conn, hash string) *nativeSession {
+	return &nativeSession{
+		conn:       conn,
+		hash:       hash,
+		answers:    make(chan []string, 1),
+		clientDone: make(chan struct{}),
+	}
+}
+
+// readLoop forwards answer messages from the client until it disconnects.
+func (s *nativeSession) readLoop() {
+	defer close(s.clientDone)
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logf("DEBUG", "WebSocket read error for hash %s: %v", s.hash, err)
+			}
+			return
+		}
+		var msg AnswerMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "answers" {
+			logf("DEBUG", "Ignoring unexpected message for hash %s", s.hash)
+			continue
+		}
+		select {
+		case s.answers <- msg.Answers:
+		default:
+			logf("DEBUG", "Ignoring unsolicited answers for hash %s", s.hash)
+		}
+	}
+}
+
+// send writes a JSON message to the client.
+func (s *nativeSession) send(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		logf("ERROR", "Failed to marshal message: %v", err)
+		return
+	}
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		logf("DEBUG", "Failed to send message for hash %s: %v", s.hash, err)
+	}
+}
+
+// info sends an informational line to the client.
+func (s *nativeSession) info(format string, args ...interface{}) {
+	s.send(InfoMessage{Type: "info", Message: fmt.Sprintf(format, args...)})
+}
+
+// ask relays questions to the client and waits for the answers.
+func (s *nativeSession) ask(name, instruction string, questions []PromptQuestion) ([]string, error) {
+	if len(questions) == 0 {
+		if instruction != "" {
+			s.info("%s", instruction)
+		}
+		return []string{}, nil
+	}
+
+	// Drop any unsolicited answers left over from earlier prompts
+	select {
+	case <-s.answers:
+	default:
+	}
+	s.send(PromptMessage{Type: "prompt", Name: name, Instruction: instruction, Questions: questions})
+
+	select {
+	case answers := <-s.answers:
+		if len(answers) != len(questions) {
+			return nil, ErrAnswerMismatch
+		}
+		return answers, nil
+	case <-s.clientDone:
+		return nil, ErrClientGone
+	case <-time.After(idleTimeout):
+		s.timedOut.Store(true)
+		return nil, ErrPromptTimeout
+	}
+}
+
+// keyboardInteractive adapts ask to ssh.KeyboardInteractiveChallenge.
+func (s *nativeSession) keyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	qs := make([]PromptQuestion, len(questions))
+	for i := range questions {
+		qs[i] = PromptQuestion{Prompt: questions[i], Echo: echos[i]}
+	}
+	return s.ask(name, instruction, qs)
+}
+
+// hostKeyCallback verifies the server key against known_hosts and asks the
+// user to confirm unknown hosts, as ssh does with StrictHostKeyChecking=ask.
+// Confirmed keys are added to known_hosts; changed keys are always rejected.
+func (s *nativeSession) hostKeyCallback(known ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if known != nil {
+			err := known(hostname, remote, key)
+			if err == nil {
+				return nil
+			}
+			var keyErr *knownhosts.KeyError
+			if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+				return err
+			}
+		}
+
+		answers, err := s.ask("", fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.",
+			hostname, key.Type(), ssh.FingerprintSHA256(key)),
+			[]PromptQuestion{{Prompt: "Are you sure you want to continue connecting (yes/no)? ", Echo: true}})
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(strings.TrimSpace(answers[0])) != "yes" {
+			return errors.New("host key verification failed")
+		}
+		if err := addKnownHost(hostname, key); err != nil {
+			logf("WARN", "Failed to add %s to known_hosts: %v", hostname, err)
+		} else {
+			s.info("Permanently added '%s' (%s) to the list of known hosts.", hostname, key.Type())
+		}
+		return nil
+	}
+}
+
+// addKnownHost appends a confirmed host key to known_hosts, so later
+// sessions, and ssh itself, trust it without asking.
+func addKnownHost(hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(sshConfigDir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(sshConfigDir, "known_hosts"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+// clientConfig builds the SSH client configuration for target.
+func (s *nativeSession) clientConfig(target sshTarget) *ssh.ClientConfig {
+	var known ssh.HostKeyCallback
+	if cb, err := knownhosts.New(filepath.Join(sshConfigDir, "known_hosts")); err == nil {
+		known = cb
+	} else if !os.IsNotExist(err) {
+		logf("WARN", "Failed to load known_hosts: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if signers := loadSigners(target.IdentityFiles); len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	auth = append(auth,
+		ssh.RetryableAuthMethod(ssh.KeyboardInteractive(s.keyboardInteractive), 3),
+		ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			answers, err := s.ask("", "", []PromptQuestion{{Prompt: fmt.Sprintf("%s@%s's password: ", target.User, target.HostName)}})
+			if err != nil {
+				return "", err
+			}
+			return answers[0], nil
+		}), 3),
+	)
+
+	return &ssh.ClientConfig{
+		User:            target.User,
+		Auth:            auth,
+		HostKeyCallback: s.hostKeyCallback(known),
+		BannerCallback: func(message string) error {
+			s.info("%s", strings.TrimRight(message, "\r\n"))
+			return nil
+		},
+	}
+}
+
+// dial connects and authenticates to target. The handshake is aborted if the
+// client disconnects or the session exceeds maxDuration.
+func (s *nativeSession) dial(target sshTarget) (*ssh.Client, error) {
+	netConn, err := net.DialTimeout("tcp", target.Addr(), 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-handshakeDone:
+		case <-s.clientDone:
+			netConn.Close()
+		case <-time.After(maxDuration):
+			s.timedOut.Store(true)
+			netConn.Close()
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(netConn, target.Addr(), s.clientConfig(target))
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// loadSigners reads the unencrypted private keys among paths. Missing files
+// and passphrase-protected keys are skipped.
+func loadSigners(paths []string) []ssh.Signer {
+	var signers []ssh.Signer
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			logf("DEBUG", "Skipping identity %s: %v", p, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// handleNativeAuthSession authenticates an interactive tunnel with the Go SSH
+// client and hands the connection to an in-process forwarder.
+func handleNativeAuthSession(conn *websocket.Conn, hash string) {
+	defer func() {
+		conn.Close()
+		connTracker.Release(hash)
+		logf("INFO", "WebSocket connection closed for hash: %s", hash)
+	}()
+
+	s := newNativeSession(conn, hash)
+	go s.readLoop()
+
+	tunnel, err := findTunnel(configFile, hash)
+	if err != nil {
+		logf("ERROR", "Failed to load tunnel %s: %v", hash, err)
+		sendStatus(conn, "error", "Tunnel configuration not found", MethodNative, 1)
+		return
+	}
+	if !tunnel.Interactive {
+		sendStatus(conn, "error", fmt.Sprintf("Tunnel '%s' is not marked as interactive", tunnel.Name), MethodNative, 1)
+		return
+	}
+	if forwarders.Get(hash) != nil || isTunnelRunning(hash) {
+		sendStatus(conn, "success", "Tunnel is already running", MethodNative, 0)
+		return
+	}
+
+	target := resolveSSHTarget(tunnel.RemoteHost)
+	s.info("Connecting to %s as %s...", target.Addr(), target.User)
+	appendTunnelLog(hash, "INFO", "Starting native SSH session for: %s (%s)", tunnel.Name, target.Addr())
+
+	client, err := s.dial(target)
+	if err != nil {
+		logf("WARN", "Native authentication failed for hash %s: %v", hash, err)
+		appendTunnelLog(hash, "ERROR", "Authentication failed: %v", err)
+		if s.timedOut.Load() {
+			sendStatus(conn, "timeout", "Session timed out", MethodNative, 0)
+		} else {
+			sendStatus(conn, "error", "Authentication failed", MethodNative, 1)
+		}
+		return
+	}
+
+	s.info("Authenticated, starting port forward...")
+	if _, err := forwarders.Start(client, tunnel); err != nil {
+		logf("ERROR", "Failed to start forwarder for hash %s: %v", hash, err)
+		sendStatus(conn, "error", "Failed to start port forward: "+err.Error(), MethodNative, 1)
+		return
+	}
+	sendStatus(conn, "success", "Tunnel authenticated and running", MethodNative, 0)
+	reauthWatcher.Track(hash, MethodNative)
+}
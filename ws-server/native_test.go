@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process SSH server requiring two-factor
+// keyboard-interactive auth and supporting direct-tcpip channels.
+type testSSHServer struct {
+	Addr    string
+	HostKey ssh.PublicKey
+}
+
+func startTestSSHServer(t *testing.T, password, code string) *testSSHServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey failed: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "Two-factor authentication",
+				[]string{"Password: ", "Verification code: "}, []bool{false, true})
+			if err != nil {
+				return nil, err
+			}
+			if conn.User() != "tester" || answers[0] != password || answers[1] != code {
+				return nil, errors.New("access denied")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSSHConn(nc, config)
+		}
+	}()
+
+	return &testSSHServer{Addr: ln.Addr().String(), HostKey: signer.PublicKey()}
+}
+
+func serveTestSSHConn(nc net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "direct-tcpip" {
+			newCh.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var payload struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+			newCh.Reject(ssh.Prohibited, "bad payload")
+			continue
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port)))
+		if err != nil {
+			newCh.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			defer ch.Close()
+			defer target.Close()
+			go io.Copy(target, ch)
+			io.Copy(ch, target)
+		}()
+	}
+}
+
+// startEchoServer starts a TCP echo server and returns its address.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// freePort returns a currently unused local TCP port.
+func freePort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// withTestHolder replaces the forwarder placeholder process with sleep.
+func withTestHolder(t *testing.T) {
+	t.Helper()
+	old := holderCommand
+	holderCommand = func(hash string) *exec.Cmd { return exec.Command("sleep", "60") }
+	t.Cleanup(func() { holderCommand = old })
+}
+
+// writeNativeTestConfig writes an interactive tunnel for srv and returns its hash.
+func writeNativeTestConfig(t *testing.T, srv *testSSHServer, echoAddr, localPort string, trustHost bool) string {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(srv.Addr)
+	os.WriteFile(filepath.Join(sshConfigDir, "config"),
+		[]byte(fmt.Sprintf("Host testhost\n  HostName %s\n  Port %s\n  User tester\n", host, port)), 0600)
+	if trustHost {
+		line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey)
+		os.WriteFile(filepath.Join(sshConfigDir, "known_hosts"), []byte(line+"\n"), 0600)
+	} else {
+		os.Remove(filepath.Join(sshConfigDir, "known_hosts"))
+	}
+
+	config := fmt.Sprintf("tunnels:\n  - name: \"native-test\"\n    remote_host: \"testhost\"\n    remote_port: \"%s\"\n    local_port: \"127.0.0.1:%s\"\n    interactive: true\n",
+		echoAddr, localPort)
+	os.WriteFile(configFile, []byte(config), 0644)
+
+	tunnels, err := parseTunnelConfig(strings.NewReader(config))
+	if err != nil || len(tunnels) != 1 {
+		t.Fatalf("parseTunnelConfig: %v, %d tunnels", err, len(tunnels))
+	}
+	return tunnels[0].Hash
+}
+
+// readNativeMessage reads the next JSON message and returns its type and raw data.
+func readNativeMessage(t *testing.T, conn *websocket.Conn) (string, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("non-JSON message %q", data)
+	}
+	return msg.Type, data
+}
+
+// runNativeSession dials the native session and answers each prompt with
+// respond until a status message arrives.
+func runNativeSession(t *testing.T, serverURL, hash string, respond func(PromptMessage) []string) StatusMessage {
+	t.Helper()
+	wsURL := "ws" + strings.TrimPrefix(serverURL, "http") + "/ws/auth/" + hash + "?mode=native"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	for {
+		msgType, data := readNativeMessage(t, conn)
+		switch msgType {
+		case "prompt":
+			var prompt PromptMessage
+			json.Unmarshal(data, &prompt)
+			conn.WriteJSON(AnswerMessage{Type: "answers", Answers: respond(prompt)})
+		case "status":
+			var status StatusMessage
+			json.Unmarshal(data, &status)
+			return status
+		}
+	}
+}
+
+func TestNativeAuthSession(t *testing.T) {
+	setupTestTracker(t, 5)
+	withAPIKey(t, "")
+	withAllowedOrigins(t, []string{"*"})
+	withTestPaths(t)
+	withTestHolder(t)
+
+	srv := startTestSSHServer(t, "secret", "123456")
+	echoAddr := startEchoServer(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/auth/", wsAuthHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	t.Run("Success", func(t *testing.T) {
+		localPort := freePort(t)
+		hash := writeNativeTestConfig(t, srv, echoAddr, localPort, true)
+
+		var prompts []PromptMessage
+		status := runNativeSession(t, server.URL, hash, func(p PromptMessage) []string {
+			prompts = append(prompts, p)
+			return []string{"secret", "123456"}
+		})
+		if status.Code != "success" || status.Method != MethodNative {
+			t.Fatalf("status = %+v, want success via native", status)
+		}
+		if len(prompts) != 1 || len(prompts[0].Questions) != 2 {
+			t.Fatalf("prompts = %+v, want one prompt with two questions", prompts)
+		}
+		if prompts[0].Questions[0].Echo || !prompts[0].Questions[1].Echo {
+			t.Errorf("echo flags = %+v, want [false true]", prompts[0].Questions)
+		}
+
+		f := forwarders.Get(hash)
+		if f == nil {
+			t.Fatal("forwarder not registered")
+		}
+		defer func() {
+			f.Close()
+			<-f.Done()
+		}()
+
+		if pid := tunnelStatePID(hash); pid != f.holder.Process.Pid {
+			t.Errorf("state PID = %d, want holder PID %d", pid, f.holder.Process.Pid)
+		}
+
+		c, err := net.DialTimeout("tcp", "127.0.0.1:"+localPort, 5*time.Second)
+		if err != nil {
+			t.Fatalf("dial forwarded port: %v", err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("echo through tunnel = %q, %v; want ping", buf, err)
+		}
+
+		// A second session for a running tunnel succeeds without prompting
+		status = runNativeSession(t, server.URL, hash, func(p PromptMessage) []string {
+			t.Errorf("unexpected prompt for running tunnel: %+v", p)
+			return nil
+		})
+		if status.Code != "success" {
+			t.Errorf("status = %+v, want success for running tunnel", status)
+		}
+	})
+
+	t.Run("HolderKilledStopsForwarder", func(t *testing.T) {
+		withTestHub(t)
+		hash := writeNativeTestConfig(t, srv, echoAddr, freePort(t), true)
+		status := runNativeSession(t, server.URL, hash, func(p PromptMessage) []string {
+			return []string{"secret", "123456"}
+		})
+		if status.Code != "success" {
+			t.Fatalf("status = %+v, want success", status)
+		}
+		f := forwarders.Get(hash)
+		if f == nil {
+			t.Fatal("forwarder not registered")
+		}
+
+		// autossh-cli stop-tunnel kills the PID from the state file
+		f.holder.Process.Kill()
+		select {
+		case <-f.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("forwarder still running after holder was killed")
+		}
+		time.Sleep(50 * time.Millisecond)
+		if forwarders.Get(hash) != nil {
+			t.Error("forwarder still registered after stop")
+		}
+		if pid := tunnelStatePID(hash); pid != 0 {
+			t.Errorf("state file still records PID %d after stop", pid)
+		}
+		if eventHub.Pending() != 0 {
+			t.Error("a deliberate stop raised a reauth event")
+		}
+	})
+
+	t.Run("SSHDropRaisesReauth", func(t *testing.T) {
+		withTestHub(t)
+		ch, _ := eventHub.Subscribe()
+		defer eventHub.Unsubscribe(ch)
+
+		hash := writeNativeTestConfig(t, srv, echoAddr, freePort(t), true)
+		status := runNativeSession(t, server.URL, hash, func(p PromptMessage) []string {
+			return []string{"secret", "123456"}
+		})
+		if status.Code != "success" {
+			t.Fatalf("status = %+v, want success", status)
+		}
+		f := forwarders.Get(hash)
+		if f == nil {
+			t.Fatal("forwarder not registered")
+		}
+
+		// The SSH connection goes away without anyone stopping the tunnel
+		f.client.Close()
+		select {
+		case ev := <-ch:
+			if ev.Type != "reauth_required" || ev.Hash != hash || ev.Method != MethodNative {
+				t.Errorf("event = %+v", ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no reauth event after the SSH connection dropped")
+		}
+		<-f.Done()
+		if reauthWatcher.Count() != 0 || eventHub.Pending() != 1 {
+			t.Errorf("watched = %d, pending = %d; want 0 and 1", reauthWatcher.Count(), eventHub.Pending())
+		}
+	})
+
+	t.Run("WrongAnswers", func(t *testing.T) {
+		hash := writeNativeTestConfig(t, srv, echoAddr, freePort(t), true)
+		status := runNativeSession(t, server.URL, hash, func(p PromptMessage) []string {
+			return []string{"wrong", "000000"}
+		})
+		if status.Code != "error" {
+			t.Errorf("status = %+v, want error", status)
+		}
+		if forwarders.Get(hash) != nil {
+			t.Error("forwarder registered after failed auth")
+		}
+	})
+
+	t.Run("UnknownHostRejected", func(t *testing.T) {
+		hash := writeNativeTestConfig(t, srv, echoAddr, freePort(t), false)
+		var hostPrompt PromptMessage
+		status := runNativeSession(t, server.URL, hash, func(p PromptMessage) []string {
+			hostPrompt = p
+			return []string{"no"}
+		})
+		if status.Code != "error" {
+			t.Errorf("status = %+v, want error", status)
+		}
+		if !strings.Contains(hostPrompt.Instruction, "authenticity of host") {
+			t.Errorf("instruction = %q, want host key confirmation", hostPrompt.Instruction)
+		}
+	})
+
+	t.Run("UnknownHostAcceptedIsRemembered", func(t *testing.T) {
+		hash := writeNativeTestConfig(t, srv, echoAddr, freePort(t), false)
+		answer := func(p PromptMessage) []string {
+			if strings.Contains(p.Instruction, "authenticity of host") {
+				return []string{"yes"}
+			}
+			return []string{"secret", "123456"}
+		}
+		if status := runNativeSession(t, server.URL, hash, answer); status.Code != "success" {
+			t.Fatalf("status = %+v, want success", status)
+		}
+		f := forwarders.Get(hash)
+		f.Close()
+		<-f.Done()
+
+		data, _ := os.ReadFile(filepath.Join(sshConfigDir, "known_hosts"))
+		if want := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey); !strings.Contains(string(data), want) {
+			t.Errorf("known_hosts = %q, want %q", data, want)
+		}
+		status := runNativeSession(t, server.URL, hash, func(p PromptMessage) []string {
+			if strings.Contains(p.Instruction, "authenticity of host") {
+				t.Errorf("host key confirmed again: %+v", p)
+			}
+			return answer(p)
+		})
+		if status.Code != "success" {
+			t.Errorf("second status = %+v, want success", status)
+		}
+		if f := forwarders.Get(hash); f != nil {
+			f.Close()
+			<-f.Done()
+		}
+	})
+
+	t.Run("NotInteractive", func(t *testing.T) {
+		config := "tunnels:\n  - remote_host: testhost\n    remote_port: 1\n    local_port: 2\n"
+		os.WriteFile(configFile, []byte(config), 0644)
+		tunnels, _ := parseTunnelConfig(strings.NewReader(config))
+		status := runNativeSession(t, server.URL, tunnels[0].Hash, func(p PromptMessage) []string { return nil })
+		if status.Code != "error" || !strings.Contains(status.Message, "not marked as interactive") {
+			t.Errorf("status = %+v, want not-interactive error", status)
+		}
+	})
+
+	// Wait for handler goroutines to drain before globals are restored
+	time.Sleep(50 * time.Millisecond)
+}
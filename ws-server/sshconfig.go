@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sshTarget is the resolved connection target for a tunnel's remote_host.
+type sshTarget struct {
+	Alias         string
+	HostName      string
+	Port          string
+	User          string
+	IdentityFiles []string
+}
+
+// Addr returns the host:port to dial.
+func (t sshTarget) Addr() string {
+	return net.JoinHostPort(t.HostName, t.Port)
+}
+
+// resolveSSHTarget turns a remote_host value ("user@host" or an alias) into a
+// dial target, applying HostName, User, Port and IdentityFile from the
+// ssh_config in SSH_CONFIG_DIR. Only the subset of ssh_config needed to reach
+// the same hosts as the ssh command line is supported.
+func resolveSSHTarget(remoteHost string) sshTarget {
+	target := sshTarget{Alias: remoteHost}
+	if idx := strings.LastIndex(remoteHost, "@"); idx != -1 {
+		target.User = remoteHost[:idx]
+		target.Alias = remoteHost[idx+1:]
+	}
+
+	if f, err := os.Open(filepath.Join(sshConfigDir, "config")); err == nil {
+		applySSHConfig(f, &target)
+		f.Close()
+	}
+
+	if target.HostName == "" {
+		target.HostName = target.Alias
+	}
+	if target.Port == "" {
+		target.Port = "22"
+	}
+	if target.User == "" {
+		if u, err := user.Current(); err == nil {
+			target.User = u.Username
+		}
+	}
+	if len(target.IdentityFiles) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			target.IdentityFiles = append(target.IdentityFiles, filepath.Join(sshConfigDir, name))
+		}
+	}
+	return target
+}
+
+// applySSHConfig fills unset fields of target from matching Host blocks.
+// As with ssh, the first value obtained for each keyword wins.
+func applySSHConfig(r io.Reader, target *sshTarget) {
+	matched := true // keywords before the first Host line apply to all hosts
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.IndexAny(line, " \t=")
+		if idx == -1 {
+			continue
+		}
+		key := line[:idx]
+		value := strings.TrimLeft(line[idx:], " \t=")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+
+		switch strings.ToLower(key) {
+		case "host":
+			matched = hostPatternsMatch(strings.Fields(value), target.Alias)
+		case "match":
+			// Match blocks are not supported; skip their keywords.
+			matched = false
+		case "hostname":
+			if matched && target.HostName == "" {
+				target.HostName = strings.ReplaceAll(value, "%h", target.Alias)
+			}
+		case "user":
+			if matched && target.User == "" {
+				target.User = value
+			}
+		case "port":
+			if matched && target.Port == "" {
+				target.Port = value
+			}
+		case "identityfile":
+			if matched {
+				if strings.HasPrefix(value, "~/") {
+					value = filepath.Join(filepath.Dir(sshConfigDir), value[2:])
+				}
+				target.IdentityFiles = append(target.IdentityFiles, value)
+			}
+		}
+	}
+}
+
+// hostPatternsMatch reports whether alias matches a Host pattern list,
+// honouring "!" negations.
+func hostPatternsMatch(patterns []string, alias string) bool {
+	result := false
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if ok, _ := path.Match(p, alias); ok {
+			if negate {
+				return false
+			}
+			result = true
+		}
+	}
+	return result
+}
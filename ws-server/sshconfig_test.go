@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplySSHConfig(t *testing.T) {
+	config := `
+# global defaults come after specific hosts, as in real configs
+Host jump
+    HostName 10.0.0.5
+    Port 2200
+    User alice
+    IdentityFile ~/.ssh/jump_key
+
+Host *.internal !bad.internal
+    User bob
+
+Host *
+    Port 22
+    User fallback
+`
+	tests := []struct {
+		alias, user, hostName, port string
+	}{
+		{"jump", "alice", "10.0.0.5", "2200"},
+		{"db.internal", "bob", "", "22"},
+		{"bad.internal", "fallback", "", "22"},
+		{"other", "fallback", "", "22"},
+	}
+	for _, tt := range tests {
+		target := sshTarget{Alias: tt.alias}
+		applySSHConfig(strings.NewReader(config), &target)
+		if target.User != tt.user || target.HostName != tt.hostName || target.Port != tt.port {
+			t.Errorf("%s: got user=%q host=%q port=%q, want %q %q %q",
+				tt.alias, target.User, target.HostName, target.Port, tt.user, tt.hostName, tt.port)
+		}
+	}
+}
+
+func TestResolveSSHTarget(t *testing.T) {
+	withTestPaths(t)
+	os.WriteFile(filepath.Join(sshConfigDir, "config"),
+		[]byte("Host jump\n  HostName 10.0.0.5\n  User alice\n"), 0600)
+
+	target := resolveSSHTarget("jump")
+	if target.Addr() != "10.0.0.5:22" || target.User != "alice" {
+		t.Errorf("resolveSSHTarget(jump) = %+v", target)
+	}
+
+	// user@ in remote_host takes precedence over the config
+	target = resolveSSHTarget("carol@jump")
+	if target.User != "carol" || target.HostName != "10.0.0.5" {
+		t.Errorf("resolveSSHTarget(carol@jump) = %+v", target)
+	}
+
+	// Unknown hosts are dialled directly with default identities
+	target = resolveSSHTarget("dave@example.com")
+	if target.Addr() != "example.com:22" || target.User != "dave" {
+		t.Errorf("resolveSSHTarget(dave@example.com) = %+v", target)
+	}
+	if len(target.IdentityFiles) == 0 {
+		t.Error("expected default identity files")
+	}
+}
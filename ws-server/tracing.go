@@ -0,0 +1,17 @@
+package main
+
+import "otlptrace"
+
+// tracer is nil unless an OTLP endpoint is configured.
+var tracer *otlptrace.Tracer
+
+// loadTracingFromEnv sets up trace export from the standard OpenTelemetry
+// variables (see otlptrace.FromEnv), as service autossh-ws-server.
+func loadTracingFromEnv() error {
+	t, err := otlptrace.FromEnv("autossh-ws-server", "", logf)
+	if err != nil {
+		return err
+	}
+	tracer = t
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Paths shared with the shell scripts. They follow the same environment
+// variables and defaults as config_parser.sh and state_manager.sh.
+var (
+	configFile   = "/etc/autossh/config/config.yaml"
+	stateFile    = "/tmp/autossh_tunnels.state"
+	sshConfigDir = "/home/myuser/.ssh"
+	logDir       = "/tmp/autossh-logs"
+)
+
+// ErrTunnelNotFound is returned when no tunnel in the config matches a hash.
+var ErrTunnelNotFound = errors.New("tunnel configuration not found")
+
+// TunnelConfig is a single tunnel entry from config.yaml.
+type TunnelConfig struct {
+	Name        string
+	RemoteHost  string
+	RemotePort  string
+	LocalPort   string
+	Direction   string
+	Interactive bool
+	Hash        string
+}
+
+// calculateTunnelHash mirrors config_parser.sh:calculate_tunnel_hash.
+func calculateTunnelHash(name, remoteHost, remotePort, localPort, direction, interactive string) string {
+	sum := md5.Sum([]byte(name + "|" + remoteHost + "|" + remotePort + "|" + localPort + "|" + direction + "|" + interactive))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseTunnelConfig parses the tunnels section of config.yaml using the same
+// line-based rules as config_parser.sh:parse_config, so that hashes match.
+func parseTunnelConfig(r io.Reader) ([]TunnelConfig, error) {
+	var (
+		tunnels    []TunnelConfig
+		inTunnels  bool
+		inTunnel   bool
+		fields     map[string]string
+		fieldNames = []string{"name", "remote_host", "remote_port", "local_port", "direction", "interactive"}
+	)
+
+	flush := func() {
+		if fields == nil || fields["remote_host"] == "" || fields["remote_port"] == "" || fields["local_port"] == "" {
+			return
+		}
+		name := fields["name"]
+		if name == "" {
+			name = "unnamed"
+		}
+		direction := fields["direction"]
+		if direction == "" {
+			direction = "remote_to_local"
+		}
+		interactive := fields["interactive"]
+		if interactive == "" {
+			interactive = "false"
+		}
+		tunnels = append(tunnels, TunnelConfig{
+			Name:        name,
+			RemoteHost:  fields["remote_host"],
+			RemotePort:  fields["remote_port"],
+			LocalPort:   fields["local_port"],
+			Direction:   direction,
+			Interactive: interactive == "true",
+			Hash:        calculateTunnelHash(name, fields["remote_host"], fields["remote_port"], fields["local_port"], direction, interactive),
+		})
+	}
+
+	setField := func(line string) {
+		for _, key := range fieldNames {
+			if strings.HasPrefix(line, key+":") {
+				value := strings.TrimSpace(strings.TrimPrefix(line, key+":"))
+				if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+					value = value[1 : len(value)-1]
+				}
+				fields[key] = value
+				return
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "tunnels:" {
+			inTunnels = true
+			continue
+		}
+		if !inTunnels {
+			continue
+		}
+		if strings.HasPrefix(line, "-") {
+			flush()
+			fields = make(map[string]string)
+			inTunnel = true
+			setField(strings.TrimSpace(strings.TrimPrefix(line, "-")))
+			continue
+		}
+		if inTunnel {
+			setField(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return tunnels, nil
+}
+
+// findTunnel loads the config file and returns the tunnel with the given hash.
+func findTunnel(path, hash string) (*TunnelConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tunnels, err := parseTunnelConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tunnels {
+		if tunnels[i].Hash == hash {
+			return &tunnels[i], nil
+		}
+	}
+	return nil, ErrTunnelNotFound
+}
+
+// splitBindSpec splits a "host:port" or bare "port" value, defaulting the host
+// to localhost like interactive_auth.sh does.
+func splitBindSpec(spec string) (host, port string) {
+	if idx := strings.LastIndex(spec, ":"); idx != -1 {
+		return spec[:idx], spec[idx+1:]
+	}
+	return "localhost", spec
+}
+
+// appendTunnelState registers a running tunnel in the shared state file using
+// the tab-separated format of state_manager.sh:save_tunnel_state.
+func appendTunnelState(t *TunnelConfig, pid int) error {
+	f, err := os.OpenFile(stateFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n",
+		t.RemoteHost, t.RemotePort, t.LocalPort, t.Direction, t.Name, t.Hash, pid)
+	return err
+}
+
+// removeTunnelState drops hash's entry from the state file, like
+// state_manager.sh:remove_tunnel_from_state, but only while it still records
+// pid, so an entry written since by autossh-cli is kept.
+func removeTunnelState(hash string, pid int) error {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var kept []string
+	removed := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		cols := strings.Split(strings.TrimRight(line, "\n"), "\t")
+		if len(cols) >= 7 && cols[5] == hash && strings.TrimSpace(cols[6]) == strconv.Itoa(pid) {
+			removed = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if !removed {
+		return nil
+	}
+	tmp := stateFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(kept, "")), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFile)
+}
+
+// tunnelStatePID returns the PID recorded for hash in the state file, or 0.
+func tunnelStatePID(hash string) int {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return 0
+	}
+	pid := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		cols := strings.Split(line, "\t")
+		if len(cols) >= 7 && cols[5] == hash {
+			if p, err := strconv.Atoi(strings.TrimSpace(cols[6])); err == nil {
+				pid = p
+			}
+		}
+	}
+	return pid
+}
+
+// isTunnelRunning mirrors state_manager.sh:is_tunnel_running.
+func isTunnelRunning(hash string) bool {
+	pid := tunnelStatePID(hash)
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
+
+// appendTunnelLog writes a line to the per-tunnel log read by /logs/{hash}.
+func appendTunnelLog(hash, level, format string, args ...interface{}) {
+	if err := os.MkdirAll(logDir, 0777); err != nil {
+		return
+	}
+	f, err := os.OpenFile(filepath.Join(logDir, "tunnel-"+hash+".log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "[%s] [%s] [NATIVE] %s\n", time.Now().Format("2006-01-02 15:04:05"), level, fmt.Sprintf(format, args...))
+}
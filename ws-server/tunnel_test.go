@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// withTestPaths points the shared config/state/log/ssh paths at a temp dir.
+func withTestPaths(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	oldConfig, oldState, oldSSH, oldLog := configFile, stateFile, sshConfigDir, logDir
+	configFile = filepath.Join(dir, "config.yaml")
+	stateFile = filepath.Join(dir, "autossh_tunnels.state")
+	sshConfigDir = filepath.Join(dir, ".ssh")
+	logDir = filepath.Join(dir, "logs")
+	os.MkdirAll(sshConfigDir, 0700)
+	t.Cleanup(func() {
+		configFile, stateFile, sshConfigDir, logDir = oldConfig, oldState, oldSSH, oldLog
+	})
+	return dir
+}
+
+// sampleConfig is config/config.yaml.sample; the expected hashes below were
+// produced by config_parser.sh:parse_config.
+const sampleConfig = `tunnels:
+  # Basic tunnel example (name is optional)
+  - remote_host: "user@remote-host1"
+    remote_port: 8000
+    local_port: 8001
+
+  # Tunnel with explicit direction
+  - remote_host: "user@remote-host2"
+    remote_port: 9000
+    local_port: 9001
+    direction: remote_to_local
+
+  - name: "jumphost-tunnel"
+    remote_host: "user@jumphost.example.com"
+    remote_port: 22
+    local_port: 2222
+    direction: remote_to_local
+    interactive: true
+`
+
+func TestParseTunnelConfig_MatchesShellParser(t *testing.T) {
+	tunnels, err := parseTunnelConfig(strings.NewReader(sampleConfig))
+	if err != nil {
+		t.Fatalf("parseTunnelConfig failed: %v", err)
+	}
+	if len(tunnels) != 3 {
+		t.Fatalf("got %d tunnels, want 3", len(tunnels))
+	}
+
+	want := []struct {
+		name        string
+		hash        string
+		interactive bool
+	}{
+		{"unnamed", "76692f8a1adb8d8bee5f3b29e1b42602", false},
+		{"unnamed", "5657c75272242354bb96bfe914951bfd", false},
+		{"jumphost-tunnel", "c65f58326bea843a8439fbe9b8e887b2", true},
+	}
+	for i, w := range want {
+		if tunnels[i].Name != w.name {
+			t.Errorf("tunnel %d name = %q, want %q", i, tunnels[i].Name, w.name)
+		}
+		if tunnels[i].Hash != w.hash {
+			t.Errorf("tunnel %d hash = %q, want %q", i, tunnels[i].Hash, w.hash)
+		}
+		if tunnels[i].Interactive != w.interactive {
+			t.Errorf("tunnel %d interactive = %v, want %v", i, tunnels[i].Interactive, w.interactive)
+		}
+	}
+	if tunnels[0].Direction != "remote_to_local" {
+		t.Errorf("default direction = %q, want remote_to_local", tunnels[0].Direction)
+	}
+	if tunnels[2].RemoteHost != "user@jumphost.example.com" {
+		t.Errorf("quoted remote_host = %q, want quotes stripped", tunnels[2].RemoteHost)
+	}
+}
+
+func TestParseTunnelConfig_SkipsIncomplete(t *testing.T) {
+	config := "tunnels:\n  - name: broken\n    remote_host: host\n  - remote_host: h\n    remote_port: 1\n    local_port: 2\n"
+	tunnels, err := parseTunnelConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("parseTunnelConfig failed: %v", err)
+	}
+	if len(tunnels) != 1 || tunnels[0].RemoteHost != "h" {
+		t.Errorf("got %+v, want only the complete tunnel", tunnels)
+	}
+}
+
+func TestFindTunnel(t *testing.T) {
+	withTestPaths(t)
+	os.WriteFile(configFile, []byte(sampleConfig), 0644)
+
+	tun, err := findTunnel(configFile, "c65f58326bea843a8439fbe9b8e887b2")
+	if err != nil {
+		t.Fatalf("findTunnel failed: %v", err)
+	}
+	if tun.Name != "jumphost-tunnel" {
+		t.Errorf("Name = %q, want jumphost-tunnel", tun.Name)
+	}
+
+	if _, err := findTunnel(configFile, "00000000000000000000000000000000"); err != ErrTunnelNotFound {
+		t.Errorf("err = %v, want ErrTunnelNotFound", err)
+	}
+}
+
+func TestSplitBindSpec(t *testing.T) {
+	tests := []struct {
+		spec, host, port string
+	}{
+		{"8080", "localhost", "8080"},
+		{"127.0.0.1:8080", "127.0.0.1", "8080"},
+		{"0.0.0.0:22", "0.0.0.0", "22"},
+	}
+	for _, tt := range tests {
+		host, port := splitBindSpec(tt.spec)
+		if host != tt.host || port != tt.port {
+			t.Errorf("splitBindSpec(%q) = %q, %q; want %q, %q", tt.spec, host, port, tt.host, tt.port)
+		}
+	}
+}
+
+func TestTunnelState_AppendAndLookup(t *testing.T) {
+	withTestPaths(t)
+
+	tun := &TunnelConfig{
+		Name: "t1", RemoteHost: "user@host", RemotePort: "22", LocalPort: "2222",
+		Direction: "remote_to_local", Hash: "aaaabbbbccccddddeeeeffffaaaabbbb",
+	}
+	if err := appendTunnelState(tun, os.Getpid()); err != nil {
+		t.Fatalf("appendTunnelState failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(stateFile)
+	want := "user@host\t22\t2222\tremote_to_local\tt1\taaaabbbbccccddddeeeeffffaaaabbbb\t"
+	if !strings.HasPrefix(string(data), want) {
+		t.Errorf("state line = %q, want prefix %q", data, want)
+	}
+	if pid := tunnelStatePID(tun.Hash); pid != os.Getpid() {
+		t.Errorf("tunnelStatePID = %d, want %d", pid, os.Getpid())
+	}
+	if !isTunnelRunning(tun.Hash) {
+		t.Error("isTunnelRunning = false for live PID")
+	}
+	if isTunnelRunning("00000000000000000000000000000000") {
+		t.Error("isTunnelRunning = true for unknown hash")
+	}
+}
+
+func TestTunnelState_Remove(t *testing.T) {
+	withTestPaths(t)
+
+	tun := &TunnelConfig{Name: "t1", RemoteHost: "host", RemotePort: "22", LocalPort: "2222", Hash: "aaaabbbbccccddddeeeeffffaaaabbbb"}
+	other := &TunnelConfig{Name: "t2", RemoteHost: "host", RemotePort: "23", LocalPort: "2323", Hash: "11112222333344445555666677778888"}
+	appendTunnelState(tun, 100)
+	appendTunnelState(other, 200)
+
+	// An entry autossh-cli wrote since under another PID is kept
+	if err := removeTunnelState(tun.Hash, 999); err != nil || tunnelStatePID(tun.Hash) != 100 {
+		t.Errorf("removeTunnelState with a stale PID: %v, PID now %d", err, tunnelStatePID(tun.Hash))
+	}
+	if err := removeTunnelState(tun.Hash, 100); err != nil {
+		t.Fatalf("removeTunnelState failed: %v", err)
+	}
+	if pid := tunnelStatePID(tun.Hash); pid != 0 {
+		t.Errorf("tunnelStatePID after remove = %d, want 0", pid)
+	}
+	if pid := tunnelStatePID(other.Hash); pid != 200 {
+		t.Errorf("other tunnel's PID = %d, want 200", pid)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reauth watcher configuration
+var (
+	reauthPollInterval = 10 * time.Second
+	reauthWebhookURL   = ""
+	reauthWebhookToken = ""
+	reauthLogLines     = 20
+)
+
+// watchedTunnel is an interactive tunnel that authenticated successfully.
+type watchedTunnel struct {
+	hash            string
+	name            string
+	remoteHost      string
+	method          string
+	authenticatedAt time.Time
+	seenRunning     bool // its PID was alive at least once
+	suspect         bool // its PID was dead at the previous check
+	misses          int  // checks without a state entry before it was seen running
+}
+
+// ReauthWatcher detects when authenticated interactive tunnels die, since
+// nothing restarts them automatically, and raises reauth_required events.
+type ReauthWatcher struct {
+	mu      sync.Mutex
+	tunnels map[string]*watchedTunnel
+	hub     *EventHub
+}
+
+// NewReauthWatcher creates a watcher publishing to hub.
+func NewReauthWatcher(hub *EventHub) *ReauthWatcher {
+	return &ReauthWatcher{
+		tunnels: make(map[string]*watchedTunnel),
+		hub:     hub,
+	}
+}
+
+// Global reauth watcher
+var reauthWatcher = NewReauthWatcher(eventHub)
+
+// Track starts watching hash after a successful authentication through
+// method, and clears any pending reauth event for it.
+func (w *ReauthWatcher) Track(hash, method string) {
+	wt := &watchedTunnel{
+		hash:            hash,
+		name:            hash,
+		method:          method,
+		authenticatedAt: time.Now(),
+	}
+	if len(hash) > 8 {
+		wt.name = hash[:8]
+	}
+	if t, err := findTunnel(configFile, hash); err == nil {
+		wt.name = t.Name
+		wt.remoteHost = t.RemoteHost
+	}
+
+	w.mu.Lock()
+	w.tunnels[hash] = wt
+	w.mu.Unlock()
+	w.hub.Resolve(hash)
+}
+
+// Count returns the number of watched tunnels.
+func (w *ReauthWatcher) Count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.tunnels)
+}
+
+// Check compares watched tunnels against the state file. A tunnel whose
+// state entry disappears was stopped on purpose and is forgotten; one whose
+// PID is dead on two consecutive checks while its entry remains has dropped.
+// The second check avoids racing stop_tunnel_by_hash, which kills the PID
+// before removing the entry.
+func (w *ReauthWatcher) Check() {
+	var dropped []ReauthEvent
+
+	w.mu.Lock()
+	for hash, wt := range w.tunnels {
+		pid := tunnelStatePID(hash)
+		switch {
+		case pid == 0:
+			wt.misses++
+			if wt.seenRunning || wt.misses > 3 {
+				delete(w.tunnels, hash)
+			}
+		case syscall.Kill(pid, 0) == nil:
+			wt.seenRunning = true
+			wt.suspect = false
+		case !wt.suspect:
+			wt.suspect = true
+		default:
+			dropped = append(dropped, wt.event())
+			delete(w.tunnels, hash)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, ev := range dropped {
+		w.raise(ev)
+	}
+}
+
+// Dropped raises reauth_required for hash at once, for a native forwarder
+// that saw its SSH connection go. Its state entry is removed along with
+// the forwarder, so Check would take it for a deliberate stop.
+func (w *ReauthWatcher) Dropped(hash string) {
+	w.mu.Lock()
+	wt := w.tunnels[hash]
+	delete(w.tunnels, hash)
+	w.mu.Unlock()
+	if wt != nil {
+		w.raise(wt.event())
+	}
+}
+
+// event describes the drop of wt, detected now.
+func (wt *watchedTunnel) event() ReauthEvent {
+	now := time.Now()
+	return ReauthEvent{
+		Type:            "reauth_required",
+		Hash:            wt.hash,
+		Name:            wt.name,
+		RemoteHost:      wt.remoteHost,
+		Method:          wt.method,
+		AuthenticatedAt: wt.authenticatedAt,
+		DetectedAt:      now,
+		UptimeSeconds:   int64(now.Sub(wt.authenticatedAt).Seconds()),
+		LogTail:         tailTunnelLog(wt.hash, reauthLogLines),
+	}
+}
+
+// raise publishes ev and sends the webhook.
+func (w *ReauthWatcher) raise(ev ReauthEvent) {
+	logf("WARN", "Interactive tunnel %s (%s) dropped after %s, re-authentication required",
+		ev.Name, ev.Hash, time.Duration(ev.UptimeSeconds)*time.Second)
+	w.hub.Publish(ev)
+	if reauthWebhookURL != "" {
+		go sendReauthWebhook(ev)
+	}
+}
+
+// Run checks tunnels every reauthPollInterval until done is closed.
+func (w *ReauthWatcher) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(reauthPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			w.Check()
+		}
+	}
+}
+
+// tailTunnelLog returns up to n trailing lines of a tunnel's log file.
+func tailTunnelLog(hash string, n int) []string {
+	data, err := os.ReadFile(filepath.Join(logDir, "tunnel-"+hash+".log"))
+	if err != nil {
+		return []string{}
+	}
+	text := strings.TrimRight(strings.ReplaceAll(string(data), "\r", ""), "\n")
+	if text == "" || n <= 0 {
+		return []string{}
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// webhookClient is used for reauth webhook deliveries.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// sendReauthWebhook POSTs ev as JSON to the configured webhook.
+func sendReauthWebhook(ev ReauthEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, reauthWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		logf("ERROR", "Invalid reauth webhook URL: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if reauthWebhookToken != "" {
+		req.Header.Set("Authorization", "Bearer "+reauthWebhookToken)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		logf("ERROR", "Reauth webhook for %s failed: %v", ev.Hash, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logf("ERROR", "Reauth webhook for %s returned %s", ev.Hash, resp.Status)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withTestHub replaces the global event hub and watcher.
+func withTestHub(t *testing.T) *ReauthWatcher {
+	t.Helper()
+	oldHub, oldWatcher := eventHub, reauthWatcher
+	eventHub = NewEventHub()
+	reauthWatcher = NewReauthWatcher(eventHub)
+	t.Cleanup(func() { eventHub, reauthWatcher = oldHub, oldWatcher })
+	return reauthWatcher
+}
+
+// deadPID returns the PID of a process that has already exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("run true: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+// writeWatchedTunnel writes a config with one interactive tunnel and records
+// it in the state file with pid.
+func writeWatchedTunnel(t *testing.T, pid int) *TunnelConfig {
+	t.Helper()
+	config := `tunnels:
+  - name: "bastion"
+    remote_host: "user@bastion"
+    remote_port: 8080
+    local_port: 18080
+    interactive: true
+`
+	os.WriteFile(configFile, []byte(config), 0644)
+	tunnels, err := parseTunnelConfig(strings.NewReader(config))
+	if err != nil || len(tunnels) != 1 {
+		t.Fatalf("parse config: %v", err)
+	}
+	tun := &tunnels[0]
+	if err := appendTunnelState(tun, pid); err != nil {
+		t.Fatalf("append state: %v", err)
+	}
+	return tun
+}
+
+func TestReauthWatcher_DroppedTunnel(t *testing.T) {
+	withTestPaths(t)
+	w := withTestHub(t)
+	tun := writeWatchedTunnel(t, deadPID(t))
+
+	os.MkdirAll(logDir, 0755)
+	var log strings.Builder
+	for i := 0; i < 30; i++ {
+		log.WriteString("Starting SSH session...\n")
+	}
+	log.WriteString("Connection to bastion closed by remote host.\n")
+	os.WriteFile(filepath.Join(logDir, "tunnel-"+tun.Hash+".log"), []byte(log.String()), 0644)
+
+	ch, pending := eventHub.Subscribe()
+	defer eventHub.Unsubscribe(ch)
+	if len(pending) != 0 {
+		t.Fatalf("pending = %d, want 0", len(pending))
+	}
+
+	w.Track(tun.Hash, MethodInteractive)
+
+	// First dead check only marks the tunnel suspect
+	w.Check()
+	select {
+	case ev := <-ch:
+		t.Fatalf("event after first check: %+v", ev)
+	default:
+	}
+
+	w.Check()
+	select {
+	case ev := <-ch:
+		if ev.Type != "reauth_required" || ev.Hash != tun.Hash || ev.Name != "bastion" {
+			t.Errorf("event = %+v", ev)
+		}
+		if ev.RemoteHost != "user@bastion" || ev.Method != MethodInteractive {
+			t.Errorf("event remote_host/method = %q/%q", ev.RemoteHost, ev.Method)
+		}
+		if len(ev.LogTail) != reauthLogLines {
+			t.Errorf("log tail has %d lines, want %d", len(ev.LogTail), reauthLogLines)
+		}
+		if last := ev.LogTail[len(ev.LogTail)-1]; !strings.Contains(last, "closed by remote host") {
+			t.Errorf("last log line = %q", last)
+		}
+	default:
+		t.Fatal("no event after second check")
+	}
+
+	if w.Count() != 0 {
+		t.Errorf("watched = %d after drop, want 0", w.Count())
+	}
+	if eventHub.Pending() != 1 {
+		t.Errorf("pending = %d, want 1", eventHub.Pending())
+	}
+
+	// Authenticating again resolves the pending event
+	w.Track(tun.Hash, MethodNative)
+	if eventHub.Pending() != 0 {
+		t.Errorf("pending = %d after re-auth, want 0", eventHub.Pending())
+	}
+}
+
+func TestReauthWatcher_IntentionalStop(t *testing.T) {
+	withTestPaths(t)
+	w := withTestHub(t)
+
+	holder := exec.Command("sleep", "60")
+	if err := holder.Start(); err != nil {
+		t.Fatalf("start sleep: %v", err)
+	}
+	defer holder.Process.Kill()
+	tun := writeWatchedTunnel(t, holder.Process.Pid)
+
+	w.Track(tun.Hash, MethodInteractive)
+	w.Check()
+	if w.Count() != 1 {
+		t.Fatalf("watched = %d while running, want 1", w.Count())
+	}
+
+	// autossh-cli stop-tunnel kills the process and removes the state entry
+	holder.Process.Kill()
+	holder.Wait()
+	os.WriteFile(stateFile, nil, 0666)
+
+	w.Check()
+	w.Check()
+	if w.Count() != 0 {
+		t.Errorf("watched = %d after stop, want 0", w.Count())
+	}
+	if eventHub.Pending() != 0 {
+		t.Errorf("pending = %d after intentional stop, want 0", eventHub.Pending())
+	}
+}
+
+func TestReauthWatcher_Webhook(t *testing.T) {
+	withTestPaths(t)
+	w := withTestHub(t)
+	tun := writeWatchedTunnel(t, deadPID(t))
+
+	type delivery struct {
+		auth string
+		ev   ReauthEvent
+	}
+	got := make(chan delivery, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var ev ReauthEvent
+		json.Unmarshal(body, &ev)
+		got <- delivery{r.Header.Get("Authorization"), ev}
+	}))
+	defer hook.Close()
+
+	oldURL, oldToken := reauthWebhookURL, reauthWebhookToken
+	reauthWebhookURL, reauthWebhookToken = hook.URL, "s3cret"
+	t.Cleanup(func() { reauthWebhookURL, reauthWebhookToken = oldURL, oldToken })
+
+	w.Track(tun.Hash, MethodNative)
+	w.Check()
+	w.Check()
+
+	select {
+	case d := <-got:
+		if d.auth != "Bearer s3cret" {
+			t.Errorf("Authorization = %q", d.auth)
+		}
+		if d.ev.Hash != tun.Hash || d.ev.Method != MethodNative {
+			t.Errorf("webhook event = %+v", d.ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}
+
+func TestWsEventsHandler(t *testing.T) {
+	withAPIKey(t, "test-key")
+	withAllowedOrigins(t, []string{"*"})
+	withTestHub(t)
+
+	eventHub.Publish(ReauthEvent{Type: "reauth_required", Hash: "pending-hash", Name: "old"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/events", wsEventsHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/events"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+		t.Fatal("Dial without API key succeeded")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Dial without API key: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token=test-key", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	read := func() ReauthEvent {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		var ev ReauthEvent
+		json.Unmarshal(data, &ev)
+		return ev
+	}
+
+	if ev := read(); ev.Hash != "pending-hash" {
+		t.Errorf("first event = %+v, want pending event", ev)
+	}
+
+	// The handler subscribed before sending pending events
+	eventHub.Publish(ReauthEvent{Type: "reauth_required", Hash: "new-hash", Name: "new"})
+	if ev := read(); ev.Hash != "new-hash" {
+		t.Errorf("second event = %+v, want new-hash", ev)
+	}
+}